@@ -0,0 +1,91 @@
+// migrate はPostgreSQLのスキーママイグレーションを実行するコマンド
+//
+// 使い方:
+//
+//	migrate up          未適用のマイグレーションを全て適用する
+//	migrate down [N]    最新のマイグレーションを N 件（デフォルト1件）取り消す
+//	migrate version     適用済みの最新バージョンを表示する
+//
+// 接続先はサーバーと同じく DATABASE_URL または DB_* 環境変数（または -config で指定した設定ファイル）で指定する。
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	_ "github.com/lib/pq"
+	"github.com/tasukuchiba/text_messaging_app/internal/config"
+	"github.com/tasukuchiba/text_messaging_app/internal/storage/migrations"
+)
+
+func main() {
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML config file (environment variables take precedence)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-config file] up | down [N] | version\n", os.Args[0])
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	databaseURL, err := cfg.Database.ConnString()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := sql.Open("postgres", databaseURL)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	migrator, err := migrations.New(db)
+	if err != nil {
+		log.Fatalf("Failed to load migrations: %v", err)
+	}
+
+	ctx := context.Background()
+	switch flag.Arg(0) {
+	case "up":
+		n, err := migrator.Up(ctx)
+		if err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		log.Printf("Applied %d migration(s)", n)
+
+	case "down":
+		steps := 1
+		if flag.NArg() > 1 {
+			steps, err = strconv.Atoi(flag.Arg(1))
+			if err != nil || steps <= 0 {
+				log.Fatalf("Invalid number of steps: %s", flag.Arg(1))
+			}
+		}
+		n, err := migrator.Down(ctx, steps)
+		if err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		log.Printf("Reverted %d migration(s)", n)
+
+	case "version":
+		version, err := migrator.Version(ctx)
+		if err != nil {
+			log.Fatalf("Failed to get version: %v", err)
+		}
+		fmt.Println(version)
+
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
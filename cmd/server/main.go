@@ -1,96 +1,276 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/tasukuchiba/text_messaging_app/internal/auth"
+	"github.com/tasukuchiba/text_messaging_app/internal/backplane"
+	"github.com/tasukuchiba/text_messaging_app/internal/config"
 	"github.com/tasukuchiba/text_messaging_app/internal/handlers"
+	"github.com/tasukuchiba/text_messaging_app/internal/logging"
+	"github.com/tasukuchiba/text_messaging_app/internal/metrics"
+	"github.com/tasukuchiba/text_messaging_app/internal/ratelimit"
 	"github.com/tasukuchiba/text_messaging_app/internal/storage"
 	"github.com/tasukuchiba/text_messaging_app/internal/websocket"
 )
 
 func main() {
-	// ストレージの初期化
-	store, cleanup := initStorage()
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML config file (environment variables take precedence)")
+	flag.Parse()
+
+	// 設定の読み込み（不正な値があれば全て表示して起動しない）
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// ログはJSON形式で標準出力に書き出す（CloudWatch Logs Insights で検索できるようにする）
+	slog.SetDefault(logging.New(os.Stdout, cfg.Log.Level))
+	slog.Info("Configuration loaded",
+		"config_file", *configPath,
+		"storage", cfg.Storage.Type,
+		"rate_limit_messages", cfg.RateLimit.Messages.String(),
+		"rate_limit_room_messages", cfg.RateLimit.RoomMessages.String(),
+		"rate_limit_ws_frames", cfg.RateLimit.Frames.String(),
+		"rate_limit_ws_typing_frames", cfg.RateLimit.TypingFrames.String(),
+	)
+
+	// メトリクス（/metrics で公開する）
+	m := metrics.New()
+
+	// ストレージの初期化（操作ごとのレイテンシとエラーを記録する）
+	rawStore, cleanup := initStorage(cfg)
 	if cleanup != nil {
 		defer cleanup()
 	}
+	store := m.InstrumentStorage(rawStore)
 
-	// ハンドラーの初期化
-	messageHandler := handlers.NewMessageHandler(store)
+	// バックプレーンの初期化（複数インスタンス間のブロードキャスト用）
+	bp, closeBackplane := initBackplane(cfg)
+	if closeBackplane != nil {
+		defer closeBackplane()
+	}
 
 	// WebSocket Hubの初期化と起動
-	hub := websocket.NewHub(store)
+	hub := websocket.NewHub(store,
+		websocket.WithBackplane(bp),
+		websocket.WithFrameRateLimit(ratelimit.NewLimiter(cfg.RateLimit.Frames)),
+		websocket.WithTypingRateLimit(ratelimit.NewLimiter(cfg.RateLimit.TypingFrames)),
+		websocket.WithClientConfig(cfg.WebSocket.Client()),
+		websocket.WithTypingTTL(cfg.WebSocket.TypingTTL),
+		websocket.WithPresenceHeartbeat(cfg.WebSocket.PresenceHeartbeat),
+		websocket.WithMetrics(m),
+	)
+	m.WatchConnections(hub.ClientCount)
 	go hub.Run()
 
-	// ルーティング設定
-	http.HandleFunc("/messages", messageHandler.HandleMessages)
-	http.HandleFunc("/messages/", messageHandler.HandleMessageByID)
+	// セッショントークンの発行・検証
+	tokens := auth.NewTokenManager(authSecret(cfg.Auth.Secret), cfg.Auth.TokenTTL)
+
+	// ハンドラーの初期化
+	// メッセージの書き込みはHubと共有するサービス経由で行い、WebSocketクライアントにも配信する
+	authHandler := handlers.NewAuthHandler(store, tokens)
+	messageHandler := handlers.NewMessageHandler(hub.Messages(),
+		handlers.WithCreateRateLimit(ratelimit.NewLimiter(cfg.RateLimit.Messages)))
+	roomHandler := handlers.NewRoomHandler(store, hub.Messages(),
+		handlers.WithRoomMessageRateLimit(ratelimit.NewLimiter(cfg.RateLimit.RoomMessages)))
+	presenceHandler := handlers.NewPresenceHandler(hub)
+	healthHandler := handlers.NewHealthHandler(
+		handlers.WithHealthCheck("storage", store),
+		handlers.WithHealthCheck("hub", hub),
+	)
+
+	// ルーティング設定（/auth 以外は認証が必要）
+	// route で登録したエンドポイントはリクエストIDを割り当て、リクエスト数とレイテンシを記録する
+	route := func(pattern string, handler http.Handler) {
+		http.Handle(pattern, logging.RequestID(m.Middleware(pattern, handler)))
+	}
+	route("/auth/register", http.HandlerFunc(authHandler.HandleRegister))
+	route("/auth/login", http.HandlerFunc(authHandler.HandleLogin))
+	route("/messages", tokens.Middleware(http.HandlerFunc(messageHandler.HandleMessages)))
+	route("/messages/search", tokens.Middleware(http.HandlerFunc(messageHandler.HandleSearch)))
+	route("/messages/", tokens.Middleware(http.HandlerFunc(messageHandler.HandleMessageByID)))
+	route("/rooms", tokens.Middleware(http.HandlerFunc(roomHandler.HandleRooms)))
+	route("/rooms/", tokens.Middleware(http.HandlerFunc(roomHandler.HandleRoomByID)))
+	route("/presence", tokens.Middleware(http.HandlerFunc(presenceHandler.HandlePresence)))
 
 	// WebSocketエンドポイント
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+	route("/ws", tokens.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		websocket.ServeWs(hub, w, r)
-	})
+	})))
 
 	// ヘルスチェック用エンドポイント
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
-	})
-
-	// サーバー起動（環境変数PORTがあればそれを使用）
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	// /livez はコンテナのヘルスチェック（プロセスの再起動の判断）に、
+	// /readyz はALBのターゲットグループ（振り分けの判断）に使う
+	// /health は以前の設定との互換のために残している（/livez と同じ）
+	route("/livez", http.HandlerFunc(healthHandler.HandleLive))
+	route("/readyz", http.HandlerFunc(healthHandler.HandleReady))
+	route("/health", http.HandlerFunc(healthHandler.HandleLive))
+
+	// Prometheus のスクレイプ用エンドポイント（VPC内からのみ到達できる前提で認証はしない）
+	http.Handle("/metrics", m.Handler())
+
+	// サーバー起動
+	server := &http.Server{Addr: cfg.Server.Addr()}
+
+	// SIGTERM（ECSのタスク停止）または SIGINT を受けたらシャットダウンする
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		slog.Info("Server starting", "addr", server.Addr)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		fatal("Server failed to start", err)
+	case <-ctx.Done():
+		stop()
+	}
+
+	shutdown(server, hub, cfg.Server.ShutdownTimeout)
+}
+
+// fatal はエラーをログに残してプロセスを終了する
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// shutdown は処理中のHTTPリクエストを待ってからWebSocketクライアントを切断する
+// ストレージとバックプレーンは main の defer でこの後にクローズされる
+// timeout はシャットダウン処理全体の期限（ECSのタスク停止時の猶予より短くする）
+func shutdown(server *http.Server, hub *websocket.Hub, timeout time.Duration) {
+	slog.Info("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// 新しい接続の受け付けを止め、処理中のHTTPリクエストの完了を待つ
+	// （ハイジャック済みのWebSocket接続は対象外なので、続けてHubを停止する）
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("HTTP server shutdown failed", "error", err)
 	}
-	addr := ":" + port
-	log.Printf("Server starting on %s", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Fatalf("Server failed to start: %v", err)
+
+	// 全クライアントに going away のクローズフレームを送ってHubを停止する
+	if err := hub.Stop(ctx); err != nil {
+		slog.Error("Hub shutdown failed", "error", err)
 	}
+
+	slog.Info("Shutdown complete")
 }
 
-// initStorage は環境変数に基づいてストレージを初期化する
-func initStorage() (storage.Storage, func()) {
-	storageType := os.Getenv("STORAGE_TYPE")
-
-	switch storageType {
-	case "postgres":
-		databaseURL := os.Getenv("DATABASE_URL")
-		if databaseURL == "" {
-			// 個別の環境変数からDATABASE_URLを組み立てる（ECS + Secrets Manager対応）
-			dbHost := os.Getenv("DB_HOST")
-			dbPort := os.Getenv("DB_PORT")
-			dbUser := os.Getenv("DB_USERNAME")
-			dbPass := os.Getenv("DB_PASSWORD")
-			dbName := os.Getenv("DB_NAME")
-			if dbHost != "" && dbUser != "" && dbPass != "" && dbName != "" {
-				if dbPort == "" {
-					dbPort = "5432"
-				}
-				databaseURL = fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=require",
-					dbUser, dbPass, dbHost, dbPort, dbName)
-			} else {
-				log.Fatal("DATABASE_URL or DB_HOST/DB_USERNAME/DB_PASSWORD/DB_NAME is required when STORAGE_TYPE=postgres")
+// initStorage は設定に基づいてストレージを初期化する
+func initStorage(cfg config.Config) (storage.Storage, func()) {
+	switch cfg.Storage.Type {
+	case config.StoragePostgres:
+		store, err := storage.NewPostgresStorage(context.Background(), postgresURL(cfg),
+			storage.WithPoolConfig(cfg.Database.Pool()))
+		if err != nil {
+			fatal("Failed to connect to PostgreSQL", err)
+		}
+
+		// データベースが応答しない場合にリクエストが止まり続けないよう、操作ごとに期限を設ける
+		timeouts := cfg.Storage.Timeouts()
+		slog.Info("Using PostgreSQL storage", "read_timeout", timeouts.Read.String(), "write_timeout", timeouts.Write.String())
+		return storage.NewTimeoutStorage(store, timeouts), func() {
+			if err := store.Close(); err != nil {
+				slog.Error("Failed to close database connection", "error", err)
+			}
+		}
+
+	case config.StorageSQLite:
+		store, err := storage.NewSQLiteStorage(context.Background(), cfg.Storage.SQLitePath)
+		if err != nil {
+			fatal("Failed to open SQLite database", err)
+		}
+
+		timeouts := cfg.Storage.Timeouts()
+		slog.Info("Using SQLite storage", "path", cfg.Storage.SQLitePath, "read_timeout", timeouts.Read.String(), "write_timeout", timeouts.Write.String())
+		return storage.NewTimeoutStorage(store, timeouts), func() {
+			if err := store.Close(); err != nil {
+				slog.Error("Failed to close database connection", "error", err)
 			}
 		}
 
-		store, err := storage.NewPostgresStorage(databaseURL)
+	default:
+		if cfg.Storage.WALDir == "" {
+			slog.Info("Using in-memory storage")
+			return storage.NewMemoryStorage(), nil
+		}
+
+		// 変更を追記ログに書き込み、再起動時に復元する
+		wal := cfg.Storage.WAL()
+		store, err := storage.OpenMemoryStorage(cfg.Storage.WALDir, wal)
 		if err != nil {
-			log.Fatalf("Failed to connect to PostgreSQL: %v", err)
+			fatal("Failed to restore in-memory storage from write-ahead log", err)
 		}
 
-		log.Println("Using PostgreSQL storage")
+		slog.Info("Using in-memory storage with write-ahead log", "dir", cfg.Storage.WALDir, "sync", string(wal.Sync),
+			"sync_interval", wal.SyncInterval.String(), "compact_interval", wal.CompactInterval.String())
 		return store, func() {
 			if err := store.Close(); err != nil {
-				log.Printf("Error closing database connection: %v", err)
+				slog.Error("Failed to close write-ahead log", "error", err)
+			}
+		}
+	}
+}
+
+// initBackplane は設定に基づいてバックプレーンを初期化する
+// PostgreSQLを使う場合は LISTEN/NOTIFY で他のインスタンスにも配信する
+// SQLiteは1台で動かす前提なので、メモリ上のバックプレーンを使う
+func initBackplane(cfg config.Config) (backplane.Backplane, func()) {
+	switch cfg.Storage.Type {
+	case config.StoragePostgres:
+		bp, err := backplane.NewPostgresBackplane(postgresURL(cfg), backplane.DefaultChannel)
+		if err != nil {
+			fatal("Failed to start PostgreSQL backplane", err)
+		}
+
+		slog.Info("Using PostgreSQL LISTEN/NOTIFY backplane")
+		return bp, func() {
+			if err := bp.Close(); err != nil {
+				slog.Error("Failed to close backplane", "error", err)
 			}
 		}
 
 	default:
-		log.Println("Using in-memory storage")
-		return storage.NewMemoryStorage(), nil
+		return backplane.NewMemoryBackplane(), nil
+	}
+}
+
+// authSecret はトークン署名用の鍵を返す
+// 設定されていない場合はランダムな鍵を生成する（再起動すると発行済みのトークンは無効になる）
+// 複数インスタンスで動かす PostgreSQL では設定の検証で必須にしているので、生成するのは単一インスタンスで動かす場合のみ
+func authSecret(secret string) []byte {
+	if secret != "" {
+		return []byte(secret)
+	}
+
+	slog.Warn("AUTH_SECRET is not set; using a random secret (tokens will not survive a restart)")
+	generated := make([]byte, 32)
+	if _, err := rand.Read(generated); err != nil {
+		fatal("Failed to generate auth secret", err)
+	}
+	return generated
+}
+
+// postgresURL はPostgreSQLの接続URLを返す（設定の検証済みなのでエラーにはならない）
+func postgresURL(cfg config.Config) string {
+	databaseURL, err := cfg.Database.ConnString()
+	if err != nil {
+		fatal("Invalid PostgreSQL configuration", err)
 	}
+	return databaseURL
 }
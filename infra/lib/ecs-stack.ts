@@ -150,8 +150,19 @@ export class EcsStack extends cdk.Stack {
       ],
     });
 
+    // トークン署名用の鍵（全タスクで共有し、デプロイや再起動でもログイン状態を保つ）
+    const authSecret = new secretsmanager.Secret(this, 'AuthSecret', {
+      secretName: `text-messaging-${environment}/auth-secret`,
+      description: 'Signing key for session tokens',
+      generateSecretString: {
+        passwordLength: 64,
+        excludePunctuation: true,
+      },
+    });
+
     // Secrets Manager からシークレットを読み取る権限を追加
     databaseSecret.grantRead(executionRole);
+    authSecret.grantRead(executionRole);
 
     // タスクロール（アプリケーション用）
     const taskRole = new iam.Role(this, 'TaskRole', {
@@ -204,6 +215,7 @@ export class EcsStack extends cdk.Stack {
         DB_USERNAME: ecs.Secret.fromSecretsManager(databaseSecret, 'username'),
         DB_PASSWORD: ecs.Secret.fromSecretsManager(databaseSecret, 'password'),
         DB_NAME: ecs.Secret.fromSecretsManager(databaseSecret, 'dbname'),
+        AUTH_SECRET: ecs.Secret.fromSecretsManager(authSecret),
       },
 
       // ログ設定
@@ -214,7 +226,7 @@ export class EcsStack extends cdk.Stack {
 
       // ヘルスチェック
       healthCheck: {
-        command: ['CMD-SHELL', 'curl -f http://localhost:8080/health || exit 1'],
+        command: ['CMD-SHELL', 'curl -f http://localhost:8080/livez || exit 1'],
         interval: cdk.Duration.seconds(30),
         timeout: cdk.Duration.seconds(5),
         retries: 3,
@@ -265,7 +277,7 @@ export class EcsStack extends cdk.Stack {
       protocol: elbv2.ApplicationProtocol.HTTP,
       targetType: elbv2.TargetType.IP, // Fargate = IP ターゲット
       healthCheck: {
-        path: '/health',
+        path: '/readyz', // ストレージやHubが応答しないタスクには振り分けない
         protocol: elbv2.Protocol.HTTP,
         healthyHttpCodes: '200',
         interval: cdk.Duration.seconds(30),
@@ -284,7 +296,7 @@ export class EcsStack extends cdk.Stack {
       protocol: elbv2.ApplicationProtocol.HTTP,
       targetType: elbv2.TargetType.IP,
       healthCheck: {
-        path: '/health',
+        path: '/readyz', // ストレージやHubが応答しないタスクには振り分けない
         protocol: elbv2.Protocol.HTTP,
         healthyHttpCodes: '200',
         interval: cdk.Duration.seconds(30),
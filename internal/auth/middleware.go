@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// contextKey はコンテキストに値を格納するためのキーの型
+type contextKey struct{}
+
+// WithIdentity は認証済みユーザーをコンテキストに格納する
+func WithIdentity(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// IdentityFromContext はコンテキストから認証済みユーザーを取り出す
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(contextKey{}).(Identity)
+	return id, ok
+}
+
+// Middleware はセッショントークンを検証し、認証済みユーザーをコンテキストに格納する
+//
+// トークンは Authorization: Bearer ヘッダー、またはヘッダーを設定できない
+// ブラウザのWebSocket接続向けに token クエリパラメータで受け取る。
+// 検証に失敗した場合は 401 を返す。
+func (m *TokenManager) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := tokenFromRequest(r)
+		if token == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		id, err := m.Verify(token)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), id)))
+	})
+}
+
+// tokenFromRequest はリクエストからセッショントークンを取り出す
+func tokenFromRequest(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		token, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok {
+			return ""
+		}
+		return token
+	}
+	return r.URL.Query().Get("token")
+}
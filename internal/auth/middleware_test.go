@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tasukuchiba/text_messaging_app/internal/models"
+)
+
+func TestMiddleware(t *testing.T) {
+	m := NewTokenManager([]byte("secret"), time.Hour)
+	token, _, err := m.Issue(models.User{ID: "user-1", Username: "alice"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	handler := m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := IdentityFromContext(r.Context())
+		if !ok {
+			t.Error("expected identity in context")
+		}
+		w.Write([]byte(id.Username))
+	}))
+
+	tests := []struct {
+		name   string
+		path   string
+		header string
+		status int
+	}{
+		{"bearer header", "/", "Bearer " + token, http.StatusOK},
+		{"query param", "/?token=" + token, "", http.StatusOK},
+		{"missing token", "/", "", http.StatusUnauthorized},
+		{"invalid token", "/", "Bearer invalid", http.StatusUnauthorized},
+		{"not bearer", "/?token=" + token, "Basic abc", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, rec.Code)
+			}
+			if tt.status == http.StatusOK && rec.Body.String() != "alice" {
+				t.Errorf("expected identity 'alice', got '%s'", rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package auth
+
+import (
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MaxPasswordLength はパスワードの最大バイト数（bcrypt が扱える長さ）
+const MaxPasswordLength = 72
+
+// dummyHash は存在しないユーザーのログインで照合に使うハッシュ
+// HashPassword と同じコストで作成しておき、照合にかかる時間を揃える
+const dummyHash = "$2a$10$RUgPlkKWZSPHIJ5VrIGigOjQ5HUWhWsH81bcbTkB6ay4yjCHT4raK"
+
+// HashPassword はパスワードをbcryptでハッシュ化する
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// CheckPassword はパスワードがハッシュと一致するかを確認する
+func CheckPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// CheckDummyPassword はユーザーが存在しない場合に、存在する場合と同じだけ時間をかけて照合する
+// 応答時間からユーザーの有無を推測されないようにするためのもので、結果は常に false
+func CheckDummyPassword(password string) bool {
+	CheckPassword(dummyHash, password)
+	return false
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/tasukuchiba/text_messaging_app/internal/models"
+)
+
+var (
+	// ErrInvalidToken はトークンの形式や署名が不正な場合のエラー
+	ErrInvalidToken = errors.New("invalid token")
+
+	// ErrTokenExpired はトークンの有効期限が切れている場合のエラー
+	ErrTokenExpired = errors.New("token expired")
+)
+
+// DefaultTokenTTL はセッショントークンのデフォルトの有効期間
+const DefaultTokenTTL = 24 * time.Hour
+
+// Identity は認証済みユーザーを表す
+type Identity struct {
+	UserID   string `json:"sub"`
+	Username string `json:"name"`
+}
+
+// claims はトークンに埋め込む情報
+type claims struct {
+	Identity
+	ExpiresAt int64 `json:"exp"`
+}
+
+// TokenManager はHMAC-SHA256で署名したセッショントークンを発行・検証する
+//
+// トークンは base64url(JSON) + "." + base64url(署名) の形式。
+// 同じシークレットを共有する全てのインスタンスで検証できる。
+type TokenManager struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+// NewTokenManager は新しいTokenManagerを作成する
+func NewTokenManager(secret []byte, ttl time.Duration) *TokenManager {
+	if ttl <= 0 {
+		ttl = DefaultTokenTTL
+	}
+	return &TokenManager{secret: secret, ttl: ttl}
+}
+
+// Issue はユーザーのセッショントークンを発行し、トークンと有効期限を返す
+func (m *TokenManager) Issue(user models.User) (string, time.Time, error) {
+	expiresAt := time.Now().Add(m.ttl)
+	payload, err := json.Marshal(claims{
+		Identity:  Identity{UserID: user.ID, Username: user.Username},
+		ExpiresAt: expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + m.sign(encoded), expiresAt, nil
+}
+
+// Verify はトークンの署名と有効期限を検証し、ユーザー情報を返す
+func (m *TokenManager) Verify(token string) (Identity, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return Identity{}, ErrInvalidToken
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(m.sign(encoded))) {
+		return Identity{}, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return Identity{}, ErrInvalidToken
+	}
+
+	var c claims
+	if err := json.Unmarshal(payload, &c); err != nil || c.Username == "" {
+		return Identity{}, ErrInvalidToken
+	}
+
+	if time.Now().Unix() >= c.ExpiresAt {
+		return Identity{}, ErrTokenExpired
+	}
+
+	return c.Identity, nil
+}
+
+// sign はペイロードのHMAC-SHA256署名を返す
+func (m *TokenManager) sign(encoded string) string {
+	mac := hmac.New(sha256.New, m.secret)
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
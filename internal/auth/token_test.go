@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tasukuchiba/text_messaging_app/internal/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestTokenManager_IssueVerify(t *testing.T) {
+	m := NewTokenManager([]byte("secret"), time.Hour)
+
+	token, expiresAt, err := m.Issue(models.User{ID: "user-1", Username: "alice"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if time.Until(expiresAt) <= 0 {
+		t.Errorf("expected expiry in the future, got %v", expiresAt)
+	}
+
+	id, err := m.Verify(token)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id.UserID != "user-1" || id.Username != "alice" {
+		t.Errorf("unexpected identity: %+v", id)
+	}
+}
+
+func TestTokenManager_VerifyInvalid(t *testing.T) {
+	m := NewTokenManager([]byte("secret"), time.Hour)
+	token, _, err := m.Issue(models.User{ID: "user-1", Username: "alice"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	payload, signature, _ := strings.Cut(token, ".")
+
+	// 別ユーザーのペイロードに差し替えたトークン
+	forged, _, _ := m.Issue(models.User{ID: "user-2", Username: "mallory"})
+	forgedPayload, _, _ := strings.Cut(forged, ".")
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"empty", ""},
+		{"no signature", payload},
+		{"tampered payload", forgedPayload + "." + signature},
+		{"tampered signature", payload + "." + signature + "x"},
+		{"not base64", "!!!." + signature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := m.Verify(tt.token); err != ErrInvalidToken {
+				t.Errorf("expected ErrInvalidToken, got %v", err)
+			}
+		})
+	}
+
+	// 別のシークレットで署名したトークンは受け付けない
+	other := NewTokenManager([]byte("other-secret"), time.Hour)
+	if _, err := other.Verify(token); err != ErrInvalidToken {
+		t.Errorf("expected ErrInvalidToken, got %v", err)
+	}
+}
+
+func TestTokenManager_VerifyExpired(t *testing.T) {
+	m := NewTokenManager([]byte("secret"), time.Nanosecond)
+	token, _, err := m.Issue(models.User{ID: "user-1", Username: "alice"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	time.Sleep(time.Second)
+
+	if _, err := m.Verify(token); err != ErrTokenExpired {
+		t.Errorf("expected ErrTokenExpired, got %v", err)
+	}
+}
+
+func TestPassword(t *testing.T) {
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if hash == "correct horse" {
+		t.Fatal("expected password to be hashed")
+	}
+
+	if !CheckPassword(hash, "correct horse") {
+		t.Error("expected password to match")
+	}
+	if CheckPassword(hash, "wrong horse") {
+		t.Error("expected wrong password not to match")
+	}
+
+	// 存在しないユーザー用の照合は HashPassword と同じコストで、常に一致しない
+	if CheckDummyPassword("correct horse") {
+		t.Error("expected dummy check never to match")
+	}
+	cost, err := bcrypt.Cost([]byte(dummyHash))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want, _ := bcrypt.Cost([]byte(hash)); cost != want {
+		t.Errorf("expected dummy hash cost %d, got %d", want, cost)
+	}
+}
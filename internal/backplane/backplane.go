@@ -0,0 +1,77 @@
+package backplane
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrClosed はクローズ済みのバックプレーンに配信しようとした場合のエラー
+var ErrClosed = errors.New("backplane closed")
+
+// MaxPayloadSize は全ての実装で配信できるペイロードの上限（PostgreSQLのNOTIFYの制限に合わせる）
+// これを超える大きさのペイロードは PostgresBackplane では ErrPayloadTooLarge になる
+const MaxPayloadSize = 7999
+
+// subscriberBuffer は購読者ごとの受信バッファサイズ
+const subscriberBuffer = 256
+
+// Backplane は複数のHub（サーバーインスタンス）間でブロードキャストを中継するインターフェース
+//
+// Publish されたメッセージは、配信元を含む全ての購読者に届く。
+type Backplane interface {
+	// Publish はメッセージを全ての購読者に配信する
+	Publish(payload []byte) error
+
+	// Subscribe は配信されたメッセージを受け取るチャネルを返す
+	// チャネルはバックプレーンがクローズされると閉じられる
+	Subscribe() <-chan []byte
+
+	// Close は配信を停止してリソースを解放する
+	Close() error
+}
+
+// subscribers はプロセス内の購読者へのファンアウトを管理する
+type subscribers struct {
+	mu     sync.RWMutex
+	chans  []chan []byte
+	closed bool
+}
+
+// add は新しい購読者を追加する
+func (s *subscribers) add() <-chan []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch := make(chan []byte, subscriberBuffer)
+	if s.closed {
+		close(ch)
+		return ch
+	}
+	s.chans = append(s.chans, ch)
+	return ch
+}
+
+// deliver は全ての購読者にメッセージを渡す
+func (s *subscribers) deliver(payload []byte) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrClosed
+	}
+	for _, ch := range s.chans {
+		ch <- payload
+	}
+	return nil
+}
+
+// close は全ての購読者のチャネルを閉じる
+func (s *subscribers) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	for _, ch := range s.chans {
+		close(ch)
+	}
+}
@@ -0,0 +1,29 @@
+package backplane
+
+// MemoryBackplane はプロセス内だけで配信するバックプレーン
+//
+// 単一インスタンスでの運用や、同じプロセス内に複数のHubを立てるテストで使う。
+type MemoryBackplane struct {
+	subs subscribers
+}
+
+// NewMemoryBackplane は新しいMemoryBackplaneを作成する
+func NewMemoryBackplane() *MemoryBackplane {
+	return &MemoryBackplane{}
+}
+
+// Publish はメッセージを全ての購読者に配信する
+func (b *MemoryBackplane) Publish(payload []byte) error {
+	return b.subs.deliver(payload)
+}
+
+// Subscribe は配信されたメッセージを受け取るチャネルを返す
+func (b *MemoryBackplane) Subscribe() <-chan []byte {
+	return b.subs.add()
+}
+
+// Close は全ての購読者のチャネルを閉じる
+func (b *MemoryBackplane) Close() error {
+	b.subs.close()
+	return nil
+}
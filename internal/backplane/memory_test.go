@@ -0,0 +1,58 @@
+package backplane
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryBackplane_PublishSubscribe(t *testing.T) {
+	bp := NewMemoryBackplane()
+	defer bp.Close()
+
+	sub1 := bp.Subscribe()
+	sub2 := bp.Subscribe()
+
+	if err := bp.Publish([]byte("hello")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// 全ての購読者に届く
+	for i, sub := range []<-chan []byte{sub1, sub2} {
+		select {
+		case payload := <-sub:
+			if string(payload) != "hello" {
+				t.Errorf("subscriber %d: expected 'hello', got '%s'", i, payload)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("subscriber %d: timeout waiting for payload", i)
+		}
+	}
+}
+
+func TestMemoryBackplane_Close(t *testing.T) {
+	bp := NewMemoryBackplane()
+	sub := bp.Subscribe()
+
+	if err := bp.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// クローズ後はチャネルが閉じられる
+	if _, ok := <-sub; ok {
+		t.Error("expected subscriber channel to be closed")
+	}
+
+	if err := bp.Publish([]byte("hello")); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+
+	// クローズ後の購読は閉じたチャネルを返す
+	if _, ok := <-bp.Subscribe(); ok {
+		t.Error("expected closed channel after Close")
+	}
+}
+
+// TestMemoryBackplane_ImplementsBackplane はMemoryBackplaneがBackplaneインターフェースを実装していることを確認する
+func TestMemoryBackplane_ImplementsBackplane(t *testing.T) {
+	var _ Backplane = (*MemoryBackplane)(nil)
+}
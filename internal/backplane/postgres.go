@@ -0,0 +1,114 @@
+package backplane
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// DefaultChannel はNOTIFYに使うデフォルトのチャネル名
+	DefaultChannel = "chat_broadcast"
+
+	// maxNotifyPayload はNOTIFYで送れるペイロードの上限（PostgreSQLの制限は8000バイト未満）
+	maxNotifyPayload = MaxPayloadSize
+
+	// LISTEN接続の再接続間隔
+	minReconnectInterval = 1 * time.Second
+	maxReconnectInterval = 30 * time.Second
+)
+
+// ErrPayloadTooLarge はNOTIFYで送れない大きさのペイロードを配信しようとした場合のエラー
+var ErrPayloadTooLarge = errors.New("payload too large for NOTIFY")
+
+// PostgresBackplane はPostgreSQLのLISTEN/NOTIFYで複数インスタンス間に配信するバックプレーン
+type PostgresBackplane struct {
+	db       *sql.DB
+	listener *pq.Listener
+	channel  string
+	subs     subscribers
+	done     chan struct{}
+}
+
+// NewPostgresBackplane は新しいPostgresBackplaneを作成し、チャネルのLISTENを開始する
+func NewPostgresBackplane(databaseURL, channel string) (*PostgresBackplane, error) {
+	db, err := sql.Open("postgres", databaseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// NOTIFY送信用なので接続は少なくてよい
+	db.SetMaxOpenConns(2)
+	db.SetMaxIdleConns(1)
+	db.SetConnMaxLifetime(5 * time.Minute)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	listener := pq.NewListener(databaseURL, minReconnectInterval, maxReconnectInterval, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			slog.Warn("Backplane listener event", "event", int(event), "error", err)
+		}
+	})
+	if err := listener.Listen(channel); err != nil {
+		listener.Close()
+		db.Close()
+		return nil, err
+	}
+
+	b := &PostgresBackplane{
+		db:       db,
+		listener: listener,
+		channel:  channel,
+		done:     make(chan struct{}),
+	}
+	go b.receive()
+
+	return b, nil
+}
+
+// Publish はNOTIFYでメッセージを全インスタンスに配信する
+func (b *PostgresBackplane) Publish(payload []byte) error {
+	if len(payload) > maxNotifyPayload {
+		return ErrPayloadTooLarge
+	}
+	_, err := b.db.Exec("SELECT pg_notify($1, $2)", b.channel, string(payload))
+	return err
+}
+
+// Subscribe は配信されたメッセージを受け取るチャネルを返す
+func (b *PostgresBackplane) Subscribe() <-chan []byte {
+	return b.subs.add()
+}
+
+// receive はLISTENで受け取った通知を購読者に渡す
+func (b *PostgresBackplane) receive() {
+	defer close(b.done)
+	defer b.subs.close()
+
+	for n := range b.listener.Notify {
+		// 再接続時は nil が届く（切断中の通知は失われている）
+		if n == nil {
+			slog.Warn("Backplane listener reconnected; notifications during the outage may have been lost")
+			continue
+		}
+		if err := b.subs.deliver([]byte(n.Extra)); err != nil {
+			return
+		}
+	}
+}
+
+// Close はLISTENを停止してデータベース接続を閉じる
+func (b *PostgresBackplane) Close() error {
+	err := b.listener.Close()
+	<-b.done
+	if dbErr := b.db.Close(); err == nil {
+		err = dbErr
+	}
+	return err
+}
@@ -0,0 +1,322 @@
+// Package config はサーバーの設定を読み込んで検証する
+//
+// 設定はデフォルト値、設定ファイル（YAML、任意）、環境変数の順に上書きする。
+// 環境変数の名前は env.go の envVars を参照。
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/tasukuchiba/text_messaging_app/internal/auth"
+	"github.com/tasukuchiba/text_messaging_app/internal/ratelimit"
+	"github.com/tasukuchiba/text_messaging_app/internal/storage"
+	"github.com/tasukuchiba/text_messaging_app/internal/websocket"
+	"gopkg.in/yaml.v3"
+)
+
+// ストレージの種類
+const (
+	StorageMemory   = "memory"
+	StoragePostgres = "postgres"
+	StorageSQLite   = "sqlite"
+)
+
+// Config はサーバー全体の設定
+type Config struct {
+	Server    Server    `yaml:"server"`
+	Log       Log       `yaml:"log"`
+	Storage   Storage   `yaml:"storage"`
+	Database  Database  `yaml:"database"`
+	WebSocket WebSocket `yaml:"websocket"`
+	RateLimit RateLimit `yaml:"rate_limit"`
+	Auth      Auth      `yaml:"auth"`
+}
+
+// Server はHTTPサーバーの設定
+type Server struct {
+	Port int `yaml:"port"`
+
+	// シャットダウン処理全体の期限（ECSのタスク停止時の猶予より短くする）
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+// Log はログ出力の設定
+type Log struct {
+	Level slog.Level `yaml:"level"`
+}
+
+// Storage はストレージの種類と操作ごとのタイムアウト
+type Storage struct {
+	Type string `yaml:"type"`
+
+	// Type が sqlite の場合のデータベースファイルのパス
+	SQLitePath string `yaml:"sqlite_path"`
+
+	// Type が memory の場合に追記ログとスナップショットを置くディレクトリ（空の場合は永続化しない）
+	WALDir             string             `yaml:"wal_dir"`
+	WALSync            storage.SyncPolicy `yaml:"wal_sync"`
+	WALSyncInterval    time.Duration      `yaml:"wal_sync_interval"`
+	WALCompactInterval time.Duration      `yaml:"wal_compact_interval"`
+
+	// 0 の場合は呼び出し元の期限だけが適用される
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+}
+
+// Database はPostgreSQLの接続先と接続プールの設定
+//
+// URL があればそれを使い、なければ個別の項目から組み立てる（ECS + Secrets Manager対応）。
+type Database struct {
+	URL      string `yaml:"url"`
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Name     string `yaml:"name"`
+	SSLMode  string `yaml:"sslmode"`
+
+	MaxOpenConns    int           `yaml:"max_open_conns"`
+	MaxIdleConns    int           `yaml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+}
+
+// WebSocket はWebSocket接続の設定
+type WebSocket struct {
+	MaxMessageSize int64         `yaml:"max_message_size"`
+	SendBufferSize int           `yaml:"send_buffer_size"`
+	PongWait       time.Duration `yaml:"pong_wait"`
+	WriteWait      time.Duration `yaml:"write_wait"`
+	TypingTTL      time.Duration `yaml:"typing_ttl"`
+
+	// 生存していることを他のインスタンスに配信する間隔（接続中の全ユーザーはその6回ごとに配信し直す）
+	PresenceHeartbeat time.Duration `yaml:"presence_heartbeat"`
+}
+
+// RateLimit はユーザーごとの流量制限（"5/1s,10" 形式、"off" で無効）
+type RateLimit struct {
+	// REST API でのメッセージ作成（POST /messages）
+	Messages ratelimit.Limit `yaml:"messages"`
+
+	// REST API でのルームへのメッセージ作成（POST /rooms/{id}/messages）
+	RoomMessages ratelimit.Limit `yaml:"room_messages"`
+
+	// WebSocket のメッセージ送信・編集・購読
+	Frames ratelimit.Limit `yaml:"ws_frames"`
+
+	// WebSocket の入力中の通知（typing_start/typing_stop）
+	TypingFrames ratelimit.Limit `yaml:"ws_typing_frames"`
+}
+
+// Auth はセッショントークンの設定
+type Auth struct {
+	// トークンの署名用の鍵
+	// 空の場合は起動ごとにランダムに生成する（PostgreSQL では複数インスタンスで共有するため必須）
+	Secret   string        `yaml:"secret"`
+	TokenTTL time.Duration `yaml:"token_ttl"`
+}
+
+// Default はデフォルトの設定を返す
+func Default() Config {
+	return Config{
+		Server: Server{
+			Port:            8080,
+			ShutdownTimeout: 20 * time.Second,
+		},
+		Log: Log{Level: slog.LevelInfo},
+		Storage: Storage{
+			Type:         StorageMemory,
+			SQLitePath:   "chat.db",
+			ReadTimeout:  storage.DefaultTimeouts.Read,
+			WriteTimeout: storage.DefaultTimeouts.Write,
+
+			WALSync:            storage.DefaultWALConfig.Sync,
+			WALSyncInterval:    storage.DefaultWALConfig.SyncInterval,
+			WALCompactInterval: storage.DefaultWALConfig.CompactInterval,
+		},
+		Database: Database{
+			Port:            5432,
+			SSLMode:         "require",
+			MaxOpenConns:    storage.DefaultPoolConfig.MaxOpenConns,
+			MaxIdleConns:    storage.DefaultPoolConfig.MaxIdleConns,
+			ConnMaxLifetime: storage.DefaultPoolConfig.ConnMaxLifetime,
+		},
+		WebSocket: WebSocket{
+			MaxMessageSize: websocket.DefaultClientConfig.MaxMessageSize,
+			SendBufferSize: websocket.DefaultClientConfig.SendBufferSize,
+			PongWait:       websocket.DefaultClientConfig.PongWait,
+			WriteWait:      websocket.DefaultClientConfig.WriteWait,
+			TypingTTL:      websocket.DefaultTypingTTL,
+
+			PresenceHeartbeat: websocket.DefaultPresenceHeartbeat,
+		},
+		RateLimit: RateLimit{
+			// 1秒に5回、連続10回まで
+			Messages:     ratelimit.Every(5, time.Second, 10),
+			RoomMessages: ratelimit.Every(5, time.Second, 10),
+			// 1秒に10回、連続20回まで
+			Frames: ratelimit.Every(10, time.Second, 20),
+			// 1秒に5回、連続10回まで
+			TypingFrames: ratelimit.Every(5, time.Second, 10),
+		},
+		Auth: Auth{TokenTTL: auth.DefaultTokenTTL},
+	}
+}
+
+// Load はデフォルト値に設定ファイルと環境変数を重ねて読み込み、検証する
+// path が空の場合は設定ファイルを読まない
+func Load(path string) (Config, error) {
+	return load(path, os.LookupEnv)
+}
+
+// load は環境変数の参照先を差し替えられる Load
+func load(path string, lookup func(string) (string, bool)) (Config, error) {
+	cfg := Default()
+	if path != "" {
+		if err := cfg.readFile(path); err != nil {
+			return Config{}, err
+		}
+	}
+	if err := cfg.applyEnv(lookup); err != nil {
+		return Config{}, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// readFile は設定ファイルの値で上書きする
+// 知らない項目があれば書き間違いとしてエラーにする
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate は設定の値を検証し、問題のある項目を全てまとめたエラーを返す
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, field, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: "+format, append([]any{field}, args...)...))
+		}
+	}
+
+	check(c.Server.Port > 0 && c.Server.Port <= 65535, "server.port", "must be between 1 and 65535 (got %d)", c.Server.Port)
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout", "must be positive (got %s)", c.Server.ShutdownTimeout)
+
+	switch c.Storage.Type {
+	case StorageMemory:
+		if c.Storage.WALDir != "" {
+			var policy storage.SyncPolicy
+			check(policy.UnmarshalText([]byte(c.Storage.WALSync)) == nil,
+				"storage.wal_sync", "must be %q, %q or %q (got %q)", storage.SyncAlways, storage.SyncInterval, storage.SyncNever, c.Storage.WALSync)
+			check(c.Storage.WALSync != storage.SyncInterval || c.Storage.WALSyncInterval > 0,
+				"storage.wal_sync_interval", "must be positive when wal_sync is %q (got %s)", storage.SyncInterval, c.Storage.WALSyncInterval)
+			check(c.Storage.WALCompactInterval >= 0, "storage.wal_compact_interval", "must not be negative (got %s)", c.Storage.WALCompactInterval)
+		}
+	case StoragePostgres:
+		if _, err := c.Database.ConnString(); err != nil {
+			errs = append(errs, err)
+		}
+		// インスタンスごとに鍵が異なると、他のインスタンスが発行したトークンを受け付けられない
+		check(c.Auth.Secret != "", "auth.secret", "is required for PostgreSQL (tokens must be verifiable by every instance)")
+	case StorageSQLite:
+		check(c.Storage.SQLitePath != "", "storage.sqlite_path", "is required for SQLite")
+	default:
+		check(false, "storage.type", "must be %q, %q or %q (got %q)", StorageMemory, StoragePostgres, StorageSQLite, c.Storage.Type)
+	}
+	check(c.Storage.ReadTimeout >= 0, "storage.read_timeout", "must not be negative (got %s)", c.Storage.ReadTimeout)
+	check(c.Storage.WriteTimeout >= 0, "storage.write_timeout", "must not be negative (got %s)", c.Storage.WriteTimeout)
+
+	check(c.Database.MaxOpenConns >= 0, "database.max_open_conns", "must not be negative (got %d)", c.Database.MaxOpenConns)
+	check(c.Database.MaxIdleConns >= 0, "database.max_idle_conns", "must not be negative (got %d)", c.Database.MaxIdleConns)
+	check(c.Database.MaxOpenConns == 0 || c.Database.MaxIdleConns <= c.Database.MaxOpenConns,
+		"database.max_idle_conns", "must not exceed max_open_conns (%d > %d)", c.Database.MaxIdleConns, c.Database.MaxOpenConns)
+	check(c.Database.ConnMaxLifetime >= 0, "database.conn_max_lifetime", "must not be negative (got %s)", c.Database.ConnMaxLifetime)
+
+	check(c.WebSocket.MaxMessageSize > 0, "websocket.max_message_size", "must be positive (got %d)", c.WebSocket.MaxMessageSize)
+	check(c.WebSocket.SendBufferSize > 0, "websocket.send_buffer_size", "must be positive (got %d)", c.WebSocket.SendBufferSize)
+	check(c.WebSocket.PongWait > 0, "websocket.pong_wait", "must be positive (got %s)", c.WebSocket.PongWait)
+	check(c.WebSocket.WriteWait > 0, "websocket.write_wait", "must be positive (got %s)", c.WebSocket.WriteWait)
+	check(c.WebSocket.TypingTTL > 0, "websocket.typing_ttl", "must be positive (got %s)", c.WebSocket.TypingTTL)
+	check(c.WebSocket.PresenceHeartbeat > 0, "websocket.presence_heartbeat", "must be positive (got %s)", c.WebSocket.PresenceHeartbeat)
+
+	check(c.Auth.TokenTTL > 0, "auth.token_ttl", "must be positive (got %s)", c.Auth.TokenTTL)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// Addr はHTTPサーバーの待ち受けアドレスを返す
+func (s Server) Addr() string {
+	return ":" + strconv.Itoa(s.Port)
+}
+
+// Timeouts はストレージ操作のタイムアウトを返す
+func (s Storage) Timeouts() storage.Timeouts {
+	return storage.Timeouts{Read: s.ReadTimeout, Write: s.WriteTimeout}
+}
+
+// WAL はメモリ上のストレージの追記ログの設定を返す
+func (s Storage) WAL() storage.WALConfig {
+	return storage.WALConfig{
+		Sync:            s.WALSync,
+		SyncInterval:    s.WALSyncInterval,
+		CompactInterval: s.WALCompactInterval,
+	}
+}
+
+// ConnString はPostgreSQLの接続URLを返す
+func (d Database) ConnString() (string, error) {
+	if d.URL != "" {
+		return d.URL, nil
+	}
+	if d.Host == "" || d.Username == "" || d.Password == "" || d.Name == "" {
+		return "", errors.New("database: DATABASE_URL or DB_HOST/DB_USERNAME/DB_PASSWORD/DB_NAME is required for PostgreSQL")
+	}
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(d.Username, d.Password),
+		Host:     d.Host + ":" + strconv.Itoa(d.Port),
+		Path:     "/" + d.Name,
+		RawQuery: url.Values{"sslmode": {d.SSLMode}}.Encode(),
+	}
+	return u.String(), nil
+}
+
+// Pool は接続プールの設定を返す
+func (d Database) Pool() storage.PoolConfig {
+	return storage.PoolConfig{
+		MaxOpenConns:    d.MaxOpenConns,
+		MaxIdleConns:    d.MaxIdleConns,
+		ConnMaxLifetime: d.ConnMaxLifetime,
+	}
+}
+
+// Client はWebSocket接続ごとの設定を返す
+func (w WebSocket) Client() websocket.ClientConfig {
+	return websocket.ClientConfig{
+		MaxMessageSize: w.MaxMessageSize,
+		SendBufferSize: w.SendBufferSize,
+		PongWait:       w.PongWait,
+		WriteWait:      w.WriteWait,
+	}
+}
@@ -0,0 +1,135 @@
+package config
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/tasukuchiba/text_messaging_app/internal/logging"
+)
+
+// envVar は設定項目を上書きする環境変数
+type envVar struct {
+	name string
+	set  func(value string) error
+}
+
+// envVars は環境変数と設定項目の対応を返す
+func (c *Config) envVars() []envVar {
+	return []envVar{
+		{"PORT", intVar(&c.Server.Port)},
+		{"SHUTDOWN_TIMEOUT", durationVar(&c.Server.ShutdownTimeout)},
+
+		{"LOG_LEVEL", func(v string) error {
+			level, err := logging.ParseLevel(v)
+			if err != nil {
+				return err
+			}
+			c.Log.Level = level
+			return nil
+		}},
+
+		{"STORAGE_TYPE", stringVar(&c.Storage.Type)},
+		{"SQLITE_PATH", stringVar(&c.Storage.SQLitePath)},
+		{"STORAGE_WAL_DIR", stringVar(&c.Storage.WALDir)},
+		{"STORAGE_WAL_SYNC", textVar(&c.Storage.WALSync)},
+		{"STORAGE_WAL_SYNC_INTERVAL", durationVar(&c.Storage.WALSyncInterval)},
+		{"STORAGE_WAL_COMPACT_INTERVAL", durationVar(&c.Storage.WALCompactInterval)},
+		{"STORAGE_READ_TIMEOUT", durationVar(&c.Storage.ReadTimeout)},
+		{"STORAGE_WRITE_TIMEOUT", durationVar(&c.Storage.WriteTimeout)},
+
+		{"DATABASE_URL", stringVar(&c.Database.URL)},
+		{"DB_HOST", stringVar(&c.Database.Host)},
+		{"DB_PORT", intVar(&c.Database.Port)},
+		{"DB_USERNAME", stringVar(&c.Database.Username)},
+		{"DB_PASSWORD", stringVar(&c.Database.Password)},
+		{"DB_NAME", stringVar(&c.Database.Name)},
+		{"DB_SSLMODE", stringVar(&c.Database.SSLMode)},
+		{"DB_MAX_OPEN_CONNS", intVar(&c.Database.MaxOpenConns)},
+		{"DB_MAX_IDLE_CONNS", intVar(&c.Database.MaxIdleConns)},
+		{"DB_CONN_MAX_LIFETIME", durationVar(&c.Database.ConnMaxLifetime)},
+
+		{"WS_MAX_MESSAGE_SIZE", int64Var(&c.WebSocket.MaxMessageSize)},
+		{"WS_SEND_BUFFER_SIZE", intVar(&c.WebSocket.SendBufferSize)},
+		{"WS_PONG_WAIT", durationVar(&c.WebSocket.PongWait)},
+		{"WS_WRITE_WAIT", durationVar(&c.WebSocket.WriteWait)},
+		{"WS_TYPING_TTL", durationVar(&c.WebSocket.TypingTTL)},
+		{"WS_PRESENCE_HEARTBEAT", durationVar(&c.WebSocket.PresenceHeartbeat)},
+
+		{"RATE_LIMIT_MESSAGES", textVar(&c.RateLimit.Messages)},
+		{"RATE_LIMIT_ROOM_MESSAGES", textVar(&c.RateLimit.RoomMessages)},
+		{"RATE_LIMIT_WS_FRAMES", textVar(&c.RateLimit.Frames)},
+		{"RATE_LIMIT_WS_TYPING_FRAMES", textVar(&c.RateLimit.TypingFrames)},
+
+		{"AUTH_SECRET", stringVar(&c.Auth.Secret)},
+		{"AUTH_TOKEN_TTL", durationVar(&c.Auth.TokenTTL)},
+	}
+}
+
+// applyEnv は設定されている環境変数の値で上書きする
+// 空の環境変数は未設定として扱う
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	var errs []error
+	for _, env := range c.envVars() {
+		v, ok := lookup(env.name)
+		if !ok || v == "" {
+			continue
+		}
+		if err := env.set(v); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", env.name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid environment:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+func stringVar(p *string) func(string) error {
+	return func(v string) error {
+		*p = v
+		return nil
+	}
+}
+
+func intVar(p *int) func(string) error {
+	return func(v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", v)
+		}
+		*p = n
+		return nil
+	}
+}
+
+func int64Var(p *int64) func(string) error {
+	return func(v string) error {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", v)
+		}
+		*p = n
+		return nil
+	}
+}
+
+// durationVar は "5s" のような期間を読み込む（"0" も受け付ける）
+func durationVar(p *time.Duration) func(string) error {
+	return func(v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*p = d
+		return nil
+	}
+}
+
+func textVar(p encoding.TextUnmarshaler) func(string) error {
+	return func(v string) error {
+		return p.UnmarshalText([]byte(v))
+	}
+}
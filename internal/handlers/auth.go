@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tasukuchiba/text_messaging_app/internal/auth"
+	"github.com/tasukuchiba/text_messaging_app/internal/models"
+	"github.com/tasukuchiba/text_messaging_app/internal/storage"
+)
+
+// minPasswordLength はパスワードの最小文字数
+const minPasswordLength = 8
+
+// usernamePattern はユーザー名として使える文字列
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{3,32}$`)
+
+// AuthHandler はユーザー登録とログインのHTTPリクエストを処理する
+type AuthHandler struct {
+	storage storage.Storage
+	tokens  *auth.TokenManager
+}
+
+// NewAuthHandler は新しいAuthHandlerを作成する
+func NewAuthHandler(s storage.Storage, tokens *auth.TokenManager) *AuthHandler {
+	return &AuthHandler{storage: s, tokens: tokens}
+}
+
+// CredentialsRequest はユーザー登録・ログインリクエストのボディ
+type CredentialsRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// LoginResponse はログインレスポンスのボディ
+type LoginResponse struct {
+	Token     string      `json:"token"`
+	ExpiresAt time.Time   `json:"expires_at"`
+	User      models.User `json:"user"`
+}
+
+// HandleRegister は /auth/register エンドポイントのハンドラー
+func (h *AuthHandler) HandleRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req CredentialsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !usernamePattern.MatchString(req.Username) {
+		http.Error(w, "Username must be 3-32 characters of letters, digits, '_' or '-'", http.StatusBadRequest)
+		return
+	}
+	if len(req.Password) < minPasswordLength {
+		http.Error(w, "Password must be at least 8 characters", http.StatusBadRequest)
+		return
+	}
+	if !validPasswordLength(w, req.Password) {
+		return
+	}
+
+	hash, err := auth.HashPassword(req.Password)
+	if err != nil {
+		internalError(w, r, "Failed to hash password", err)
+		return
+	}
+
+	user := models.User{
+		ID:           uuid.New().String(),
+		Username:     req.Username,
+		PasswordHash: hash,
+		CreatedAt:    time.Now(),
+	}
+
+	if err := h.storage.CreateUser(r.Context(), user); err != nil {
+		if errors.Is(err, storage.ErrUserExists) {
+			http.Error(w, "Username already taken", http.StatusConflict)
+			return
+		}
+		internalError(w, r, "Failed to create user", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(user)
+}
+
+// HandleLogin は /auth/login エンドポイントのハンドラー
+func (h *AuthHandler) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req CredentialsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !validPasswordLength(w, req.Password) {
+		return
+	}
+
+	user, err := h.storage.GetUserByUsername(r.Context(), req.Username)
+	if err != nil && !errors.Is(err, storage.ErrUserNotFound) {
+		internalError(w, r, "Failed to look up user", err)
+		return
+	}
+
+	// ユーザーの有無を推測されないよう、どちらの場合もパスワードを照合して同じエラーを返す
+	var valid bool
+	if err != nil {
+		valid = auth.CheckDummyPassword(req.Password)
+	} else {
+		valid = auth.CheckPassword(user.PasswordHash, req.Password)
+	}
+	if !valid {
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+
+	token, expiresAt, err := h.tokens.Issue(user)
+	if err != nil {
+		internalError(w, r, "Failed to issue token", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LoginResponse{
+		Token:     token,
+		ExpiresAt: expiresAt,
+		User:      user,
+	})
+}
+
+// validPasswordLength はパスワードが bcrypt で扱える長さかを確認し、長すぎる場合は 400 を返す
+func validPasswordLength(w http.ResponseWriter, password string) bool {
+	if len(password) > auth.MaxPasswordLength {
+		http.Error(w, fmt.Sprintf("Password must be at most %d bytes", auth.MaxPasswordLength), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tasukuchiba/text_messaging_app/internal/auth"
+	"github.com/tasukuchiba/text_messaging_app/internal/models"
+	"github.com/tasukuchiba/text_messaging_app/internal/storage"
+)
+
+func TestHandleRegisterAndLogin(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	tokens := auth.NewTokenManager([]byte("secret"), time.Hour)
+	handler := NewAuthHandler(store, tokens)
+
+	body := `{"username":"alice","password":"correct horse"}`
+	req := httptest.NewRequest(http.MethodPost, "/auth/register", bytes.NewBufferString(body))
+	rec := httptest.NewRecorder()
+
+	handler.HandleRegister(rec, req)
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "correct horse") || strings.Contains(rec.Body.String(), "password") {
+		t.Errorf("expected password not to be exposed, got %s", rec.Body.String())
+	}
+
+	var user models.User
+	if err := json.NewDecoder(rec.Body).Decode(&user); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if user.ID == "" || user.Username != "alice" {
+		t.Errorf("unexpected user: %+v", user)
+	}
+
+	// 発行されたトークンで認証済みユーザーが決まる
+	req = httptest.NewRequest(http.MethodPost, "/auth/login", bytes.NewBufferString(body))
+	rec = httptest.NewRecorder()
+
+	handler.HandleLogin(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+
+	var resp LoginResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	id, err := tokens.Verify(resp.Token)
+	if err != nil {
+		t.Fatalf("expected valid token, got %v", err)
+	}
+	if id.UserID != user.ID || id.Username != "alice" {
+		t.Errorf("unexpected identity: %+v", id)
+	}
+}
+
+func TestHandleRegister_Errors(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	handler := NewAuthHandler(store, auth.NewTokenManager([]byte("secret"), time.Hour))
+	store.CreateUser(context.Background(), models.User{ID: "user-1", Username: "taken"})
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"invalid body", `invalid json`, http.StatusBadRequest},
+		{"short username", `{"username":"al","password":"correct horse"}`, http.StatusBadRequest},
+		{"invalid username", `{"username":"al ice","password":"correct horse"}`, http.StatusBadRequest},
+		{"short password", `{"username":"alice","password":"short"}`, http.StatusBadRequest},
+		{"long password", `{"username":"alice","password":"` + strings.Repeat("x", auth.MaxPasswordLength+1) + `"}`, http.StatusBadRequest},
+		{"username taken", `{"username":"taken","password":"correct horse"}`, http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/auth/register", bytes.NewBufferString(tt.body))
+			rec := httptest.NewRecorder()
+
+			handler.HandleRegister(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, rec.Code)
+			}
+		})
+	}
+}
+
+func TestHandleLogin_InvalidCredentials(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	handler := NewAuthHandler(store, auth.NewTokenManager([]byte("secret"), time.Hour))
+	hash, err := auth.HashPassword("correct horse")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	store.CreateUser(context.Background(), models.User{ID: "user-1", Username: "alice", PasswordHash: hash})
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"wrong password", `{"username":"alice","password":"wrong horse"}`, http.StatusUnauthorized},
+		{"unknown user", `{"username":"bob","password":"correct horse"}`, http.StatusUnauthorized},
+		{"long password", `{"username":"alice","password":"` + strings.Repeat("x", auth.MaxPasswordLength+1) + `"}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/auth/login", bytes.NewBufferString(tt.body))
+			rec := httptest.NewRecorder()
+
+			handler.HandleLogin(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, rec.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultHealthTimeout は /readyz で各コンポーネントの応答を待つ時間
+// ALBのヘルスチェックのタイムアウト（デフォルト5秒）より短くする
+const DefaultHealthTimeout = 2 * time.Second
+
+// コンポーネントの状態
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+)
+
+// Pinger は利用できるかどうかを確認できるコンポーネント
+// websocket.Hub や PostgreSQL を使うストレージが実装する
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// healthCheck は /readyz で確認するコンポーネント
+type healthCheck struct {
+	name   string
+	pinger Pinger
+}
+
+// HealthHandler はヘルスチェックのHTTPリクエストを処理する
+type HealthHandler struct {
+	checks  []healthCheck
+	timeout time.Duration
+}
+
+// HealthHandlerOption はHealthHandlerの設定を変更する関数
+type HealthHandlerOption func(*HealthHandler)
+
+// WithHealthCheck は /readyz で確認するコンポーネントを追加する
+func WithHealthCheck(name string, pinger Pinger) HealthHandlerOption {
+	return func(h *HealthHandler) {
+		h.checks = append(h.checks, healthCheck{name: name, pinger: pinger})
+	}
+}
+
+// WithHealthTimeout は各コンポーネントの応答を待つ時間を指定する
+func WithHealthTimeout(timeout time.Duration) HealthHandlerOption {
+	return func(h *HealthHandler) {
+		h.timeout = timeout
+	}
+}
+
+// NewHealthHandler は新しいHealthHandlerを作成する
+func NewHealthHandler(opts ...HealthHandlerOption) *HealthHandler {
+	h := &HealthHandler{timeout: DefaultHealthTimeout}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// healthErrorTimeout は応答が timeout までに返らなかったコンポーネントの ComponentStatus.Error
+const healthErrorTimeout = "timeout"
+
+// ComponentStatus はコンポーネント1つ分の状態
+type ComponentStatus struct {
+	Status string `json:"status"`
+
+	// 応答しなかった理由（接続先などを漏らさないよう、タイムアウトした場合の "timeout" だけを返す）
+	Error string `json:"error,omitempty"`
+}
+
+// HealthResponse はヘルスチェックレスポンスのボディ
+type HealthResponse struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentStatus `json:"components,omitempty"`
+}
+
+// HandleLive は /livez エンドポイントのハンドラー
+// プロセスがリクエストに応答できれば常に 200 を返す（依存先の状態は確認しない）
+func (h *HealthHandler) HandleLive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeHealth(w, http.StatusOK, HealthResponse{Status: StatusOK})
+}
+
+// HandleReady は /readyz エンドポイントのハンドラー
+// 全てのコンポーネントが応答すれば 200、1つでも応答しなければ 503 を返す
+func (h *HealthHandler) HandleReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+	defer cancel()
+
+	resp := HealthResponse{Status: StatusOK, Components: make(map[string]ComponentStatus, len(h.checks))}
+	errs := make([]error, len(h.checks))
+
+	// 遅いコンポーネントがあっても全体の待ち時間が timeout を超えないよう並行に確認する
+	var wg sync.WaitGroup
+	for i, check := range h.checks {
+		wg.Add(1)
+		go func(i int, check healthCheck) {
+			defer wg.Done()
+			errs[i] = check.pinger.Ping(ctx)
+		}(i, check)
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	for i, check := range h.checks {
+		if errs[i] != nil {
+			// エラーの詳細はリクエストIDと一緒にログにだけ出す
+			slog.WarnContext(r.Context(), "Readiness check failed", "component", check.name, "error", errs[i])
+			component := ComponentStatus{Status: StatusUnavailable}
+			if errors.Is(errs[i], context.DeadlineExceeded) {
+				component.Error = healthErrorTimeout
+			}
+			resp.Components[check.name] = component
+			resp.Status = StatusUnavailable
+			status = http.StatusServiceUnavailable
+			continue
+		}
+		resp.Components[check.name] = ComponentStatus{Status: StatusOK}
+	}
+	writeHealth(w, status, resp)
+}
+
+// writeHealth はヘルスチェックの結果をJSONで返す
+// ロードバランサーやプロキシにキャッシュさせない
+func writeHealth(w http.ResponseWriter, status int, resp HealthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pingFunc は関数を Pinger として使うためのテスト用の型
+type pingFunc func(ctx context.Context) error
+
+func (f pingFunc) Ping(ctx context.Context) error {
+	return f(ctx)
+}
+
+func healthy() Pinger {
+	return pingFunc(func(context.Context) error { return nil })
+}
+
+func decodeHealth(t *testing.T, rec *httptest.ResponseRecorder) HealthResponse {
+	t.Helper()
+	var resp HealthResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	return resp
+}
+
+func TestHandleLive(t *testing.T) {
+	// 依存先が応答しなくても /livez は 200 を返す
+	handler := NewHealthHandler(WithHealthCheck("storage", pingFunc(func(context.Context) error {
+		return errors.New("connection refused")
+	})))
+
+	rec := httptest.NewRecorder()
+	handler.HandleLive(rec, httptest.NewRequest(http.MethodGet, "/livez", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+	if resp := decodeHealth(t, rec); resp.Status != StatusOK {
+		t.Errorf("expected status ok, got %q", resp.Status)
+	}
+}
+
+func TestHandleReady_AllHealthy(t *testing.T) {
+	handler := NewHealthHandler(
+		WithHealthCheck("storage", healthy()),
+		WithHealthCheck("hub", healthy()),
+	)
+
+	rec := httptest.NewRecorder()
+	handler.HandleReady(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+	resp := decodeHealth(t, rec)
+	if resp.Status != StatusOK || len(resp.Components) != 2 {
+		t.Fatalf("expected ok with 2 components, got %+v", resp)
+	}
+	for name, c := range resp.Components {
+		if c.Status != StatusOK {
+			t.Errorf("expected %s to be ok, got %+v", name, c)
+		}
+	}
+}
+
+func TestHandleReady_Unavailable(t *testing.T) {
+	handler := NewHealthHandler(
+		WithHealthCheck("storage", pingFunc(func(context.Context) error {
+			return errors.New("dial tcp db.internal:5432: connection refused")
+		})),
+		WithHealthCheck("hub", healthy()),
+	)
+
+	rec := httptest.NewRecorder()
+	handler.HandleReady(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+	// 接続先などのエラーの詳細は返さない
+	if strings.Contains(rec.Body.String(), "db.internal") {
+		t.Errorf("expected error details not to be exposed, got %s", rec.Body.String())
+	}
+	resp := decodeHealth(t, rec)
+	if resp.Status != StatusUnavailable {
+		t.Errorf("expected status unavailable, got %q", resp.Status)
+	}
+	if c := resp.Components["storage"]; c.Status != StatusUnavailable || c.Error != "" {
+		t.Errorf("expected storage to be unavailable, got %+v", c)
+	}
+	if c := resp.Components["hub"]; c.Status != StatusOK {
+		t.Errorf("expected hub to be ok, got %+v", c)
+	}
+}
+
+func TestHandleReady_Timeout(t *testing.T) {
+	// 応答しないコンポーネントがあっても timeout で打ち切る
+	handler := NewHealthHandler(
+		WithHealthTimeout(50*time.Millisecond),
+		WithHealthCheck("hub", pingFunc(func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})),
+	)
+
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	handler.HandleReady(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected readiness check to give up after the timeout, took %v", elapsed)
+	}
+
+	if c := decodeHealth(t, rec).Components["hub"]; c.Status != StatusUnavailable || c.Error != "timeout" {
+		t.Errorf("expected hub to time out, got %+v", c)
+	}
+}
+
+func TestHandleReady_MethodNotAllowed(t *testing.T) {
+	handler := NewHealthHandler()
+
+	rec := httptest.NewRecorder()
+	handler.HandleReady(rec, httptest.NewRequest(http.MethodPost, "/readyz", nil))
+
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+}
@@ -1,31 +1,98 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/google/uuid"
+	"github.com/tasukuchiba/text_messaging_app/internal/auth"
 	"github.com/tasukuchiba/text_messaging_app/internal/models"
+	"github.com/tasukuchiba/text_messaging_app/internal/ratelimit"
+	"github.com/tasukuchiba/text_messaging_app/internal/service"
 	"github.com/tasukuchiba/text_messaging_app/internal/storage"
 )
 
 // MessageHandler はメッセージ関連のHTTPリクエストを処理する
 type MessageHandler struct {
-	storage storage.Storage
+	messages *service.MessageService
+
+	// メッセージ作成とリアクション追加の流量制限（nil の場合は制限しない）
+	createLimiter *ratelimit.Limiter
+}
+
+// MessageHandlerOption はMessageHandlerの設定を変更する関数
+type MessageHandlerOption func(*MessageHandler)
+
+// WithCreateRateLimit は POST /messages と POST /messages/{id}/reactions/{emoji} の流量制限を指定する
+func WithCreateRateLimit(limiter *ratelimit.Limiter) MessageHandlerOption {
+	return func(h *MessageHandler) {
+		h.createLimiter = limiter
+	}
 }
 
 // NewMessageHandler は新しいMessageHandlerを作成する
-func NewMessageHandler(s storage.Storage) *MessageHandler {
-	return &MessageHandler{storage: s}
+func NewMessageHandler(messages *service.MessageService, opts ...MessageHandlerOption) *MessageHandler {
+	h := &MessageHandler{messages: messages}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
 }
 
 // CreateMessageRequest はメッセージ作成リクエストのボディ
+// 送信者は認証済みユーザーから決まるため、リクエストでは指定しない
 type CreateMessageRequest struct {
-	Sender  string `json:"sender"`
 	Content string `json:"content"`
+
+	// 返信先のメッセージID（指定するとスレッドへの返信になる）
+	ParentID string `json:"parent_id,omitempty"`
+}
+
+// create はリクエストの内容で roomID のメッセージを作成する
+func (req CreateMessageRequest) create(ctx context.Context, messages *service.MessageService, roomID, sender string) (models.Message, error) {
+	if req.ParentID != "" {
+		return messages.CreateReply(ctx, roomID, req.ParentID, sender, req.Content)
+	}
+	return messages.CreateMessage(ctx, roomID, sender, req.Content)
+}
+
+// contentTooLongMessage は本文が長すぎる場合のエラーメッセージ
+var contentTooLongMessage = fmt.Sprintf("Content must be at most %d bytes", service.MaxContentSize)
+
+// UpdateMessageRequest はメッセージ編集リクエストのボディ
+type UpdateMessageRequest struct {
+	Content string `json:"content"`
+}
+
+// MessageListResponse はメッセージ一覧レスポンスのボディ
+type MessageListResponse struct {
+	Messages []models.Message `json:"messages"`
+
+	// 続きを取得するためのカーソル（リクエストと同じパラメータ名で指定する）
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// ThreadResponse はスレッド取得レスポンスのボディ
+type ThreadResponse struct {
+	// スレッドの起点のメッセージ（返信数と最後の返信日時を含む）
+	Root models.Message `json:"root"`
+
+	// 古い順に並んだ返信
+	Messages []models.Message `json:"messages"`
+
+	// 続きを取得するためのカーソル（リクエストと同じパラメータ名で指定する）
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// SearchResponse はメッセージ検索レスポンスのボディ
+type SearchResponse struct {
+	Results []storage.SearchResult `json:"results"`
 }
 
 // HandleMessages は /messages エンドポイントのハンドラー
@@ -40,45 +107,180 @@ func (h *MessageHandler) HandleMessages(w http.ResponseWriter, r *http.Request)
 	}
 }
 
-// HandleMessageByID は /messages/{id} エンドポイントのハンドラー
+// HandleMessageByID は /messages/{id}、/messages/{id}/revisions、/messages/{id}/thread、
+// /messages/{id}/reactions/{emoji} エンドポイントのハンドラー
 func (h *MessageHandler) HandleMessageByID(w http.ResponseWriter, r *http.Request) {
-	id := strings.TrimPrefix(r.URL.Path, "/messages/")
+	id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/messages/"), "/")
 	if id == "" {
 		http.Error(w, "Message ID is required", http.StatusBadRequest)
 		return
 	}
 
-	switch r.Method {
-	case http.MethodGet:
-		h.getMessageByID(w, r, id)
-	case http.MethodDelete:
-		h.deleteMessage(w, r, id)
+	switch sub {
+	case "":
+		switch r.Method {
+		case http.MethodGet:
+			h.getMessageByID(w, r, id)
+		case http.MethodPatch:
+			h.updateMessage(w, r, id)
+		case http.MethodDelete:
+			h.deleteMessage(w, r, id)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	case "revisions":
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.getRevisions(w, r, id)
+	case "thread":
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.getThread(w, r, id)
 	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		if emoji, ok := strings.CutPrefix(sub, "reactions/"); ok {
+			h.handleReaction(w, r, id, emoji)
+			return
+		}
+		http.NotFound(w, r)
 	}
 }
 
-// getMessages は全てのメッセージを取得する
+// getMessages はメッセージ一覧をページ単位で取得する
+//
+// クエリパラメータ:
+//   - limit: 取得件数（最大 storage.MaxListLimit）
+//   - before: このカーソルより古いメッセージを取得する（未指定なら最新から）
+//   - after: このカーソルより新しいメッセージを取得する
 func (h *MessageHandler) getMessages(w http.ResponseWriter, r *http.Request) {
-	messages, err := h.storage.GetAll()
+	opts, err := parseListOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := h.messages.ListMessages(r.Context(), opts, viewer(r))
+	if err != nil {
+		if errors.Is(err, storage.ErrInvalidCursor) {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		internalError(w, r, "Failed to list messages", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MessageListResponse{
+		Messages:   page.Messages,
+		NextCursor: page.NextCursor,
+	})
+}
+
+// HandleSearch は /messages/search エンドポイントのハンドラー
+//
+// クエリパラメータ:
+//   - q: 検索語（必須、空白区切りの全ての語を含むメッセージを検索する）
+//   - sender: 送信者で絞り込む
+//   - since, until: 作成日時の範囲（RFC3339、since 以上 until 未満）
+//   - limit: 取得件数（最大 storage.MaxListLimit）
+func (h *MessageHandler) HandleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	opts, err := parseSearchOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results, err := h.messages.SearchMessages(r.Context(), opts, viewer(r))
 	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		internalError(w, r, "Failed to search messages", err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(messages)
+	json.NewEncoder(w).Encode(SearchResponse{Results: results})
+}
+
+// parseSearchOptions はクエリパラメータから検索条件を組み立てる
+func parseSearchOptions(r *http.Request) (storage.SearchOptions, error) {
+	query := r.URL.Query()
+	opts := storage.SearchOptions{
+		Query:  strings.TrimSpace(query.Get("q")),
+		Sender: query.Get("sender"),
+	}
+
+	if opts.Query == "" {
+		return storage.SearchOptions{}, errors.New("q is required")
+	}
+
+	for _, p := range []struct {
+		name string
+		dest *time.Time
+	}{
+		{"since", &opts.Since},
+		{"until", &opts.Until},
+	} {
+		v := query.Get(p.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return storage.SearchOptions{}, fmt.Errorf("%s must be an RFC3339 timestamp", p.name)
+		}
+		*p.dest = t
+	}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return storage.SearchOptions{}, errors.New("limit must be a positive integer")
+		}
+		opts.Limit = limit
+	}
+
+	return opts, nil
+}
+
+// parseListOptions はクエリパラメータから一覧取得条件を組み立てる
+func parseListOptions(r *http.Request) (storage.ListOptions, error) {
+	query := r.URL.Query()
+	opts := storage.ListOptions{
+		Before: query.Get("before"),
+		After:  query.Get("after"),
+	}
+
+	if opts.Before != "" && opts.After != "" {
+		return storage.ListOptions{}, errors.New("before and after cannot be used together")
+	}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return storage.ListOptions{}, errors.New("limit must be a positive integer")
+		}
+		opts.Limit = limit
+	}
+
+	return opts, nil
 }
 
 // getMessageByID は指定されたIDのメッセージを取得する
 func (h *MessageHandler) getMessageByID(w http.ResponseWriter, r *http.Request, id string) {
-	msg, err := h.storage.GetByID(id)
+	msg, err := h.messages.GetMessage(r.Context(), id, viewer(r))
 	if err != nil {
 		if errors.Is(err, storage.ErrNotFound) {
 			http.Error(w, "Message not found", http.StatusNotFound)
 			return
 		}
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		internalError(w, r, "Failed to get message", err)
 		return
 	}
 
@@ -88,45 +290,245 @@ func (h *MessageHandler) getMessageByID(w http.ResponseWriter, r *http.Request,
 
 // createMessage は新しいメッセージを作成する
 func (h *MessageHandler) createMessage(w http.ResponseWriter, r *http.Request) {
+	sender, ok := requireSender(w, r)
+	if !ok {
+		return
+	}
+	if !allowRequest(w, r, h.createLimiter) {
+		return
+	}
+
 	var req CreateMessageRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	if req.Sender == "" || req.Content == "" {
-		http.Error(w, "Sender and content are required", http.StatusBadRequest)
+	msg, err := req.create(r.Context(), h.messages, "", sender)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrEmptyContent):
+			http.Error(w, "Content is required", http.StatusBadRequest)
+			return
+		case errors.Is(err, service.ErrContentTooLong):
+			http.Error(w, contentTooLongMessage, http.StatusBadRequest)
+			return
+		case errors.Is(err, storage.ErrParentNotFound):
+			http.Error(w, "Parent message not found", http.StatusNotFound)
+			return
+		}
+		internalError(w, r, "Failed to create message", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(msg)
+}
+
+// updateMessage は指定されたIDのメッセージの本文を編集する
+func (h *MessageHandler) updateMessage(w http.ResponseWriter, r *http.Request, id string) {
+	sender, ok := requireSender(w, r)
+	if !ok {
 		return
 	}
 
-	msg := models.Message{
-		ID:        uuid.New().String(),
-		Sender:    req.Sender,
-		Content:   req.Content,
-		CreatedAt: time.Now(),
+	var req UpdateMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
 	}
 
-	if err := h.storage.Save(msg); err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	msg, err := h.messages.EditMessage(r.Context(), id, sender, req.Content)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrEmptyContent):
+			http.Error(w, "Content is required", http.StatusBadRequest)
+		case errors.Is(err, service.ErrContentTooLong):
+			http.Error(w, contentTooLongMessage, http.StatusBadRequest)
+		case errors.Is(err, storage.ErrNotFound):
+			http.Error(w, "Message not found", http.StatusNotFound)
+		case errors.Is(err, service.ErrNotMessageOwner):
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		default:
+			internalError(w, r, "Failed to edit message", err)
+		}
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(msg)
 }
 
-// deleteMessage は指定されたIDのメッセージを削除する
-func (h *MessageHandler) deleteMessage(w http.ResponseWriter, r *http.Request, id string) {
-	err := h.storage.Delete(id)
+// getRevisions は指定されたIDのメッセージの編集履歴を取得する
+func (h *MessageHandler) getRevisions(w http.ResponseWriter, r *http.Request, id string) {
+	revisions, err := h.messages.GetRevisions(r.Context(), id)
 	if err != nil {
 		if errors.Is(err, storage.ErrNotFound) {
 			http.Error(w, "Message not found", http.StatusNotFound)
 			return
 		}
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		internalError(w, r, "Failed to get revisions", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revisions)
+}
+
+// getThread は指定されたIDのメッセージが属するスレッドの起点と返信をページ単位で取得する
+// クエリパラメータは getMessages と同じ
+func (h *MessageHandler) getThread(w http.ResponseWriter, r *http.Request, id string) {
+	opts, err := parseListOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	root, page, err := h.messages.ListThread(r.Context(), id, opts, viewer(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			http.Error(w, "Message not found", http.StatusNotFound)
+		case errors.Is(err, storage.ErrInvalidCursor):
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		default:
+			internalError(w, r, "Failed to get thread", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ThreadResponse{
+		Root:       root,
+		Messages:   page.Messages,
+		NextCursor: page.NextCursor,
+	})
+}
+
+// deleteMessage は指定されたIDのメッセージを削除する
+func (h *MessageHandler) deleteMessage(w http.ResponseWriter, r *http.Request, id string) {
+	sender, ok := requireSender(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.messages.DeleteMessage(r.Context(), id, sender)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			http.Error(w, "Message not found", http.StatusNotFound)
+		case errors.Is(err, service.ErrNotMessageOwner):
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		default:
+			internalError(w, r, "Failed to delete message", err)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleReaction はメッセージへのリアクションを追加・削除する
+//
+// POST はリアクションを追加したメッセージを返す（追加した場合は 201、既に追加済みの場合は 200）。
+// DELETE はリアクションを削除して 204 を返す。emoji はURLエンコードして指定する。
+func (h *MessageHandler) handleReaction(w http.ResponseWriter, r *http.Request, id, emoji string) {
+	switch r.Method {
+	case http.MethodPost:
+		h.addReaction(w, r, id, emoji)
+	case http.MethodDelete:
+		h.removeReaction(w, r, id, emoji)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// addReaction はメッセージに認証済みユーザーのリアクションを追加する
+func (h *MessageHandler) addReaction(w http.ResponseWriter, r *http.Request, id, emoji string) {
+	user, ok := requireSender(w, r)
+	if !ok {
+		return
+	}
+	if !allowRequest(w, r, h.createLimiter) {
+		return
+	}
+
+	msg, added, err := h.messages.AddReaction(r.Context(), id, emoji, user)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrInvalidEmoji):
+			http.Error(w, "Invalid emoji", http.StatusBadRequest)
+		case errors.Is(err, storage.ErrNotFound):
+			http.Error(w, "Message not found", http.StatusNotFound)
+		default:
+			internalError(w, r, "Failed to add reaction", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if added {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(msg)
+}
+
+// removeReaction はメッセージから認証済みユーザーのリアクションを削除する
+func (h *MessageHandler) removeReaction(w http.ResponseWriter, r *http.Request, id, emoji string) {
+	user, ok := requireSender(w, r)
+	if !ok {
+		return
+	}
+
+	if _, err := h.messages.RemoveReaction(r.Context(), id, emoji, user); err != nil {
+		switch {
+		case errors.Is(err, service.ErrInvalidEmoji):
+			http.Error(w, "Invalid emoji", http.StatusBadRequest)
+		case errors.Is(err, storage.ErrNotFound):
+			http.Error(w, "Message not found", http.StatusNotFound)
+		case errors.Is(err, storage.ErrReactionNotFound):
+			http.Error(w, "Reaction not found", http.StatusNotFound)
+		default:
+			internalError(w, r, "Failed to remove reaction", err)
+		}
 		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// viewer はリアクションの ReactedByMe を判定するための閲覧者のユーザー名を返す
+// 認証されていない場合は空文字になり、どのリアクションも ReactedByMe にならない
+func viewer(r *http.Request) string {
+	id, _ := auth.IdentityFromContext(r.Context())
+	return id.Username
+}
+
+// requireSender は認証済みユーザーのユーザー名を送信者として取り出す
+// 認証されていない場合は 401 を返して false を返す
+func requireSender(w http.ResponseWriter, r *http.Request) (string, bool) {
+	id, ok := auth.IdentityFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", false
+	}
+	return id.Username, true
+}
+
+// allowRequest はリクエストが流量制限の範囲内かどうかを確認する
+// 超えている場合は 429 と Retry-After ヘッダーを返して false を返す
+func allowRequest(w http.ResponseWriter, r *http.Request, limiter *ratelimit.Limiter) bool {
+	ok, wait := limiter.Allow(ratelimit.KeyForRequest(r))
+	if !ok {
+		ratelimit.Reject(w, wait)
+	}
+	return ok
+}
+
+// internalError は想定外のエラーをリクエストIDとともにログに残し、500 を返す
+// エラーの詳細はクライアントには返さない
+func internalError(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	slog.ErrorContext(r.Context(), msg, "method", r.Method, "path", r.URL.Path, "error", err)
+	http.Error(w, "Internal server error", http.StatusInternalServerError)
+}
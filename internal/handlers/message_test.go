@@ -2,20 +2,43 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/tasukuchiba/text_messaging_app/internal/auth"
 	"github.com/tasukuchiba/text_messaging_app/internal/models"
+	"github.com/tasukuchiba/text_messaging_app/internal/ratelimit"
+	"github.com/tasukuchiba/text_messaging_app/internal/service"
 	"github.com/tasukuchiba/text_messaging_app/internal/storage"
 )
 
+// recordingPublisher は配信されたイベントを記録するテスト用のEventPublisher
+type recordingPublisher struct {
+	events []service.Event
+}
+
+func (p *recordingPublisher) PublishEvent(event service.Event) error {
+	p.events = append(p.events, event)
+	return nil
+}
+
+// asUser はリクエストに認証済みユーザーを設定する（認証ミドルウェアを通った状態にする）
+func asUser(req *http.Request, username string) *http.Request {
+	return req.WithContext(auth.WithIdentity(req.Context(), auth.Identity{UserID: username + "-id", Username: username}))
+}
+
 func TestHandleMessages_GET(t *testing.T) {
 	store := storage.NewMemoryStorage()
-	store.Save(models.Message{ID: "1", Sender: "alice", Content: "Hello"})
+	store.Save(context.Background(), models.Message{ID: "1", Sender: "alice", Content: "Hello"})
 
-	handler := NewMessageHandler(store)
+	handler := NewMessageHandler(service.NewMessageService(store, nil))
 
 	req := httptest.NewRequest(http.MethodGet, "/messages", nil)
 	rec := httptest.NewRecorder()
@@ -26,22 +49,112 @@ func TestHandleMessages_GET(t *testing.T) {
 		t.Errorf("expected status %d, got %d", http.StatusOK, rec.Code)
 	}
 
-	var messages []models.Message
-	if err := json.NewDecoder(rec.Body).Decode(&messages); err != nil {
+	var resp MessageListResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
 		t.Fatalf("failed to decode response: %v", err)
 	}
 
-	if len(messages) != 1 {
-		t.Errorf("expected 1 message, got %d", len(messages))
+	if len(resp.Messages) != 1 {
+		t.Errorf("expected 1 message, got %d", len(resp.Messages))
+	}
+	if resp.NextCursor != "" {
+		t.Errorf("expected empty next_cursor, got '%s'", resp.NextCursor)
+	}
+}
+
+func TestHandleMessages_GET_Pagination(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 1; i <= 5; i++ {
+		store.Save(context.Background(), models.Message{
+			ID:        fmt.Sprintf("msg-%d", i),
+			Sender:    "alice",
+			Content:   "Hello",
+			CreatedAt: base.Add(time.Duration(i) * time.Second),
+		})
+	}
+	handler := NewMessageHandler(service.NewMessageService(store, nil))
+
+	get := func(query string) MessageListResponse {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/messages"+query, nil)
+		rec := httptest.NewRecorder()
+		handler.HandleMessages(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+		}
+		var resp MessageListResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		return resp
+	}
+
+	// 最新の2件
+	first := get("?limit=2")
+	if len(first.Messages) != 2 || first.Messages[0].ID != "msg-4" || first.Messages[1].ID != "msg-5" {
+		t.Fatalf("unexpected first page: %+v", first.Messages)
+	}
+	if first.NextCursor == "" {
+		t.Fatal("expected next_cursor on first page")
+	}
+
+	// それより古い2件
+	second := get("?limit=2&before=" + first.NextCursor)
+	if len(second.Messages) != 2 || second.Messages[0].ID != "msg-2" || second.Messages[1].ID != "msg-3" {
+		t.Fatalf("unexpected second page: %+v", second.Messages)
+	}
+
+	// 最後のページには続きがない
+	last := get("?limit=2&before=" + second.NextCursor)
+	if len(last.Messages) != 1 || last.Messages[0].ID != "msg-1" {
+		t.Fatalf("unexpected last page: %+v", last.Messages)
+	}
+	if last.NextCursor != "" {
+		t.Errorf("expected empty next_cursor on last page, got '%s'", last.NextCursor)
+	}
+
+	// after で新しい方向に辿る
+	forward := get("?limit=3&after=" + second.NextCursor)
+	if len(forward.Messages) != 3 || forward.Messages[0].ID != "msg-3" || forward.Messages[2].ID != "msg-5" {
+		t.Fatalf("unexpected forward page: %+v", forward.Messages)
+	}
+}
+
+func TestHandleMessages_GET_InvalidParams(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	handler := NewMessageHandler(service.NewMessageService(store, nil))
+
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{"non-numeric limit", "?limit=abc"},
+		{"zero limit", "?limit=0"},
+		{"invalid cursor", "?before=not-a-cursor"},
+		{"before and after", "?before=a&after=b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/messages"+tt.query, nil)
+			rec := httptest.NewRecorder()
+
+			handler.HandleMessages(rec, req)
+
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("expected status %d, got %d", http.StatusBadRequest, rec.Code)
+			}
+		})
 	}
 }
 
 func TestHandleMessages_POST(t *testing.T) {
 	store := storage.NewMemoryStorage()
-	handler := NewMessageHandler(store)
+	handler := NewMessageHandler(service.NewMessageService(store, nil))
 
-	body := `{"sender":"alice","content":"Hello"}`
-	req := httptest.NewRequest(http.MethodPost, "/messages", bytes.NewBufferString(body))
+	body := `{"content":"Hello"}`
+	req := asUser(httptest.NewRequest(http.MethodPost, "/messages", bytes.NewBufferString(body)), "alice")
 	req.Header.Set("Content-Type", "application/json")
 	rec := httptest.NewRecorder()
 
@@ -64,12 +177,58 @@ func TestHandleMessages_POST(t *testing.T) {
 	}
 }
 
+func TestHandleMessages_POST_RateLimited(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	limiter := ratelimit.NewLimiter(ratelimit.Every(1, time.Minute, 2))
+	handler := NewMessageHandler(service.NewMessageService(store, nil), WithCreateRateLimit(limiter))
+
+	post := func(username string) *httptest.ResponseRecorder {
+		req := asUser(httptest.NewRequest(http.MethodPost, "/messages", bytes.NewBufferString(`{"content":"Hello"}`)), username)
+		rec := httptest.NewRecorder()
+		handler.HandleMessages(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := post("alice"); rec.Code != http.StatusCreated {
+			t.Fatalf("request %d: expected status %d, got %d", i+1, http.StatusCreated, rec.Code)
+		}
+	}
+
+	rec := post("alice")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status %d, got %d", http.StatusTooManyRequests, rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("expected Retry-After header")
+	}
+
+	// 制限はユーザーごと
+	if rec := post("bob"); rec.Code != http.StatusCreated {
+		t.Errorf("expected bob to be allowed, got %d", rec.Code)
+	}
+
+	// 制限されたリクエストは保存されない
+	all, _ := store.GetAll(context.Background())
+	if len(all) != 3 {
+		t.Errorf("expected 3 stored messages, got %d", len(all))
+	}
+
+	// 一覧の取得は制限しない
+	req := asUser(httptest.NewRequest(http.MethodGet, "/messages", nil), "alice")
+	rec = httptest.NewRecorder()
+	handler.HandleMessages(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected GET to be allowed, got %d", rec.Code)
+	}
+}
+
 func TestHandleMessages_POST_InvalidBody(t *testing.T) {
 	store := storage.NewMemoryStorage()
-	handler := NewMessageHandler(store)
+	handler := NewMessageHandler(service.NewMessageService(store, nil))
 
 	body := `invalid json`
-	req := httptest.NewRequest(http.MethodPost, "/messages", bytes.NewBufferString(body))
+	req := asUser(httptest.NewRequest(http.MethodPost, "/messages", bytes.NewBufferString(body)), "alice")
 	rec := httptest.NewRecorder()
 
 	handler.HandleMessages(rec, req)
@@ -81,21 +240,20 @@ func TestHandleMessages_POST_InvalidBody(t *testing.T) {
 
 func TestHandleMessages_POST_MissingFields(t *testing.T) {
 	store := storage.NewMemoryStorage()
-	handler := NewMessageHandler(store)
+	handler := NewMessageHandler(service.NewMessageService(store, nil))
 
 	tests := []struct {
 		name string
 		body string
 	}{
-		{"missing sender", `{"content":"Hello"}`},
-		{"missing content", `{"sender":"alice"}`},
-		{"empty sender", `{"sender":"","content":"Hello"}`},
-		{"empty content", `{"sender":"alice","content":""}`},
+		{"missing content", `{}`},
+		{"empty content", `{"content":""}`},
+		{"too long content", `{"content":"` + strings.Repeat("x", service.MaxContentSize+1) + `"}`},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			req := httptest.NewRequest(http.MethodPost, "/messages", bytes.NewBufferString(tt.body))
+			req := asUser(httptest.NewRequest(http.MethodPost, "/messages", bytes.NewBufferString(tt.body)), "alice")
 			rec := httptest.NewRecorder()
 
 			handler.HandleMessages(rec, req)
@@ -107,9 +265,67 @@ func TestHandleMessages_POST_MissingFields(t *testing.T) {
 	}
 }
 
+func TestHandleMessages_POST_IgnoresClaimedSender(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	handler := NewMessageHandler(service.NewMessageService(store, nil))
+
+	// ボディで送信者を名乗っても、認証済みユーザーが送信者になる
+	body := `{"sender":"bob","content":"Hello"}`
+	req := asUser(httptest.NewRequest(http.MethodPost, "/messages", bytes.NewBufferString(body)), "alice")
+	rec := httptest.NewRecorder()
+
+	handler.HandleMessages(rec, req)
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, rec.Code)
+	}
+
+	var msg models.Message
+	if err := json.NewDecoder(rec.Body).Decode(&msg); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if msg.Sender != "alice" {
+		t.Errorf("expected sender 'alice', got '%s'", msg.Sender)
+	}
+}
+
+func TestHandleMessages_Unauthenticated(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	store.Save(context.Background(), models.Message{ID: "test-id", Sender: "alice", Content: "Hello"})
+	handler := NewMessageHandler(service.NewMessageService(store, nil))
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+	}{
+		{"POST", http.MethodPost, "/messages", `{"content":"Hello"}`},
+		{"PATCH", http.MethodPatch, "/messages/test-id", `{"content":"Hi"}`},
+		{"DELETE", http.MethodDelete, "/messages/test-id", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, bytes.NewBufferString(tt.body))
+			rec := httptest.NewRecorder()
+
+			if tt.path == "/messages" {
+				handler.HandleMessages(rec, req)
+			} else {
+				handler.HandleMessageByID(rec, req)
+			}
+
+			if rec.Code != http.StatusUnauthorized {
+				t.Errorf("expected status %d, got %d", http.StatusUnauthorized, rec.Code)
+			}
+		})
+	}
+}
+
 func TestHandleMessages_MethodNotAllowed(t *testing.T) {
 	store := storage.NewMemoryStorage()
-	handler := NewMessageHandler(store)
+	handler := NewMessageHandler(service.NewMessageService(store, nil))
 
 	req := httptest.NewRequest(http.MethodPut, "/messages", nil)
 	rec := httptest.NewRecorder()
@@ -123,8 +339,8 @@ func TestHandleMessages_MethodNotAllowed(t *testing.T) {
 
 func TestHandleMessageByID_GET(t *testing.T) {
 	store := storage.NewMemoryStorage()
-	store.Save(models.Message{ID: "test-id", Sender: "alice", Content: "Hello"})
-	handler := NewMessageHandler(store)
+	store.Save(context.Background(), models.Message{ID: "test-id", Sender: "alice", Content: "Hello"})
+	handler := NewMessageHandler(service.NewMessageService(store, nil))
 
 	req := httptest.NewRequest(http.MethodGet, "/messages/test-id", nil)
 	rec := httptest.NewRecorder()
@@ -147,7 +363,7 @@ func TestHandleMessageByID_GET(t *testing.T) {
 
 func TestHandleMessageByID_GET_NotFound(t *testing.T) {
 	store := storage.NewMemoryStorage()
-	handler := NewMessageHandler(store)
+	handler := NewMessageHandler(service.NewMessageService(store, nil))
 
 	req := httptest.NewRequest(http.MethodGet, "/messages/non-existent", nil)
 	rec := httptest.NewRecorder()
@@ -161,14 +377,24 @@ func TestHandleMessageByID_GET_NotFound(t *testing.T) {
 
 func TestHandleMessageByID_DELETE(t *testing.T) {
 	store := storage.NewMemoryStorage()
-	store.Save(models.Message{ID: "test-id", Sender: "alice", Content: "Hello"})
-	handler := NewMessageHandler(store)
+	store.Save(context.Background(), models.Message{ID: "test-id", Sender: "alice", Content: "Hello"})
+	handler := NewMessageHandler(service.NewMessageService(store, nil))
 
-	req := httptest.NewRequest(http.MethodDelete, "/messages/test-id", nil)
+	// 送信者以外は削除できない
+	req := asUser(httptest.NewRequest(http.MethodDelete, "/messages/test-id", nil), "bob")
 	rec := httptest.NewRecorder()
 
 	handler.HandleMessageByID(rec, req)
 
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected status %d, got %d", http.StatusForbidden, rec.Code)
+	}
+
+	req = asUser(httptest.NewRequest(http.MethodDelete, "/messages/test-id", nil), "alice")
+	rec = httptest.NewRecorder()
+
+	handler.HandleMessageByID(rec, req)
+
 	if rec.Code != http.StatusNoContent {
 		t.Errorf("expected status %d, got %d", http.StatusNoContent, rec.Code)
 	}
@@ -185,9 +411,9 @@ func TestHandleMessageByID_DELETE(t *testing.T) {
 
 func TestHandleMessageByID_DELETE_NotFound(t *testing.T) {
 	store := storage.NewMemoryStorage()
-	handler := NewMessageHandler(store)
+	handler := NewMessageHandler(service.NewMessageService(store, nil))
 
-	req := httptest.NewRequest(http.MethodDelete, "/messages/non-existent", nil)
+	req := asUser(httptest.NewRequest(http.MethodDelete, "/messages/non-existent", nil), "alice")
 	rec := httptest.NewRecorder()
 
 	handler.HandleMessageByID(rec, req)
@@ -196,3 +422,375 @@ func TestHandleMessageByID_DELETE_NotFound(t *testing.T) {
 		t.Errorf("expected status %d, got %d", http.StatusNotFound, rec.Code)
 	}
 }
+
+func TestHandleMessages_POST_PublishesEvent(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	publisher := &recordingPublisher{}
+	handler := NewMessageHandler(service.NewMessageService(store, publisher))
+
+	body := `{"content":"Deployed!"}`
+	req := asUser(httptest.NewRequest(http.MethodPost, "/messages", bytes.NewBufferString(body)), "bot")
+	rec := httptest.NewRecorder()
+
+	handler.HandleMessages(rec, req)
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, rec.Code)
+	}
+
+	if len(publisher.events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(publisher.events))
+	}
+	event := publisher.events[0]
+	if event.Type != service.EventMessage {
+		t.Errorf("expected event type '%s', got '%s'", service.EventMessage, event.Type)
+	}
+	if event.Message.Content != "Deployed!" {
+		t.Errorf("expected content 'Deployed!', got '%s'", event.Message.Content)
+	}
+}
+
+func TestHandleMessageByID_DELETE_PublishesEvent(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	store.Save(context.Background(), models.Message{ID: "test-id", Sender: "alice", Content: "Hello"})
+	publisher := &recordingPublisher{}
+	handler := NewMessageHandler(service.NewMessageService(store, publisher))
+
+	req := asUser(httptest.NewRequest(http.MethodDelete, "/messages/test-id", nil), "alice")
+	rec := httptest.NewRecorder()
+
+	handler.HandleMessageByID(rec, req)
+
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, rec.Code)
+	}
+
+	if len(publisher.events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(publisher.events))
+	}
+	event := publisher.events[0]
+	if event.Type != service.EventMessageDeleted {
+		t.Errorf("expected event type '%s', got '%s'", service.EventMessageDeleted, event.Type)
+	}
+	if event.Message.ID != "test-id" {
+		t.Errorf("expected message ID 'test-id', got '%s'", event.Message.ID)
+	}
+}
+
+func TestHandleMessageByID_PATCH(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	store.Save(context.Background(), models.Message{ID: "test-id", Sender: "alice", Content: "Helo"})
+	publisher := &recordingPublisher{}
+	handler := NewMessageHandler(service.NewMessageService(store, publisher))
+
+	body := `{"content":"Hello"}`
+	req := asUser(httptest.NewRequest(http.MethodPatch, "/messages/test-id", bytes.NewBufferString(body)), "alice")
+	rec := httptest.NewRecorder()
+
+	handler.HandleMessageByID(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+
+	var msg models.Message
+	if err := json.NewDecoder(rec.Body).Decode(&msg); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if msg.Content != "Hello" || !msg.Edited || msg.UpdatedAt == nil {
+		t.Errorf("unexpected edited message: %+v", msg)
+	}
+
+	if len(publisher.events) != 1 || publisher.events[0].Type != service.EventMessageEdited {
+		t.Errorf("expected 1 message_edited event, got %+v", publisher.events)
+	}
+
+	// 編集履歴に元の本文が残る
+	req = httptest.NewRequest(http.MethodGet, "/messages/test-id/revisions", nil)
+	rec = httptest.NewRecorder()
+
+	handler.HandleMessageByID(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+
+	var revisions []models.MessageRevision
+	if err := json.NewDecoder(rec.Body).Decode(&revisions); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(revisions) != 1 || revisions[0].Content != "Helo" {
+		t.Errorf("unexpected revisions: %+v", revisions)
+	}
+}
+
+func TestHandleMessageByID_PATCH_Errors(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	store.Save(context.Background(), models.Message{ID: "test-id", Sender: "alice", Content: "Hello"})
+	handler := NewMessageHandler(service.NewMessageService(store, nil))
+
+	tests := []struct {
+		name   string
+		user   string
+		path   string
+		body   string
+		status int
+	}{
+		{"invalid body", "alice", "/messages/test-id", `invalid json`, http.StatusBadRequest},
+		{"missing content", "alice", "/messages/test-id", `{}`, http.StatusBadRequest},
+		{"too long content", "alice", "/messages/test-id", `{"content":"` + strings.Repeat("x", service.MaxContentSize+1) + `"}`, http.StatusBadRequest},
+		{"not owner", "bob", "/messages/test-id", `{"content":"Hi"}`, http.StatusForbidden},
+		{"not found", "alice", "/messages/non-existent", `{"content":"Hi"}`, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := asUser(httptest.NewRequest(http.MethodPatch, tt.path, bytes.NewBufferString(tt.body)), tt.user)
+			rec := httptest.NewRecorder()
+
+			handler.HandleMessageByID(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, rec.Code)
+			}
+		})
+	}
+}
+
+func TestHandleMessages_POST_Reply(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	store.Save(context.Background(), models.Message{ID: "root", Sender: "bob", Content: "Lunch?"})
+	publisher := &recordingPublisher{}
+	handler := NewMessageHandler(service.NewMessageService(store, publisher))
+
+	body := `{"content":"Sure","parent_id":"root"}`
+	req := asUser(httptest.NewRequest(http.MethodPost, "/messages", bytes.NewBufferString(body)), "alice")
+	rec := httptest.NewRecorder()
+
+	handler.HandleMessages(rec, req)
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, rec.Code)
+	}
+	var msg models.Message
+	if err := json.NewDecoder(rec.Body).Decode(&msg); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if msg.ParentID != "root" || msg.ThreadRootID != "root" {
+		t.Errorf("unexpected reply: %+v", msg)
+	}
+	if len(publisher.events) != 1 || publisher.events[0].Type != service.EventThreadReply {
+		t.Errorf("expected 1 thread_reply event, got %+v", publisher.events)
+	}
+
+	// 返信先が存在しない場合
+	body = `{"content":"Sure","parent_id":"non-existent"}`
+	req = asUser(httptest.NewRequest(http.MethodPost, "/messages", bytes.NewBufferString(body)), "alice")
+	rec = httptest.NewRecorder()
+
+	handler.HandleMessages(rec, req)
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestHandleMessageByID_Thread(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	store.Save(context.Background(), models.Message{ID: "root", Sender: "bob", Content: "Lunch?", CreatedAt: base})
+	for i := 1; i <= 3; i++ {
+		store.Save(context.Background(), models.Message{
+			ID: fmt.Sprintf("r%d", i), Sender: "alice", Content: "Sure", CreatedAt: base.Add(time.Duration(i) * time.Second),
+			ParentID: "root", ThreadRootID: "root",
+		})
+	}
+	handler := NewMessageHandler(service.NewMessageService(store, nil))
+
+	get := func(path string) (*httptest.ResponseRecorder, ThreadResponse) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler.HandleMessageByID(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		var resp ThreadResponse
+		if rec.Code == http.StatusOK {
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+		}
+		return rec, resp
+	}
+
+	// 起点には返信数と最後の返信日時が付き、返信は古い順に並ぶ
+	rec, resp := get("/messages/root/thread?limit=2")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+	if resp.Root.ID != "root" || resp.Root.ReplyCount != 3 || resp.Root.LastReplyAt == nil || !resp.Root.LastReplyAt.Equal(base.Add(3*time.Second)) {
+		t.Errorf("unexpected root: %+v", resp.Root)
+	}
+	if len(resp.Messages) != 2 || resp.Messages[0].ID != "r2" || resp.Messages[1].ID != "r3" || resp.NextCursor == "" {
+		t.Fatalf("unexpected replies: %+v (%q)", resp.Messages, resp.NextCursor)
+	}
+
+	// 返信のIDを指定しても同じスレッドを取得できる
+	rec, resp = get("/messages/r3/thread?before=" + resp.NextCursor)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+	if resp.Root.ID != "root" || len(resp.Messages) != 1 || resp.Messages[0].ID != "r1" || resp.NextCursor != "" {
+		t.Errorf("unexpected thread: %+v", resp)
+	}
+
+	// 返信はメッセージ一覧に含まれない
+	rec = httptest.NewRecorder()
+	handler.HandleMessages(rec, httptest.NewRequest(http.MethodGet, "/messages", nil))
+	var list MessageListResponse
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(list.Messages) != 1 || list.Messages[0].ID != "root" {
+		t.Errorf("expected only root in list, got %+v", list.Messages)
+	}
+
+	if rec, _ := get("/messages/non-existent/thread"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, rec.Code)
+	}
+	if rec, _ := get("/messages/root/thread?before=invalid"); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.HandleMessageByID(rec, httptest.NewRequest(http.MethodPost, "/messages/root/thread", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+}
+
+func TestHandleMessageByID_Reactions(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	store.Save(context.Background(), models.Message{ID: "test-id", Sender: "bob", Content: "Hello", CreatedAt: time.Now()})
+	publisher := &recordingPublisher{}
+	handler := NewMessageHandler(service.NewMessageService(store, publisher))
+	path := "/messages/test-id/reactions/" + url.PathEscape("👍")
+
+	do := func(method, path, username string) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler.HandleMessageByID(rec, asUser(httptest.NewRequest(method, path, nil), username))
+		return rec
+	}
+
+	// 追加したリアクションは閲覧者から見た集計としてメッセージに付く
+	rec := do(http.MethodPost, path, "alice")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+	}
+	var msg models.Message
+	if err := json.NewDecoder(rec.Body).Decode(&msg); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(msg.Reactions) != 1 || msg.Reactions[0] != (models.Reaction{Emoji: "👍", Count: 1, ReactedByMe: true}) {
+		t.Errorf("unexpected reactions: %+v", msg.Reactions)
+	}
+
+	// 追加済みのリアクションをもう一度追加しても成功する
+	if rec := do(http.MethodPost, path, "alice"); rec.Code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+	if len(publisher.events) != 1 || publisher.events[0].Type != service.EventReactionAdded {
+		t.Errorf("expected 1 reaction_added event, got %+v", publisher.events)
+	}
+
+	rec = do(http.MethodGet, "/messages/test-id", "bob")
+	msg = models.Message{}
+	if err := json.NewDecoder(rec.Body).Decode(&msg); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(msg.Reactions) != 1 || msg.Reactions[0] != (models.Reaction{Emoji: "👍", Count: 1}) {
+		t.Errorf("unexpected reactions for bob: %+v", msg.Reactions)
+	}
+
+	if rec := do(http.MethodDelete, path, "alice"); rec.Code != http.StatusNoContent {
+		t.Errorf("expected status %d, got %d", http.StatusNoContent, rec.Code)
+	}
+	if len(publisher.events) != 2 || publisher.events[1].Type != service.EventReactionRemoved {
+		t.Errorf("expected reaction_removed event, got %+v", publisher.events)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		want   int
+	}{
+		{"reaction not found", http.MethodDelete, path, http.StatusNotFound},
+		{"message not found", http.MethodPost, "/messages/non-existent/reactions/x", http.StatusNotFound},
+		{"invalid emoji", http.MethodPost, "/messages/test-id/reactions/a%20b", http.StatusBadRequest},
+		{"missing emoji", http.MethodPost, "/messages/test-id/reactions/", http.StatusBadRequest},
+		{"method not allowed", http.MethodGet, path, http.StatusMethodNotAllowed},
+		{"unknown path", http.MethodPost, "/messages/test-id/reactions", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := do(tt.method, tt.path, "alice"); rec.Code != tt.want {
+				t.Errorf("expected status %d, got %d", tt.want, rec.Code)
+			}
+		})
+	}
+}
+
+func TestHandleSearch(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	store.Save(context.Background(), models.Message{ID: "1", Sender: "alice", Content: "Deploy the API", CreatedAt: base})
+	store.Save(context.Background(), models.Message{ID: "2", Sender: "bob", Content: "deploy finished", CreatedAt: base.Add(time.Hour)})
+	handler := NewMessageHandler(service.NewMessageService(store, nil))
+
+	req := httptest.NewRequest(http.MethodGet, "/messages/search?q=deploy&sender=alice&since=2026-01-01T00:00:00Z", nil)
+	rec := httptest.NewRecorder()
+
+	handler.HandleSearch(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+
+	var resp SearchResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(resp.Results) != 1 || resp.Results[0].Message.ID != "1" {
+		t.Fatalf("unexpected results: %+v", resp.Results)
+	}
+	if resp.Results[0].Snippet != "<mark>Deploy</mark> the API" {
+		t.Errorf("unexpected snippet: %q", resp.Results[0].Snippet)
+	}
+}
+
+func TestHandleSearch_InvalidParams(t *testing.T) {
+	handler := NewMessageHandler(service.NewMessageService(storage.NewMemoryStorage(), nil))
+
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{"missing q", ""},
+		{"blank q", "?q=%20"},
+		{"invalid since", "?q=deploy&since=yesterday"},
+		{"invalid until", "?q=deploy&until=2026-01-01"},
+		{"invalid limit", "?q=deploy&limit=0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/messages/search"+tt.query, nil)
+			rec := httptest.NewRecorder()
+
+			handler.HandleSearch(rec, req)
+
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("expected status %d, got %d", http.StatusBadRequest, rec.Code)
+			}
+		})
+	}
+}
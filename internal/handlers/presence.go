@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// PresenceSource はオンライン中のユーザー一覧を提供する
+// websocket.Hub が実装する
+type PresenceSource interface {
+	OnlineUsers() []string
+}
+
+// PresenceHandler はオンライン状態のHTTPリクエストを処理する
+type PresenceHandler struct {
+	presence PresenceSource
+}
+
+// NewPresenceHandler は新しいPresenceHandlerを作成する
+func NewPresenceHandler(presence PresenceSource) *PresenceHandler {
+	return &PresenceHandler{presence: presence}
+}
+
+// PresenceResponse はオンライン中のユーザー一覧レスポンスのボディ
+type PresenceResponse struct {
+	Users []string `json:"users"`
+}
+
+// HandlePresence は /presence エンドポイントのハンドラー
+func (h *PresenceHandler) HandlePresence(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	users := h.presence.OnlineUsers()
+	if users == nil {
+		users = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PresenceResponse{Users: users})
+}
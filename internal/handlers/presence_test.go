@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// staticPresence は固定のユーザー一覧を返すテスト用の PresenceSource
+type staticPresence []string
+
+func (p staticPresence) OnlineUsers() []string {
+	return p
+}
+
+func TestHandlePresence_GET(t *testing.T) {
+	handler := NewPresenceHandler(staticPresence{"alice", "bob"})
+
+	req := httptest.NewRequest(http.MethodGet, "/presence", nil)
+	rec := httptest.NewRecorder()
+
+	handler.HandlePresence(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+
+	var resp PresenceResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(resp.Users) != 2 || resp.Users[0] != "alice" || resp.Users[1] != "bob" {
+		t.Errorf("expected [alice bob], got %v", resp.Users)
+	}
+}
+
+func TestHandlePresence_Empty(t *testing.T) {
+	handler := NewPresenceHandler(staticPresence(nil))
+
+	req := httptest.NewRequest(http.MethodGet, "/presence", nil)
+	rec := httptest.NewRecorder()
+
+	handler.HandlePresence(rec, req)
+
+	// 誰もいない場合も null ではなく空の配列を返す
+	if body := rec.Body.String(); body != "{\"users\":[]}\n" {
+		t.Errorf("expected empty users array, got %q", body)
+	}
+}
+
+func TestHandlePresence_MethodNotAllowed(t *testing.T) {
+	handler := NewPresenceHandler(staticPresence(nil))
+
+	req := httptest.NewRequest(http.MethodPost, "/presence", nil)
+	rec := httptest.NewRecorder()
+
+	handler.HandlePresence(rec, req)
+
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+}
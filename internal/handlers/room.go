@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tasukuchiba/text_messaging_app/internal/models"
+	"github.com/tasukuchiba/text_messaging_app/internal/ratelimit"
+	"github.com/tasukuchiba/text_messaging_app/internal/service"
+	"github.com/tasukuchiba/text_messaging_app/internal/storage"
+)
+
+// RoomHandler はルーム関連のHTTPリクエストを処理する
+type RoomHandler struct {
+	storage  storage.Storage
+	messages *service.MessageService
+
+	// ルームへのメッセージ作成の流量制限（nil の場合は制限しない）
+	createMessageLimiter *ratelimit.Limiter
+}
+
+// RoomHandlerOption はRoomHandlerの設定を変更する関数
+type RoomHandlerOption func(*RoomHandler)
+
+// WithRoomMessageRateLimit は POST /rooms/{id}/messages の流量制限を指定する
+func WithRoomMessageRateLimit(limiter *ratelimit.Limiter) RoomHandlerOption {
+	return func(h *RoomHandler) {
+		h.createMessageLimiter = limiter
+	}
+}
+
+// NewRoomHandler は新しいRoomHandlerを作成する
+func NewRoomHandler(s storage.Storage, messages *service.MessageService, opts ...RoomHandlerOption) *RoomHandler {
+	h := &RoomHandler{storage: s, messages: messages}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// CreateRoomRequest はルーム作成リクエストのボディ
+type CreateRoomRequest struct {
+	Name string `json:"name"`
+}
+
+// HandleRooms は /rooms エンドポイントのハンドラー
+func (h *RoomHandler) HandleRooms(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.getRooms(w, r)
+	case http.MethodPost:
+		h.createRoom(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleRoomByID は /rooms/{id} および /rooms/{id}/messages エンドポイントのハンドラー
+func (h *RoomHandler) HandleRoomByID(w http.ResponseWriter, r *http.Request) {
+	id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/rooms/"), "/")
+	if id == "" {
+		http.Error(w, "Room ID is required", http.StatusBadRequest)
+		return
+	}
+
+	switch sub {
+	case "":
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.getRoom(w, r, id)
+	case "messages":
+		switch r.Method {
+		case http.MethodGet:
+			h.getRoomMessages(w, r, id)
+		case http.MethodPost:
+			h.createRoomMessage(w, r, id)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// getRooms は全てのルームを取得する
+func (h *RoomHandler) getRooms(w http.ResponseWriter, r *http.Request) {
+	rooms, err := h.storage.ListRooms(r.Context())
+	if err != nil {
+		internalError(w, r, "Failed to list rooms", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rooms)
+}
+
+// createRoom は新しいルームを作成する
+func (h *RoomHandler) createRoom(w http.ResponseWriter, r *http.Request) {
+	var req CreateRoomRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+
+	room := models.Room{
+		ID:        uuid.New().String(),
+		Name:      req.Name,
+		CreatedAt: time.Now(),
+	}
+
+	if err := h.storage.CreateRoom(r.Context(), room); err != nil {
+		internalError(w, r, "Failed to create room", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(room)
+}
+
+// getRoom は指定されたIDのルームを取得する
+func (h *RoomHandler) getRoom(w http.ResponseWriter, r *http.Request, id string) {
+	room, err := h.storage.GetRoom(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, storage.ErrRoomNotFound) {
+			http.Error(w, "Room not found", http.StatusNotFound)
+			return
+		}
+		internalError(w, r, "Failed to get room", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(room)
+}
+
+// getRoomMessages はルーム内のメッセージ一覧をページ単位で取得する
+// クエリパラメータは GET /messages と同じ
+func (h *RoomHandler) getRoomMessages(w http.ResponseWriter, r *http.Request, id string) {
+	opts, err := parseListOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.RoomID = id
+
+	page, err := h.messages.ListMessages(r.Context(), opts, viewer(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrRoomNotFound):
+			http.Error(w, "Room not found", http.StatusNotFound)
+		case errors.Is(err, storage.ErrInvalidCursor):
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		default:
+			internalError(w, r, "Failed to list room messages", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MessageListResponse{
+		Messages:   page.Messages,
+		NextCursor: page.NextCursor,
+	})
+}
+
+// createRoomMessage はルームに新しいメッセージを作成する
+func (h *RoomHandler) createRoomMessage(w http.ResponseWriter, r *http.Request, id string) {
+	sender, ok := requireSender(w, r)
+	if !ok {
+		return
+	}
+	if !allowRequest(w, r, h.createMessageLimiter) {
+		return
+	}
+
+	var req CreateMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	msg, err := req.create(r.Context(), h.messages, id, sender)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrEmptyContent):
+			http.Error(w, "Content is required", http.StatusBadRequest)
+			return
+		case errors.Is(err, service.ErrContentTooLong):
+			http.Error(w, contentTooLongMessage, http.StatusBadRequest)
+			return
+		case errors.Is(err, storage.ErrRoomNotFound):
+			http.Error(w, "Room not found", http.StatusNotFound)
+			return
+		case errors.Is(err, storage.ErrParentNotFound):
+			http.Error(w, "Parent message not found", http.StatusNotFound)
+			return
+		}
+		internalError(w, r, "Failed to create room message", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(msg)
+}
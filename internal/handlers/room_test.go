@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tasukuchiba/text_messaging_app/internal/models"
+	"github.com/tasukuchiba/text_messaging_app/internal/ratelimit"
+	"github.com/tasukuchiba/text_messaging_app/internal/service"
+	"github.com/tasukuchiba/text_messaging_app/internal/storage"
+)
+
+func TestHandleRooms_POST(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	handler := NewRoomHandler(store, service.NewMessageService(store, nil))
+
+	body := `{"name":"general"}`
+	req := httptest.NewRequest(http.MethodPost, "/rooms", bytes.NewBufferString(body))
+	rec := httptest.NewRecorder()
+
+	handler.HandleRooms(rec, req)
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, rec.Code)
+	}
+
+	var room models.Room
+	if err := json.NewDecoder(rec.Body).Decode(&room); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if room.ID == "" {
+		t.Error("expected ID to be generated")
+	}
+	if room.Name != "general" {
+		t.Errorf("expected name 'general', got '%s'", room.Name)
+	}
+
+	if _, err := store.GetRoom(context.Background(), room.ID); err != nil {
+		t.Errorf("expected room to be stored, got %v", err)
+	}
+}
+
+func TestHandleRooms_POST_MissingName(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	handler := NewRoomHandler(store, service.NewMessageService(store, nil))
+
+	req := httptest.NewRequest(http.MethodPost, "/rooms", bytes.NewBufferString(`{}`))
+	rec := httptest.NewRecorder()
+
+	handler.HandleRooms(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestHandleRooms_GET(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	store.CreateRoom(context.Background(), models.Room{ID: "room-1", Name: "general", CreatedAt: time.Now()})
+	store.CreateRoom(context.Background(), models.Room{ID: "room-2", Name: "random", CreatedAt: time.Now().Add(time.Second)})
+	handler := NewRoomHandler(store, service.NewMessageService(store, nil))
+
+	req := httptest.NewRequest(http.MethodGet, "/rooms", nil)
+	rec := httptest.NewRecorder()
+
+	handler.HandleRooms(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+
+	var rooms []models.Room
+	if err := json.NewDecoder(rec.Body).Decode(&rooms); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(rooms) != 2 || rooms[0].ID != "room-1" {
+		t.Errorf("unexpected rooms: %+v", rooms)
+	}
+}
+
+func TestHandleRoomByID_GET_NotFound(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	handler := NewRoomHandler(store, service.NewMessageService(store, nil))
+
+	req := httptest.NewRequest(http.MethodGet, "/rooms/non-existent", nil)
+	rec := httptest.NewRecorder()
+
+	handler.HandleRoomByID(rec, req)
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestHandleRoomByID_Messages(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	store.CreateRoom(context.Background(), models.Room{ID: "room-1", Name: "general", CreatedAt: time.Now()})
+	store.Save(context.Background(), models.Message{ID: "global", Sender: "bob", Content: "Outside", CreatedAt: time.Now()})
+	handler := NewRoomHandler(store, service.NewMessageService(store, nil))
+
+	body := `{"content":"Hello room"}`
+	req := asUser(httptest.NewRequest(http.MethodPost, "/rooms/room-1/messages", bytes.NewBufferString(body)), "alice")
+	rec := httptest.NewRecorder()
+
+	handler.HandleRoomByID(rec, req)
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, rec.Code)
+	}
+
+	var created models.Message
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if created.RoomID != "room-1" || created.Sender != "alice" {
+		t.Errorf("unexpected created message: %+v", created)
+	}
+
+	// ルームのメッセージのみ取得される
+	req = httptest.NewRequest(http.MethodGet, "/rooms/room-1/messages", nil)
+	rec = httptest.NewRecorder()
+
+	handler.HandleRoomByID(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+
+	var resp MessageListResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(resp.Messages) != 1 || resp.Messages[0].ID != created.ID {
+		t.Errorf("unexpected messages: %+v", resp.Messages)
+	}
+
+	// 返信先は同じルームのメッセージでなければならない
+	for _, tt := range []struct {
+		parentID string
+		status   int
+	}{
+		{created.ID, http.StatusCreated},
+		{"global", http.StatusNotFound},
+	} {
+		body := fmt.Sprintf(`{"content":"Reply","parent_id":%q}`, tt.parentID)
+		req := asUser(httptest.NewRequest(http.MethodPost, "/rooms/room-1/messages", bytes.NewBufferString(body)), "alice")
+		rec := httptest.NewRecorder()
+
+		handler.HandleRoomByID(rec, req)
+
+		if rec.Code != tt.status {
+			t.Errorf("parent %s: expected status %d, got %d", tt.parentID, tt.status, rec.Code)
+		}
+	}
+}
+
+func TestHandleRoomByID_Messages_RoomNotFound(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	handler := NewRoomHandler(store, service.NewMessageService(store, nil))
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+	}{
+		{"GET", http.MethodGet, ""},
+		{"POST", http.MethodPost, `{"content":"Hello"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := asUser(httptest.NewRequest(tt.method, "/rooms/non-existent/messages", bytes.NewBufferString(tt.body)), "alice")
+			rec := httptest.NewRecorder()
+
+			handler.HandleRoomByID(rec, req)
+
+			if rec.Code != http.StatusNotFound {
+				t.Errorf("expected status %d, got %d", http.StatusNotFound, rec.Code)
+			}
+		})
+	}
+}
+
+func TestHandleRoomByID_Messages_InvalidContent(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	store.CreateRoom(context.Background(), models.Room{ID: "room-1", Name: "general", CreatedAt: time.Now()})
+	handler := NewRoomHandler(store, service.NewMessageService(store, nil))
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"missing content", `{}`},
+		{"empty content", `{"content":""}`},
+		{"too long content", `{"content":"` + strings.Repeat("x", service.MaxContentSize+1) + `"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := asUser(httptest.NewRequest(http.MethodPost, "/rooms/room-1/messages", bytes.NewBufferString(tt.body)), "alice")
+			rec := httptest.NewRecorder()
+
+			handler.HandleRoomByID(rec, req)
+
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("expected status %d, got %d", http.StatusBadRequest, rec.Code)
+			}
+		})
+	}
+}
+
+func TestHandleRoomByID_Messages_RateLimited(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	store.CreateRoom(context.Background(), models.Room{ID: "room-1", Name: "general", CreatedAt: time.Now()})
+	limiter := ratelimit.NewLimiter(ratelimit.Every(1, time.Minute, 1))
+	handler := NewRoomHandler(store, service.NewMessageService(store, nil), WithRoomMessageRateLimit(limiter))
+
+	for i, want := range []int{http.StatusCreated, http.StatusTooManyRequests} {
+		req := asUser(httptest.NewRequest(http.MethodPost, "/rooms/room-1/messages", bytes.NewBufferString(`{"content":"Hello"}`)), "alice")
+		rec := httptest.NewRecorder()
+
+		handler.HandleRoomByID(rec, req)
+
+		if rec.Code != want {
+			t.Errorf("request %d: expected status %d, got %d", i+1, want, rec.Code)
+		}
+	}
+}
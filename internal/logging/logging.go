@@ -0,0 +1,55 @@
+// Package logging は log/slog によるJSON形式の構造化ログとリクエストIDを扱う
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// New はJSON形式でログを書き出すロガーを作成する
+//
+// ログを書き出す際に渡されたコンテキストにリクエストIDがあれば request_id として付け加える。
+// （slog.InfoContext などコンテキストを受け取る関数で書き出した場合のみ）
+func New(w io.Writer, level slog.Leveler) *slog.Logger {
+	return slog.New(contextHandler{
+		Handler: slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level}),
+	})
+}
+
+// ParseLevel はログレベルの文字列（debug, info, warn, error）を解釈する
+// 空の場合は info とする
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if s == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(s))); err != nil {
+		return 0, err
+	}
+	return level, nil
+}
+
+// contextHandler はコンテキストのリクエストIDをログに付け加える
+type contextHandler struct {
+	slog.Handler
+}
+
+// Handle はリクエストIDを付け加えてから下位のハンドラーに渡す
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestIDFromContext(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+// WithAttrs は属性を追加したハンドラーを返す
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+// WithGroup はグループを追加したハンドラーを返す
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{Handler: h.Handler.WithGroup(name)}
+}
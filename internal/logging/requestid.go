@@ -0,0 +1,58 @@
+package logging
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// RequestIDHeader はリクエストIDをやり取りするヘッダー
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength はクライアントから受け付けるリクエストIDの最大長
+const maxRequestIDLength = 128
+
+// requestIDKey はコンテキストにリクエストIDを格納するキー
+type requestIDKey struct{}
+
+// WithRequestID はリクエストIDを格納したコンテキストを返す
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext はコンテキストに格納されたリクエストIDを返す
+// 格納されていない場合は空文字列を返す
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// RequestID はリクエストごとにIDを割り当てるミドルウェア
+//
+// ロードバランサーなどが X-Request-ID を付けていればそれを引き継ぎ、なければ生成する。
+// IDはレスポンスの X-Request-ID ヘッダーで返し、コンテキスト経由でログに付け加える。
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(WithRequestID(r.Context(), id)))
+	})
+}
+
+// validRequestID はクライアントから受け取ったリクエストIDをそのままログに書けるか確認する
+// （空白や制御文字を含むものや、長すぎるものは受け付けない）
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
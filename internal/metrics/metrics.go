@@ -0,0 +1,117 @@
+// Package metrics はPrometheus形式のメトリクスを収集して /metrics で公開する
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// namespace は全てのメトリクス名の接頭辞
+const namespace = "chat"
+
+// Metrics はアプリケーションのメトリクスをまとめて保持する
+//
+// プロセス全体のデフォルトレジストリではなく専用のレジストリに登録するので、
+// テストなどで複数作成しても衝突しない。
+type Metrics struct {
+	registry *prometheus.Registry
+
+	httpRequests *prometheus.CounterVec
+	httpDuration *prometheus.HistogramVec
+
+	fanOutLatency  prometheus.Histogram
+	droppedClients prometheus.Counter
+
+	storageDuration *prometheus.HistogramVec
+	storageErrors   *prometheus.CounterVec
+}
+
+// New は新しいMetricsを作成する
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "Number of HTTP requests by route, method and status code.",
+		}, []string{"route", "method", "status"}),
+
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP request latency by route and method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+
+		fanOutLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "broadcast_fanout_duration_seconds",
+			Help:      "Time from publishing a broadcast to queueing it for every local WebSocket client.",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}),
+
+		droppedClients: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "websocket_dropped_clients_total",
+			Help:      "WebSocket clients disconnected because their send buffer was full.",
+		}),
+
+		storageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "storage_operation_duration_seconds",
+			Help:      "Storage operation latency by operation.",
+			Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		}, []string{"operation"}),
+
+		storageErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "storage_errors_total",
+			Help:      "Unexpected storage errors by operation (not found and conflicts are not counted).",
+		}, []string{"operation"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.httpRequests,
+		m.httpDuration,
+		m.fanOutLatency,
+		m.droppedClients,
+		m.storageDuration,
+		m.storageErrors,
+	)
+	return m
+}
+
+// Handler は /metrics エンドポイントのハンドラーを返す
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// WatchConnections は接続中のWebSocketクライアント数を収集時に count から取得する
+func (m *Metrics) WatchConnections(count func() int) {
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "websocket_connections",
+		Help:      "WebSocket clients currently connected to this instance.",
+	}, func() float64 {
+		return float64(count())
+	}))
+}
+
+// ObserveFanOut はブロードキャストの配信にかかった時間を記録する
+// websocket.HubMetrics を実装する
+func (m *Metrics) ObserveFanOut(d time.Duration) {
+	m.fanOutLatency.Observe(d.Seconds())
+}
+
+// ClientDropped は送信バッファが溢れて切断したクライアントを数える
+// websocket.HubMetrics を実装する
+func (m *Metrics) ClientDropped() {
+	m.droppedClients.Inc()
+}
@@ -0,0 +1,131 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tasukuchiba/text_messaging_app/internal/models"
+	"github.com/tasukuchiba/text_messaging_app/internal/storage"
+)
+
+// scrape は /metrics の出力を取得する
+func scrape(t *testing.T, m *Metrics) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	body, _ := io.ReadAll(rec.Body)
+	return string(body)
+}
+
+func TestMiddleware_RecordsRouteAndStatus(t *testing.T) {
+	m := New()
+	handler := m.Middleware("/messages/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "missing") {
+			http.Error(w, "Message not found", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+
+	for _, path := range []string{"/messages/1", "/messages/2", "/messages/missing"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	// パスではなく登録したパターンでまとめて数える
+	if got := testutil.ToFloat64(m.httpRequests.WithLabelValues("/messages/", "GET", "200")); got != 2 {
+		t.Errorf("Expected 2 successful requests, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.httpRequests.WithLabelValues("/messages/", "GET", "404")); got != 1 {
+		t.Errorf("Expected 1 not found request, got %v", got)
+	}
+	if got := testutil.CollectAndCount(m.httpDuration); got != 1 {
+		t.Errorf("Expected 1 latency series, got %d", got)
+	}
+}
+
+func TestMiddleware_RecordsUpgrade(t *testing.T) {
+	m := New()
+	server := httptest.NewServer(m.Middleware("/ws", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("Hijack failed: %v", err)
+			return
+		}
+		conn.Close()
+	})))
+	defer server.Close()
+
+	if resp, err := http.Get(server.URL); err == nil {
+		resp.Body.Close()
+	}
+	server.Close()
+
+	if got := testutil.ToFloat64(m.httpRequests.WithLabelValues("/ws", "GET", "101")); got != 1 {
+		t.Errorf("Expected hijacked request recorded as 101, got %v", got)
+	}
+}
+
+// failingStorage は保存に失敗するテスト用のストレージ
+type failingStorage struct {
+	*storage.MemoryStorage
+}
+
+func (s *failingStorage) Save(ctx context.Context, msg models.Message) error {
+	return errors.New("connection refused")
+}
+
+func TestInstrumentedStorage(t *testing.T) {
+	m := New()
+	store := m.InstrumentStorage(&failingStorage{MemoryStorage: storage.NewMemoryStorage()})
+
+	if err := store.Save(context.Background(), models.Message{ID: "1"}); err == nil {
+		t.Fatal("Expected error from Save")
+	}
+	// 見つからないのは想定内なのでエラーに数えない
+	if _, err := store.GetByID(context.Background(), "missing"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+
+	if got := testutil.ToFloat64(m.storageErrors.WithLabelValues("save")); got != 1 {
+		t.Errorf("Expected 1 save error, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.storageErrors.WithLabelValues("get_by_id")); got != 0 {
+		t.Errorf("Expected no get_by_id errors, got %v", got)
+	}
+	if got := testutil.CollectAndCount(m.storageDuration); got != 2 {
+		t.Errorf("Expected latency for 2 operations, got %d", got)
+	}
+}
+
+func TestInstrumentedStorage_ImplementsStorage(t *testing.T) {
+	var _ storage.Storage = (*InstrumentedStorage)(nil)
+}
+
+func TestHandler_ExposesMetrics(t *testing.T) {
+	m := New()
+	connections := 3
+	m.WatchConnections(func() int { return connections })
+	m.ClientDropped()
+	m.ObserveFanOut(0)
+
+	body := scrape(t, m)
+	for _, want := range []string{
+		"chat_websocket_connections 3",
+		"chat_websocket_dropped_clients_total 1",
+		"chat_broadcast_fanout_duration_seconds_count 1",
+		"go_goroutines",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %q in /metrics output", want)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/tasukuchiba/text_messaging_app/internal/models"
+	"github.com/tasukuchiba/text_messaging_app/internal/storage"
+)
+
+// expectedErrors は正常な応答として扱い、エラー数に含めないストレージのエラー
+var expectedErrors = []error{
+	storage.ErrNotFound,
+	storage.ErrRoomNotFound,
+	storage.ErrUserNotFound,
+	storage.ErrUserExists,
+	storage.ErrDuplicateMessage,
+	storage.ErrParentNotFound,
+	storage.ErrReactionExists,
+	storage.ErrReactionNotFound,
+	storage.ErrInvalidCursor,
+}
+
+// InstrumentedStorage は操作ごとのレイテンシとエラー数を記録して下位のストレージを呼び出す
+type InstrumentedStorage struct {
+	next    storage.Storage
+	metrics *Metrics
+}
+
+// InstrumentStorage は next をメトリクス付きで包んだストレージを作成する
+func (m *Metrics) InstrumentStorage(next storage.Storage) *InstrumentedStorage {
+	return &InstrumentedStorage{next: next, metrics: m}
+}
+
+// observe は操作のレイテンシと、想定外のエラーであればエラー数を記録する
+func (s *InstrumentedStorage) observe(operation string, start time.Time, err error) {
+	s.metrics.storageDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err == nil {
+		return
+	}
+	for _, expected := range expectedErrors {
+		if errors.Is(err, expected) {
+			return
+		}
+	}
+	s.metrics.storageErrors.WithLabelValues(operation).Inc()
+}
+
+// Save はメッセージを保存する
+func (s *InstrumentedStorage) Save(ctx context.Context, msg models.Message) (err error) {
+	defer func(start time.Time) { s.observe("save", start, err) }(time.Now())
+	return s.next.Save(ctx, msg)
+}
+
+// GetAll は全てのメッセージを取得する
+func (s *InstrumentedStorage) GetAll(ctx context.Context) (_ []models.Message, err error) {
+	defer func(start time.Time) { s.observe("get_all", start, err) }(time.Now())
+	return s.next.GetAll(ctx)
+}
+
+// List はカーソルを使ってメッセージをページ単位で取得する
+func (s *InstrumentedStorage) List(ctx context.Context, opts storage.ListOptions) (_ storage.MessagePage, err error) {
+	defer func(start time.Time) { s.observe("list", start, err) }(time.Now())
+	return s.next.List(ctx, opts)
+}
+
+// ListThread はスレッドへの返信をカーソルを使ってページ単位で取得する
+func (s *InstrumentedStorage) ListThread(ctx context.Context, rootID string, opts storage.ListOptions) (_ storage.MessagePage, err error) {
+	defer func(start time.Time) { s.observe("list_thread", start, err) }(time.Now())
+	return s.next.ListThread(ctx, rootID, opts)
+}
+
+// ListReplies はチャンネルの全てのスレッドへの返信をカーソルを使ってページ単位で取得する
+func (s *InstrumentedStorage) ListReplies(ctx context.Context, opts storage.ListOptions) (_ storage.MessagePage, err error) {
+	defer func(start time.Time) { s.observe("list_replies", start, err) }(time.Now())
+	return s.next.ListReplies(ctx, opts)
+}
+
+// GetByID は指定されたIDのメッセージを取得する
+func (s *InstrumentedStorage) GetByID(ctx context.Context, id string) (_ models.Message, err error) {
+	defer func(start time.Time) { s.observe("get_by_id", start, err) }(time.Now())
+	return s.next.GetByID(ctx, id)
+}
+
+// GetByClientMsgID は送信者とクライアントが付けたIDでメッセージを取得する
+func (s *InstrumentedStorage) GetByClientMsgID(ctx context.Context, sender, clientMsgID string) (_ models.Message, err error) {
+	defer func(start time.Time) { s.observe("get_by_client_msg_id", start, err) }(time.Now())
+	return s.next.GetByClientMsgID(ctx, sender, clientMsgID)
+}
+
+// Delete は指定されたIDのメッセージを削除する
+func (s *InstrumentedStorage) Delete(ctx context.Context, id string) (err error) {
+	defer func(start time.Time) { s.observe("delete", start, err) }(time.Now())
+	return s.next.Delete(ctx, id)
+}
+
+// UpdateContent はメッセージの本文を更新し、更新前の本文を編集履歴に残す
+func (s *InstrumentedStorage) UpdateContent(ctx context.Context, id, content string, editedAt time.Time) (_ models.Message, err error) {
+	defer func(start time.Time) { s.observe("update_content", start, err) }(time.Now())
+	return s.next.UpdateContent(ctx, id, content, editedAt)
+}
+
+// GetRevisions はメッセージの編集履歴を古い順に取得する
+func (s *InstrumentedStorage) GetRevisions(ctx context.Context, id string) (_ []models.MessageRevision, err error) {
+	defer func(start time.Time) { s.observe("get_revisions", start, err) }(time.Now())
+	return s.next.GetRevisions(ctx, id)
+}
+
+// CreateRoom はルームを作成する
+func (s *InstrumentedStorage) CreateRoom(ctx context.Context, room models.Room) (err error) {
+	defer func(start time.Time) { s.observe("create_room", start, err) }(time.Now())
+	return s.next.CreateRoom(ctx, room)
+}
+
+// GetRoom は指定されたIDのルームを取得する
+func (s *InstrumentedStorage) GetRoom(ctx context.Context, id string) (_ models.Room, err error) {
+	defer func(start time.Time) { s.observe("get_room", start, err) }(time.Now())
+	return s.next.GetRoom(ctx, id)
+}
+
+// ListRooms は全てのルームを作成日時順に取得する
+func (s *InstrumentedStorage) ListRooms(ctx context.Context) (_ []models.Room, err error) {
+	defer func(start time.Time) { s.observe("list_rooms", start, err) }(time.Now())
+	return s.next.ListRooms(ctx)
+}
+
+// CreateUser はユーザーを作成する
+func (s *InstrumentedStorage) CreateUser(ctx context.Context, user models.User) (err error) {
+	defer func(start time.Time) { s.observe("create_user", start, err) }(time.Now())
+	return s.next.CreateUser(ctx, user)
+}
+
+// GetUserByUsername はユーザー名でユーザーを取得する
+func (s *InstrumentedStorage) GetUserByUsername(ctx context.Context, username string) (_ models.User, err error) {
+	defer func(start time.Time) { s.observe("get_user_by_username", start, err) }(time.Now())
+	return s.next.GetUserByUsername(ctx, username)
+}
+
+// Search は本文の全文検索でメッセージを新しい順に取得する
+func (s *InstrumentedStorage) Search(ctx context.Context, opts storage.SearchOptions) (_ []storage.SearchResult, err error) {
+	defer func(start time.Time) { s.observe("search", start, err) }(time.Now())
+	return s.next.Search(ctx, opts)
+}
+
+// AddReaction はメッセージに username の絵文字リアクションを追加する
+func (s *InstrumentedStorage) AddReaction(ctx context.Context, messageID, emoji, username string, createdAt time.Time) (err error) {
+	defer func(start time.Time) { s.observe("add_reaction", start, err) }(time.Now())
+	return s.next.AddReaction(ctx, messageID, emoji, username, createdAt)
+}
+
+// RemoveReaction はメッセージから username の絵文字リアクションを削除する
+func (s *InstrumentedStorage) RemoveReaction(ctx context.Context, messageID, emoji, username string) (err error) {
+	defer func(start time.Time) { s.observe("remove_reaction", start, err) }(time.Now())
+	return s.next.RemoveReaction(ctx, messageID, emoji, username)
+}
+
+// ListReactions はメッセージごとのリアクションを絵文字ごとに集計して取得する
+func (s *InstrumentedStorage) ListReactions(ctx context.Context, messageIDs []string, viewer string) (_ map[string][]models.Reaction, err error) {
+	defer func(start time.Time) { s.observe("list_reactions", start, err) }(time.Now())
+	return s.next.ListReactions(ctx, messageIDs, viewer)
+}
+
+// Ping は下位のストレージが利用できるか確認する
+func (s *InstrumentedStorage) Ping(ctx context.Context) (err error) {
+	defer func(start time.Time) { s.observe("ping", start, err) }(time.Now())
+	return storage.Ping(ctx, s.next)
+}
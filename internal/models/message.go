@@ -4,8 +4,55 @@ import "time"
 
 // Message はチャットメッセージを表す構造体
 type Message struct {
-	ID        string    `json:"id"`
+	ID string `json:"id"`
+
+	// 所属するルームのID（空の場合は全体チャンネル）
+	RoomID string `json:"room_id,omitempty"`
+
 	Sender    string    `json:"sender"`
 	Content   string    `json:"content"`
 	CreatedAt time.Time `json:"created_at"`
+
+	// 送信したクライアントが付けたID（再送されたメッセージの重複排除に使う）
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+
+	// 編集済みかどうかと最終編集日時
+	Edited    bool       `json:"edited"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+
+	// 返信先のメッセージIDと、返信が属するスレッドの起点のメッセージID
+	// 返信への返信も起点のスレッドに入る（スレッドは入れ子にしない）
+	ParentID     string `json:"parent_id,omitempty"`
+	ThreadRootID string `json:"thread_root_id,omitempty"`
+
+	// スレッドの起点のメッセージの場合の返信数と最後の返信日時
+	ReplyCount  int        `json:"reply_count,omitempty"`
+	LastReplyAt *time.Time `json:"last_reply_at,omitempty"`
+
+	// 絵文字ごとのリアクションの集計（最初にリアクションされた順）
+	// 閲覧するユーザーによって ReactedByMe が変わるので、ストレージには保存しない
+	Reactions []Reaction `json:"reactions,omitempty"`
+}
+
+// Reaction はメッセージへの1つの絵文字のリアクションの集計
+type Reaction struct {
+	Emoji string `json:"emoji"`
+	Count int    `json:"count"`
+
+	// 閲覧しているユーザーがこの絵文字でリアクションしているかどうか
+	ReactedByMe bool `json:"reacted_by_me"`
+}
+
+// IsReply はスレッドへの返信かどうかを返す
+func (m Message) IsReply() bool {
+	return m.ThreadRootID != ""
+}
+
+// MessageRevision はメッセージの編集前の本文を表す構造体
+type MessageRevision struct {
+	MessageID string `json:"message_id"`
+	Content   string `json:"content"`
+
+	// この本文が編集によって置き換えられた日時
+	EditedAt time.Time `json:"edited_at"`
 }
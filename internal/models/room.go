@@ -0,0 +1,10 @@
+package models
+
+import "time"
+
+// Room はチャットルームを表す構造体
+type Room struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
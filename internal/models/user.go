@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// User はチャットのユーザーアカウントを表す構造体
+type User struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+
+	// パスワードのハッシュ（レスポンスには含めない）
+	PasswordHash string `json:"-"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,217 @@
+// Package ratelimit はキー（ユーザーやIPアドレス）ごとのトークンバケットによる流量制限を提供する
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tasukuchiba/text_messaging_app/internal/auth"
+)
+
+// ErrInvalidLimit は制限の指定が不正な場合のエラー
+var ErrInvalidLimit = errors.New("invalid rate limit")
+
+// sweepInterval は使われなくなったバケットを削除する間隔
+const sweepInterval = time.Minute
+
+// Limit はトークンバケットの設定
+type Limit struct {
+	// 1秒あたりに補充するトークン数（0以下なら制限しない）
+	Rate float64
+
+	// バケットの容量（連続して許可する最大回数）
+	Burst int
+}
+
+// Every は interval ごとに count 回を許可する Limit を返す
+func Every(count int, interval time.Duration, burst int) Limit {
+	return Limit{Rate: float64(count) / interval.Seconds(), Burst: burst}
+}
+
+// Disabled は制限しない設定かどうかを返す
+func (l Limit) Disabled() bool {
+	return l.Rate <= 0
+}
+
+// String は ParseLimit で読み込める形式で返す
+func (l Limit) String() string {
+	if l.Disabled() {
+		return "off"
+	}
+	return fmt.Sprintf("%s/1s,%d", strconv.FormatFloat(l.Rate, 'f', -1, 64), l.Burst)
+}
+
+// MarshalText は String と同じ形式で返す（設定ファイルへの書き出し用）
+func (l Limit) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// UnmarshalText は ParseLimit と同じ形式を読み込む（設定ファイルからの読み込み用）
+func (l *Limit) UnmarshalText(text []byte) error {
+	limit, err := ParseLimit(string(text))
+	if err != nil {
+		return err
+	}
+	*l = limit
+	return nil
+}
+
+// ParseLimit は "<回数>/<期間>[,<バースト>]" 形式の文字列から Limit を作成する
+//
+// 例: "5/1s,10"（1秒に5回、連続10回まで）、"60/m"（1分に60回、バーストは回数と同じ）、"off"（制限しない）
+func ParseLimit(s string) (Limit, error) {
+	s = strings.TrimSpace(s)
+	if s == "off" || s == "0" {
+		return Limit{}, nil
+	}
+
+	spec, burstStr, hasBurst := strings.Cut(s, ",")
+	countStr, intervalStr, ok := strings.Cut(spec, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("%w: %q", ErrInvalidLimit, s)
+	}
+
+	count, err := strconv.Atoi(countStr)
+	if err != nil || count <= 0 {
+		return Limit{}, fmt.Errorf("%w: %q", ErrInvalidLimit, s)
+	}
+
+	// "s" や "m" のように数値を省略した期間は1単位として扱う
+	if intervalStr != "" && (intervalStr[0] < '0' || intervalStr[0] > '9') {
+		intervalStr = "1" + intervalStr
+	}
+	interval, err := time.ParseDuration(intervalStr)
+	if err != nil || interval <= 0 {
+		return Limit{}, fmt.Errorf("%w: %q", ErrInvalidLimit, s)
+	}
+
+	burst := count
+	if hasBurst {
+		burst, err = strconv.Atoi(burstStr)
+		if err != nil || burst <= 0 {
+			return Limit{}, fmt.Errorf("%w: %q", ErrInvalidLimit, s)
+		}
+	}
+
+	return Every(count, interval, burst), nil
+}
+
+// bucket はキー1つ分のトークンバケット
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter はキーごとのトークンバケットで流量を制限する
+//
+// nil の Limiter は全て許可する。
+type Limiter struct {
+	mu        sync.Mutex
+	limit     Limit
+	buckets   map[string]*bucket
+	lastSweep time.Time
+
+	// 現在時刻（テストで差し替える）
+	now func() time.Time
+}
+
+// NewLimiter は新しいLimiterを作成する
+// limit が制限しない設定の場合は nil を返す
+func NewLimiter(limit Limit) *Limiter {
+	if limit.Disabled() {
+		return nil
+	}
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &Limiter{
+		limit:   limit,
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Allow はキーのトークンを1つ消費する
+// トークンが足りない場合は false と、次に許可されるまでの時間を返す
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.limit.Rate * float64(time.Second))
+	return false, wait
+}
+
+// refill は最後に使われてからの経過時間分を補充したトークン数を返す
+func (l *Limiter) refill(b *bucket, now time.Time) float64 {
+	elapsed := now.Sub(b.last).Seconds()
+	return math.Min(float64(l.limit.Burst), b.tokens+elapsed*l.limit.Rate)
+}
+
+// sweep は満タンまで補充されたバケットを削除する（ロックを取得済みで呼び出す）
+// 満タンのバケットは新しく作った場合と同じなので、削除しても結果は変わらない
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if l.refill(b, now) >= float64(l.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// UserKey は認証済みユーザーのキーを返す
+func UserKey(username string) string {
+	return "user:" + username
+}
+
+// KeyForRequest はリクエストのキーを返す
+// 認証済みの場合はユーザー、そうでなければ接続元のIPアドレスをキーにする
+func KeyForRequest(r *http.Request) string {
+	if id, ok := auth.IdentityFromContext(r.Context()); ok {
+		return UserKey(id.Username)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// RetryAfterSeconds は Retry-After ヘッダーに設定する秒数（切り上げ、最低1秒）を返す
+func RetryAfterSeconds(wait time.Duration) int {
+	return max(1, int(math.Ceil(wait.Seconds())))
+}
+
+// Reject は 429 Too Many Requests を Retry-After ヘッダー付きで返す
+func Reject(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(RetryAfterSeconds(wait)))
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+}
@@ -0,0 +1,155 @@
+package ratelimit
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tasukuchiba/text_messaging_app/internal/auth"
+)
+
+// fakeClock はテスト用に手動で進める時計
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// newTestLimiter は fakeClock を使う Limiter を作成する
+func newTestLimiter(limit Limit) (*Limiter, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l := NewLimiter(limit)
+	l.now = clock.Now
+	return l, clock
+}
+
+func TestLimiter_Allow(t *testing.T) {
+	l, clock := newTestLimiter(Every(2, time.Second, 3))
+
+	// バーストの回数までは続けて許可される
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("alice"); !ok {
+			t.Fatalf("request %d should be allowed", i+1)
+		}
+	}
+
+	ok, wait := l.Allow("alice")
+	if ok {
+		t.Fatal("request beyond burst should be rejected")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("expected wait 500ms, got %v", wait)
+	}
+
+	// 他のキーには影響しない
+	if ok, _ := l.Allow("bob"); !ok {
+		t.Error("another key should be allowed")
+	}
+
+	// 時間が経つと補充される
+	clock.Advance(500 * time.Millisecond)
+	if ok, _ := l.Allow("alice"); !ok {
+		t.Error("request after refill should be allowed")
+	}
+	if ok, _ := l.Allow("alice"); ok {
+		t.Error("only one token should have been refilled")
+	}
+}
+
+func TestLimiter_Sweep(t *testing.T) {
+	l, clock := newTestLimiter(Every(1, time.Second, 1))
+
+	l.Allow("alice")
+	l.Allow("bob")
+	if len(l.buckets) != 2 {
+		t.Fatalf("expected 2 buckets, got %d", len(l.buckets))
+	}
+
+	// 満タンまで補充されたバケットは削除される
+	clock.Advance(sweepInterval)
+	l.Allow("carol")
+	if len(l.buckets) != 1 {
+		t.Errorf("expected only the new bucket to remain, got %d", len(l.buckets))
+	}
+}
+
+func TestLimiter_Disabled(t *testing.T) {
+	l := NewLimiter(Limit{})
+	if l != nil {
+		t.Fatal("expected nil limiter for a disabled limit")
+	}
+	for i := 0; i < 100; i++ {
+		if ok, _ := l.Allow("alice"); !ok {
+			t.Fatal("nil limiter should allow everything")
+		}
+	}
+}
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Limit
+	}{
+		{"5/1s,10", Limit{Rate: 5, Burst: 10}},
+		{"60/m", Limit{Rate: 1, Burst: 60}},
+		{"1/500ms", Limit{Rate: 2, Burst: 1}},
+		{"off", Limit{}},
+		{"0", Limit{}},
+	}
+	for _, tt := range tests {
+		got, err := ParseLimit(tt.in)
+		if err != nil {
+			t.Errorf("ParseLimit(%q) returned error: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseLimit(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "5", "x/1s", "5/x", "0/1s", "5/1s,0", "5/-1s", "5/1s,x"} {
+		if _, err := ParseLimit(in); !errors.Is(err, ErrInvalidLimit) {
+			t.Errorf("ParseLimit(%q) should return ErrInvalidLimit, got %v", in, err)
+		}
+	}
+
+	// String の結果は読み込み直せる
+	limit := Every(5, time.Second, 10)
+	if got, err := ParseLimit(limit.String()); err != nil || got != limit {
+		t.Errorf("ParseLimit(%q) = %+v, %v", limit.String(), got, err)
+	}
+}
+
+func TestKeyForRequest(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/messages", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	if got := KeyForRequest(req); got != "ip:192.0.2.1" {
+		t.Errorf("expected ip key, got %q", got)
+	}
+
+	// 認証済みならユーザーをキーにする
+	req = req.WithContext(auth.WithIdentity(req.Context(), auth.Identity{UserID: "1", Username: "alice"}))
+	if got := KeyForRequest(req); got != "user:alice" {
+		t.Errorf("expected user key, got %q", got)
+	}
+}
+
+func TestReject(t *testing.T) {
+	rec := httptest.NewRecorder()
+	Reject(rec, 1200*time.Millisecond)
+
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d, got %d", http.StatusTooManyRequests, rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("expected Retry-After 2, got %q", got)
+	}
+}
@@ -0,0 +1,444 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/tasukuchiba/text_messaging_app/internal/models"
+	"github.com/tasukuchiba/text_messaging_app/internal/storage"
+)
+
+// イベントの種類（WebSocketで送るフレームの type と同じ値）
+const (
+	EventMessage         = "message"
+	EventMessageEdited   = "message_edited"
+	EventMessageDeleted  = "message_deleted"
+	EventThreadReply     = "thread_reply"
+	EventReactionAdded   = "reaction_added"
+	EventReactionRemoved = "reaction_removed"
+)
+
+// ErrNotMessageOwner はメッセージの送信者以外が変更しようとした場合のエラー
+var ErrNotMessageOwner = errors.New("only the sender can modify this message")
+
+// ErrEmptyContent は本文が空のメッセージを送信・編集しようとした場合のエラー
+var ErrEmptyContent = errors.New("content is required")
+
+// MaxContentSize はメッセージの本文の最大バイト数（JSONの文字列にエスケープした後の大きさで数える）
+// 配信するフレームが他の項目と合わせてバックプレーンのペイロードの上限（NOTIFYの 8000 バイト未満）に収まるようにしておく
+const MaxContentSize = 6000
+
+// ErrContentTooLong は本文が MaxContentSize を超える場合のエラー
+var ErrContentTooLong = fmt.Errorf("content must be at most %d bytes", MaxContentSize)
+
+// ErrInvalidEmoji はリアクションの絵文字として使えない文字列の場合のエラー
+var ErrInvalidEmoji = errors.New("invalid emoji")
+
+// maxEmojiLength はリアクションの絵文字の最大文字数
+// 肌の色や結合文字を含む絵文字と、:thumbsup: のような短縮名が入る長さにしておく
+const maxEmojiLength = 32
+
+// Event はメッセージの変更を通知するイベント
+type Event struct {
+	Type    string
+	Message models.Message
+
+	// thread_reply イベントの場合のスレッドの起点（返信数と最後の返信日時は返信を保存した後の値）
+	Thread *models.Message
+
+	// reaction_added, reaction_removed イベントの場合の変更内容
+	Reaction *ReactionChange
+}
+
+// ReactionChange はリアクションの追加・削除の内容
+type ReactionChange struct {
+	Emoji string
+	User  string
+
+	// 変更後のこの絵文字のリアクション数
+	Count int
+}
+
+// EventPublisher はイベントを接続中のクライアントに配信するインターフェース
+type EventPublisher interface {
+	PublishEvent(event Event) error
+}
+
+// MessageService はメッセージの作成・削除と、それに伴うイベント配信をまとめて扱う
+//
+// REST API と WebSocket のどちらから操作しても同じイベントが配信されるように、
+// メッセージの書き込みは必ずこのサービスを経由する。
+type MessageService struct {
+	storage   storage.Storage
+	publisher EventPublisher
+}
+
+// NewMessageService は新しいMessageServiceを作成する
+// publisher が nil の場合はイベントを配信しない
+func NewMessageService(store storage.Storage, publisher EventPublisher) *MessageService {
+	return &MessageService{storage: store, publisher: publisher}
+}
+
+// CreateMessage はメッセージを保存して message イベントを配信する
+// roomID が空の場合は全体チャンネルのメッセージになる
+func (s *MessageService) CreateMessage(ctx context.Context, roomID, sender, content string) (models.Message, error) {
+	msg, _, err := s.SendMessage(ctx, roomID, sender, content, "")
+	return msg, err
+}
+
+// SendMessage はクライアントが付けたIDで再送を重複排除しながらメッセージを保存する
+//
+// 同じ送信者の同じ clientMsgID のメッセージが既にある場合は、保存もイベントの配信もせずに
+// そのメッセージを返し、duplicate を true にする。clientMsgID が空の場合は重複排除しない。
+// 本文が空の場合は ErrEmptyContent、MaxContentSize を超える場合は ErrContentTooLong を返す。
+func (s *MessageService) SendMessage(ctx context.Context, roomID, sender, content, clientMsgID string) (msg models.Message, duplicate bool, err error) {
+	if err := validateContent(content); err != nil {
+		return models.Message{}, false, err
+	}
+
+	msg = models.Message{RoomID: roomID, Sender: sender, Content: content, ClientMsgID: clientMsgID}
+	msg, duplicate, err = s.send(ctx, msg)
+	if err != nil || duplicate {
+		return msg, duplicate, err
+	}
+
+	s.publish(Event{Type: EventMessage, Message: msg})
+	return msg, false, nil
+}
+
+// CreateReply は返信を保存して thread_reply イベントを配信する
+func (s *MessageService) CreateReply(ctx context.Context, roomID, parentID, sender, content string) (models.Message, error) {
+	msg, _, err := s.SendReply(ctx, roomID, parentID, sender, content, "")
+	return msg, err
+}
+
+// SendReply は parentID のメッセージへの返信を保存して thread_reply イベントを配信する
+//
+// 返信先は roomID と同じルームのメッセージでなければならず、見つからない場合は storage.ErrParentNotFound を返す。
+// 返信への返信は、返信先が属するスレッドに入る。重複排除と本文の確認は SendMessage と同じ。
+func (s *MessageService) SendReply(ctx context.Context, roomID, parentID, sender, content, clientMsgID string) (msg models.Message, duplicate bool, err error) {
+	if err := validateContent(content); err != nil {
+		return models.Message{}, false, err
+	}
+
+	parent, err := s.storage.GetByID(ctx, parentID)
+	if errors.Is(err, storage.ErrNotFound) || (err == nil && parent.RoomID != roomID) {
+		return models.Message{}, false, storage.ErrParentNotFound
+	}
+	if err != nil {
+		return models.Message{}, false, err
+	}
+
+	rootID := parent.ID
+	if parent.IsReply() {
+		rootID = parent.ThreadRootID
+	}
+
+	msg = models.Message{RoomID: roomID, Sender: sender, Content: content, ClientMsgID: clientMsgID, ParentID: parent.ID, ThreadRootID: rootID}
+	msg, duplicate, err = s.send(ctx, msg)
+	if err != nil || duplicate {
+		return msg, duplicate, err
+	}
+
+	// 返信数と最後の返信日時を更新した後の起点を配信する
+	root, err := s.storage.GetByID(ctx, rootID)
+	if err != nil {
+		slog.Error("Failed to get thread root", "message_id", msg.ID, "thread_root_id", rootID, "error", err)
+		return msg, false, nil
+	}
+	s.publish(Event{Type: EventThreadReply, Message: msg, Thread: &root})
+	return msg, false, nil
+}
+
+// send は msg に ID と作成日時を付けて保存する（イベントは配信しない）
+// 同じ送信者の同じ ClientMsgID のメッセージが既にある場合は、保存せずにそのメッセージを返し、duplicate を true にする
+func (s *MessageService) send(ctx context.Context, msg models.Message) (_ models.Message, duplicate bool, err error) {
+	if msg.ClientMsgID != "" {
+		existing, err := s.storage.GetByClientMsgID(ctx, msg.Sender, msg.ClientMsgID)
+		if err == nil {
+			return existing, true, nil
+		}
+		if !errors.Is(err, storage.ErrNotFound) {
+			return models.Message{}, false, err
+		}
+	}
+
+	msg.ID = uuid.New().String()
+	msg.CreatedAt = time.Now()
+
+	if err := s.storage.Save(ctx, msg); err != nil {
+		// 同時に届いた再送に先を越された場合は、保存済みのメッセージを返す
+		if errors.Is(err, storage.ErrDuplicateMessage) {
+			existing, err := s.storage.GetByClientMsgID(ctx, msg.Sender, msg.ClientMsgID)
+			if err != nil {
+				return models.Message{}, false, err
+			}
+			return existing, true, nil
+		}
+		return models.Message{}, false, err
+	}
+	return msg, false, nil
+}
+
+// validateContent は本文が空の場合に ErrEmptyContent、MaxContentSize を超える場合に ErrContentTooLong を返す
+func validateContent(content string) error {
+	if content == "" {
+		return ErrEmptyContent
+	}
+	if len(content) > MaxContentSize {
+		return ErrContentTooLong
+	}
+	// 記号や制御文字はエスケープで最大6バイトになるため、エスケープした後の大きさでも確かめる
+	encoded, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+	if len(encoded)-2 > MaxContentSize {
+		return ErrContentTooLong
+	}
+	return nil
+}
+
+// EditMessage はメッセージの本文を更新して message_edited イベントを配信する
+// 編集できるのはメッセージの送信者本人のみで、本文を空にする場合は ErrEmptyContent、長すぎる場合は ErrContentTooLong を返す。返すメッセージには editor から見たリアクションを付ける
+func (s *MessageService) EditMessage(ctx context.Context, id, editor, content string) (models.Message, error) {
+	if err := validateContent(content); err != nil {
+		return models.Message{}, err
+	}
+
+	current, err := s.storage.GetByID(ctx, id)
+	if err != nil {
+		return models.Message{}, err
+	}
+	if current.Sender != editor {
+		return models.Message{}, ErrNotMessageOwner
+	}
+
+	msg, err := s.storage.UpdateContent(ctx, id, content, time.Now())
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	s.publish(Event{Type: EventMessageEdited, Message: msg})
+
+	if err := s.attachReactions(ctx, editor, &msg); err != nil {
+		return models.Message{}, err
+	}
+	return msg, nil
+}
+
+// DeleteMessage はメッセージを削除して message_deleted イベントを配信する
+// 削除できるのはメッセージの送信者本人のみ
+func (s *MessageService) DeleteMessage(ctx context.Context, id, actor string) error {
+	// 所有者の確認と配信先のルームを知るために削除前に取得する
+	msg, err := s.storage.GetByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if msg.Sender != actor {
+		return ErrNotMessageOwner
+	}
+
+	if err := s.storage.Delete(ctx, id); err != nil {
+		return err
+	}
+
+	s.publish(Event{Type: EventMessageDeleted, Message: msg})
+	return nil
+}
+
+// AddReaction はメッセージに user の絵文字リアクションを追加して reaction_added イベントを配信する
+//
+// 同じリアクションが既にある場合は、追加もイベントの配信もせずに added を false にする。
+// 返すメッセージには user から見たリアクションを付ける。
+func (s *MessageService) AddReaction(ctx context.Context, id, emoji, user string) (msg models.Message, added bool, err error) {
+	if !validEmoji(emoji) {
+		return models.Message{}, false, ErrInvalidEmoji
+	}
+
+	err = s.storage.AddReaction(ctx, id, emoji, user, time.Now())
+	if err != nil && !errors.Is(err, storage.ErrReactionExists) {
+		return models.Message{}, false, err
+	}
+	added = err == nil
+
+	msg, err = s.GetMessage(ctx, id, user)
+	if err != nil {
+		return models.Message{}, false, err
+	}
+	if added {
+		s.publishReaction(EventReactionAdded, msg, emoji, user)
+	}
+	return msg, added, nil
+}
+
+// RemoveReaction はメッセージから user の絵文字リアクションを削除して reaction_removed イベントを配信する
+// 返すメッセージには user から見たリアクションを付ける
+func (s *MessageService) RemoveReaction(ctx context.Context, id, emoji, user string) (models.Message, error) {
+	if !validEmoji(emoji) {
+		return models.Message{}, ErrInvalidEmoji
+	}
+
+	if err := s.storage.RemoveReaction(ctx, id, emoji, user); err != nil {
+		return models.Message{}, err
+	}
+
+	msg, err := s.GetMessage(ctx, id, user)
+	if err != nil {
+		return models.Message{}, err
+	}
+	s.publishReaction(EventReactionRemoved, msg, emoji, user)
+	return msg, nil
+}
+
+// publishReaction は変更後のリアクション数を付けてリアクションのイベントを配信する
+func (s *MessageService) publishReaction(eventType string, msg models.Message, emoji, user string) {
+	change := &ReactionChange{Emoji: emoji, User: user}
+	for _, r := range msg.Reactions {
+		if r.Emoji == emoji {
+			change.Count = r.Count
+		}
+	}
+
+	// 閲覧者ごとに異なるリアクションの集計は配信しない
+	msg.Reactions = nil
+	s.publish(Event{Type: eventType, Message: msg, Reaction: change})
+}
+
+// validEmoji はリアクションの絵文字として使える文字列かどうかを判定する
+// 絵文字そのものかは判定せず、空白・制御文字・パスの区切りを含まない短い文字列を受け付ける
+func validEmoji(emoji string) bool {
+	if emoji == "" || !utf8.ValidString(emoji) || utf8.RuneCountInString(emoji) > maxEmojiLength {
+		return false
+	}
+	return !strings.ContainsFunc(emoji, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r) || r == '/'
+	})
+}
+
+// GetMessage は指定されたIDのメッセージを viewer から見たリアクションを付けて取得する
+func (s *MessageService) GetMessage(ctx context.Context, id, viewer string) (models.Message, error) {
+	msg, err := s.storage.GetByID(ctx, id)
+	if err != nil {
+		return models.Message{}, err
+	}
+	if err := s.attachReactions(ctx, viewer, &msg); err != nil {
+		return models.Message{}, err
+	}
+	return msg, nil
+}
+
+// GetRevisions はメッセージの編集履歴を古い順に取得する
+func (s *MessageService) GetRevisions(ctx context.Context, id string) ([]models.MessageRevision, error) {
+	return s.storage.GetRevisions(ctx, id)
+}
+
+// ListMessages はカーソルを使ってメッセージを viewer から見たリアクションを付けてページ単位で取得する
+func (s *MessageService) ListMessages(ctx context.Context, opts storage.ListOptions, viewer string) (storage.MessagePage, error) {
+	page, err := s.storage.List(ctx, opts)
+	if err != nil {
+		return storage.MessagePage{}, err
+	}
+	if err := s.attachReactions(ctx, viewer, pointers(page.Messages)...); err != nil {
+		return storage.MessagePage{}, err
+	}
+	return page, nil
+}
+
+// ListReplies はチャンネル（opts.RoomID）の全てのスレッドへの返信を viewer から見たリアクションを付けてページ単位で取得する
+func (s *MessageService) ListReplies(ctx context.Context, opts storage.ListOptions, viewer string) (storage.MessagePage, error) {
+	page, err := s.storage.ListReplies(ctx, opts)
+	if err != nil {
+		return storage.MessagePage{}, err
+	}
+	if err := s.attachReactions(ctx, viewer, pointers(page.Messages)...); err != nil {
+		return storage.MessagePage{}, err
+	}
+	return page, nil
+}
+
+// ListThread は id のメッセージが属するスレッドの起点と、返信をカーソルを使ってページ単位で取得する
+// id が返信の場合は、その返信が属するスレッドを取得する。起点と返信には viewer から見たリアクションを付ける
+func (s *MessageService) ListThread(ctx context.Context, id string, opts storage.ListOptions, viewer string) (models.Message, storage.MessagePage, error) {
+	root, err := s.storage.GetByID(ctx, id)
+	if err != nil {
+		return models.Message{}, storage.MessagePage{}, err
+	}
+	if root.IsReply() {
+		if root, err = s.storage.GetByID(ctx, root.ThreadRootID); err != nil {
+			return models.Message{}, storage.MessagePage{}, err
+		}
+	}
+
+	page, err := s.storage.ListThread(ctx, root.ID, opts)
+	if err != nil {
+		return models.Message{}, storage.MessagePage{}, err
+	}
+	if err := s.attachReactions(ctx, viewer, append(pointers(page.Messages), &root)...); err != nil {
+		return models.Message{}, storage.MessagePage{}, err
+	}
+	return root, page, nil
+}
+
+// SearchMessages は本文の全文検索でメッセージを viewer から見たリアクションを付けて新しい順に取得する
+func (s *MessageService) SearchMessages(ctx context.Context, opts storage.SearchOptions, viewer string) ([]storage.SearchResult, error) {
+	results, err := s.storage.Search(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]*models.Message, len(results))
+	for i := range results {
+		messages[i] = &results[i].Message
+	}
+	if err := s.attachReactions(ctx, viewer, messages...); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// attachReactions は viewer から見たリアクションの集計をまとめて取得してメッセージに付ける
+func (s *MessageService) attachReactions(ctx context.Context, viewer string, messages ...*models.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	ids := make([]string, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+	}
+	reactions, err := s.storage.ListReactions(ctx, ids, viewer)
+	if err != nil {
+		return err
+	}
+	for _, msg := range messages {
+		msg.Reactions = reactions[msg.ID]
+	}
+	return nil
+}
+
+// pointers はスライスの各メッセージへのポインタを返す
+func pointers(messages []models.Message) []*models.Message {
+	ptrs := make([]*models.Message, len(messages))
+	for i := range messages {
+		ptrs[i] = &messages[i]
+	}
+	return ptrs
+}
+
+// publish はイベントを配信する
+// 保存は完了しているため、配信に失敗してもエラーは返さずログに残す
+func (s *MessageService) publish(event Event) {
+	if s.publisher == nil {
+		return
+	}
+	if err := s.publisher.PublishEvent(event); err != nil {
+		slog.Error("Failed to publish message event", "event", event.Type, "message_id", event.Message.ID, "error", err)
+	}
+}
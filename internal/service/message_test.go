@@ -0,0 +1,445 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/tasukuchiba/text_messaging_app/internal/models"
+	"github.com/tasukuchiba/text_messaging_app/internal/storage"
+)
+
+// recordingPublisher は配信されたイベントを記録するテスト用のEventPublisher
+type recordingPublisher struct {
+	events []Event
+	err    error
+}
+
+func (p *recordingPublisher) PublishEvent(event Event) error {
+	p.events = append(p.events, event)
+	return p.err
+}
+
+func TestMessageService_CreateMessage(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	publisher := &recordingPublisher{}
+	svc := NewMessageService(store, publisher)
+
+	msg, err := svc.CreateMessage(context.Background(), "", "alice", "Hello")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if msg.ID == "" || msg.CreatedAt.IsZero() {
+		t.Errorf("expected ID and CreatedAt to be set, got %+v", msg)
+	}
+
+	if _, err := store.GetByID(context.Background(), msg.ID); err != nil {
+		t.Errorf("expected message to be stored, got %v", err)
+	}
+
+	if len(publisher.events) != 1 || publisher.events[0].Type != EventMessage {
+		t.Fatalf("expected 1 message event, got %+v", publisher.events)
+	}
+	if publisher.events[0].Message.ID != msg.ID {
+		t.Errorf("expected event for %s, got %s", msg.ID, publisher.events[0].Message.ID)
+	}
+}
+
+func TestMessageService_SendMessage_Deduplicates(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	publisher := &recordingPublisher{}
+	svc := NewMessageService(store, publisher)
+	ctx := context.Background()
+
+	first, duplicate, err := svc.SendMessage(ctx, "", "alice", "Hello", "c-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if duplicate {
+		t.Error("first send should not be a duplicate")
+	}
+	if first.ClientMsgID != "c-1" {
+		t.Errorf("expected client_msg_id c-1, got %q", first.ClientMsgID)
+	}
+
+	// 同じ client_msg_id での再送は保存済みのメッセージを返し、配信し直さない
+	retry, duplicate, err := svc.SendMessage(ctx, "", "alice", "Hello", "c-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !duplicate {
+		t.Error("retry should be reported as a duplicate")
+	}
+	if retry.ID != first.ID || !retry.CreatedAt.Equal(first.CreatedAt) {
+		t.Errorf("expected retry to return %s, got %+v", first.ID, retry)
+	}
+	if len(publisher.events) != 1 {
+		t.Errorf("expected 1 event, got %d", len(publisher.events))
+	}
+
+	// client_msg_id がなければ重複排除しない
+	for i := 0; i < 2; i++ {
+		if _, duplicate, err := svc.SendMessage(ctx, "", "alice", "Hello", ""); err != nil || duplicate {
+			t.Fatalf("expected a new message, got duplicate=%v err=%v", duplicate, err)
+		}
+	}
+	all, _ := store.GetAll(ctx)
+	if len(all) != 3 {
+		t.Errorf("expected 3 stored messages, got %d", len(all))
+	}
+}
+
+func TestMessageService_CreateMessage_RoomNotFound(t *testing.T) {
+	publisher := &recordingPublisher{}
+	svc := NewMessageService(storage.NewMemoryStorage(), publisher)
+
+	if _, err := svc.CreateMessage(context.Background(), "non-existent", "alice", "Hello"); err != storage.ErrRoomNotFound {
+		t.Errorf("expected ErrRoomNotFound, got %v", err)
+	}
+
+	// 保存に失敗した場合は配信しない
+	if len(publisher.events) != 0 {
+		t.Errorf("expected no events, got %+v", publisher.events)
+	}
+}
+
+func TestMessageService_CreateMessage_PublishError(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	publisher := &recordingPublisher{err: errors.New("backplane down")}
+	svc := NewMessageService(store, publisher)
+
+	// 配信に失敗しても保存済みのメッセージは返す
+	msg, err := svc.CreateMessage(context.Background(), "", "alice", "Hello")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := store.GetByID(context.Background(), msg.ID); err != nil {
+		t.Errorf("expected message to be stored, got %v", err)
+	}
+}
+
+func TestMessageService_EditMessage(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	store.Save(context.Background(), models.Message{ID: "test-id", Sender: "alice", Content: "Helo"})
+	publisher := &recordingPublisher{}
+	svc := NewMessageService(store, publisher)
+
+	msg, err := svc.EditMessage(context.Background(), "test-id", "alice", "Hello")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if msg.Content != "Hello" || !msg.Edited {
+		t.Errorf("unexpected edited message: %+v", msg)
+	}
+
+	if len(publisher.events) != 1 || publisher.events[0].Type != EventMessageEdited {
+		t.Fatalf("expected 1 message_edited event, got %+v", publisher.events)
+	}
+
+	// 送信者以外は編集できない
+	if _, err := svc.EditMessage(context.Background(), "test-id", "mallory", "Hacked"); err != ErrNotMessageOwner {
+		t.Errorf("expected ErrNotMessageOwner, got %v", err)
+	}
+
+	if _, err := svc.EditMessage(context.Background(), "non-existent", "alice", "Hello"); err != storage.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	// 本文を空にする編集はできない
+	if _, err := svc.EditMessage(context.Background(), "test-id", "alice", ""); err != ErrEmptyContent {
+		t.Errorf("expected ErrEmptyContent, got %v", err)
+	}
+
+	if len(publisher.events) != 1 {
+		t.Errorf("expected no additional events, got %+v", publisher.events)
+	}
+
+	revisions, err := svc.GetRevisions(context.Background(), "test-id")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(revisions) != 1 || revisions[0].Content != "Helo" {
+		t.Errorf("unexpected revisions: %+v", revisions)
+	}
+}
+
+func TestMessageService_EmptyContent(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	store.Save(context.Background(), models.Message{ID: "root", Sender: "alice", Content: "Hello"})
+	publisher := &recordingPublisher{}
+	svc := NewMessageService(store, publisher)
+	ctx := context.Background()
+
+	// 本文が空のメッセージは送信・返信のどちらでも保存しない
+	if _, _, err := svc.SendMessage(ctx, "", "alice", "", "c-1"); err != ErrEmptyContent {
+		t.Errorf("SendMessage: expected ErrEmptyContent, got %v", err)
+	}
+	if _, _, err := svc.SendReply(ctx, "", "root", "alice", "", "c-2"); err != ErrEmptyContent {
+		t.Errorf("SendReply: expected ErrEmptyContent, got %v", err)
+	}
+	if _, err := svc.CreateMessage(ctx, "", "alice", ""); err != ErrEmptyContent {
+		t.Errorf("CreateMessage: expected ErrEmptyContent, got %v", err)
+	}
+	if _, err := svc.CreateReply(ctx, "", "root", "alice", ""); err != ErrEmptyContent {
+		t.Errorf("CreateReply: expected ErrEmptyContent, got %v", err)
+	}
+
+	msgs, err := store.GetAll(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(msgs) != 1 {
+		t.Errorf("expected only the root message to be stored, got %+v", msgs)
+	}
+	if len(publisher.events) != 0 {
+		t.Errorf("expected no events, got %+v", publisher.events)
+	}
+}
+
+func TestMessageService_ContentTooLong(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	store.Save(context.Background(), models.Message{ID: "root", Sender: "alice", Content: "Hello"})
+	publisher := &recordingPublisher{}
+	svc := NewMessageService(store, publisher)
+	ctx := context.Background()
+
+	if _, err := svc.CreateMessage(ctx, "", "alice", strings.Repeat("x", MaxContentSize)); err != nil {
+		t.Fatalf("expected content of MaxContentSize to be accepted, got %v", err)
+	}
+	publisher.events = nil
+
+	// エスケープで大きくなる文字はエスケープした後の大きさで数える
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"too many bytes", strings.Repeat("x", MaxContentSize+1)},
+		{"too many bytes after escaping", strings.Repeat("<", MaxContentSize/6+1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := svc.CreateMessage(ctx, "", "alice", tt.content); err != ErrContentTooLong {
+				t.Errorf("CreateMessage: expected ErrContentTooLong, got %v", err)
+			}
+			if _, err := svc.CreateReply(ctx, "", "root", "alice", tt.content); err != ErrContentTooLong {
+				t.Errorf("CreateReply: expected ErrContentTooLong, got %v", err)
+			}
+			if _, err := svc.EditMessage(ctx, "root", "alice", tt.content); err != ErrContentTooLong {
+				t.Errorf("EditMessage: expected ErrContentTooLong, got %v", err)
+			}
+		})
+	}
+
+	if len(publisher.events) != 0 {
+		t.Errorf("expected no events, got %+v", publisher.events)
+	}
+}
+
+func TestMessageService_DeleteMessage(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	store.CreateRoom(context.Background(), models.Room{ID: "room-1", Name: "general"})
+	store.Save(context.Background(), models.Message{ID: "test-id", RoomID: "room-1", Sender: "alice", Content: "Hello"})
+	publisher := &recordingPublisher{}
+	svc := NewMessageService(store, publisher)
+
+	// 送信者以外は削除できない
+	if err := svc.DeleteMessage(context.Background(), "test-id", "mallory"); err != ErrNotMessageOwner {
+		t.Errorf("expected ErrNotMessageOwner, got %v", err)
+	}
+
+	if err := svc.DeleteMessage(context.Background(), "test-id", "alice"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := store.GetByID(context.Background(), "test-id"); err != storage.ErrNotFound {
+		t.Errorf("expected ErrNotFound after delete, got %v", err)
+	}
+
+	if len(publisher.events) != 1 || publisher.events[0].Type != EventMessageDeleted {
+		t.Fatalf("expected 1 message_deleted event, got %+v", publisher.events)
+	}
+	if publisher.events[0].Message.RoomID != "room-1" {
+		t.Errorf("expected event for room 'room-1', got '%s'", publisher.events[0].Message.RoomID)
+	}
+
+	if err := svc.DeleteMessage(context.Background(), "non-existent", "alice"); err != storage.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if len(publisher.events) != 1 {
+		t.Errorf("expected no additional events, got %+v", publisher.events)
+	}
+}
+
+func TestMessageService_SendReply(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	store.CreateRoom(context.Background(), models.Room{ID: "room-1", Name: "general"})
+	store.Save(context.Background(), models.Message{ID: "root", RoomID: "room-1", Sender: "alice", Content: "Hello"})
+	publisher := &recordingPublisher{}
+	svc := NewMessageService(store, publisher)
+
+	first, _, err := svc.SendReply(context.Background(), "room-1", "root", "bob", "Hi", "c-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if first.ParentID != "root" || first.ThreadRootID != "root" || first.RoomID != "room-1" {
+		t.Errorf("unexpected reply: %+v", first)
+	}
+
+	// 返信への返信は起点のスレッドに入る
+	second, _, err := svc.SendReply(context.Background(), "room-1", first.ID, "alice", "Hey", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if second.ParentID != first.ID || second.ThreadRootID != "root" {
+		t.Errorf("unexpected nested reply: %+v", second)
+	}
+
+	// thread_reply イベントには返信後の起点が付く
+	if len(publisher.events) != 2 || publisher.events[1].Type != EventThreadReply {
+		t.Fatalf("expected 2 thread_reply events, got %+v", publisher.events)
+	}
+	event := publisher.events[1]
+	if event.Message.ID != second.ID || event.Thread == nil || event.Thread.ID != "root" || event.Thread.ReplyCount != 2 {
+		t.Errorf("unexpected event: %+v", event)
+	}
+
+	// 再送は重複排除され、イベントも配信しない
+	again, duplicate, err := svc.SendReply(context.Background(), "room-1", "root", "bob", "Hi", "c-1")
+	if err != nil || !duplicate || again.ID != first.ID {
+		t.Errorf("expected duplicate of %s, got %+v (duplicate=%v, err=%v)", first.ID, again, duplicate, err)
+	}
+	if len(publisher.events) != 2 {
+		t.Errorf("expected no additional events, got %+v", publisher.events)
+	}
+
+	// 返信先が存在しないか、別のルームのメッセージの場合
+	if _, _, err := svc.SendReply(context.Background(), "room-1", "non-existent", "bob", "Hi", ""); err != storage.ErrParentNotFound {
+		t.Errorf("expected ErrParentNotFound, got %v", err)
+	}
+	if _, _, err := svc.SendReply(context.Background(), "", "root", "bob", "Hi", ""); err != storage.ErrParentNotFound {
+		t.Errorf("expected ErrParentNotFound for another room, got %v", err)
+	}
+}
+
+func TestMessageService_ListThread(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	svc := NewMessageService(store, nil)
+	root, err := svc.CreateMessage(context.Background(), "", "alice", "Hello")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	reply, err := svc.CreateReply(context.Background(), "", root.ID, "bob", "Hi")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// 返信のIDを指定しても、その返信が属するスレッドを取得する
+	for _, id := range []string{root.ID, reply.ID} {
+		got, page, err := svc.ListThread(context.Background(), id, storage.ListOptions{}, "alice")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got.ID != root.ID || got.ReplyCount != 1 {
+			t.Errorf("unexpected root for %s: %+v", id, got)
+		}
+		if len(page.Messages) != 1 || page.Messages[0].ID != reply.ID {
+			t.Errorf("unexpected replies for %s: %+v", id, page.Messages)
+		}
+	}
+
+	if _, _, err := svc.ListThread(context.Background(), "non-existent", storage.ListOptions{}, "alice"); err != storage.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestMessageService_Reactions(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	publisher := &recordingPublisher{}
+	svc := NewMessageService(store, publisher)
+	ctx := context.Background()
+
+	root, err := svc.CreateMessage(ctx, "", "alice", "Hello")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	reply, err := svc.CreateReply(ctx, "", root.ID, "bob", "Hi")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	publisher.events = nil
+
+	msg, added, err := svc.AddReaction(ctx, reply.ID, "👍", "alice")
+	if err != nil || !added {
+		t.Fatalf("expected reaction to be added, got added=%v err=%v", added, err)
+	}
+	if len(msg.Reactions) != 1 || msg.Reactions[0] != (models.Reaction{Emoji: "👍", Count: 1, ReactedByMe: true}) {
+		t.Errorf("unexpected reactions: %+v", msg.Reactions)
+	}
+	if _, _, err := svc.AddReaction(ctx, reply.ID, "👍", "bob"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// 既に追加済みの場合はイベントを配信しない
+	if _, added, err := svc.AddReaction(ctx, reply.ID, "👍", "bob"); err != nil || added {
+		t.Errorf("expected existing reaction, got added=%v err=%v", added, err)
+	}
+	if len(publisher.events) != 2 {
+		t.Fatalf("expected 2 events, got %+v", publisher.events)
+	}
+	event := publisher.events[1]
+	if event.Type != EventReactionAdded || event.Message.ID != reply.ID || event.Message.ThreadRootID != root.ID {
+		t.Errorf("unexpected event: %+v", event)
+	}
+	if event.Reaction == nil || *event.Reaction != (ReactionChange{Emoji: "👍", User: "bob", Count: 2}) {
+		t.Errorf("unexpected reaction change: %+v", event.Reaction)
+	}
+	if event.Message.Reactions != nil {
+		t.Errorf("expected event without per-viewer reactions, got %+v", event.Message.Reactions)
+	}
+
+	// 取得するメッセージには閲覧者から見たリアクションが付く
+	_, page, err := svc.ListThread(ctx, root.ID, storage.ListOptions{}, "carol")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := page.Messages[0].Reactions; len(got) != 1 || got[0] != (models.Reaction{Emoji: "👍", Count: 2}) {
+		t.Errorf("unexpected reactions for carol: %+v", got)
+	}
+
+	msg, err = svc.RemoveReaction(ctx, reply.ID, "👍", "alice")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(msg.Reactions) != 1 || msg.Reactions[0].Count != 1 || msg.Reactions[0].ReactedByMe {
+		t.Errorf("unexpected reactions after removal: %+v", msg.Reactions)
+	}
+	event = publisher.events[len(publisher.events)-1]
+	if event.Type != EventReactionRemoved || event.Reaction == nil || event.Reaction.Count != 1 {
+		t.Errorf("unexpected event: %+v", event)
+	}
+
+	if _, err := svc.RemoveReaction(ctx, reply.ID, "👍", "alice"); err != storage.ErrReactionNotFound {
+		t.Errorf("expected ErrReactionNotFound, got %v", err)
+	}
+	if _, _, err := svc.AddReaction(ctx, "non-existent", "👍", "alice"); err != storage.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	for _, emoji := range []string{"", "a b", "a/b", "\x00", strings.Repeat("x", maxEmojiLength+1)} {
+		if _, _, err := svc.AddReaction(ctx, root.ID, emoji, "alice"); err != ErrInvalidEmoji {
+			t.Errorf("expected ErrInvalidEmoji for %q, got %v", emoji, err)
+		}
+	}
+}
+
+func TestMessageService_NilPublisher(t *testing.T) {
+	svc := NewMessageService(storage.NewMemoryStorage(), nil)
+
+	msg, err := svc.CreateMessage(context.Background(), "", "alice", "Hello")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := svc.DeleteMessage(context.Background(), msg.ID, "alice"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/tasukuchiba/text_messaging_app/internal/storage"
+	"github.com/tasukuchiba/text_messaging_app/internal/storage/storagetest"
+)
+
+func TestMemoryStorage_Conformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) storage.Storage {
+		return storage.NewMemoryStorage()
+	})
+}
+
+func TestSQLiteStorage_Conformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) storage.Storage {
+		return storage.NewTestSQLiteStorage(t)
+	})
+}
+
+func TestPostgresStorage_Conformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) storage.Storage {
+		s := storage.NewTestPostgresStorage(t)
+		t.Cleanup(func() { s.Close() })
+
+		// 前のテストの残りがあっても空の状態から始める
+		if err := storage.ResetPostgres(s); err != nil {
+			t.Fatalf("failed to reset database: %v", err)
+		}
+		t.Cleanup(func() {
+			if err := storage.ResetPostgres(s); err != nil {
+				t.Errorf("failed to cleanup database: %v", err)
+			}
+		})
+		return s
+	})
+}
+
+func TestTimeoutStorage_Conformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) storage.Storage {
+		return storage.NewTimeoutStorage(storage.NewMemoryStorage(), storage.DefaultTimeouts)
+	})
+}
+
+func TestMemoryStorage_WALConformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) storage.Storage {
+		s, err := storage.OpenMemoryStorage(t.TempDir(), storage.DefaultWALConfig)
+		if err != nil {
+			t.Fatalf("OpenMemoryStorage failed: %v", err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/tasukuchiba/text_messaging_app/internal/models"
+)
+
+// Cursor はメッセージ一覧のページング位置を表す
+// created_at と id の組でメッセージの並び順を一意に決める
+type Cursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+// CursorOf はメッセージの位置を表すカーソルを返す
+func CursorOf(msg models.Message) Cursor {
+	return Cursor{CreatedAt: msg.CreatedAt, ID: msg.ID}
+}
+
+// Encode はカーソルをクライアントに返す不透明な文字列に変換する
+func (c Cursor) Encode() string {
+	raw := c.CreatedAt.UTC().Format(time.RFC3339Nano) + "|" + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// Compare はカーソルの前後関係を比較する（a < b なら負、a > b なら正）
+func (c Cursor) Compare(other Cursor) int {
+	if c.CreatedAt.Before(other.CreatedAt) {
+		return -1
+	}
+	if c.CreatedAt.After(other.CreatedAt) {
+		return 1
+	}
+	return strings.Compare(c.ID, other.ID)
+}
+
+// DecodeCursor は Encode で生成された文字列をカーソルに戻す
+func DecodeCursor(s string) (Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+
+	ts, id, ok := strings.Cut(string(raw), "|")
+	if !ok || id == "" {
+		return Cursor{}, ErrInvalidCursor
+	}
+
+	createdAt, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+
+	return Cursor{CreatedAt: createdAt, ID: id}, nil
+}
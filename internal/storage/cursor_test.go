@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCursor_EncodeDecode(t *testing.T) {
+	c := Cursor{CreatedAt: time.Date(2026, 2, 2, 12, 0, 0, 123456789, time.UTC), ID: "test-id"}
+
+	decoded, err := DecodeCursor(c.Encode())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !decoded.CreatedAt.Equal(c.CreatedAt) || decoded.ID != c.ID {
+		t.Errorf("expected %+v, got %+v", c, decoded)
+	}
+}
+
+func TestDecodeCursor_Invalid(t *testing.T) {
+	for _, s := range []string{"", "!!!", "bm8tc2VwYXJhdG9y", "bm90LWEtdGltZXxpZA"} {
+		if _, err := DecodeCursor(s); err != ErrInvalidCursor {
+			t.Errorf("DecodeCursor(%q): expected ErrInvalidCursor, got %v", s, err)
+		}
+	}
+}
+
+func TestCursor_Compare(t *testing.T) {
+	now := time.Now()
+	a := Cursor{CreatedAt: now, ID: "a"}
+	b := Cursor{CreatedAt: now, ID: "b"}
+	later := Cursor{CreatedAt: now.Add(time.Second), ID: "a"}
+
+	if a.Compare(b) >= 0 {
+		t.Error("expected a < b when timestamps are equal")
+	}
+	if later.Compare(b) <= 0 {
+		t.Error("expected later > b")
+	}
+	if a.Compare(a) != 0 {
+		t.Error("expected a == a")
+	}
+}
@@ -0,0 +1,15 @@
+package storage
+
+// 外部テストパッケージ（storage_test）から使うテスト用の関数
+
+// NewTestPostgresStorage はテスト用のPostgresStorageを作成する（利用できない場合はスキップする）
+var NewTestPostgresStorage = skipIfNoPostgres
+
+// NewTestSQLiteStorage はテスト用の一時ファイルにSQLiteStorageを作成する
+var NewTestSQLiteStorage = newTestSQLiteStorage
+
+// ResetPostgres はテスト用データベースのメッセージ・ルーム・ユーザーを全て削除する
+func ResetPostgres(s *PostgresStorage) error {
+	_, err := s.db.Exec("DELETE FROM messages; DELETE FROM rooms; DELETE FROM users")
+	return err
+}
@@ -1,62 +1,628 @@
 package storage
 
 import (
+	"context"
+	"slices"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/tasukuchiba/text_messaging_app/internal/models"
 )
 
 // MemoryStorage はメッセージをメモリ上に保存するストレージ
+// 操作がブロックすることはないため、各メソッドの ctx は使わない
+//
+// OpenMemoryStorage で作成した場合は、変更を追記ログにも書き込んで再起動後に復元する（wal.go）。
+// 読み取りは常にメモリ上のデータだけで行う。
 type MemoryStorage struct {
-	mu       sync.RWMutex
-	messages []models.Message
+	mu sync.RWMutex
+
+	// ルームIDごとのメッセージ（created_at, id の順に並べて保持する）
+	// 全体チャンネルのメッセージは空文字のキーに入る
+	messages map[string][]models.Message
+
+	// スレッドの起点のメッセージIDごとの返信（messages と同じ順に並べて保持する）
+	threads map[string][]models.Message
+
+	// ルームIDごとのルーム
+	rooms map[string]models.Room
+
+	// メッセージIDごとの編集履歴
+	revisions map[string][]models.MessageRevision
+
+	// ユーザー名ごとのユーザー
+	users map[string]models.User
+
+	// メッセージIDごとのリアクション（追加した順に保持する）
+	reactions map[string][]reaction
+
+	// 本文の全文検索用インデックス
+	index *searchIndex
+
+	// 送信者とクライアントが付けたIDごとのメッセージID
+	clientMsgIDs map[clientMsgKey]string
+
+	// 変更を書き込む追記ログ（永続化しない場合は nil）
+	journal *journal
+}
+
+// clientMsgKey は送信者とクライアントが付けたIDの組
+type clientMsgKey struct {
+	sender      string
+	clientMsgID string
 }
 
 // NewMemoryStorage は新しいMemoryStorageを作成する
 func NewMemoryStorage() *MemoryStorage {
 	return &MemoryStorage{
-		messages: make([]models.Message, 0),
+		messages:  make(map[string][]models.Message),
+		threads:   make(map[string][]models.Message),
+		rooms:     make(map[string]models.Room),
+		revisions: make(map[string][]models.MessageRevision),
+		users:     make(map[string]models.User),
+		reactions: make(map[string][]reaction),
+		index:     newSearchIndex(),
+
+		clientMsgIDs: make(map[clientMsgKey]string),
 	}
 }
 
 // Save はメッセージを保存する
-func (s *MemoryStorage) Save(msg models.Message) error {
+func (s *MemoryStorage) Save(ctx context.Context, msg models.Message) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.messages = append(s.messages, msg)
+
+	if msg.RoomID != "" {
+		if _, ok := s.rooms[msg.RoomID]; !ok {
+			return ErrRoomNotFound
+		}
+	}
+
+	if msg.ClientMsgID != "" {
+		key := clientMsgKey{sender: msg.Sender, clientMsgID: msg.ClientMsgID}
+		if _, ok := s.clientMsgIDs[key]; ok {
+			return ErrDuplicateMessage
+		}
+	}
+
+	if msg.IsReply() {
+		if _, _, ok := s.locateRootLocked(msg.ThreadRootID); !ok {
+			return ErrParentNotFound
+		}
+	}
+
+	if err := s.logLocked(walRecord{Op: walOpSave, Message: &msg}); err != nil {
+		return err
+	}
+	s.saveLocked(msg)
 	return nil
 }
 
+// saveLocked は検証済みのメッセージを保存する（ロックを取得済みで呼び出す）
+// 返信数と最後の返信日時は保存済みの返信から求めるので、起点のメッセージは返信より先に保存する
+func (s *MemoryStorage) saveLocked(msg models.Message) {
+	if msg.ClientMsgID != "" {
+		s.clientMsgIDs[clientMsgKey{sender: msg.Sender, clientMsgID: msg.ClientMsgID}] = msg.ID
+	}
+
+	msg.Reactions = nil
+	if msg.IsReply() {
+		s.threads[msg.ThreadRootID] = insertSorted(s.threads[msg.ThreadRootID], msg)
+		s.refreshThreadLocked(msg.ThreadRootID)
+	} else {
+		msg.ReplyCount = 0
+		msg.LastReplyAt = nil
+		s.messages[msg.RoomID] = insertSorted(s.messages[msg.RoomID], msg)
+	}
+	s.index.add(msg.ID, msg.Content)
+}
+
+// insertSorted は created_at, id の並び順を保つ位置にメッセージを挿入する
+func insertSorted(messages []models.Message, msg models.Message) []models.Message {
+	key := CursorOf(msg)
+	i := sort.Search(len(messages), func(i int) bool {
+		return CursorOf(messages[i]).Compare(key) > 0
+	})
+	messages = append(messages, models.Message{})
+	copy(messages[i+1:], messages[i:])
+	messages[i] = msg
+	return messages
+}
+
+// refreshThreadLocked はスレッドの起点の返信数と最後の返信日時を返信から求め直す（ロックを取得済みで呼び出す）
+func (s *MemoryStorage) refreshThreadLocked(rootID string) {
+	messages, i, ok := s.locateRootLocked(rootID)
+	if !ok {
+		return
+	}
+	replies := s.threads[rootID]
+	messages[i].ReplyCount = len(replies)
+	messages[i].LastReplyAt = nil
+	if len(replies) > 0 {
+		// 返信は古い順に並んでいるので、最後の返信が最も新しい
+		lastReplyAt := replies[len(replies)-1].CreatedAt
+		messages[i].LastReplyAt = &lastReplyAt
+	}
+}
+
 // GetAll は全てのメッセージを取得する
-func (s *MemoryStorage) GetAll() ([]models.Message, error) {
+func (s *MemoryStorage) GetAll(ctx context.Context) ([]models.Message, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	result := make([]models.Message, len(s.messages))
-	copy(result, s.messages)
+	result := make([]models.Message, 0)
+	for _, messages := range s.messages {
+		result = append(result, messages...)
+	}
+	for _, replies := range s.threads {
+		result = append(result, replies...)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return CursorOf(result[i]).Compare(CursorOf(result[j])) < 0
+	})
 	return result, nil
 }
 
-// GetByID は指定されたIDのメッセージを取得する
-func (s *MemoryStorage) GetByID(id string) (models.Message, error) {
+// List はカーソルを使ってメッセージをページ単位で取得する
+func (s *MemoryStorage) List(ctx context.Context, opts ListOptions) (MessagePage, error) {
+	q, err := parseListOptions(opts)
+	if err != nil {
+		return MessagePage{}, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if q.roomID != "" {
+		if _, ok := s.rooms[q.roomID]; !ok {
+			return MessagePage{}, ErrRoomNotFound
+		}
+	}
+
+	return pageOf(s.messages[q.roomID], q), nil
+}
+
+// ListThread はスレッドへの返信をカーソルを使ってページ単位で取得する
+func (s *MemoryStorage) ListThread(ctx context.Context, rootID string, opts ListOptions) (MessagePage, error) {
+	q, err := parseListOptions(opts)
+	if err != nil {
+		return MessagePage{}, err
+	}
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	for _, msg := range s.messages {
-		if msg.ID == id {
-			return msg, nil
+
+	if _, _, ok := s.locateRootLocked(rootID); !ok {
+		return MessagePage{}, ErrNotFound
+	}
+	return pageOf(s.threads[rootID], q), nil
+}
+
+// ListReplies はチャンネルの全てのスレッドへの返信をカーソルを使ってページ単位で取得する
+func (s *MemoryStorage) ListReplies(ctx context.Context, opts ListOptions) (MessagePage, error) {
+	q, err := parseListOptions(opts)
+	if err != nil {
+		return MessagePage{}, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if q.roomID != "" {
+		if _, ok := s.rooms[q.roomID]; !ok {
+			return MessagePage{}, ErrRoomNotFound
 		}
 	}
-	return models.Message{}, ErrNotFound
+
+	// 返信はスレッドごとに保持しているので、チャンネルの全スレッドを作成日時順にまとめる
+	var replies []models.Message
+	for _, root := range s.messages[q.roomID] {
+		replies = append(replies, s.threads[root.ID]...)
+	}
+	sort.Slice(replies, func(i, j int) bool {
+		return CursorOf(replies[i]).Compare(CursorOf(replies[j])) < 0
+	})
+	return pageOf(replies, q), nil
+}
+
+// pageOf は並び順に保持したメッセージから q のページを切り出してコピーする
+func pageOf(messages []models.Message, q listQuery) MessagePage {
+	n := len(messages)
+	var start, end int
+	var page MessagePage
+
+	if q.forward {
+		start = sort.Search(n, func(i int) bool {
+			return CursorOf(messages[i]).Compare(*q.cursor) > 0
+		})
+		end = min(start+q.limit, n)
+		if end < n && end > start {
+			page.NextCursor = CursorOf(messages[end-1]).Encode()
+		}
+	} else {
+		end = n
+		if q.cursor != nil {
+			end = sort.Search(n, func(i int) bool {
+				return CursorOf(messages[i]).Compare(*q.cursor) >= 0
+			})
+		}
+		start = max(end-q.limit, 0)
+		if start > 0 && end > start {
+			page.NextCursor = CursorOf(messages[start]).Encode()
+		}
+	}
+
+	page.Messages = make([]models.Message, end-start)
+	copy(page.Messages, messages[start:end])
+	return page
+}
+
+// GetByID は指定されたIDのメッセージを取得する
+func (s *MemoryStorage) GetByID(ctx context.Context, id string) (models.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	msg, ok := s.findLocked(id)
+	if !ok {
+		return models.Message{}, ErrNotFound
+	}
+	return msg, nil
+}
+
+// GetByClientMsgID は送信者とクライアントが付けたIDでメッセージを取得する
+func (s *MemoryStorage) GetByClientMsgID(ctx context.Context, sender, clientMsgID string) (models.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	id, ok := s.clientMsgIDs[clientMsgKey{sender: sender, clientMsgID: clientMsgID}]
+	if !ok {
+		return models.Message{}, ErrNotFound
+	}
+	msg, ok := s.findLocked(id)
+	if !ok {
+		return models.Message{}, ErrNotFound
+	}
+	return msg, nil
 }
 
 // Delete は指定されたIDのメッセージを削除する
-func (s *MemoryStorage) Delete(id string) error {
+func (s *MemoryStorage) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.findLocked(id); !ok {
+		return ErrNotFound
+	}
+	if err := s.logLocked(walRecord{Op: walOpDelete, ID: id}); err != nil {
+		return err
+	}
+	s.deleteLocked(id)
+	return nil
+}
+
+// deleteLocked は指定されたIDのメッセージを削除する（ロックを取得済みで呼び出す）
+func (s *MemoryStorage) deleteLocked(id string) bool {
+	messages, i, ok := s.locateLocked(id)
+	if !ok {
+		return false
+	}
+	msg := messages[i]
+	messages = append(messages[:i], messages[i+1:]...)
+	s.forgetLocked(msg)
+
+	if msg.IsReply() {
+		s.threads[msg.ThreadRootID] = messages
+		s.refreshThreadLocked(msg.ThreadRootID)
+		return true
+	}
+	s.messages[msg.RoomID] = messages
+	for _, reply := range s.threads[id] {
+		s.forgetLocked(reply)
+	}
+	delete(s.threads, id)
+	return true
+}
+
+// forgetLocked は削除したメッセージの編集履歴、リアクションと索引を削除する（ロックを取得済みで呼び出す）
+func (s *MemoryStorage) forgetLocked(msg models.Message) {
+	delete(s.revisions, msg.ID)
+	delete(s.reactions, msg.ID)
+	delete(s.clientMsgIDs, clientMsgKey{sender: msg.Sender, clientMsgID: msg.ClientMsgID})
+	s.index.remove(msg.ID, msg.Content)
+}
+
+// UpdateContent はメッセージの本文を更新し、更新前の本文を編集履歴に残す
+func (s *MemoryStorage) UpdateContent(ctx context.Context, id, content string, editedAt time.Time) (models.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.findLocked(id); !ok {
+		return models.Message{}, ErrNotFound
+	}
+	if err := s.logLocked(walRecord{Op: walOpUpdateContent, ID: id, Content: content, EditedAt: &editedAt}); err != nil {
+		return models.Message{}, err
+	}
+	msg, _ := s.updateContentLocked(id, content, editedAt)
+	return msg, nil
+}
+
+// updateContentLocked はメッセージの本文を更新する（ロックを取得済みで呼び出す）
+func (s *MemoryStorage) updateContentLocked(id, content string, editedAt time.Time) (models.Message, bool) {
+	messages, i, ok := s.locateLocked(id)
+	if !ok {
+		return models.Message{}, false
+	}
+	msg := messages[i]
+	s.revisions[id] = append(s.revisions[id], models.MessageRevision{
+		MessageID: id,
+		Content:   msg.Content,
+		EditedAt:  editedAt,
+	})
+	s.index.remove(id, msg.Content)
+	s.index.add(id, content)
+	msg.Content = content
+	msg.Edited = true
+	msg.UpdatedAt = &editedAt
+	messages[i] = msg
+	return msg, true
+}
+
+// GetRevisions はメッセージの編集履歴を古い順に取得する
+func (s *MemoryStorage) GetRevisions(ctx context.Context, id string) ([]models.MessageRevision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.findLocked(id); !ok {
+		return nil, ErrNotFound
+	}
+	revisions := make([]models.MessageRevision, len(s.revisions[id]))
+	copy(revisions, s.revisions[id])
+	return revisions, nil
+}
+
+// findLocked は指定されたIDのメッセージを探す（ロックを取得済みで呼び出す）
+func (s *MemoryStorage) findLocked(id string) (models.Message, bool) {
+	messages, i, ok := s.locateLocked(id)
+	if !ok {
+		return models.Message{}, false
+	}
+	return messages[i], true
+}
+
+// locateLocked は指定されたIDのメッセージを保持しているスライスと位置を探す（ロックを取得済みで呼び出す）
+func (s *MemoryStorage) locateLocked(id string) ([]models.Message, int, bool) {
+	if messages, i, ok := s.locateRootLocked(id); ok {
+		return messages, i, true
+	}
+	for _, replies := range s.threads {
+		if i := slices.IndexFunc(replies, func(msg models.Message) bool { return msg.ID == id }); i >= 0 {
+			return replies, i, true
+		}
+	}
+	return nil, 0, false
+}
+
+// locateRootLocked はスレッドへの返信ではないメッセージだけを探す（ロックを取得済みで呼び出す）
+func (s *MemoryStorage) locateRootLocked(id string) ([]models.Message, int, bool) {
+	for _, messages := range s.messages {
+		if i := slices.IndexFunc(messages, func(msg models.Message) bool { return msg.ID == id }); i >= 0 {
+			return messages, i, true
+		}
+	}
+	return nil, 0, false
+}
+
+// CreateRoom はルームを作成する
+func (s *MemoryStorage) CreateRoom(ctx context.Context, room models.Room) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.logLocked(walRecord{Op: walOpCreateRoom, Room: &room}); err != nil {
+		return err
+	}
+	s.rooms[room.ID] = room
+	return nil
+}
+
+// GetRoom は指定されたIDのルームを取得する
+func (s *MemoryStorage) GetRoom(ctx context.Context, id string) (models.Room, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	room, ok := s.rooms[id]
+	if !ok {
+		return models.Room{}, ErrRoomNotFound
+	}
+	return room, nil
+}
+
+// ListRooms は全てのルームを作成日時順に取得する
+func (s *MemoryStorage) ListRooms(ctx context.Context) ([]models.Room, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rooms := make([]models.Room, 0, len(s.rooms))
+	for _, room := range s.rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		if !rooms[i].CreatedAt.Equal(rooms[j].CreatedAt) {
+			return rooms[i].CreatedAt.Before(rooms[j].CreatedAt)
+		}
+		return rooms[i].ID < rooms[j].ID
+	})
+	return rooms, nil
+}
+
+// CreateUser はユーザーを作成する
+func (s *MemoryStorage) CreateUser(ctx context.Context, user models.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[user.Username]; ok {
+		return ErrUserExists
+	}
+	if err := s.logLocked(walRecord{Op: walOpCreateUser, User: newWALUser(user)}); err != nil {
+		return err
+	}
+	s.users[user.Username] = user
+	return nil
+}
+
+// GetUserByUsername はユーザー名でユーザーを取得する
+func (s *MemoryStorage) GetUserByUsername(ctx context.Context, username string) (models.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, ok := s.users[username]
+	if !ok {
+		return models.User{}, ErrUserNotFound
+	}
+	return user, nil
+}
+
+// Search は転置インデックスを使って本文の全文検索を行い、新しい順に取得する
+func (s *MemoryStorage) Search(ctx context.Context, opts SearchOptions) ([]SearchResult, error) {
+	terms := queryTerms(opts.Query)
+	results := make([]SearchResult, 0)
+	if len(terms) == 0 {
+		return results, nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := s.index.lookup(terms)
+	if len(ids) == 0 {
+		return results, nil
+	}
+
+	var matched []models.Message
+	for _, byKey := range []map[string][]models.Message{s.messages, s.threads} {
+		for _, messages := range byKey {
+			for _, msg := range messages {
+				if _, ok := ids[msg.ID]; !ok {
+					continue
+				}
+				if opts.Sender != "" && msg.Sender != opts.Sender {
+					continue
+				}
+				if !opts.Since.IsZero() && msg.CreatedAt.Before(opts.Since) {
+					continue
+				}
+				if !opts.Until.IsZero() && !msg.CreatedAt.Before(opts.Until) {
+					continue
+				}
+				matched = append(matched, msg)
+			}
+		}
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		return CursorOf(matched[i]).Compare(CursorOf(matched[j])) > 0
+	})
+	for _, msg := range matched[:min(len(matched), normalizeLimit(opts.Limit))] {
+		results = append(results, SearchResult{Message: msg, Snippet: highlight(msg.Content, terms)})
+	}
+	return results, nil
+}
+
+// reaction は1人のユーザーの1つの絵文字のリアクション
+type reaction struct {
+	Emoji     string    `json:"emoji"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AddReaction はメッセージに username の絵文字リアクションを追加する
+func (s *MemoryStorage) AddReaction(ctx context.Context, messageID, emoji, username string, createdAt time.Time) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	for i, msg := range s.messages {
-		if msg.ID == id {
-			s.messages = append(s.messages[:i], s.messages[i+1:]...)
-			return nil
+	if _, ok := s.findLocked(messageID); !ok {
+		return ErrNotFound
+	}
+	if s.indexReactionLocked(messageID, emoji, username) >= 0 {
+		return ErrReactionExists
+	}
+	r := reaction{Emoji: emoji, Username: username, CreatedAt: createdAt}
+	if err := s.logLocked(walRecord{Op: walOpAddReaction, ID: messageID, Reaction: &r}); err != nil {
+		return err
+	}
+	s.reactions[messageID] = append(s.reactions[messageID], r)
+	return nil
+}
+
+// RemoveReaction はメッセージから username の絵文字リアクションを削除する
+func (s *MemoryStorage) RemoveReaction(ctx context.Context, messageID, emoji, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.findLocked(messageID); !ok {
+		return ErrNotFound
+	}
+	if s.indexReactionLocked(messageID, emoji, username) < 0 {
+		return ErrReactionNotFound
+	}
+	r := reaction{Emoji: emoji, Username: username}
+	if err := s.logLocked(walRecord{Op: walOpRemoveReaction, ID: messageID, Reaction: &r}); err != nil {
+		return err
+	}
+	s.removeReactionLocked(messageID, emoji, username)
+	return nil
+}
+
+// indexReactionLocked はリアクションの位置を探す（見つからなければ -1、ロックを取得済みで呼び出す）
+func (s *MemoryStorage) indexReactionLocked(messageID, emoji, username string) int {
+	return slices.IndexFunc(s.reactions[messageID], func(r reaction) bool {
+		return r.Emoji == emoji && r.Username == username
+	})
+}
+
+// removeReactionLocked はリアクションを削除する（ロックを取得済みで呼び出す）
+func (s *MemoryStorage) removeReactionLocked(messageID, emoji, username string) bool {
+	i := s.indexReactionLocked(messageID, emoji, username)
+	if i < 0 {
+		return false
+	}
+	reactions := slices.Delete(s.reactions[messageID], i, i+1)
+	if len(reactions) == 0 {
+		delete(s.reactions, messageID)
+	} else {
+		s.reactions[messageID] = reactions
+	}
+	return true
+}
+
+// ListReactions はメッセージごとのリアクションを絵文字ごとに集計して取得する
+func (s *MemoryStorage) ListReactions(ctx context.Context, messageIDs []string, viewer string) (map[string][]models.Reaction, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make(map[string][]models.Reaction)
+	for _, id := range messageIDs {
+		if _, ok := result[id]; ok {
+			continue
+		}
+		if reactions := aggregateReactions(s.reactions[id], viewer); len(reactions) > 0 {
+			result[id] = reactions
+		}
+	}
+	return result, nil
+}
+
+// aggregateReactions はリアクションを絵文字ごとに集計し、最初にリアクションされた順に並べる
+func aggregateReactions(reactions []reaction, viewer string) []models.Reaction {
+	var result []models.Reaction
+	first := make(map[string]time.Time)
+	for _, r := range reactions {
+		i := slices.IndexFunc(result, func(agg models.Reaction) bool { return agg.Emoji == r.Emoji })
+		if i < 0 {
+			i = len(result)
+			result = append(result, models.Reaction{Emoji: r.Emoji})
+			first[r.Emoji] = r.CreatedAt
+		} else if r.CreatedAt.Before(first[r.Emoji]) {
+			first[r.Emoji] = r.CreatedAt
+		}
+		result[i].Count++
+		if r.Username == viewer {
+			result[i].ReactedByMe = true
 		}
 	}
-	return ErrNotFound
+	sort.SliceStable(result, func(i, j int) bool {
+		a, b := first[result[i].Emoji], first[result[j].Emoji]
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+		return result[i].Emoji < result[j].Emoji
+	})
+	return result
 }
@@ -0,0 +1,9 @@
+-- 日時はUTCの固定長の文字列（2006-01-02T15:04:05.000000000Z）で保存し、文字列の順序と時刻の順序を一致させる
+CREATE TABLE IF NOT EXISTS messages (
+    id TEXT PRIMARY KEY,
+    sender TEXT NOT NULL,
+    content TEXT NOT NULL,
+    created_at TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_messages_created_at ON messages(created_at);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_messages_room_created_at_id;
+ALTER TABLE messages DROP COLUMN IF EXISTS room_id;
+DROP TABLE IF EXISTS rooms;
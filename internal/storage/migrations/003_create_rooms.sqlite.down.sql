@@ -0,0 +1,18 @@
+-- SQLiteは外部キーを持つカラムを削除できないので、messages を作り直す
+DROP INDEX IF EXISTS idx_messages_room_created_at_id;
+
+CREATE TABLE messages_without_room (
+    id TEXT PRIMARY KEY,
+    sender TEXT NOT NULL,
+    content TEXT NOT NULL,
+    created_at TEXT NOT NULL
+);
+INSERT INTO messages_without_room (id, sender, content, created_at)
+    SELECT id, sender, content, created_at FROM messages;
+DROP TABLE messages;
+ALTER TABLE messages_without_room RENAME TO messages;
+
+CREATE INDEX IF NOT EXISTS idx_messages_created_at ON messages(created_at);
+CREATE INDEX IF NOT EXISTS idx_messages_created_at_id ON messages(created_at, id);
+
+DROP TABLE IF EXISTS rooms;
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS rooms (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    created_at TEXT NOT NULL
+);
+
+ALTER TABLE messages ADD COLUMN room_id TEXT REFERENCES rooms(id) ON DELETE CASCADE;
+
+CREATE INDEX IF NOT EXISTS idx_messages_room_created_at_id ON messages(room_id, created_at, id);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS rooms (
+    id VARCHAR(36) PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS room_id VARCHAR(36) REFERENCES rooms(id) ON DELETE CASCADE;
+
+CREATE INDEX IF NOT EXISTS idx_messages_room_created_at_id ON messages(room_id, created_at, id);
@@ -0,0 +1,20 @@
+-- 本文の全文検索用のFTS5テーブル（messages の変更はトリガーで反映する）
+CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(
+    id UNINDEXED,
+    content,
+    tokenize = "unicode61 remove_diacritics 0"
+);
+
+INSERT INTO messages_fts (id, content) SELECT id, content FROM messages;
+
+CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+    INSERT INTO messages_fts (id, content) VALUES (new.id, new.content);
+END;
+
+CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF content ON messages BEGIN
+    UPDATE messages_fts SET content = new.content WHERE id = old.id;
+END;
+
+CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+    DELETE FROM messages_fts WHERE id = old.id;
+END;
@@ -0,0 +1,4 @@
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS client_msg_id TEXT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_sender_client_msg_id
+    ON messages (sender, client_msg_id) WHERE client_msg_id IS NOT NULL;
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_messages_thread_root_created_at_id;
+ALTER TABLE messages DROP COLUMN IF EXISTS last_reply_at;
+ALTER TABLE messages DROP COLUMN IF EXISTS reply_count;
+ALTER TABLE messages DROP COLUMN IF EXISTS thread_root_id;
+ALTER TABLE messages DROP COLUMN IF EXISTS parent_id;
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_messages_thread_root_created_at_id;
+ALTER TABLE messages DROP COLUMN last_reply_at;
+ALTER TABLE messages DROP COLUMN reply_count;
+ALTER TABLE messages DROP COLUMN thread_root_id;
+ALTER TABLE messages DROP COLUMN parent_id;
@@ -0,0 +1,8 @@
+-- 返信数と最後の返信日時は一覧で毎回数えずに済むように起点の行に持たせる
+-- SQLiteは外部キーを持つカラムを削除できないので、thread_root_id には外部キーを付けず、返信の削除はアプリケーションで行う
+ALTER TABLE messages ADD COLUMN parent_id TEXT;
+ALTER TABLE messages ADD COLUMN thread_root_id TEXT;
+ALTER TABLE messages ADD COLUMN reply_count INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE messages ADD COLUMN last_reply_at TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_messages_thread_root_created_at_id ON messages(thread_root_id, created_at, id);
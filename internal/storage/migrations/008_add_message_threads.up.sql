@@ -0,0 +1,7 @@
+-- 返信数と最後の返信日時は一覧で毎回数えずに済むように起点の行に持たせる
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS parent_id VARCHAR(36);
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS thread_root_id VARCHAR(36) REFERENCES messages(id) ON DELETE CASCADE;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS reply_count INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS last_reply_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS idx_messages_thread_root_created_at_id ON messages(thread_root_id, created_at, id);
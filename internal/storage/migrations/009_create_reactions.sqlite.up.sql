@@ -0,0 +1,8 @@
+-- 1人のユーザーは1つのメッセージに同じ絵文字で1回だけリアクションできる
+CREATE TABLE IF NOT EXISTS reactions (
+    message_id TEXT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    emoji TEXT NOT NULL,
+    username TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    PRIMARY KEY (message_id, emoji, username)
+);
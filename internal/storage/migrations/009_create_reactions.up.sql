@@ -0,0 +1,8 @@
+-- 1人のユーザーは1つのメッセージに同じ絵文字で1回だけリアクションできる
+CREATE TABLE IF NOT EXISTS reactions (
+    message_id VARCHAR(36) NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    emoji VARCHAR(64) NOT NULL,
+    username VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (message_id, emoji, username)
+);
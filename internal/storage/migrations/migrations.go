@@ -0,0 +1,115 @@
+// Package migrations はデータベースのスキーマを管理するバージョン付きマイグレーション
+//
+// マイグレーションは NNN_説明.up.sql / NNN_説明.down.sql のペアで、バイナリに埋め込まれる。
+// 適用済みのバージョンは schema_migrations テーブルに記録する。
+// 既存のデータベースにも適用できるように、up は IF NOT EXISTS などで冪等に書く。
+//
+// 方言ごとにSQLが異なる場合は NNN_説明.sqlite.up.sql のように方言名を付けたファイルを置く。
+// 方言名のないファイルはPostgreSQLと、方言名付きのファイルがない方言で使われる。
+// バージョン番号と説明は全ての方言で共通にする。
+package migrations
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+//go:embed *.sql
+var files embed.FS
+
+// fileNamePattern はマイグレーションファイル名の形式（方言名は省略できる）
+var fileNamePattern = regexp.MustCompile(`^(\d+)_(\w+)(?:\.(\w+))?\.(up|down)\.sql$`)
+
+// Dialect はマイグレーションを適用するデータベースの種類
+type Dialect string
+
+const (
+	Postgres Dialect = "postgres"
+	SQLite   Dialect = "sqlite"
+)
+
+// Migration は1つのバージョンのマイグレーション
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Load はファイルシステムからPostgreSQL用のマイグレーションを読み込み、バージョン順に並べて返す
+func Load(fsys fs.FS) ([]Migration, error) {
+	return LoadDialect(fsys, Postgres)
+}
+
+// LoadDialect はファイルシステムから指定した方言のマイグレーションを読み込み、バージョン順に並べて返す
+// 方言名付きのファイルがあれば、同じバージョンの方言名のないファイルより優先する
+func LoadDialect(fsys fs.FS, dialect Dialect) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	// 方言名付きのファイルから読み込んだ up / down（方言名のないファイルで上書きしない）
+	specific := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		m := fileNamePattern.FindStringSubmatch(entry.Name())
+		if m == nil {
+			continue
+		}
+
+		version, err := strconv.Atoi(m[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %s: %w", entry.Name(), err)
+		}
+
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		} else if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has conflicting names %q and %q", version, mig.Name, m[2])
+		}
+
+		// 他の方言のファイルはバージョンと説明の確認にだけ使う
+		fileDialect, direction := Dialect(m[3]), m[4]
+		if fileDialect != "" && fileDialect != dialect {
+			continue
+		}
+		key := m[1] + "." + direction
+		if fileDialect == "" && specific[key] {
+			continue
+		}
+		specific[key] = fileDialect != ""
+
+		body, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		if direction == "up" {
+			mig.Up = string(body)
+		} else {
+			mig.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" || mig.Down == "" {
+			return nil, fmt.Errorf("migration %03d_%s must have both up and down files", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
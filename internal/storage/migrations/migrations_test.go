@@ -0,0 +1,140 @@
+package migrations
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoad_Embedded(t *testing.T) {
+	migrations, err := Load(files)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("expected embedded migrations")
+	}
+
+	// バージョンは1から欠番なく並ぶ
+	for i, mig := range migrations {
+		if mig.Version != i+1 {
+			t.Errorf("expected version %d, got %d (%s)", i+1, mig.Version, mig.Name)
+		}
+	}
+	if migrations[0].Name != "create_messages" {
+		t.Errorf("expected first migration 'create_messages', got '%s'", migrations[0].Name)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	fsys := fstest.MapFS{
+		"002_add_index.up.sql":      {Data: []byte("CREATE INDEX i ON t(x);")},
+		"002_add_index.down.sql":    {Data: []byte("DROP INDEX i;")},
+		"001_create_table.up.sql":   {Data: []byte("CREATE TABLE t (x INT);")},
+		"001_create_table.down.sql": {Data: []byte("DROP TABLE t;")},
+		"README.md":                 {Data: []byte("ignored")},
+	}
+
+	migrations, err := Load(fsys)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(migrations) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(migrations))
+	}
+	if migrations[0].Version != 1 || migrations[0].Name != "create_table" || migrations[0].Down != "DROP TABLE t;" {
+		t.Errorf("unexpected first migration: %+v", migrations[0])
+	}
+	if migrations[1].Version != 2 || migrations[1].Up != "CREATE INDEX i ON t(x);" {
+		t.Errorf("unexpected second migration: %+v", migrations[1])
+	}
+}
+
+func TestLoadDialect(t *testing.T) {
+	fsys := fstest.MapFS{
+		"001_create_table.up.sql":          {Data: []byte("CREATE TABLE t (x SERIAL);")},
+		"001_create_table.down.sql":        {Data: []byte("DROP TABLE t;")},
+		"001_create_table.sqlite.up.sql":   {Data: []byte("CREATE TABLE t (x INTEGER);")},
+		"001_create_table.sqlite.down.sql": {Data: []byte("DROP TABLE t;")},
+		"002_add_index.up.sql":             {Data: []byte("CREATE INDEX i ON t(x);")},
+		"002_add_index.down.sql":           {Data: []byte("DROP INDEX i;")},
+	}
+
+	tests := []struct {
+		dialect Dialect
+		want    string
+	}{
+		{Postgres, "CREATE TABLE t (x SERIAL);"},
+		{SQLite, "CREATE TABLE t (x INTEGER);"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.dialect), func(t *testing.T) {
+			migrations, err := LoadDialect(fsys, tt.dialect)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(migrations) != 2 {
+				t.Fatalf("expected 2 migrations, got %d", len(migrations))
+			}
+			// 方言名付きのファイルがあればそちらを使い、なければ共通のファイルを使う
+			if migrations[0].Up != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, migrations[0].Up)
+			}
+			if migrations[1].Up != "CREATE INDEX i ON t(x);" {
+				t.Errorf("unexpected second migration: %+v", migrations[1])
+			}
+		})
+	}
+}
+
+func TestLoadDialect_Embedded(t *testing.T) {
+	postgres, err := LoadDialect(files, Postgres)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sqlite, err := LoadDialect(files, SQLite)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// どの方言でも同じバージョンと説明が並ぶ
+	if len(postgres) != len(sqlite) {
+		t.Fatalf("expected %d SQLite migrations, got %d", len(postgres), len(sqlite))
+	}
+	for i := range postgres {
+		if postgres[i].Version != sqlite[i].Version || postgres[i].Name != sqlite[i].Name {
+			t.Errorf("migration %d differs: %s vs %s", i, postgres[i].Name, sqlite[i].Name)
+		}
+	}
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		fsys fstest.MapFS
+		want string
+	}{
+		{
+			"missing down",
+			fstest.MapFS{"001_create_table.up.sql": {Data: []byte("CREATE TABLE t (x INT);")}},
+			"must have both up and down",
+		},
+		{
+			"conflicting names",
+			fstest.MapFS{
+				"001_create_table.up.sql":   {Data: []byte("CREATE TABLE t (x INT);")},
+				"001_create_other.down.sql": {Data: []byte("DROP TABLE t;")},
+			},
+			"conflicting names",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(tt.fsys)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+)
+
+// advisoryLockKey は同時に起動した複数のインスタンスがマイグレーションを
+// 並行して実行しないように取得する pg_advisory_lock のキー
+const advisoryLockKey int64 = 7_243_911_004
+
+// Migrator は埋め込まれたマイグレーションをデータベースに適用する
+type Migrator struct {
+	db         *sql.DB
+	dialect    Dialect
+	migrations []Migration
+}
+
+// New は埋め込まれたPostgreSQL用のマイグレーションを使うMigratorを作成する
+func New(db *sql.DB) (*Migrator, error) {
+	return NewForDialect(db, Postgres)
+}
+
+// NewForDialect は埋め込まれた指定した方言のマイグレーションを使うMigratorを作成する
+func NewForDialect(db *sql.DB, dialect Dialect) (*Migrator, error) {
+	migrations, err := LoadDialect(files, dialect)
+	if err != nil {
+		return nil, err
+	}
+	m := NewWithMigrations(db, migrations)
+	m.dialect = dialect
+	return m, nil
+}
+
+// NewWithMigrations は指定したマイグレーションを使うPostgreSQL用のMigratorを作成する
+func NewWithMigrations(db *sql.DB, migrations []Migration) *Migrator {
+	return &Migrator{db: db, dialect: Postgres, migrations: migrations}
+}
+
+// Up は未適用のマイグレーションを古い順に全て適用し、適用した件数を返す
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	applied := 0
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		current, err := currentVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, mig := range m.migrations {
+			if mig.Version <= current {
+				continue
+			}
+			if err := apply(ctx, conn, mig.Up, func(tx *sql.Tx) error {
+				_, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version) VALUES ($1)", mig.Version)
+				return err
+			}); err != nil {
+				return fmt.Errorf("migration %03d_%s up: %w", mig.Version, mig.Name, err)
+			}
+			slog.InfoContext(ctx, "Applied migration", "version", mig.Version, "name", mig.Name)
+			applied++
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down は適用済みのマイグレーションを新しい順に steps 件取り消し、取り消した件数を返す
+func (m *Migrator) Down(ctx context.Context, steps int) (int, error) {
+	reverted := 0
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		for reverted < steps {
+			current, err := currentVersion(ctx, conn)
+			if err != nil {
+				return err
+			}
+			if current == 0 {
+				return nil
+			}
+
+			mig, ok := m.find(current)
+			if !ok {
+				return fmt.Errorf("migration %d is applied but not known to this binary", current)
+			}
+			if err := apply(ctx, conn, mig.Down, func(tx *sql.Tx) error {
+				_, err := tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = $1", mig.Version)
+				return err
+			}); err != nil {
+				return fmt.Errorf("migration %03d_%s down: %w", mig.Version, mig.Name, err)
+			}
+			slog.InfoContext(ctx, "Reverted migration", "version", mig.Version, "name", mig.Name)
+			reverted++
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// Version は適用済みの最新バージョンを返す（未適用の場合は0）
+func (m *Migrator) Version(ctx context.Context) (int, error) {
+	var version int
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		var err error
+		version, err = currentVersion(ctx, conn)
+		return err
+	})
+	return version, err
+}
+
+// find は指定したバージョンのマイグレーションを探す
+func (m *Migrator) find(version int) (Migration, bool) {
+	for _, mig := range m.migrations {
+		if mig.Version == version {
+			return mig, true
+		}
+	}
+	return Migration{}, false
+}
+
+// withLock は1つの接続上でアドバイザリロックを取得して fn を実行する
+//
+// pg_advisory_lock はセッション単位のロックなので、取得から解放まで同じ接続を使う。
+// SQLiteは1つのプロセスからしか使わない前提なのでロックは取らない。
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	createTable := `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version BIGINT PRIMARY KEY,
+			applied_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		)
+	`
+	if m.dialect == SQLite {
+		createTable = `
+			CREATE TABLE IF NOT EXISTS schema_migrations (
+				version INTEGER PRIMARY KEY,
+				applied_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+			)
+		`
+	} else {
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", advisoryLockKey); err != nil {
+			return fmt.Errorf("acquire migration lock: %w", err)
+		}
+		defer func() {
+			// ctx がキャンセルされていても解放できるように新しいコンテキストを使う
+			if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", advisoryLockKey); err != nil {
+				slog.Error("Failed to release migration lock", "error", err)
+			}
+		}()
+	}
+
+	if _, err := conn.ExecContext(ctx, createTable); err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	return fn(conn)
+}
+
+// currentVersion は適用済みの最新バージョンを取得する
+func currentVersion(ctx context.Context, conn *sql.Conn) (int, error) {
+	var version int
+	err := conn.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
+
+// apply はSQLとバージョンの記録を1つのトランザクションで実行する
+func apply(ctx context.Context, conn *sql.Conn, query string, record func(tx *sql.Tx) error) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, query); err != nil {
+		return err
+	}
+	if err := record(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -1,11 +1,16 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/tasukuchiba/text_messaging_app/internal/models"
+	"github.com/tasukuchiba/text_messaging_app/internal/storage/migrations"
 )
 
 // PostgresStorage はメッセージをPostgreSQLに保存するストレージ
@@ -13,101 +18,287 @@ type PostgresStorage struct {
 	db *sql.DB
 }
 
+// PoolConfig はデータベースの接続プールの設定
+type PoolConfig struct {
+	// 同時に開く接続の最大数（0以下なら無制限）
+	MaxOpenConns int
+
+	// 待機させておく接続の最大数
+	MaxIdleConns int
+
+	// 接続を使い回す最大の期間（0以下なら無制限）
+	ConnMaxLifetime time.Duration
+}
+
+// DefaultPoolConfig は接続プールの設定の指定がない場合の値
+var DefaultPoolConfig = PoolConfig{
+	MaxOpenConns:    10,
+	MaxIdleConns:    5,
+	ConnMaxLifetime: 5 * time.Minute,
+}
+
+// PostgresOption はPostgresStorageの設定を変更する関数
+type PostgresOption func(*postgresOptions)
+
+// postgresOptions はPostgresStorageの作成時の設定
+type postgresOptions struct {
+	pool PoolConfig
+}
+
+// WithPoolConfig は接続プールの設定を指定する
+func WithPoolConfig(pool PoolConfig) PostgresOption {
+	return func(o *postgresOptions) {
+		o.pool = pool
+	}
+}
+
 // NewPostgresStorage は新しいPostgresStorageを作成する
-func NewPostgresStorage(databaseURL string) (*PostgresStorage, error) {
+// 接続確認とマイグレーションは ctx の期限内に行う
+func NewPostgresStorage(ctx context.Context, databaseURL string, opts ...PostgresOption) (*PostgresStorage, error) {
+	o := postgresOptions{pool: DefaultPoolConfig}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	db, err := sql.Open("postgres", databaseURL)
 	if err != nil {
 		return nil, err
 	}
 
 	// 接続プール設定
-	db.SetMaxOpenConns(10)
-	db.SetMaxIdleConns(5)
-	db.SetConnMaxLifetime(5 * time.Minute)
+	db.SetMaxOpenConns(o.pool.MaxOpenConns)
+	db.SetMaxIdleConns(o.pool.MaxIdleConns)
+	db.SetConnMaxLifetime(o.pool.ConnMaxLifetime)
 
 	// 接続確認
-	if err := db.Ping(); err != nil {
+	if err := db.PingContext(ctx); err != nil {
 		return nil, err
 	}
 
 	storage := &PostgresStorage{db: db}
 
 	// マイグレーション実行
-	if err := storage.migrate(); err != nil {
+	if err := storage.migrate(ctx); err != nil {
 		return nil, err
 	}
 
 	return storage, nil
 }
 
-// migrate はデータベーススキーマを作成する
-func (s *PostgresStorage) migrate() error {
-	query := `
-		CREATE TABLE IF NOT EXISTS messages (
-			id VARCHAR(36) PRIMARY KEY,
-			sender VARCHAR(255) NOT NULL,
-			content TEXT NOT NULL,
-			created_at TIMESTAMP WITH TIME ZONE NOT NULL
-		);
-		CREATE INDEX IF NOT EXISTS idx_messages_created_at ON messages(created_at);
-	`
-	_, err := s.db.Exec(query)
+// migrate は未適用のマイグレーションを適用する
+// 複数のインスタンスが同時に起動しても、アドバイザリロックで1つずつ実行される
+func (s *PostgresStorage) migrate(ctx context.Context) error {
+	migrator, err := migrations.New(s.db)
+	if err != nil {
+		return err
+	}
+	_, err = migrator.Up(ctx)
 	return err
 }
 
+// messageColumns はメッセージ取得時に SELECT するカラム（scanMessage と順序を合わせる）
+const messageColumns = "id, room_id, sender, content, created_at, updated_at, client_msg_id, " +
+	"parent_id, thread_root_id, reply_count, last_reply_at"
+
+// clientMsgIDIndex は送信者ごとの client_msg_id の一意インデックス（007 のマイグレーションで作成）
+const clientMsgIDIndex = "idx_messages_sender_client_msg_id"
+
+// threadStatsQuery はスレッドの起点（$1）の返信数と最後の返信日時を返信から求め直す
+const threadStatsQuery = `
+	UPDATE messages SET
+		reply_count = (SELECT COUNT(*) FROM messages WHERE thread_root_id = $1),
+		last_reply_at = (SELECT MAX(created_at) FROM messages WHERE thread_root_id = $1)
+	WHERE id = $1
+`
+
 // Save はメッセージを保存する
-func (s *PostgresStorage) Save(msg models.Message) error {
+// 返信の場合は起点の行を先に更新してロックし、保存が終わるまで起点の削除や同じスレッドの更新を待たせる
+func (s *PostgresStorage) Save(ctx context.Context, msg models.Message) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if msg.IsReply() {
+		result, err := tx.ExecContext(ctx, `
+			UPDATE messages SET reply_count = reply_count + 1, last_reply_at = GREATEST(last_reply_at, $2)
+			WHERE id = $1 AND thread_root_id IS NULL
+		`, msg.ThreadRootID, msg.CreatedAt)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrParentNotFound
+		}
+	}
+
 	query := `
-		INSERT INTO messages (id, sender, content, created_at)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO messages (id, room_id, sender, content, created_at, client_msg_id, parent_id, thread_root_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
 	`
-	_, err := s.db.Exec(query, msg.ID, msg.Sender, msg.Content, msg.CreatedAt)
-	return err
+	_, err = tx.ExecContext(ctx, query,
+		msg.ID, nullString(msg.RoomID), msg.Sender, msg.Content, msg.CreatedAt, nullString(msg.ClientMsgID),
+		nullString(msg.ParentID), nullString(msg.ThreadRootID))
+	if isForeignKeyViolation(err) {
+		return ErrRoomNotFound
+	}
+	if isUniqueViolation(err) && violatedConstraint(err) == clientMsgIDIndex {
+		return ErrDuplicateMessage
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 // GetAll は全てのメッセージを取得する
-func (s *PostgresStorage) GetAll() ([]models.Message, error) {
+func (s *PostgresStorage) GetAll(ctx context.Context) ([]models.Message, error) {
 	query := `
-		SELECT id, sender, content, created_at
+		SELECT ` + messageColumns + `
 		FROM messages
-		ORDER BY created_at ASC
+		ORDER BY created_at ASC, id ASC
 	`
-	rows, err := s.db.Query(query)
+	rows, err := s.db.QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var messages []models.Message
-	for rows.Next() {
-		var msg models.Message
-		if err := rows.Scan(&msg.ID, &msg.Sender, &msg.Content, &msg.CreatedAt); err != nil {
-			return nil, err
+	return scanMessages(rows)
+}
+
+// List はカーソルを使ってメッセージをページ単位で取得する
+func (s *PostgresStorage) List(ctx context.Context, opts ListOptions) (MessagePage, error) {
+	q, err := parseListOptions(opts)
+	if err != nil {
+		return MessagePage{}, err
+	}
+
+	if q.roomID != "" {
+		if _, err := s.GetRoom(ctx, q.roomID); err != nil {
+			return MessagePage{}, err
 		}
-		messages = append(messages, msg)
 	}
 
-	if err := rows.Err(); err != nil {
-		return nil, err
+	if q.roomID == "" {
+		return s.listPage(ctx, q, "room_id IS NULL AND thread_root_id IS NULL")
 	}
+	return s.listPage(ctx, q, "room_id = $2 AND thread_root_id IS NULL", q.roomID)
+}
 
-	// nilではなく空のスライスを返す
-	if messages == nil {
-		messages = []models.Message{}
+// ListThread はスレッドへの返信をカーソルを使ってページ単位で取得する
+func (s *PostgresStorage) ListThread(ctx context.Context, rootID string, opts ListOptions) (MessagePage, error) {
+	q, err := parseListOptions(opts)
+	if err != nil {
+		return MessagePage{}, err
 	}
 
-	return messages, nil
+	root, err := s.GetByID(ctx, rootID)
+	if err != nil {
+		return MessagePage{}, err
+	}
+	if root.IsReply() {
+		return MessagePage{}, ErrNotFound
+	}
+	return s.listPage(ctx, q, "thread_root_id = $2", rootID)
+}
+
+// ListReplies はチャンネルの全てのスレッドへの返信をカーソルを使ってページ単位で取得する
+func (s *PostgresStorage) ListReplies(ctx context.Context, opts ListOptions) (MessagePage, error) {
+	q, err := parseListOptions(opts)
+	if err != nil {
+		return MessagePage{}, err
+	}
+
+	if q.roomID == "" {
+		return s.listPage(ctx, q, "room_id IS NULL AND thread_root_id IS NOT NULL")
+	}
+	if _, err := s.GetRoom(ctx, q.roomID); err != nil {
+		return MessagePage{}, err
+	}
+	return s.listPage(ctx, q, "room_id = $2 AND thread_root_id IS NOT NULL", q.roomID)
+}
+
+// listPage は filter に一致するメッセージを q のカーソルと件数でページ単位で取得する
+// filter のプレースホルダは $2 から始め、値を args に渡す（$1 は件数に使う）
+func (s *PostgresStorage) listPage(ctx context.Context, q listQuery, filter string, args ...any) (MessagePage, error) {
+	// 続きの有無を判定するために1件多く取得する
+	args = append([]any{q.limit + 1}, args...)
+	where := "WHERE " + filter
+
+	order := "DESC"
+	if q.forward {
+		order = "ASC"
+	}
+	if q.cursor != nil {
+		op := "<"
+		if q.forward {
+			op = ">"
+		}
+		args = append(args, q.cursor.CreatedAt, q.cursor.ID)
+		where += fmt.Sprintf(" AND (created_at, id) %s ($%d, $%d)", op, len(args)-1, len(args))
+	}
+
+	query := `
+		SELECT ` + messageColumns + `
+		FROM messages
+		` + where + `
+		ORDER BY created_at ` + order + `, id ` + order + `
+		LIMIT $1
+	`
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return MessagePage{}, err
+	}
+	defer rows.Close()
+
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return MessagePage{}, err
+	}
+
+	var page MessagePage
+	if len(messages) > q.limit {
+		messages = messages[:q.limit]
+		page.NextCursor = CursorOf(messages[len(messages)-1]).Encode()
+	}
+
+	// 古い順に揃える
+	if !q.forward {
+		slices.Reverse(messages)
+	}
+	page.Messages = messages
+	return page, nil
 }
 
 // GetByID は指定されたIDのメッセージを取得する
-func (s *PostgresStorage) GetByID(id string) (models.Message, error) {
+func (s *PostgresStorage) GetByID(ctx context.Context, id string) (models.Message, error) {
 	query := `
-		SELECT id, sender, content, created_at
+		SELECT ` + messageColumns + `
 		FROM messages
 		WHERE id = $1
 	`
-	var msg models.Message
-	err := s.db.QueryRow(query, id).Scan(&msg.ID, &msg.Sender, &msg.Content, &msg.CreatedAt)
+	msg, err := scanMessage(s.db.QueryRowContext(ctx, query, id))
+	if err == sql.ErrNoRows {
+		return models.Message{}, ErrNotFound
+	}
+	if err != nil {
+		return models.Message{}, err
+	}
+	return msg, nil
+}
+
+// GetByClientMsgID は送信者とクライアントが付けたIDでメッセージを取得する
+func (s *PostgresStorage) GetByClientMsgID(ctx context.Context, sender, clientMsgID string) (models.Message, error) {
+	query := `
+		SELECT ` + messageColumns + `
+		FROM messages
+		WHERE sender = $1 AND client_msg_id = $2
+	`
+	msg, err := scanMessage(s.db.QueryRowContext(ctx, query, sender, clientMsgID))
 	if err == sql.ErrNoRows {
 		return models.Message{}, ErrNotFound
 	}
@@ -118,9 +309,31 @@ func (s *PostgresStorage) GetByID(id string) (models.Message, error) {
 }
 
 // Delete は指定されたIDのメッセージを削除する
-func (s *PostgresStorage) Delete(id string) error {
-	query := `DELETE FROM messages WHERE id = $1`
-	result, err := s.db.Exec(query, id)
+// スレッドの返信は外部キーの ON DELETE CASCADE で削除される
+func (s *PostgresStorage) Delete(ctx context.Context, id string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var rootID sql.NullString
+	err = tx.QueryRowContext(ctx, `SELECT thread_root_id FROM messages WHERE id = $1`, id).Scan(&rootID)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	// 返信数を数え直す前に、同じスレッドへの返信の保存や削除が終わるのを待つ
+	if rootID.Valid {
+		if _, err := tx.ExecContext(ctx, `SELECT 1 FROM messages WHERE id = $1 FOR UPDATE`, rootID.String); err != nil {
+			return err
+		}
+	}
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM messages WHERE id = $1`, id)
 	if err != nil {
 		return err
 	}
@@ -134,7 +347,355 @@ func (s *PostgresStorage) Delete(id string) error {
 		return ErrNotFound
 	}
 
-	return nil
+	if rootID.Valid {
+		if _, err := tx.ExecContext(ctx, threadStatsQuery, rootID.String); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UpdateContent はメッセージの本文を更新し、更新前の本文を編集履歴に残す
+func (s *PostgresStorage) UpdateContent(ctx context.Context, id, content string, editedAt time.Time) (models.Message, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return models.Message{}, err
+	}
+	defer tx.Rollback()
+
+	// 同時編集で履歴が欠けないように行ロックを取る
+	var previous string
+	err = tx.QueryRowContext(ctx, `SELECT content FROM messages WHERE id = $1 FOR UPDATE`, id).Scan(&previous)
+	if err == sql.ErrNoRows {
+		return models.Message{}, ErrNotFound
+	}
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO message_revisions (message_id, content, edited_at)
+		VALUES ($1, $2, $3)
+	`, id, previous, editedAt)
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	query := `
+		UPDATE messages SET content = $2, updated_at = $3
+		WHERE id = $1
+		RETURNING ` + messageColumns
+	msg, err := scanMessage(tx.QueryRowContext(ctx, query, id, content, editedAt))
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return models.Message{}, err
+	}
+	return msg, nil
+}
+
+// GetRevisions はメッセージの編集履歴を古い順に取得する
+func (s *PostgresStorage) GetRevisions(ctx context.Context, id string) ([]models.MessageRevision, error) {
+	if _, err := s.GetByID(ctx, id); err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT message_id, content, edited_at
+		FROM message_revisions
+		WHERE message_id = $1
+		ORDER BY id ASC
+	`
+	rows, err := s.db.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []models.MessageRevision{}
+	for rows.Next() {
+		var rev models.MessageRevision
+		if err := rows.Scan(&rev.MessageID, &rev.Content, &rev.EditedAt); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	return revisions, rows.Err()
+}
+
+// CreateRoom はルームを作成する
+func (s *PostgresStorage) CreateRoom(ctx context.Context, room models.Room) error {
+	query := `
+		INSERT INTO rooms (id, name, created_at)
+		VALUES ($1, $2, $3)
+	`
+	_, err := s.db.ExecContext(ctx, query, room.ID, room.Name, room.CreatedAt)
+	return err
+}
+
+// GetRoom は指定されたIDのルームを取得する
+func (s *PostgresStorage) GetRoom(ctx context.Context, id string) (models.Room, error) {
+	query := `SELECT id, name, created_at FROM rooms WHERE id = $1`
+	var room models.Room
+	err := s.db.QueryRowContext(ctx, query, id).Scan(&room.ID, &room.Name, &room.CreatedAt)
+	if err == sql.ErrNoRows {
+		return models.Room{}, ErrRoomNotFound
+	}
+	if err != nil {
+		return models.Room{}, err
+	}
+	return room, nil
+}
+
+// ListRooms は全てのルームを作成日時順に取得する
+func (s *PostgresStorage) ListRooms(ctx context.Context) ([]models.Room, error) {
+	query := `SELECT id, name, created_at FROM rooms ORDER BY created_at ASC, id ASC`
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rooms := []models.Room{}
+	for rows.Next() {
+		var room models.Room
+		if err := rows.Scan(&room.ID, &room.Name, &room.CreatedAt); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
+// CreateUser はユーザーを作成する
+func (s *PostgresStorage) CreateUser(ctx context.Context, user models.User) error {
+	query := `
+		INSERT INTO users (id, username, password_hash, created_at)
+		VALUES ($1, $2, $3, $4)
+	`
+	_, err := s.db.ExecContext(ctx, query, user.ID, user.Username, user.PasswordHash, user.CreatedAt)
+	if isUniqueViolation(err) {
+		return ErrUserExists
+	}
+	return err
+}
+
+// GetUserByUsername はユーザー名でユーザーを取得する
+func (s *PostgresStorage) GetUserByUsername(ctx context.Context, username string) (models.User, error) {
+	query := `SELECT id, username, password_hash, created_at FROM users WHERE username = $1`
+	var user models.User
+	err := s.db.QueryRowContext(ctx, query, username).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.CreatedAt)
+	if err == sql.ErrNoRows {
+		return models.User{}, ErrUserNotFound
+	}
+	if err != nil {
+		return models.User{}, err
+	}
+	return user, nil
+}
+
+// searchHeadlineOptions は ts_headline で抜粋を作るときのオプション
+var searchHeadlineOptions = fmt.Sprintf("StartSel=%s, StopSel=%s, MaxWords=%d, MinWords=15",
+	highlightStart, highlightStop, snippetMaxWords)
+
+// Search は search_vector のGINインデックスを使って本文の全文検索を行い、新しい順に取得する
+func (s *PostgresStorage) Search(ctx context.Context, opts SearchOptions) ([]SearchResult, error) {
+	results := make([]SearchResult, 0)
+	if len(queryTerms(opts.Query)) == 0 {
+		return results, nil
+	}
+
+	args := []any{opts.Query, normalizeLimit(opts.Limit), searchHeadlineOptions}
+	where := "search_vector @@ q"
+	if opts.Sender != "" {
+		args = append(args, opts.Sender)
+		where += fmt.Sprintf(" AND sender = $%d", len(args))
+	}
+	if !opts.Since.IsZero() {
+		args = append(args, opts.Since)
+		where += fmt.Sprintf(" AND created_at >= $%d", len(args))
+	}
+	if !opts.Until.IsZero() {
+		args = append(args, opts.Until)
+		where += fmt.Sprintf(" AND created_at < $%d", len(args))
+	}
+
+	query := `
+		SELECT ` + messageColumns + `, ts_headline('simple', content, q, $3)
+		FROM messages, plainto_tsquery('simple', $1) q
+		WHERE ` + where + `
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2
+	`
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var result SearchResult
+		result.Message, err = scanMessage(rows, &result.Snippet)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// AddReaction はメッセージに username の絵文字リアクションを追加する
+func (s *PostgresStorage) AddReaction(ctx context.Context, messageID, emoji, username string, createdAt time.Time) error {
+	query := `
+		INSERT INTO reactions (message_id, emoji, username, created_at)
+		VALUES ($1, $2, $3, $4)
+	`
+	_, err := s.db.ExecContext(ctx, query, messageID, emoji, username, createdAt)
+	if isForeignKeyViolation(err) {
+		return ErrNotFound
+	}
+	if isUniqueViolation(err) {
+		return ErrReactionExists
+	}
+	return err
+}
+
+// RemoveReaction はメッセージから username の絵文字リアクションを削除する
+func (s *PostgresStorage) RemoveReaction(ctx context.Context, messageID, emoji, username string) error {
+	query := `DELETE FROM reactions WHERE message_id = $1 AND emoji = $2 AND username = $3`
+	result, err := s.db.ExecContext(ctx, query, messageID, emoji, username)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n > 0 {
+		return nil
+	}
+
+	// 削除する行がなかった場合は、メッセージがないのかリアクションがないのかを区別する
+	if _, err := s.GetByID(ctx, messageID); err != nil {
+		return err
+	}
+	return ErrReactionNotFound
+}
+
+// ListReactions はメッセージごとのリアクションを絵文字ごとに集計して取得する
+func (s *PostgresStorage) ListReactions(ctx context.Context, messageIDs []string, viewer string) (map[string][]models.Reaction, error) {
+	result := make(map[string][]models.Reaction)
+	if len(messageIDs) == 0 {
+		return result, nil
+	}
+
+	query := `
+		SELECT message_id, emoji, COUNT(*), bool_or(username = $2)
+		FROM reactions
+		WHERE message_id = ANY($1)
+		GROUP BY message_id, emoji
+		ORDER BY message_id, MIN(created_at), emoji
+	`
+	rows, err := s.db.QueryContext(ctx, query, pq.Array(messageIDs), viewer)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID string
+		var reaction models.Reaction
+		if err := rows.Scan(&messageID, &reaction.Emoji, &reaction.Count, &reaction.ReactedByMe); err != nil {
+			return nil, err
+		}
+		result[messageID] = append(result[messageID], reaction)
+	}
+	return result, rows.Err()
+}
+
+// rowScanner は *sql.Row と *sql.Rows の共通インターフェース
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanMessage は messageColumns の順に並んだ1行をメッセージに変換する
+// messageColumns の後に追加のカラムがある場合は extra で受け取る
+func scanMessage(row rowScanner, extra ...any) (models.Message, error) {
+	var msg models.Message
+	var roomID sql.NullString
+	var updatedAt, lastReplyAt sql.NullTime
+	var clientMsgID, parentID, threadRootID sql.NullString
+	dest := append([]any{&msg.ID, &roomID, &msg.Sender, &msg.Content, &msg.CreatedAt, &updatedAt, &clientMsgID,
+		&parentID, &threadRootID, &msg.ReplyCount, &lastReplyAt}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return models.Message{}, err
+	}
+	msg.RoomID = roomID.String
+	msg.ClientMsgID = clientMsgID.String
+	msg.ParentID = parentID.String
+	msg.ThreadRootID = threadRootID.String
+	if updatedAt.Valid {
+		msg.Edited = true
+		msg.UpdatedAt = &updatedAt.Time
+	}
+	if lastReplyAt.Valid {
+		msg.LastReplyAt = &lastReplyAt.Time
+	}
+	return msg, nil
+}
+
+// scanMessages は行セットをメッセージのスライスに変換する
+func scanMessages(rows *sql.Rows) ([]models.Message, error) {
+	var messages []models.Message
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// nilではなく空のスライスを返す
+	if messages == nil {
+		messages = []models.Message{}
+	}
+
+	return messages, nil
+}
+
+// nullString は空文字を NULL として扱う
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// isForeignKeyViolation は外部キー制約違反のエラーかどうかを判定する
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
+
+// isUniqueViolation は一意制約違反のエラーかどうかを判定する
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// violatedConstraint は制約違反のエラーから違反した制約（インデックス）の名前を取得する
+func violatedConstraint(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Constraint
+	}
+	return ""
+}
+
+// Ping はデータベースに接続できるか確認する
+func (s *PostgresStorage) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
 }
 
 // Close はデータベース接続を閉じる
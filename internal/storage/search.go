@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"strings"
+	"unicode"
+)
+
+const (
+	// 検索結果の抜粋で一致した語を囲む文字列
+	highlightStart = "<mark>"
+	highlightStop  = "</mark>"
+
+	// 抜粋に含める最大の語数（PostgreSQL の ts_headline の MaxWords と合わせる）
+	snippetMaxWords = 35
+
+	// 抜粋で最初に一致した語の前に残す語数
+	snippetLeadingWords = 5
+)
+
+// token は本文中の1語とその位置
+type token struct {
+	text       string
+	start, end int
+}
+
+// tokenize は本文を語に分割する
+//
+// 文字と数字の連続を1語とし、小文字に揃える。
+// PostgreSQL の 'simple' 設定の to_tsvector と同様に語幹処理は行わない。
+func tokenize(s string) []token {
+	var tokens []token
+	start := -1
+	for i, r := range s {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			tokens = append(tokens, token{text: strings.ToLower(s[start:i]), start: start, end: i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, token{text: strings.ToLower(s[start:]), start: start, end: len(s)})
+	}
+	return tokens
+}
+
+// queryTerms は検索語を重複のない語の集合にする
+func queryTerms(query string) map[string]struct{} {
+	terms := make(map[string]struct{})
+	for _, t := range tokenize(query) {
+		terms[t.text] = struct{}{}
+	}
+	return terms
+}
+
+// searchIndex は語からメッセージIDを引く転置インデックス
+type searchIndex struct {
+	postings map[string]map[string]struct{}
+}
+
+// newSearchIndex は空の転置インデックスを作成する
+func newSearchIndex() *searchIndex {
+	return &searchIndex{postings: make(map[string]map[string]struct{})}
+}
+
+// add はメッセージの本文をインデックスに追加する
+func (idx *searchIndex) add(id, content string) {
+	for _, t := range tokenize(content) {
+		ids, ok := idx.postings[t.text]
+		if !ok {
+			ids = make(map[string]struct{})
+			idx.postings[t.text] = ids
+		}
+		ids[id] = struct{}{}
+	}
+}
+
+// remove はメッセージの本文をインデックスから取り除く
+func (idx *searchIndex) remove(id, content string) {
+	for _, t := range tokenize(content) {
+		ids := idx.postings[t.text]
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(idx.postings, t.text)
+		}
+	}
+}
+
+// lookup は全ての語を含むメッセージIDの集合を返す
+func (idx *searchIndex) lookup(terms map[string]struct{}) map[string]struct{} {
+	// 最も件数の少ない語から絞り込む
+	var smallest map[string]struct{}
+	for term := range terms {
+		ids := idx.postings[term]
+		if len(ids) == 0 {
+			return nil
+		}
+		if smallest == nil || len(ids) < len(smallest) {
+			smallest = ids
+		}
+	}
+
+	result := make(map[string]struct{}, len(smallest))
+	for id := range smallest {
+		matched := true
+		for term := range terms {
+			if _, ok := idx.postings[term][id]; !ok {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			result[id] = struct{}{}
+		}
+	}
+	return result
+}
+
+// highlight は本文中の検索語を強調した抜粋を作る
+//
+// 本文が snippetMaxWords 語を超える場合は、最初に一致した語の少し前から切り出す。
+func highlight(content string, terms map[string]struct{}) string {
+	tokens := tokenize(content)
+
+	from, to := 0, len(tokens)
+	if len(tokens) > snippetMaxWords {
+		first := 0
+		for i, t := range tokens {
+			if _, ok := terms[t.text]; ok {
+				first = i
+				break
+			}
+		}
+		from = max(0, min(first-snippetLeadingWords, len(tokens)-snippetMaxWords))
+		to = from + snippetMaxWords
+	}
+
+	start, end := 0, len(content)
+	if from > 0 {
+		start = tokens[from].start
+	}
+	if to < len(tokens) {
+		end = tokens[to-1].end
+	}
+
+	var b strings.Builder
+	pos := start
+	for _, t := range tokens[from:to] {
+		if _, ok := terms[t.text]; !ok {
+			continue
+		}
+		b.WriteString(content[pos:t.start])
+		b.WriteString(highlightStart)
+		b.WriteString(content[t.start:t.end])
+		b.WriteString(highlightStop)
+		pos = t.end
+	}
+	b.WriteString(content[pos:end])
+	return strings.TrimSpace(b.String())
+}
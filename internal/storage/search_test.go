@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tokens := tokenize("Hello, World! デプロイ完了 v2")
+
+	var texts []string
+	for _, tok := range tokens {
+		texts = append(texts, tok.text)
+	}
+	if got := strings.Join(texts, "|"); got != "hello|world|デプロイ完了|v2" {
+		t.Errorf("unexpected tokens: %s", got)
+	}
+
+	// 位置は元の本文を指す
+	if tokens[1].start != 7 || tokens[1].end != 12 {
+		t.Errorf("unexpected position: %+v", tokens[1])
+	}
+}
+
+func TestSearchIndex(t *testing.T) {
+	idx := newSearchIndex()
+	idx.add("1", "deploy the api")
+	idx.add("2", "deploy the web app")
+	idx.add("3", "lunch time")
+
+	got := idx.lookup(queryTerms("Deploy API"))
+	if len(got) != 1 {
+		t.Fatalf("expected 1 match, got %v", got)
+	}
+	if _, ok := got["1"]; !ok {
+		t.Errorf("expected message 1 to match, got %v", got)
+	}
+
+	if got := idx.lookup(queryTerms("deploy")); len(got) != 2 {
+		t.Errorf("expected 2 matches, got %v", got)
+	}
+	if got := idx.lookup(queryTerms("dinner")); len(got) != 0 {
+		t.Errorf("expected no matches, got %v", got)
+	}
+
+	// 取り除いた本文では見つからない
+	idx.remove("1", "deploy the api")
+	if got := idx.lookup(queryTerms("api")); len(got) != 0 {
+		t.Errorf("expected no matches after remove, got %v", got)
+	}
+	if _, ok := idx.postings["api"]; ok {
+		t.Error("expected empty posting list to be removed")
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	got := highlight("Deploy the API, then deploy again", queryTerms("deploy"))
+	want := "<mark>Deploy</mark> the API, then <mark>deploy</mark> again"
+	if got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	// 長い本文は一致した語の周辺だけを切り出す
+	words := make([]string, 100)
+	for i := range words {
+		words[i] = "word"
+	}
+	words[60] = "needle"
+	got = highlight(strings.Join(words, " "), queryTerms("needle"))
+	if !strings.Contains(got, "<mark>needle</mark>") {
+		t.Errorf("expected highlighted term, got %q", got)
+	}
+	if n := len(strings.Fields(got)); n != snippetMaxWords {
+		t.Errorf("expected %d words, got %d", snippetMaxWords, n)
+	}
+	if !strings.HasPrefix(got, strings.Repeat("word ", snippetLeadingWords)+"<mark>") {
+		t.Errorf("expected snippet to start shortly before the match, got %q", got)
+	}
+}
@@ -0,0 +1,671 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tasukuchiba/text_messaging_app/internal/models"
+	"github.com/tasukuchiba/text_messaging_app/internal/storage/migrations"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// SQLiteStorage はメッセージをSQLiteのファイルに保存するストレージ
+//
+// cgoを使わないドライバなので、PostgreSQLを用意せずに1台で動かす場合に使う。
+// SQLiteは同時に1つの書き込みしかできないため、接続は1本だけ使う。
+type SQLiteStorage struct {
+	db *sql.DB
+}
+
+// sqliteTimeLayout はSQLiteに日時を保存する形式
+// UTCの固定長にして、文字列の比較と時刻の比較を一致させる
+const sqliteTimeLayout = "2006-01-02T15:04:05.000000000Z"
+
+// NewSQLiteStorage は新しいSQLiteStorageを作成する
+// path が ":memory:" の場合はメモリ上のデータベースを使う
+// 接続確認とマイグレーションは ctx の期限内に行う
+func NewSQLiteStorage(ctx context.Context, path string) (*SQLiteStorage, error) {
+	dsn := "file:" + path + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// メモリ上のデータベースは接続ごとに別になるので、1本の接続を使い続ける
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+	db.SetConnMaxLifetime(0)
+
+	// 接続確認
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	storage := &SQLiteStorage{db: db}
+
+	// マイグレーション実行
+	if err := storage.migrate(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return storage, nil
+}
+
+// migrate は未適用のマイグレーションを適用する
+func (s *SQLiteStorage) migrate(ctx context.Context) error {
+	migrator, err := migrations.NewForDialect(s.db, migrations.SQLite)
+	if err != nil {
+		return err
+	}
+	_, err = migrator.Up(ctx)
+	return err
+}
+
+// Save はメッセージを保存する
+func (s *SQLiteStorage) Save(ctx context.Context, msg models.Message) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if msg.IsReply() {
+		// 日時は固定長の文字列なので、文字列の max() で新しい方が選ばれる
+		result, err := tx.ExecContext(ctx, `
+			UPDATE messages SET reply_count = reply_count + 1, last_reply_at = max(coalesce(last_reply_at, $2), $2)
+			WHERE id = $1 AND thread_root_id IS NULL
+		`, msg.ThreadRootID, formatSQLiteTime(msg.CreatedAt))
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrParentNotFound
+		}
+	}
+
+	query := `
+		INSERT INTO messages (id, room_id, sender, content, created_at, client_msg_id, parent_id, thread_root_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+	_, err = tx.ExecContext(ctx, query,
+		msg.ID, nullString(msg.RoomID), msg.Sender, msg.Content, formatSQLiteTime(msg.CreatedAt), nullString(msg.ClientMsgID),
+		nullString(msg.ParentID), nullString(msg.ThreadRootID))
+	if isSQLiteError(err, sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY) {
+		return ErrRoomNotFound
+	}
+	// 一意インデックスの違反はカラム名で区別する（SQLiteのエラーはインデックス名を含まない）
+	if isSQLiteError(err, sqlite3.SQLITE_CONSTRAINT_UNIQUE) && strings.Contains(err.Error(), "messages.client_msg_id") {
+		return ErrDuplicateMessage
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetAll は全てのメッセージを取得する
+func (s *SQLiteStorage) GetAll(ctx context.Context) ([]models.Message, error) {
+	query := `
+		SELECT ` + messageColumns + `
+		FROM messages
+		ORDER BY created_at ASC, id ASC
+	`
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanSQLiteMessages(rows)
+}
+
+// List はカーソルを使ってメッセージをページ単位で取得する
+func (s *SQLiteStorage) List(ctx context.Context, opts ListOptions) (MessagePage, error) {
+	q, err := parseListOptions(opts)
+	if err != nil {
+		return MessagePage{}, err
+	}
+
+	if q.roomID != "" {
+		if _, err := s.GetRoom(ctx, q.roomID); err != nil {
+			return MessagePage{}, err
+		}
+	}
+
+	if q.roomID == "" {
+		return s.listPage(ctx, q, "room_id IS NULL AND thread_root_id IS NULL")
+	}
+	return s.listPage(ctx, q, "room_id = $2 AND thread_root_id IS NULL", q.roomID)
+}
+
+// ListThread はスレッドへの返信をカーソルを使ってページ単位で取得する
+func (s *SQLiteStorage) ListThread(ctx context.Context, rootID string, opts ListOptions) (MessagePage, error) {
+	q, err := parseListOptions(opts)
+	if err != nil {
+		return MessagePage{}, err
+	}
+
+	root, err := s.GetByID(ctx, rootID)
+	if err != nil {
+		return MessagePage{}, err
+	}
+	if root.IsReply() {
+		return MessagePage{}, ErrNotFound
+	}
+	return s.listPage(ctx, q, "thread_root_id = $2", rootID)
+}
+
+// ListReplies はチャンネルの全てのスレッドへの返信をカーソルを使ってページ単位で取得する
+func (s *SQLiteStorage) ListReplies(ctx context.Context, opts ListOptions) (MessagePage, error) {
+	q, err := parseListOptions(opts)
+	if err != nil {
+		return MessagePage{}, err
+	}
+
+	if q.roomID == "" {
+		return s.listPage(ctx, q, "room_id IS NULL AND thread_root_id IS NOT NULL")
+	}
+	if _, err := s.GetRoom(ctx, q.roomID); err != nil {
+		return MessagePage{}, err
+	}
+	return s.listPage(ctx, q, "room_id = $2 AND thread_root_id IS NOT NULL", q.roomID)
+}
+
+// listPage は filter に一致するメッセージを q のカーソルと件数でページ単位で取得する
+// filter のプレースホルダは $2 から始め、値を args に渡す（$1 は件数に使う）
+func (s *SQLiteStorage) listPage(ctx context.Context, q listQuery, filter string, args ...any) (MessagePage, error) {
+	// 続きの有無を判定するために1件多く取得する
+	args = append([]any{q.limit + 1}, args...)
+	where := "WHERE " + filter
+
+	order := "DESC"
+	if q.forward {
+		order = "ASC"
+	}
+	if q.cursor != nil {
+		op := "<"
+		if q.forward {
+			op = ">"
+		}
+		args = append(args, formatSQLiteTime(q.cursor.CreatedAt), q.cursor.ID)
+		where += fmt.Sprintf(" AND (created_at, id) %s ($%d, $%d)", op, len(args)-1, len(args))
+	}
+
+	query := `
+		SELECT ` + messageColumns + `
+		FROM messages
+		` + where + `
+		ORDER BY created_at ` + order + `, id ` + order + `
+		LIMIT $1
+	`
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return MessagePage{}, err
+	}
+	defer rows.Close()
+
+	messages, err := scanSQLiteMessages(rows)
+	if err != nil {
+		return MessagePage{}, err
+	}
+
+	var page MessagePage
+	if len(messages) > q.limit {
+		messages = messages[:q.limit]
+		page.NextCursor = CursorOf(messages[len(messages)-1]).Encode()
+	}
+
+	// 古い順に揃える
+	if !q.forward {
+		slices.Reverse(messages)
+	}
+	page.Messages = messages
+	return page, nil
+}
+
+// GetByID は指定されたIDのメッセージを取得する
+func (s *SQLiteStorage) GetByID(ctx context.Context, id string) (models.Message, error) {
+	query := `
+		SELECT ` + messageColumns + `
+		FROM messages
+		WHERE id = $1
+	`
+	msg, err := scanSQLiteMessage(s.db.QueryRowContext(ctx, query, id))
+	if err == sql.ErrNoRows {
+		return models.Message{}, ErrNotFound
+	}
+	if err != nil {
+		return models.Message{}, err
+	}
+	return msg, nil
+}
+
+// GetByClientMsgID は送信者とクライアントが付けたIDでメッセージを取得する
+func (s *SQLiteStorage) GetByClientMsgID(ctx context.Context, sender, clientMsgID string) (models.Message, error) {
+	query := `
+		SELECT ` + messageColumns + `
+		FROM messages
+		WHERE sender = $1 AND client_msg_id = $2
+	`
+	msg, err := scanSQLiteMessage(s.db.QueryRowContext(ctx, query, sender, clientMsgID))
+	if err == sql.ErrNoRows {
+		return models.Message{}, ErrNotFound
+	}
+	if err != nil {
+		return models.Message{}, err
+	}
+	return msg, nil
+}
+
+// Delete は指定されたIDのメッセージを削除する
+// 編集履歴は外部キーの ON DELETE CASCADE で、検索用のインデックスはトリガーで削除される
+// thread_root_id には外部キーがないので、起点を削除する場合は返信も一緒に削除する
+func (s *SQLiteStorage) Delete(ctx context.Context, id string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var rootID sql.NullString
+	err = tx.QueryRowContext(ctx, `SELECT thread_root_id FROM messages WHERE id = $1`, id).Scan(&rootID)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM messages WHERE id = $1 OR thread_root_id = $1`, id); err != nil {
+		return err
+	}
+	if rootID.Valid {
+		if _, err := tx.ExecContext(ctx, threadStatsQuery, rootID.String); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UpdateContent はメッセージの本文を更新し、更新前の本文を編集履歴に残す
+// 接続が1本なので、トランザクションの間に他の更新が割り込むことはない
+func (s *SQLiteStorage) UpdateContent(ctx context.Context, id, content string, editedAt time.Time) (models.Message, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return models.Message{}, err
+	}
+	defer tx.Rollback()
+
+	var previous string
+	err = tx.QueryRowContext(ctx, `SELECT content FROM messages WHERE id = $1`, id).Scan(&previous)
+	if err == sql.ErrNoRows {
+		return models.Message{}, ErrNotFound
+	}
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO message_revisions (message_id, content, edited_at)
+		VALUES ($1, $2, $3)
+	`, id, previous, formatSQLiteTime(editedAt))
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	query := `
+		UPDATE messages SET content = $2, updated_at = $3
+		WHERE id = $1
+		RETURNING ` + messageColumns
+	msg, err := scanSQLiteMessage(tx.QueryRowContext(ctx, query, id, content, formatSQLiteTime(editedAt)))
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return models.Message{}, err
+	}
+	return msg, nil
+}
+
+// GetRevisions はメッセージの編集履歴を古い順に取得する
+func (s *SQLiteStorage) GetRevisions(ctx context.Context, id string) ([]models.MessageRevision, error) {
+	if _, err := s.GetByID(ctx, id); err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT message_id, content, edited_at
+		FROM message_revisions
+		WHERE message_id = $1
+		ORDER BY id ASC
+	`
+	rows, err := s.db.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []models.MessageRevision{}
+	for rows.Next() {
+		var rev models.MessageRevision
+		var editedAt sqliteTime
+		if err := rows.Scan(&rev.MessageID, &rev.Content, &editedAt); err != nil {
+			return nil, err
+		}
+		rev.EditedAt = editedAt.Time
+		revisions = append(revisions, rev)
+	}
+	return revisions, rows.Err()
+}
+
+// CreateRoom はルームを作成する
+func (s *SQLiteStorage) CreateRoom(ctx context.Context, room models.Room) error {
+	query := `
+		INSERT INTO rooms (id, name, created_at)
+		VALUES ($1, $2, $3)
+	`
+	_, err := s.db.ExecContext(ctx, query, room.ID, room.Name, formatSQLiteTime(room.CreatedAt))
+	return err
+}
+
+// GetRoom は指定されたIDのルームを取得する
+func (s *SQLiteStorage) GetRoom(ctx context.Context, id string) (models.Room, error) {
+	query := `SELECT id, name, created_at FROM rooms WHERE id = $1`
+	room, err := scanSQLiteRoom(s.db.QueryRowContext(ctx, query, id))
+	if err == sql.ErrNoRows {
+		return models.Room{}, ErrRoomNotFound
+	}
+	if err != nil {
+		return models.Room{}, err
+	}
+	return room, nil
+}
+
+// ListRooms は全てのルームを作成日時順に取得する
+func (s *SQLiteStorage) ListRooms(ctx context.Context) ([]models.Room, error) {
+	query := `SELECT id, name, created_at FROM rooms ORDER BY created_at ASC, id ASC`
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rooms := []models.Room{}
+	for rows.Next() {
+		room, err := scanSQLiteRoom(rows)
+		if err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
+// CreateUser はユーザーを作成する
+func (s *SQLiteStorage) CreateUser(ctx context.Context, user models.User) error {
+	query := `
+		INSERT INTO users (id, username, password_hash, created_at)
+		VALUES ($1, $2, $3, $4)
+	`
+	_, err := s.db.ExecContext(ctx, query, user.ID, user.Username, user.PasswordHash, formatSQLiteTime(user.CreatedAt))
+	if isSQLiteError(err, sqlite3.SQLITE_CONSTRAINT_UNIQUE) {
+		return ErrUserExists
+	}
+	return err
+}
+
+// GetUserByUsername はユーザー名でユーザーを取得する
+func (s *SQLiteStorage) GetUserByUsername(ctx context.Context, username string) (models.User, error) {
+	query := `SELECT id, username, password_hash, created_at FROM users WHERE username = $1`
+	var user models.User
+	var createdAt sqliteTime
+	err := s.db.QueryRowContext(ctx, query, username).Scan(&user.ID, &user.Username, &user.PasswordHash, &createdAt)
+	if err == sql.ErrNoRows {
+		return models.User{}, ErrUserNotFound
+	}
+	if err != nil {
+		return models.User{}, err
+	}
+	user.CreatedAt = createdAt.Time
+	return user, nil
+}
+
+// Search はFTS5のインデックスを使って本文の全文検索を行い、新しい順に取得する
+func (s *SQLiteStorage) Search(ctx context.Context, opts SearchOptions) ([]SearchResult, error) {
+	results := make([]SearchResult, 0)
+	terms := queryTerms(opts.Query)
+	if len(terms) == 0 {
+		return results, nil
+	}
+
+	args := []any{ftsMatchQuery(terms), normalizeLimit(opts.Limit)}
+	where := "id IN (SELECT id FROM messages_fts WHERE messages_fts MATCH $1)"
+	if opts.Sender != "" {
+		args = append(args, opts.Sender)
+		where += fmt.Sprintf(" AND sender = $%d", len(args))
+	}
+	if !opts.Since.IsZero() {
+		args = append(args, formatSQLiteTime(opts.Since))
+		where += fmt.Sprintf(" AND created_at >= $%d", len(args))
+	}
+	if !opts.Until.IsZero() {
+		args = append(args, formatSQLiteTime(opts.Until))
+		where += fmt.Sprintf(" AND created_at < $%d", len(args))
+	}
+
+	query := `
+		SELECT ` + messageColumns + `
+		FROM messages
+		WHERE ` + where + `
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2
+	`
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		msg, err := scanSQLiteMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		// 抜粋は MemoryStorage と同じ規則で作る
+		results = append(results, SearchResult{Message: msg, Snippet: highlight(msg.Content, terms)})
+	}
+	return results, rows.Err()
+}
+
+// AddReaction はメッセージに username の絵文字リアクションを追加する
+func (s *SQLiteStorage) AddReaction(ctx context.Context, messageID, emoji, username string, createdAt time.Time) error {
+	query := `
+		INSERT INTO reactions (message_id, emoji, username, created_at)
+		VALUES ($1, $2, $3, $4)
+	`
+	_, err := s.db.ExecContext(ctx, query, messageID, emoji, username, formatSQLiteTime(createdAt))
+	if isSQLiteError(err, sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY) {
+		return ErrNotFound
+	}
+	if isSQLiteError(err, sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY) {
+		return ErrReactionExists
+	}
+	return err
+}
+
+// RemoveReaction はメッセージから username の絵文字リアクションを削除する
+func (s *SQLiteStorage) RemoveReaction(ctx context.Context, messageID, emoji, username string) error {
+	query := `DELETE FROM reactions WHERE message_id = $1 AND emoji = $2 AND username = $3`
+	result, err := s.db.ExecContext(ctx, query, messageID, emoji, username)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n > 0 {
+		return nil
+	}
+
+	// 削除する行がなかった場合は、メッセージがないのかリアクションがないのかを区別する
+	if _, err := s.GetByID(ctx, messageID); err != nil {
+		return err
+	}
+	return ErrReactionNotFound
+}
+
+// ListReactions はメッセージごとのリアクションを絵文字ごとに集計して取得する
+// メッセージIDはJSONの配列にして json_each で展開する
+func (s *SQLiteStorage) ListReactions(ctx context.Context, messageIDs []string, viewer string) (map[string][]models.Reaction, error) {
+	result := make(map[string][]models.Reaction)
+	if len(messageIDs) == 0 {
+		return result, nil
+	}
+
+	ids, err := json.Marshal(messageIDs)
+	if err != nil {
+		return nil, err
+	}
+	query := `
+		SELECT message_id, emoji, COUNT(*), max(username = $2)
+		FROM reactions
+		WHERE message_id IN (SELECT value FROM json_each($1))
+		GROUP BY message_id, emoji
+		ORDER BY message_id, MIN(created_at), emoji
+	`
+	rows, err := s.db.QueryContext(ctx, query, string(ids), viewer)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID string
+		var reaction models.Reaction
+		if err := rows.Scan(&messageID, &reaction.Emoji, &reaction.Count, &reaction.ReactedByMe); err != nil {
+			return nil, err
+		}
+		result[messageID] = append(result[messageID], reaction)
+	}
+	return result, rows.Err()
+}
+
+// ftsMatchQuery は検索語を全て含む行に一致するFTS5の検索式を作る
+// 語は文字と数字だけからなるので、二重引用符で囲めば演算子として解釈されない
+func ftsMatchQuery(terms map[string]struct{}) string {
+	quoted := make([]string, 0, len(terms))
+	for term := range terms {
+		quoted = append(quoted, `"`+term+`"`)
+	}
+	slices.Sort(quoted)
+	return strings.Join(quoted, " AND ")
+}
+
+// sqliteTime はSQLiteに保存した日時の文字列を読み込む
+type sqliteTime struct {
+	Time  time.Time
+	Valid bool
+}
+
+// Scan は sql.Scanner の実装
+func (t *sqliteTime) Scan(src any) error {
+	var s string
+	switch v := src.(type) {
+	case nil:
+		*t = sqliteTime{}
+		return nil
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into time", src)
+	}
+	parsed, err := time.Parse(sqliteTimeLayout, s)
+	if err != nil {
+		return err
+	}
+	*t = sqliteTime{Time: parsed, Valid: true}
+	return nil
+}
+
+// formatSQLiteTime は日時をSQLiteに保存する形式の文字列にする
+func formatSQLiteTime(t time.Time) string {
+	return t.UTC().Format(sqliteTimeLayout)
+}
+
+// scanSQLiteMessage は messageColumns の順に並んだ1行をメッセージに変換する
+func scanSQLiteMessage(row rowScanner) (models.Message, error) {
+	var msg models.Message
+	var roomID sql.NullString
+	var createdAt, updatedAt, lastReplyAt sqliteTime
+	var clientMsgID, parentID, threadRootID sql.NullString
+	if err := row.Scan(&msg.ID, &roomID, &msg.Sender, &msg.Content, &createdAt, &updatedAt, &clientMsgID,
+		&parentID, &threadRootID, &msg.ReplyCount, &lastReplyAt); err != nil {
+		return models.Message{}, err
+	}
+	msg.RoomID = roomID.String
+	msg.ClientMsgID = clientMsgID.String
+	msg.ParentID = parentID.String
+	msg.ThreadRootID = threadRootID.String
+	msg.CreatedAt = createdAt.Time
+	if updatedAt.Valid {
+		msg.Edited = true
+		msg.UpdatedAt = &updatedAt.Time
+	}
+	if lastReplyAt.Valid {
+		msg.LastReplyAt = &lastReplyAt.Time
+	}
+	return msg, nil
+}
+
+// scanSQLiteMessages は行セットをメッセージのスライスに変換する
+func scanSQLiteMessages(rows *sql.Rows) ([]models.Message, error) {
+	messages := []models.Message{}
+	for rows.Next() {
+		msg, err := scanSQLiteMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// scanSQLiteRoom は id, name, created_at の1行をルームに変換する
+func scanSQLiteRoom(row rowScanner) (models.Room, error) {
+	var room models.Room
+	var createdAt sqliteTime
+	if err := row.Scan(&room.ID, &room.Name, &createdAt); err != nil {
+		return models.Room{}, err
+	}
+	room.CreatedAt = createdAt.Time
+	return room, nil
+}
+
+// isSQLiteError は指定した拡張エラーコードのSQLiteのエラーかどうかを判定する
+func isSQLiteError(err error, code int) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == code
+}
+
+// Ping はデータベースに接続できるか確認する
+func (s *SQLiteStorage) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// Close はデータベース接続を閉じる
+func (s *SQLiteStorage) Close() error {
+	return s.db.Close()
+}
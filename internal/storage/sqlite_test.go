@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tasukuchiba/text_messaging_app/internal/models"
+)
+
+// 振る舞いのテストは conformance_test.go の共通テストで行う
+
+// newTestSQLiteStorage はテスト用の一時ファイルにSQLiteStorageを作成する
+func newTestSQLiteStorage(t *testing.T) *SQLiteStorage {
+	t.Helper()
+	store, err := NewSQLiteStorage(context.Background(), filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewSQLiteStorage failed: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// TestSQLiteStorage_ImplementsStorage はSQLiteStorageがStorageインターフェースを実装していることを確認する
+func TestSQLiteStorage_ImplementsStorage(t *testing.T) {
+	var _ Storage = (*SQLiteStorage)(nil)
+}
+
+func TestSQLiteStorage_Ping(t *testing.T) {
+	store := newTestSQLiteStorage(t)
+	if err := Ping(context.Background(), store); err != nil {
+		t.Errorf("Expected nil, got %v", err)
+	}
+
+	// 閉じた後は接続できない
+	store.Close()
+	if err := Ping(context.Background(), store); err == nil {
+		t.Error("Expected error after Close")
+	}
+}
+
+func TestSQLiteStorage_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.db")
+	store, err := NewSQLiteStorage(context.Background(), path)
+	if err != nil {
+		t.Fatalf("NewSQLiteStorage failed: %v", err)
+	}
+	createdAt := time.Date(2026, 1, 1, 9, 0, 0, 123456789, time.FixedZone("JST", 9*60*60))
+	store.Save(context.Background(), models.Message{ID: "1", Sender: "alice", Content: "こんにちは 世界", CreatedAt: createdAt})
+	store.Close()
+
+	// 開き直しても保存した内容が残り、マイグレーションは再適用されない
+	store, err = NewSQLiteStorage(context.Background(), path)
+	if err != nil {
+		t.Fatalf("NewSQLiteStorage failed on reopen: %v", err)
+	}
+	defer store.Close()
+
+	msg, err := store.GetByID(context.Background(), "1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !msg.CreatedAt.Equal(createdAt) {
+		t.Errorf("expected created_at %v, got %v", createdAt, msg.CreatedAt)
+	}
+
+	// 日本語の本文も検索できる
+	results, err := store.Search(context.Background(), SearchOptions{Query: "世界"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(results) != 1 || results[0].Snippet != "こんにちは <mark>世界</mark>" {
+		t.Errorf("unexpected results: %+v", results)
+	}
+}
@@ -1,7 +1,9 @@
 package storage
 
 import (
+	"context"
 	"errors"
+	"time"
 
 	"github.com/tasukuchiba/text_messaging_app/internal/models"
 )
@@ -9,17 +11,211 @@ import (
 // ErrNotFound はメッセージが見つからない場合のエラー
 var ErrNotFound = errors.New("message not found")
 
+// ErrRoomNotFound はルームが見つからない場合のエラー
+var ErrRoomNotFound = errors.New("room not found")
+
+// ErrUserNotFound はユーザーが見つからない場合のエラー
+var ErrUserNotFound = errors.New("user not found")
+
+// ErrUserExists は同じユーザー名のユーザーが既に存在する場合のエラー
+var ErrUserExists = errors.New("user already exists")
+
+// ErrDuplicateMessage は同じ送信者が同じ client_msg_id のメッセージを既に保存している場合のエラー
+var ErrDuplicateMessage = errors.New("message already exists")
+
+// ErrParentNotFound は返信先のメッセージが見つからない場合のエラー
+var ErrParentNotFound = errors.New("parent message not found")
+
+// ErrReactionExists は同じユーザーが同じ絵文字で既にリアクションしている場合のエラー
+var ErrReactionExists = errors.New("reaction already exists")
+
+// ErrReactionNotFound はリアクションが見つからない場合のエラー
+var ErrReactionNotFound = errors.New("reaction not found")
+
+// ErrInvalidCursor はページング用カーソルが不正な場合のエラー
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+const (
+	// DefaultListLimit は件数指定がない場合の取得件数
+	DefaultListLimit = 50
+
+	// MaxListLimit は一度に取得できる最大件数
+	MaxListLimit = 200
+)
+
+// ListOptions はメッセージ一覧の取得条件
+//
+// After を指定すると、そのカーソルより新しいメッセージを古い順に取得する。
+// それ以外の場合は Before（未指定なら最新）より古いメッセージのうち
+// 新しいものから Limit 件を取得する。いずれの場合も結果は古い順に並ぶ。
+type ListOptions struct {
+	// 対象のルームID（空の場合は全体チャンネル）
+	RoomID string
+
+	// 取得件数（0以下なら DefaultListLimit、MaxListLimit を超える場合は切り詰める）
+	Limit int
+
+	// このカーソルより古いメッセージを取得する
+	Before string
+
+	// このカーソルより新しいメッセージを取得する
+	After string
+}
+
+// MessagePage はページングされたメッセージ一覧
+type MessagePage struct {
+	// 古い順に並んだメッセージ
+	Messages []models.Message
+
+	// 同じ方向の続きを取得するためのカーソル（続きがなければ空）
+	NextCursor string
+}
+
+// SearchOptions はメッセージ検索の条件
+type SearchOptions struct {
+	// 検索語（空白区切りの全ての語を含むメッセージが対象）
+	Query string
+
+	// 送信者で絞り込む（空の場合は全員）
+	Sender string
+
+	// この日時以降に作成されたメッセージに絞り込む（ゼロ値なら無制限）
+	Since time.Time
+
+	// この日時より前に作成されたメッセージに絞り込む（ゼロ値なら無制限）
+	Until time.Time
+
+	// 取得件数（0以下なら DefaultListLimit、MaxListLimit を超える場合は切り詰める）
+	Limit int
+}
+
+// SearchResult は検索にヒットしたメッセージ
+type SearchResult struct {
+	Message models.Message `json:"message"`
+
+	// 一致した語を <mark> と </mark> で囲んだ本文の抜粋（本文はエスケープしない）
+	Snippet string `json:"snippet"`
+}
+
 // Storage はメッセージストレージのインターフェース
 type Storage interface {
 	// Save はメッセージを保存する
-	Save(msg models.Message) error
+	// 同じ送信者の同じ ClientMsgID のメッセージが既にある場合は ErrDuplicateMessage を返す
+	// ThreadRootID のメッセージがない場合は ErrParentNotFound を返す。返信を保存すると起点の返信数と最後の返信日時を更新する
+	Save(ctx context.Context, msg models.Message) error
 
-	// GetAll は全てのメッセージを取得する
-	GetAll() ([]models.Message, error)
+	// GetAll は全てのメッセージを取得する（スレッドへの返信を含む）
+	GetAll(ctx context.Context) ([]models.Message, error)
+
+	// List はカーソルを使ってメッセージをページ単位で取得する（スレッドへの返信は含まない）
+	List(ctx context.Context, opts ListOptions) (MessagePage, error)
+
+	// ListThread はスレッドへの返信をカーソルを使ってページ単位で取得する（opts.RoomID は使わない）
+	// 起点のメッセージがない場合は ErrNotFound を返す
+	ListThread(ctx context.Context, rootID string, opts ListOptions) (MessagePage, error)
+
+	// ListReplies はチャンネル（opts.RoomID）の全てのスレッドへの返信をカーソルを使ってページ単位で取得する
+	// ルームがない場合は ErrRoomNotFound を返す
+	ListReplies(ctx context.Context, opts ListOptions) (MessagePage, error)
 
 	// GetByID は指定されたIDのメッセージを取得する
-	GetByID(id string) (models.Message, error)
+	GetByID(ctx context.Context, id string) (models.Message, error)
+
+	// GetByClientMsgID は送信者とクライアントが付けたIDでメッセージを取得する
+	GetByClientMsgID(ctx context.Context, sender, clientMsgID string) (models.Message, error)
 
 	// Delete は指定されたIDのメッセージを削除する
-	Delete(id string) error
+	// スレッドの起点を削除すると返信も削除し、返信を削除すると起点の返信数と最後の返信日時を更新する
+	Delete(ctx context.Context, id string) error
+
+	// UpdateContent はメッセージの本文を更新し、更新前の本文を編集履歴に残す
+	UpdateContent(ctx context.Context, id, content string, editedAt time.Time) (models.Message, error)
+
+	// GetRevisions はメッセージの編集履歴を古い順に取得する
+	GetRevisions(ctx context.Context, id string) ([]models.MessageRevision, error)
+
+	// CreateRoom はルームを作成する
+	CreateRoom(ctx context.Context, room models.Room) error
+
+	// GetRoom は指定されたIDのルームを取得する
+	GetRoom(ctx context.Context, id string) (models.Room, error)
+
+	// ListRooms は全てのルームを作成日時順に取得する
+	ListRooms(ctx context.Context) ([]models.Room, error)
+
+	// CreateUser はユーザーを作成する（ユーザー名が重複する場合は ErrUserExists）
+	CreateUser(ctx context.Context, user models.User) error
+
+	// GetUserByUsername はユーザー名でユーザーを取得する
+	GetUserByUsername(ctx context.Context, username string) (models.User, error)
+
+	// Search は本文の全文検索でメッセージを新しい順に取得する
+	Search(ctx context.Context, opts SearchOptions) ([]SearchResult, error)
+
+	// AddReaction はメッセージに username の絵文字リアクションを追加する
+	// メッセージがない場合は ErrNotFound、同じリアクションが既にある場合は ErrReactionExists を返す
+	AddReaction(ctx context.Context, messageID, emoji, username string, createdAt time.Time) error
+
+	// RemoveReaction はメッセージから username の絵文字リアクションを削除する
+	// メッセージがない場合は ErrNotFound、リアクションがない場合は ErrReactionNotFound を返す
+	RemoveReaction(ctx context.Context, messageID, emoji, username string) error
+
+	// ListReactions はメッセージごとのリアクションを絵文字ごとに集計して取得する
+	// 絵文字は最初にリアクションされた順に並び、viewer がリアクションしている絵文字は ReactedByMe になる
+	// リアクションのないメッセージはマップに含まない
+	ListReactions(ctx context.Context, messageIDs []string, viewer string) (map[string][]models.Reaction, error)
+}
+
+// pinger はデータベースへの接続を確認できるストレージ
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Ping はストレージが利用できるか確認する
+// 接続を持たないストレージ（MemoryStorage など）は常に利用できるものとして nil を返す
+func Ping(ctx context.Context, s Storage) error {
+	if p, ok := s.(pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// listQuery はデコード済みの一覧取得条件
+type listQuery struct {
+	roomID  string
+	limit   int
+	forward bool
+	cursor  *Cursor
+}
+
+// normalizeLimit は取得件数をデフォルト値と上限の範囲に収める
+func normalizeLimit(limit int) int {
+	if limit <= 0 {
+		return DefaultListLimit
+	}
+	return min(limit, MaxListLimit)
+}
+
+// parseListOptions は ListOptions を検証してバックエンド共通の形式に変換する
+func parseListOptions(opts ListOptions) (listQuery, error) {
+	q := listQuery{roomID: opts.RoomID, limit: normalizeLimit(opts.Limit)}
+
+	if opts.Before != "" && opts.After != "" {
+		return listQuery{}, ErrInvalidCursor
+	}
+
+	raw := opts.Before
+	if opts.After != "" {
+		raw = opts.After
+		q.forward = true
+	}
+	if raw != "" {
+		c, err := DecodeCursor(raw)
+		if err != nil {
+			return listQuery{}, err
+		}
+		q.cursor = &c
+	}
+
+	return q, nil
 }
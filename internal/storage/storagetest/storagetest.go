@@ -0,0 +1,945 @@
+// Package storagetest は storage.Storage の実装が満たすべき振る舞いを確認する共通テストを提供する
+//
+// 新しいバックエンドを追加したら、そのテストから RunConformance を呼び出す。
+//
+//	func TestMyStorage_Conformance(t *testing.T) {
+//		storagetest.RunConformance(t, func(t *testing.T) storage.Storage {
+//			return newTestMyStorage(t)
+//		})
+//	}
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tasukuchiba/text_messaging_app/internal/models"
+	"github.com/tasukuchiba/text_messaging_app/internal/storage"
+)
+
+// Factory は空のストレージを作成する
+// 後片付けが必要な場合は t.Cleanup に登録する
+type Factory func(t *testing.T) storage.Storage
+
+// base はテストで使うメッセージの作成日時の基準
+// PostgreSQL の精度（マイクロ秒）で表せる値にしておく
+var base = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// RunConformance は newStorage で作成したストレージに対して共通テストを実行する
+// サブテストごとに newStorage を呼び出すため、各サブテストは空のストレージから始まる
+func RunConformance(t *testing.T, newStorage Factory) {
+	t.Helper()
+
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s storage.Storage)
+	}{
+		{"SaveAndGetAll", testSaveAndGetAll},
+		{"GetByID", testGetByID},
+		{"Delete", testDelete},
+		{"ClientMsgID", testClientMsgID},
+		{"ReturnsCopies", testReturnsCopies},
+		{"List", testList},
+		{"Rooms", testRooms},
+		{"UpdateContent", testUpdateContent},
+		{"Threads", testThreads},
+		{"DeleteThread", testDeleteThread},
+		{"ListReplies", testListReplies},
+		{"Reactions", testReactions},
+		{"Users", testUsers},
+		{"Search", testSearch},
+		{"ConcurrentSave", testConcurrentSave},
+		{"ConcurrentUpdateContent", testConcurrentUpdateContent},
+		{"Ping", testPing},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newStorage(t))
+		})
+	}
+}
+
+// ids はメッセージIDをカンマ区切りで連結する
+func ids(messages []models.Message) string {
+	ids := make([]string, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+	}
+	return strings.Join(ids, ",")
+}
+
+// resultIDs は検索結果のメッセージIDをカンマ区切りで連結する
+func resultIDs(results []storage.SearchResult) string {
+	ids := make([]string, len(results))
+	for i, r := range results {
+		ids[i] = r.Message.ID
+	}
+	return strings.Join(ids, ",")
+}
+
+// mustSave はメッセージを保存し、失敗したらテストを中断する
+func mustSave(t *testing.T, s storage.Storage, msg models.Message) {
+	t.Helper()
+	if err := s.Save(context.Background(), msg); err != nil {
+		t.Fatalf("Save(%s) failed: %v", msg.ID, err)
+	}
+}
+
+// mustCreateRoom はルームを作成し、失敗したらテストを中断する
+func mustCreateRoom(t *testing.T, s storage.Storage, room models.Room) {
+	t.Helper()
+	if err := s.CreateRoom(context.Background(), room); err != nil {
+		t.Fatalf("CreateRoom(%s) failed: %v", room.ID, err)
+	}
+}
+
+func testSaveAndGetAll(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	// 空の状態
+	messages, err := s.GetAll(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(messages) != 0 {
+		t.Errorf("expected 0 messages, got %d", len(messages))
+	}
+
+	// 保存順と作成日時順が異なっていても作成日時順、同時刻ならID順に並ぶ
+	mustCreateRoom(t, s, models.Room{ID: "room-1", Name: "general", CreatedAt: base})
+	mustSave(t, s, models.Message{ID: "3", Sender: "alice", Content: "c", CreatedAt: base.Add(2 * time.Second)})
+	mustSave(t, s, models.Message{ID: "2", RoomID: "room-1", Sender: "bob", Content: "b", CreatedAt: base.Add(time.Second)})
+	mustSave(t, s, models.Message{ID: "1b", Sender: "alice", Content: "a2", CreatedAt: base})
+	mustSave(t, s, models.Message{ID: "1a", Sender: "alice", Content: "a1", CreatedAt: base})
+
+	messages, err = s.GetAll(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := ids(messages); got != "1a,1b,2,3" {
+		t.Fatalf("expected 1a,1b,2,3, got %s", got)
+	}
+
+	// 保存した内容がそのまま読める
+	msg := messages[2]
+	if msg.RoomID != "room-1" || msg.Sender != "bob" || msg.Content != "b" || !msg.CreatedAt.Equal(base.Add(time.Second)) {
+		t.Errorf("unexpected message: %+v", msg)
+	}
+	if msg.Edited || msg.UpdatedAt != nil {
+		t.Errorf("expected unedited message, got %+v", msg)
+	}
+}
+
+func testGetByID(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	mustSave(t, s, models.Message{ID: "test-id", Sender: "alice", Content: "Hello", CreatedAt: base})
+
+	msg, err := s.GetByID(ctx, "test-id")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if msg.Sender != "alice" || msg.Content != "Hello" || !msg.CreatedAt.Equal(base) {
+		t.Errorf("unexpected message: %+v", msg)
+	}
+
+	if _, err := s.GetByID(ctx, "non-existent"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func testDelete(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	mustSave(t, s, models.Message{ID: "test-id", Sender: "alice", Content: "Hello", CreatedAt: base})
+	mustSave(t, s, models.Message{ID: "other", Sender: "bob", Content: "Hi", CreatedAt: base.Add(time.Second)})
+
+	if err := s.Delete(ctx, "test-id"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// 削除後は取得できず、他のメッセージは残る
+	if _, err := s.GetByID(ctx, "test-id"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expected ErrNotFound after delete, got %v", err)
+	}
+	messages, err := s.GetAll(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := ids(messages); got != "other" {
+		t.Errorf("expected other, got %s", got)
+	}
+
+	// 存在しないIDと削除済みのIDの削除
+	if err := s.Delete(ctx, "non-existent"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if err := s.Delete(ctx, "test-id"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for deleted message, got %v", err)
+	}
+}
+
+func testClientMsgID(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	mustSave(t, s, models.Message{ID: "1", Sender: "alice", Content: "Hello", CreatedAt: base, ClientMsgID: "c-1"})
+
+	// 同じ送信者の同じ client_msg_id は保存できない
+	err := s.Save(ctx, models.Message{ID: "2", Sender: "alice", Content: "Hello", CreatedAt: base, ClientMsgID: "c-1"})
+	if !errors.Is(err, storage.ErrDuplicateMessage) {
+		t.Errorf("expected ErrDuplicateMessage, got %v", err)
+	}
+
+	// 送信者が違えば同じ client_msg_id でも保存できる
+	if err := s.Save(ctx, models.Message{ID: "3", Sender: "bob", Content: "Hello", CreatedAt: base, ClientMsgID: "c-1"}); err != nil {
+		t.Errorf("unexpected error for another sender: %v", err)
+	}
+
+	// client_msg_id のないメッセージは重複扱いしない
+	mustSave(t, s, models.Message{ID: "4", Sender: "alice", Content: "Hello", CreatedAt: base})
+	mustSave(t, s, models.Message{ID: "5", Sender: "alice", Content: "Hello", CreatedAt: base})
+
+	msg, err := s.GetByClientMsgID(ctx, "alice", "c-1")
+	if err != nil {
+		t.Fatalf("GetByClientMsgID failed: %v", err)
+	}
+	if msg.ID != "1" || msg.ClientMsgID != "c-1" {
+		t.Errorf("expected message 1 with client_msg_id c-1, got %+v", msg)
+	}
+
+	if _, err := s.GetByClientMsgID(ctx, "alice", "unknown"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	// 削除すると同じ client_msg_id で保存し直せる
+	if err := s.Delete(ctx, "1"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := s.GetByClientMsgID(ctx, "alice", "c-1"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expected ErrNotFound after delete, got %v", err)
+	}
+	if err := s.Save(ctx, models.Message{ID: "6", Sender: "alice", Content: "Hello", CreatedAt: base, ClientMsgID: "c-1"}); err != nil {
+		t.Errorf("unexpected error after delete: %v", err)
+	}
+}
+
+func testReturnsCopies(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	mustSave(t, s, models.Message{ID: "1", Sender: "alice", Content: "Hello", CreatedAt: base})
+	if _, err := s.UpdateContent(ctx, "1", "Hello!", base.Add(time.Minute)); err != nil {
+		t.Fatalf("UpdateContent failed: %v", err)
+	}
+
+	// 返された値を書き換えても保存されている内容は変わらない
+	messages, err := s.GetAll(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	messages[0].Content = "Modified by GetAll"
+
+	page, err := s.List(ctx, storage.ListOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	page.Messages[0].Content = "Modified by List"
+
+	revisions, err := s.GetRevisions(ctx, "1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	revisions[0].Content = "Modified by GetRevisions"
+
+	msg, err := s.GetByID(ctx, "1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if msg.Content != "Hello!" {
+		t.Errorf("expected stored content to be unchanged, got %q", msg.Content)
+	}
+	revisions, err = s.GetRevisions(ctx, "1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(revisions) != 1 || revisions[0].Content != "Hello" {
+		t.Errorf("expected stored revisions to be unchanged, got %+v", revisions)
+	}
+}
+
+func testList(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	// 空の一覧
+	page, err := s.List(ctx, storage.ListOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(page.Messages) != 0 || page.NextCursor != "" {
+		t.Errorf("expected empty page, got %+v", page)
+	}
+
+	mustSave(t, s, models.Message{ID: "3", Sender: "alice", Content: "c", CreatedAt: base.Add(3 * time.Second)})
+	mustSave(t, s, models.Message{ID: "1", Sender: "alice", Content: "a", CreatedAt: base.Add(1 * time.Second)})
+	mustSave(t, s, models.Message{ID: "2", Sender: "bob", Content: "b", CreatedAt: base.Add(2 * time.Second)})
+
+	// 最新の2件
+	page, err = s.List(ctx, storage.ListOptions{Limit: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := ids(page.Messages); got != "2,3" {
+		t.Fatalf("expected 2,3, got %s", got)
+	}
+	if page.NextCursor == "" {
+		t.Fatal("expected next cursor")
+	}
+
+	// 残りの1件
+	page, err = s.List(ctx, storage.ListOptions{Limit: 2, Before: page.NextCursor})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := ids(page.Messages); got != "1" {
+		t.Fatalf("expected 1, got %s", got)
+	}
+	if page.NextCursor != "" {
+		t.Errorf("expected empty next cursor, got '%s'", page.NextCursor)
+	}
+
+	// 先頭から新しい方向へ
+	after := storage.CursorOf(page.Messages[0]).Encode()
+	page, err = s.List(ctx, storage.ListOptions{Limit: 1, After: after})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := ids(page.Messages); got != "2" {
+		t.Fatalf("expected 2, got %s", got)
+	}
+	if page.NextCursor == "" {
+		t.Fatal("expected next cursor")
+	}
+
+	page, err = s.List(ctx, storage.ListOptions{Limit: 5, After: page.NextCursor})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := ids(page.Messages); got != "3" {
+		t.Fatalf("expected 3, got %s", got)
+	}
+	if page.NextCursor != "" {
+		t.Errorf("expected empty next cursor, got '%s'", page.NextCursor)
+	}
+
+	// 不正なカーソル
+	if _, err := s.List(ctx, storage.ListOptions{Before: "invalid"}); !errors.Is(err, storage.ErrInvalidCursor) {
+		t.Errorf("expected ErrInvalidCursor, got %v", err)
+	}
+	if _, err := s.List(ctx, storage.ListOptions{Before: after, After: after}); !errors.Is(err, storage.ErrInvalidCursor) {
+		t.Errorf("expected ErrInvalidCursor for both cursors, got %v", err)
+	}
+}
+
+func testRooms(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	// 存在しないルームへの保存は失敗する
+	err := s.Save(ctx, models.Message{ID: "1", RoomID: "room-1", Sender: "alice", Content: "Hello", CreatedAt: base})
+	if !errors.Is(err, storage.ErrRoomNotFound) {
+		t.Errorf("expected ErrRoomNotFound, got %v", err)
+	}
+
+	mustCreateRoom(t, s, models.Room{ID: "room-2", Name: "random", CreatedAt: base.Add(time.Second)})
+	mustCreateRoom(t, s, models.Room{ID: "room-1", Name: "general", CreatedAt: base})
+
+	rooms, err := s.ListRooms(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rooms) != 2 || rooms[0].ID != "room-1" || rooms[1].ID != "room-2" {
+		t.Errorf("unexpected rooms: %+v", rooms)
+	}
+
+	room, err := s.GetRoom(ctx, "room-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if room.Name != "general" || !room.CreatedAt.Equal(base) {
+		t.Errorf("unexpected room: %+v", room)
+	}
+
+	if _, err := s.GetRoom(ctx, "non-existent"); !errors.Is(err, storage.ErrRoomNotFound) {
+		t.Errorf("expected ErrRoomNotFound, got %v", err)
+	}
+
+	// ルームごとに一覧が分かれる
+	mustSave(t, s, models.Message{ID: "1", RoomID: "room-1", Sender: "alice", Content: "Hello", CreatedAt: base})
+	mustSave(t, s, models.Message{ID: "2", Sender: "bob", Content: "Global", CreatedAt: base})
+
+	page, err := s.List(ctx, storage.ListOptions{RoomID: "room-1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := ids(page.Messages); got != "1" || page.Messages[0].RoomID != "room-1" {
+		t.Errorf("unexpected room messages: %+v", page.Messages)
+	}
+
+	page, err = s.List(ctx, storage.ListOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := ids(page.Messages); got != "2" {
+		t.Errorf("unexpected global messages: %+v", page.Messages)
+	}
+
+	page, err = s.List(ctx, storage.ListOptions{RoomID: "room-2"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(page.Messages) != 0 {
+		t.Errorf("expected empty room, got %+v", page.Messages)
+	}
+
+	if _, err := s.List(ctx, storage.ListOptions{RoomID: "non-existent"}); !errors.Is(err, storage.ErrRoomNotFound) {
+		t.Errorf("expected ErrRoomNotFound, got %v", err)
+	}
+
+	// GetByID と Delete はルームをまたいで動作する
+	if _, err := s.GetByID(ctx, "1"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := s.Delete(ctx, "1"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func testUpdateContent(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	mustSave(t, s, models.Message{ID: "test-id", Sender: "alice", Content: "Helo", CreatedAt: base})
+
+	editedAt := base.Add(time.Minute)
+	msg, err := s.UpdateContent(ctx, "test-id", "Hello", editedAt)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if msg.Content != "Hello" || !msg.Edited || msg.UpdatedAt == nil || !msg.UpdatedAt.Equal(editedAt) {
+		t.Errorf("unexpected updated message: %+v", msg)
+	}
+	if msg.Sender != "alice" || !msg.CreatedAt.Equal(base) {
+		t.Errorf("expected other fields to be kept, got %+v", msg)
+	}
+
+	stored, err := s.GetByID(ctx, "test-id")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stored.Content != "Hello" || !stored.Edited {
+		t.Errorf("expected stored message to be updated, got %+v", stored)
+	}
+
+	if _, err := s.UpdateContent(ctx, "test-id", "Hello!", editedAt.Add(time.Minute)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	revisions, err := s.GetRevisions(ctx, "test-id")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(revisions) != 2 || revisions[0].Content != "Helo" || revisions[1].Content != "Hello" {
+		t.Fatalf("unexpected revisions: %+v", revisions)
+	}
+	if revisions[0].MessageID != "test-id" || !revisions[0].EditedAt.Equal(editedAt) {
+		t.Errorf("unexpected revision: %+v", revisions[0])
+	}
+
+	// 編集されていないメッセージの履歴は空
+	mustSave(t, s, models.Message{ID: "unedited", Sender: "bob", Content: "Hi", CreatedAt: base})
+	revisions, err = s.GetRevisions(ctx, "unedited")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(revisions) != 0 {
+		t.Errorf("expected no revisions, got %+v", revisions)
+	}
+
+	// 存在しないID
+	if _, err := s.UpdateContent(ctx, "non-existent", "x", editedAt); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := s.GetRevisions(ctx, "non-existent"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	// 削除すると履歴も消える
+	if err := s.Delete(ctx, "test-id"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := s.GetRevisions(ctx, "test-id"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expected ErrNotFound after delete, got %v", err)
+	}
+}
+
+// reply はスレッドの起点 rootID への返信を作る
+func reply(id, rootID string, createdAt time.Time) models.Message {
+	return models.Message{ID: id, Sender: "bob", Content: "reply " + id, CreatedAt: createdAt, ParentID: rootID, ThreadRootID: rootID}
+}
+
+func testThreads(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	mustSave(t, s, models.Message{ID: "root", Sender: "alice", Content: "root", CreatedAt: base})
+	mustSave(t, s, models.Message{ID: "other", Sender: "alice", Content: "other", CreatedAt: base.Add(time.Second)})
+
+	// 保存順と作成日時順が異なっていても、最後の返信日時は最も新しい返信の日時になる
+	mustSave(t, s, reply("r2", "root", base.Add(3*time.Second)))
+	mustSave(t, s, reply("r1", "root", base.Add(2*time.Second)))
+	nested := reply("r3", "root", base.Add(4*time.Second))
+	nested.ParentID = "r1"
+	mustSave(t, s, nested)
+
+	root, err := s.GetByID(ctx, "root")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if root.ReplyCount != 3 || root.LastReplyAt == nil || !root.LastReplyAt.Equal(base.Add(4*time.Second)) {
+		t.Errorf("unexpected thread stats: count=%d last=%v", root.ReplyCount, root.LastReplyAt)
+	}
+	if root.IsReply() {
+		t.Errorf("expected root not to be a reply: %+v", root)
+	}
+
+	got, err := s.GetByID(ctx, "r3")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.ParentID != "r1" || got.ThreadRootID != "root" || got.ReplyCount != 0 || got.LastReplyAt != nil {
+		t.Errorf("unexpected reply: %+v", got)
+	}
+
+	// 返信はメッセージ一覧に含まれず、スレッドの一覧に古い順に並ぶ
+	page, err := s.List(ctx, storage.ListOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := ids(page.Messages); got != "root,other" {
+		t.Errorf("expected root,other, got %s", got)
+	}
+	page, err = s.ListThread(ctx, "root", storage.ListOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := ids(page.Messages); got != "r1,r2,r3" || page.NextCursor != "" {
+		t.Errorf("expected r1,r2,r3 without cursor, got %s (%q)", got, page.NextCursor)
+	}
+
+	// スレッドの一覧もカーソルで辿れる
+	page, err = s.ListThread(ctx, "root", storage.ListOptions{Limit: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := ids(page.Messages); got != "r2,r3" || page.NextCursor == "" {
+		t.Fatalf("expected r2,r3 with cursor, got %s (%q)", got, page.NextCursor)
+	}
+	page, err = s.ListThread(ctx, "root", storage.ListOptions{Limit: 2, Before: page.NextCursor})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := ids(page.Messages); got != "r1" || page.NextCursor != "" {
+		t.Errorf("expected r1 without cursor, got %s (%q)", got, page.NextCursor)
+	}
+
+	// 返信のないメッセージのスレッドは空
+	page, err = s.ListThread(ctx, "other", storage.ListOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(page.Messages) != 0 {
+		t.Errorf("expected empty thread, got %s", ids(page.Messages))
+	}
+
+	// 存在しないメッセージと返信はスレッドの起点にならない
+	if _, err := s.ListThread(ctx, "non-existent", storage.ListOptions{}); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := s.ListThread(ctx, "r1", storage.ListOptions{}); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for reply, got %v", err)
+	}
+	if err := s.Save(ctx, reply("r4", "non-existent", base)); !errors.Is(err, storage.ErrParentNotFound) {
+		t.Errorf("expected ErrParentNotFound, got %v", err)
+	}
+	if err := s.Save(ctx, reply("r4", "r1", base)); !errors.Is(err, storage.ErrParentNotFound) {
+		t.Errorf("expected ErrParentNotFound for reply as root, got %v", err)
+	}
+
+	// 返信も検索と全件取得の対象になる
+	results, err := s.Search(ctx, storage.SearchOptions{Query: "reply"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := resultIDs(results); got != "r3,r2,r1" {
+		t.Errorf("expected r3,r2,r1, got %s", got)
+	}
+	messages, err := s.GetAll(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := ids(messages); got != "root,other,r1,r2,r3" {
+		t.Errorf("expected root,other,r1,r2,r3, got %s", got)
+	}
+}
+
+func testListReplies(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	mustCreateRoom(t, s, models.Room{ID: "room-1", Name: "general", CreatedAt: base})
+	mustSave(t, s, models.Message{ID: "a", Sender: "alice", Content: "a", CreatedAt: base})
+	mustSave(t, s, models.Message{ID: "b", Sender: "alice", Content: "b", CreatedAt: base.Add(time.Second)})
+	mustSave(t, s, models.Message{ID: "c", RoomID: "room-1", Sender: "alice", Content: "c", CreatedAt: base})
+
+	// 複数のスレッドへの返信が作成日時順に並ぶ
+	mustSave(t, s, reply("a1", "a", base.Add(2*time.Second)))
+	mustSave(t, s, reply("b1", "b", base.Add(3*time.Second)))
+	mustSave(t, s, reply("a2", "a", base.Add(4*time.Second)))
+	inRoom := reply("c1", "c", base.Add(5*time.Second))
+	inRoom.RoomID = "room-1"
+	mustSave(t, s, inRoom)
+
+	page, err := s.ListReplies(ctx, storage.ListOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := ids(page.Messages); got != "a1,b1,a2" || page.NextCursor != "" {
+		t.Errorf("expected a1,b1,a2 without cursor, got %s (%q)", got, page.NextCursor)
+	}
+
+	// カーソルより新しい返信を辿れる
+	page, err = s.ListReplies(ctx, storage.ListOptions{After: storage.CursorOf(models.Message{ID: "a1", CreatedAt: base.Add(2 * time.Second)}).Encode(), Limit: 1})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := ids(page.Messages); got != "b1" || page.NextCursor == "" {
+		t.Fatalf("expected b1 with cursor, got %s (%q)", got, page.NextCursor)
+	}
+	page, err = s.ListReplies(ctx, storage.ListOptions{After: page.NextCursor})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := ids(page.Messages); got != "a2" || page.NextCursor != "" {
+		t.Errorf("expected a2 without cursor, got %s (%q)", got, page.NextCursor)
+	}
+
+	page, err = s.ListReplies(ctx, storage.ListOptions{RoomID: "room-1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := ids(page.Messages); got != "c1" {
+		t.Errorf("expected c1, got %s", got)
+	}
+
+	if _, err := s.ListReplies(ctx, storage.ListOptions{RoomID: "non-existent"}); !errors.Is(err, storage.ErrRoomNotFound) {
+		t.Errorf("expected ErrRoomNotFound, got %v", err)
+	}
+}
+
+func testDeleteThread(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	mustSave(t, s, models.Message{ID: "root", Sender: "alice", Content: "root", CreatedAt: base})
+	mustSave(t, s, reply("r1", "root", base.Add(time.Second)))
+	mustSave(t, s, reply("r2", "root", base.Add(2*time.Second)))
+
+	// 最後の返信を削除すると、最後の返信日時は残った返信の日時に戻る
+	if err := s.Delete(ctx, "r2"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	root, err := s.GetByID(ctx, "root")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if root.ReplyCount != 1 || root.LastReplyAt == nil || !root.LastReplyAt.Equal(base.Add(time.Second)) {
+		t.Errorf("unexpected thread stats: count=%d last=%v", root.ReplyCount, root.LastReplyAt)
+	}
+
+	// 返信が無くなれば最後の返信日時も無くなる
+	if err := s.Delete(ctx, "r1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	root, err = s.GetByID(ctx, "root")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if root.ReplyCount != 0 || root.LastReplyAt != nil {
+		t.Errorf("unexpected thread stats: count=%d last=%v", root.ReplyCount, root.LastReplyAt)
+	}
+
+	// 起点を削除すると返信も削除される
+	mustSave(t, s, reply("r3", "root", base.Add(3*time.Second)))
+	if err := s.Delete(ctx, "root"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := s.GetByID(ctx, "r3"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for reply of deleted root, got %v", err)
+	}
+	results, err := s.Search(ctx, storage.SearchOptions{Query: "reply"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(results) != 0 {
+		t.Errorf("expected no results, got %s", resultIDs(results))
+	}
+}
+
+func testReactions(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	mustSave(t, s, models.Message{ID: "msg-1", Sender: "alice", Content: "hello", CreatedAt: base})
+	mustSave(t, s, models.Message{ID: "msg-2", Sender: "bob", Content: "hi", CreatedAt: base.Add(time.Second)})
+	mustSave(t, s, reply("r1", "msg-1", base.Add(2*time.Second)))
+
+	for i, r := range []struct{ id, emoji, user string }{
+		{"msg-1", "👍", "alice"},
+		{"msg-1", "🎉", "bob"},
+		{"msg-1", "👍", "bob"},
+		{"msg-2", "👍", "carol"},
+		{"r1", "❤️", "alice"},
+	} {
+		if err := s.AddReaction(ctx, r.id, r.emoji, r.user, base.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// 同じユーザーは同じ絵文字で1回だけリアクションできる
+	if err := s.AddReaction(ctx, "msg-1", "👍", "alice", base); !errors.Is(err, storage.ErrReactionExists) {
+		t.Errorf("expected ErrReactionExists, got %v", err)
+	}
+	if err := s.AddReaction(ctx, "missing", "👍", "alice", base); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	// 絵文字は最初にリアクションされた順に並び、viewer のリアクションだけが ReactedByMe になる
+	got, err := s.ListReactions(ctx, []string{"msg-1", "msg-2", "r1", "missing"}, "alice")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := map[string][]models.Reaction{
+		"msg-1": {{Emoji: "👍", Count: 2, ReactedByMe: true}, {Emoji: "🎉", Count: 1}},
+		"msg-2": {{Emoji: "👍", Count: 1}},
+		"r1":    {{Emoji: "❤️", Count: 1, ReactedByMe: true}},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	got, err = s.ListReactions(ctx, nil, "alice")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got == nil || len(got) != 0 {
+		t.Errorf("expected empty map, got %v", got)
+	}
+
+	// 削除すると集計から消え、並び順は残ったリアクションで決まる
+	if err := s.RemoveReaction(ctx, "msg-1", "👍", "alice"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.RemoveReaction(ctx, "msg-1", "👍", "alice"); !errors.Is(err, storage.ErrReactionNotFound) {
+		t.Errorf("expected ErrReactionNotFound, got %v", err)
+	}
+	if err := s.RemoveReaction(ctx, "missing", "👍", "alice"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	got, err = s.ListReactions(ctx, []string{"msg-1"}, "alice")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "[{🎉 1 false} {👍 1 false}]"; fmt.Sprint(got["msg-1"]) != want {
+		t.Errorf("expected %s, got %v", want, got["msg-1"])
+	}
+
+	// 削除したリアクションはもう一度追加できる
+	if err := s.AddReaction(ctx, "msg-1", "👍", "alice", base.Add(time.Minute)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// メッセージを削除するとリアクションも削除され、スレッドの起点を削除すると返信のリアクションも削除される
+	if err := s.Delete(ctx, "msg-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, err = s.ListReactions(ctx, []string{"msg-1", "msg-2", "r1"}, "alice")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 1 || len(got["msg-2"]) != 1 {
+		t.Errorf("expected only msg-2 reactions, got %v", got)
+	}
+}
+
+func testUsers(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	user := models.User{ID: "user-1", Username: "alice", PasswordHash: "hash", CreatedAt: base}
+
+	if err := s.CreateUser(ctx, user); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// 同じユーザー名では作成できない
+	if err := s.CreateUser(ctx, models.User{ID: "user-2", Username: "alice", CreatedAt: base}); !errors.Is(err, storage.ErrUserExists) {
+		t.Errorf("expected ErrUserExists, got %v", err)
+	}
+
+	got, err := s.GetUserByUsername(ctx, "alice")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.ID != "user-1" || got.PasswordHash != "hash" || !got.CreatedAt.Equal(base) {
+		t.Errorf("unexpected user: %+v", got)
+	}
+
+	if _, err := s.GetUserByUsername(ctx, "bob"); !errors.Is(err, storage.ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+}
+
+func testSearch(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	mustCreateRoom(t, s, models.Room{ID: "room-1", Name: "general", CreatedAt: base})
+	mustSave(t, s, models.Message{ID: "1", Sender: "alice", Content: "Deploy the API", CreatedAt: base})
+	mustSave(t, s, models.Message{ID: "2", RoomID: "room-1", Sender: "bob", Content: "deploy finished", CreatedAt: base.Add(time.Hour)})
+	mustSave(t, s, models.Message{ID: "3", Sender: "alice", Content: "lunch?", CreatedAt: base.Add(2 * time.Hour)})
+
+	// ルームを問わず新しい順に取得する
+	results, err := s.Search(ctx, storage.SearchOptions{Query: "deploy"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := resultIDs(results); got != "2,1" {
+		t.Fatalf("expected 2,1, got %s", got)
+	}
+	if results[1].Snippet != "<mark>Deploy</mark> the API" {
+		t.Errorf("unexpected snippet: %q", results[1].Snippet)
+	}
+
+	tests := []struct {
+		name string
+		opts storage.SearchOptions
+		want string
+	}{
+		{"all terms", storage.SearchOptions{Query: "deploy api"}, "1"},
+		{"sender", storage.SearchOptions{Query: "deploy", Sender: "bob"}, "2"},
+		{"since", storage.SearchOptions{Query: "deploy", Since: base.Add(time.Hour)}, "2"},
+		{"until", storage.SearchOptions{Query: "deploy", Until: base.Add(time.Hour)}, "1"},
+		{"limit", storage.SearchOptions{Query: "deploy", Limit: 1}, "2"},
+		{"no match", storage.SearchOptions{Query: "dinner"}, ""},
+		{"no terms", storage.SearchOptions{Query: "?!"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := s.Search(ctx, tt.opts)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if results == nil {
+				t.Error("expected non-nil results")
+			}
+			if got := resultIDs(results); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+
+	// 編集・削除は検索結果に反映される
+	if _, err := s.UpdateContent(ctx, "1", "Rollback the API", base.Add(3*time.Hour)); err != nil {
+		t.Fatalf("UpdateContent failed: %v", err)
+	}
+	if err := s.Delete(ctx, "2"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if results, _ := s.Search(ctx, storage.SearchOptions{Query: "deploy"}); len(results) != 0 {
+		t.Errorf("expected no results after edit and delete, got %s", resultIDs(results))
+	}
+	if results, _ := s.Search(ctx, storage.SearchOptions{Query: "rollback"}); resultIDs(results) != "1" {
+		t.Errorf("expected edited message to be found, got %s", resultIDs(results))
+	}
+}
+
+func testConcurrentSave(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	const n = 50
+
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id := fmt.Sprintf("msg-%02d", i)
+			errs <- s.Save(ctx, models.Message{ID: id, Sender: "alice", Content: "Hello", CreatedAt: base.Add(time.Duration(i) * time.Second)})
+			if _, err := s.GetByID(ctx, id); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+
+	messages, err := s.GetAll(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(messages) != n {
+		t.Fatalf("expected %d messages, got %d", n, len(messages))
+	}
+	for i, msg := range messages {
+		if want := fmt.Sprintf("msg-%02d", i); msg.ID != want {
+			t.Fatalf("expected %s at %d, got %s", want, i, msg.ID)
+		}
+	}
+}
+
+func testConcurrentUpdateContent(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	const n = 20
+	mustSave(t, s, models.Message{ID: "1", Sender: "alice", Content: "v0", CreatedAt: base})
+
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.UpdateContent(ctx, "1", fmt.Sprintf("v%d", i+1), base.Add(time.Duration(i+1)*time.Second)); err != nil {
+				t.Errorf("UpdateContent failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// 同時に編集しても履歴は欠けない
+	revisions, err := s.GetRevisions(ctx, "1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(revisions) != n {
+		t.Fatalf("expected %d revisions, got %d", n, len(revisions))
+	}
+	if revisions[0].Content != "v0" {
+		t.Errorf("expected first revision to be the original content, got %q", revisions[0].Content)
+	}
+	seen := map[string]bool{}
+	for _, rev := range revisions {
+		seen[rev.Content] = true
+	}
+	msg, err := s.GetByID(ctx, "1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if seen[msg.Content] || len(seen) != n {
+		t.Errorf("expected every content to appear once in history or as current, got current %q and %d distinct revisions", msg.Content, len(seen))
+	}
+}
+
+func testPing(t *testing.T, s storage.Storage) {
+	if err := storage.Ping(context.Background(), s); err != nil {
+		t.Errorf("Ping failed: %v", err)
+	}
+}
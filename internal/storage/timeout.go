@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/tasukuchiba/text_messaging_app/internal/models"
+)
+
+// Timeouts はストレージ操作ごとのタイムアウト
+// 0以下の値を指定した操作には呼び出し元の ctx の期限だけが適用される
+type Timeouts struct {
+	// 読み取り操作（GetAll, List, ListThread, ListReplies, GetByID, GetByClientMsgID, GetRevisions, GetRoom, ListRooms, GetUserByUsername, Search, ListReactions）
+	Read time.Duration
+
+	// 書き込み操作（Save, Delete, UpdateContent, CreateRoom, CreateUser, AddReaction, RemoveReaction）
+	Write time.Duration
+}
+
+// DefaultTimeouts はタイムアウトの指定がない場合の値
+var DefaultTimeouts = Timeouts{
+	Read:  5 * time.Second,
+	Write: 5 * time.Second,
+}
+
+// TimeoutStorage は操作ごとにタイムアウトを設定して下位のストレージを呼び出す
+//
+// データベースが応答しなくなっても、リクエストを処理する goroutine が
+// いつまでも待ち続けないようにする。
+type TimeoutStorage struct {
+	next     Storage
+	timeouts Timeouts
+}
+
+// NewTimeoutStorage は next をタイムアウト付きで包んだストレージを作成する
+func NewTimeoutStorage(next Storage, timeouts Timeouts) *TimeoutStorage {
+	return &TimeoutStorage{next: next, timeouts: timeouts}
+}
+
+// withTimeout は d が正の場合に期限付きのコンテキストを返す
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// Save はメッセージを保存する
+func (s *TimeoutStorage) Save(ctx context.Context, msg models.Message) error {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Write)
+	defer cancel()
+	return s.next.Save(ctx, msg)
+}
+
+// GetAll は全てのメッセージを取得する
+func (s *TimeoutStorage) GetAll(ctx context.Context) ([]models.Message, error) {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Read)
+	defer cancel()
+	return s.next.GetAll(ctx)
+}
+
+// List はカーソルを使ってメッセージをページ単位で取得する
+func (s *TimeoutStorage) List(ctx context.Context, opts ListOptions) (MessagePage, error) {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Read)
+	defer cancel()
+	return s.next.List(ctx, opts)
+}
+
+// ListThread はスレッドへの返信をカーソルを使ってページ単位で取得する
+func (s *TimeoutStorage) ListThread(ctx context.Context, rootID string, opts ListOptions) (MessagePage, error) {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Read)
+	defer cancel()
+	return s.next.ListThread(ctx, rootID, opts)
+}
+
+// ListReplies はチャンネルの全てのスレッドへの返信をカーソルを使ってページ単位で取得する
+func (s *TimeoutStorage) ListReplies(ctx context.Context, opts ListOptions) (MessagePage, error) {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Read)
+	defer cancel()
+	return s.next.ListReplies(ctx, opts)
+}
+
+// GetByID は指定されたIDのメッセージを取得する
+func (s *TimeoutStorage) GetByID(ctx context.Context, id string) (models.Message, error) {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Read)
+	defer cancel()
+	return s.next.GetByID(ctx, id)
+}
+
+// GetByClientMsgID は送信者とクライアントが付けたIDでメッセージを取得する
+func (s *TimeoutStorage) GetByClientMsgID(ctx context.Context, sender, clientMsgID string) (models.Message, error) {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Read)
+	defer cancel()
+	return s.next.GetByClientMsgID(ctx, sender, clientMsgID)
+}
+
+// Delete は指定されたIDのメッセージを削除する
+func (s *TimeoutStorage) Delete(ctx context.Context, id string) error {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Write)
+	defer cancel()
+	return s.next.Delete(ctx, id)
+}
+
+// UpdateContent はメッセージの本文を更新し、更新前の本文を編集履歴に残す
+func (s *TimeoutStorage) UpdateContent(ctx context.Context, id, content string, editedAt time.Time) (models.Message, error) {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Write)
+	defer cancel()
+	return s.next.UpdateContent(ctx, id, content, editedAt)
+}
+
+// GetRevisions はメッセージの編集履歴を古い順に取得する
+func (s *TimeoutStorage) GetRevisions(ctx context.Context, id string) ([]models.MessageRevision, error) {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Read)
+	defer cancel()
+	return s.next.GetRevisions(ctx, id)
+}
+
+// CreateRoom はルームを作成する
+func (s *TimeoutStorage) CreateRoom(ctx context.Context, room models.Room) error {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Write)
+	defer cancel()
+	return s.next.CreateRoom(ctx, room)
+}
+
+// GetRoom は指定されたIDのルームを取得する
+func (s *TimeoutStorage) GetRoom(ctx context.Context, id string) (models.Room, error) {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Read)
+	defer cancel()
+	return s.next.GetRoom(ctx, id)
+}
+
+// ListRooms は全てのルームを作成日時順に取得する
+func (s *TimeoutStorage) ListRooms(ctx context.Context) ([]models.Room, error) {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Read)
+	defer cancel()
+	return s.next.ListRooms(ctx)
+}
+
+// CreateUser はユーザーを作成する
+func (s *TimeoutStorage) CreateUser(ctx context.Context, user models.User) error {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Write)
+	defer cancel()
+	return s.next.CreateUser(ctx, user)
+}
+
+// GetUserByUsername はユーザー名でユーザーを取得する
+func (s *TimeoutStorage) GetUserByUsername(ctx context.Context, username string) (models.User, error) {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Read)
+	defer cancel()
+	return s.next.GetUserByUsername(ctx, username)
+}
+
+// Search は本文の全文検索でメッセージを新しい順に取得する
+func (s *TimeoutStorage) Search(ctx context.Context, opts SearchOptions) ([]SearchResult, error) {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Read)
+	defer cancel()
+	return s.next.Search(ctx, opts)
+}
+
+// AddReaction はメッセージに username の絵文字リアクションを追加する
+func (s *TimeoutStorage) AddReaction(ctx context.Context, messageID, emoji, username string, createdAt time.Time) error {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Write)
+	defer cancel()
+	return s.next.AddReaction(ctx, messageID, emoji, username, createdAt)
+}
+
+// RemoveReaction はメッセージから username の絵文字リアクションを削除する
+func (s *TimeoutStorage) RemoveReaction(ctx context.Context, messageID, emoji, username string) error {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Write)
+	defer cancel()
+	return s.next.RemoveReaction(ctx, messageID, emoji, username)
+}
+
+// ListReactions はメッセージごとのリアクションを絵文字ごとに集計して取得する
+func (s *TimeoutStorage) ListReactions(ctx context.Context, messageIDs []string, viewer string) (map[string][]models.Reaction, error) {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Read)
+	defer cancel()
+	return s.next.ListReactions(ctx, messageIDs, viewer)
+}
+
+// Ping は下位のストレージが利用できるか確認する
+func (s *TimeoutStorage) Ping(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Read)
+	defer cancel()
+	return Ping(ctx, s.next)
+}
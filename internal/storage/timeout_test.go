@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tasukuchiba/text_messaging_app/internal/models"
+)
+
+// deadlineStorage は呼び出し時のコンテキストの期限を記録するテスト用のストレージ
+type deadlineStorage struct {
+	*MemoryStorage
+	deadline    time.Time
+	hasDeadline bool
+}
+
+func (s *deadlineStorage) Save(ctx context.Context, msg models.Message) error {
+	s.deadline, s.hasDeadline = ctx.Deadline()
+	return s.MemoryStorage.Save(ctx, msg)
+}
+
+func (s *deadlineStorage) GetByID(ctx context.Context, id string) (models.Message, error) {
+	s.deadline, s.hasDeadline = ctx.Deadline()
+	if err := ctx.Err(); err != nil {
+		return models.Message{}, err
+	}
+	return s.MemoryStorage.GetByID(ctx, id)
+}
+
+func TestTimeoutStorage(t *testing.T) {
+	next := &deadlineStorage{MemoryStorage: NewMemoryStorage()}
+	store := NewTimeoutStorage(next, Timeouts{Read: time.Minute, Write: time.Hour})
+
+	// 書き込みと読み取りでそれぞれのタイムアウトが使われる
+	start := time.Now()
+	if err := store.Save(context.Background(), models.Message{ID: "1", Content: "Hello"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !next.hasDeadline || next.deadline.Sub(start) < 59*time.Minute {
+		t.Errorf("expected write deadline about an hour from now, got %v", next.deadline)
+	}
+
+	if _, err := store.GetByID(context.Background(), "1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !next.hasDeadline || next.deadline.Sub(start) > time.Minute+time.Second {
+		t.Errorf("expected read deadline about a minute from now, got %v", next.deadline)
+	}
+
+	// 呼び出し元の期限の方が早い場合はそちらが優先される
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := store.GetByID(ctx, "1"); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestTimeoutStorage_Disabled(t *testing.T) {
+	next := &deadlineStorage{MemoryStorage: NewMemoryStorage()}
+	store := NewTimeoutStorage(next, Timeouts{})
+
+	if err := store.Save(context.Background(), models.Message{ID: "1", Content: "Hello"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if next.hasDeadline {
+		t.Errorf("expected no deadline, got %v", next.deadline)
+	}
+}
+
+func TestTimeoutStorage_ImplementsStorage(t *testing.T) {
+	var _ Storage = (*TimeoutStorage)(nil)
+}
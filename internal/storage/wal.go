@@ -0,0 +1,551 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/tasukuchiba/text_messaging_app/internal/models"
+)
+
+// MemoryStorage の永続化
+//
+// 変更操作（Save, Delete, UpdateContent, CreateRoom, CreateUser, AddReaction, RemoveReaction）は、検証に通った時点で
+// 追記ログ（wal.log）に1行のJSONとして書き込んでからメモリ上のデータに反映する。
+// 起動時はスナップショット（snapshot.json）を読み込んだ後、それより新しいログを順に適用する。
+// コンパクションでは現在の状態をスナップショットに書き出してログを空にする。
+//
+// ログの各レコードには連番を付け、スナップショットには含まれる最後の連番を記録する。
+// スナップショットの書き出し後、ログを空にする前に停止しても、
+// 起動時にスナップショットに含まれるレコードを読み飛ばすため二重に適用されない。
+
+const (
+	walFileName      = "wal.log"
+	snapshotFileName = "snapshot.json"
+)
+
+// ErrCorruptWAL は追記ログまたはスナップショットを復元できない場合のエラー
+var ErrCorruptWAL = errors.New("corrupt write-ahead log")
+
+// SyncPolicy は追記ログを fsync する方針
+type SyncPolicy string
+
+const (
+	// SyncAlways は書き込みごとに fsync する（応答を返した変更は失われない）
+	SyncAlways SyncPolicy = "always"
+
+	// SyncInterval は一定間隔でまとめて fsync する（停電時は直近の間隔分が失われうる）
+	SyncInterval SyncPolicy = "interval"
+
+	// SyncNever は fsync せずOSに任せる（プロセスの異常終了では失われない）
+	SyncNever SyncPolicy = "never"
+)
+
+// UnmarshalText は "always", "interval", "never" のいずれかを読み込む
+func (p *SyncPolicy) UnmarshalText(text []byte) error {
+	switch policy := SyncPolicy(text); policy {
+	case SyncAlways, SyncInterval, SyncNever:
+		*p = policy
+		return nil
+	default:
+		return fmt.Errorf("invalid sync policy %q (must be %q, %q or %q)", text, SyncAlways, SyncInterval, SyncNever)
+	}
+}
+
+// WALConfig は追記ログの設定
+type WALConfig struct {
+	Sync SyncPolicy
+
+	// Sync が SyncInterval の場合に fsync する間隔
+	SyncInterval time.Duration
+
+	// コンパクションの間隔（0以下なら定期的に行わない）
+	CompactInterval time.Duration
+}
+
+// DefaultWALConfig は追記ログの設定の指定がない場合の値
+var DefaultWALConfig = WALConfig{
+	Sync:            SyncAlways,
+	SyncInterval:    time.Second,
+	CompactInterval: 10 * time.Minute,
+}
+
+// 追記ログのレコードの種類
+const (
+	walOpSave          = "save"
+	walOpDelete        = "delete"
+	walOpUpdateContent = "update_content"
+	walOpCreateRoom    = "create_room"
+	walOpCreateUser    = "create_user"
+
+	walOpAddReaction    = "add_reaction"
+	walOpRemoveReaction = "remove_reaction"
+)
+
+// walRecord は追記ログの1レコード
+type walRecord struct {
+	Seq uint64 `json:"seq"`
+	Op  string `json:"op"`
+
+	// save
+	Message *models.Message `json:"message,omitempty"`
+
+	// delete, update_content, add_reaction, remove_reaction
+	ID       string     `json:"id,omitempty"`
+	Content  string     `json:"content,omitempty"`
+	EditedAt *time.Time `json:"edited_at,omitempty"`
+
+	// create_room
+	Room *models.Room `json:"room,omitempty"`
+
+	// create_user
+	User *walUser `json:"user,omitempty"`
+
+	// add_reaction, remove_reaction
+	Reaction *reaction `json:"reaction,omitempty"`
+}
+
+// walUser はログとスナップショットに書き込むユーザー
+// models.User はレスポンス用にパスワードのハッシュをJSONに含めないため、別に定義する
+type walUser struct {
+	ID           string    `json:"id"`
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"password_hash"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func newWALUser(user models.User) *walUser {
+	return &walUser{ID: user.ID, Username: user.Username, PasswordHash: user.PasswordHash, CreatedAt: user.CreatedAt}
+}
+
+func (u walUser) model() models.User {
+	return models.User{ID: u.ID, Username: u.Username, PasswordHash: u.PasswordHash, CreatedAt: u.CreatedAt}
+}
+
+// walSnapshot はある時点の MemoryStorage の全データ
+type walSnapshot struct {
+	// このスナップショットに含まれる最後のレコードの連番
+	Seq uint64 `json:"seq"`
+
+	Rooms     []models.Room                       `json:"rooms"`
+	Users     []walUser                           `json:"users"`
+	Messages  []models.Message                    `json:"messages"`
+	Revisions map[string][]models.MessageRevision `json:"revisions"`
+	Reactions map[string][]reaction               `json:"reactions,omitempty"`
+}
+
+// journal は追記ログのファイル
+type journal struct {
+	mu sync.Mutex
+
+	dir  string
+	cfg  WALConfig
+	file *os.File
+
+	// ログファイルの大きさ（書き込みに失敗した場合はここまで切り詰める）
+	size int64
+
+	// 最後に書き込んだレコードと、スナップショットに含まれる最後のレコードの連番
+	seq         uint64
+	snapshotSeq uint64
+
+	// fsync していない書き込みがあるか（SyncInterval の場合）
+	dirty bool
+
+	// 書き込みの失敗後にログを元に戻せなかった場合のエラー（以降の書き込みは全て失敗する）
+	err error
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// OpenMemoryStorage は dir の追記ログから復元した MemoryStorage を作成する
+// dir がなければ作成する。使い終わったら Close でログを閉じる
+func OpenMemoryStorage(dir string, cfg WALConfig) (*MemoryStorage, error) {
+	if cfg.Sync == "" {
+		cfg.Sync = SyncAlways
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	// 作成中の s は他から参照されないため、復元の間はロックを取らない
+	s := NewMemoryStorage()
+	j := &journal{dir: dir, cfg: cfg, stop: make(chan struct{}), done: make(chan struct{})}
+
+	seq, err := s.loadSnapshot(filepath.Join(dir, snapshotFileName))
+	if err != nil {
+		return nil, err
+	}
+	j.seq, j.snapshotSeq = seq, seq
+
+	path := filepath.Join(dir, walFileName)
+	if err := s.replay(path, j); err != nil {
+		return nil, err
+	}
+
+	j.file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	s.journal = j
+	go s.runJournal()
+	return s, nil
+}
+
+// loadSnapshot はスナップショットを読み込み、含まれる最後のレコードの連番を返す
+// スナップショットがなければ何もせず 0 を返す
+func (s *MemoryStorage) loadSnapshot(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var snap walSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return 0, fmt.Errorf("%w: snapshot: %v", ErrCorruptWAL, err)
+	}
+	for _, room := range snap.Rooms {
+		s.rooms[room.ID] = room
+	}
+	for _, user := range snap.Users {
+		s.users[user.Username] = user.model()
+	}
+	for _, msg := range snap.Messages {
+		s.saveLocked(msg)
+	}
+	for id, revisions := range snap.Revisions {
+		s.revisions[id] = revisions
+	}
+	for id, reactions := range snap.Reactions {
+		s.reactions[id] = reactions
+	}
+	return snap.Seq, nil
+}
+
+// replay はスナップショットより新しいログのレコードを順に適用する
+// 書き込みの途中で停止して末尾に残った不完全なレコードは切り捨てる
+func (s *MemoryStorage) replay(path string, j *journal) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				slog.Warn("Discarding incomplete write-ahead log record", "path", path, "offset", offset, "bytes", len(line))
+				if err := os.Truncate(path, offset); err != nil {
+					return err
+				}
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		var rec walRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return fmt.Errorf("%w: record at offset %d: %v", ErrCorruptWAL, offset, err)
+		}
+		offset += int64(len(line))
+
+		// スナップショットに含まれるレコードは読み飛ばす
+		if rec.Seq <= j.snapshotSeq {
+			continue
+		}
+		if rec.Seq != j.seq+1 {
+			return fmt.Errorf("%w: expected record %d, got %d", ErrCorruptWAL, j.seq+1, rec.Seq)
+		}
+		if err := s.applyLocked(rec); err != nil {
+			return fmt.Errorf("%w: record %d: %v", ErrCorruptWAL, rec.Seq, err)
+		}
+		j.seq = rec.Seq
+	}
+
+	j.size = offset
+	return nil
+}
+
+// applyLocked はログのレコードをメモリ上のデータに反映する（ロックを取得済みで呼び出す）
+func (s *MemoryStorage) applyLocked(rec walRecord) error {
+	switch rec.Op {
+	case walOpSave:
+		if rec.Message == nil {
+			return errors.New("save without message")
+		}
+		if rec.Message.IsReply() {
+			if _, _, ok := s.locateRootLocked(rec.Message.ThreadRootID); !ok {
+				return fmt.Errorf("reply to unknown message %q", rec.Message.ThreadRootID)
+			}
+		}
+		s.saveLocked(*rec.Message)
+	case walOpDelete:
+		if !s.deleteLocked(rec.ID) {
+			return fmt.Errorf("delete of unknown message %q", rec.ID)
+		}
+	case walOpUpdateContent:
+		if rec.EditedAt == nil {
+			return errors.New("update_content without edited_at")
+		}
+		if _, ok := s.updateContentLocked(rec.ID, rec.Content, *rec.EditedAt); !ok {
+			return fmt.Errorf("update of unknown message %q", rec.ID)
+		}
+	case walOpCreateRoom:
+		if rec.Room == nil {
+			return errors.New("create_room without room")
+		}
+		s.rooms[rec.Room.ID] = *rec.Room
+	case walOpCreateUser:
+		if rec.User == nil {
+			return errors.New("create_user without user")
+		}
+		s.users[rec.User.Username] = rec.User.model()
+	case walOpAddReaction:
+		if rec.Reaction == nil {
+			return errors.New("add_reaction without reaction")
+		}
+		if _, ok := s.findLocked(rec.ID); !ok {
+			return fmt.Errorf("reaction to unknown message %q", rec.ID)
+		}
+		s.reactions[rec.ID] = append(s.reactions[rec.ID], *rec.Reaction)
+	case walOpRemoveReaction:
+		if rec.Reaction == nil {
+			return errors.New("remove_reaction without reaction")
+		}
+		if !s.removeReactionLocked(rec.ID, rec.Reaction.Emoji, rec.Reaction.Username) {
+			return fmt.Errorf("removal of unknown reaction on message %q", rec.ID)
+		}
+	default:
+		return fmt.Errorf("unknown op %q", rec.Op)
+	}
+	return nil
+}
+
+// logLocked は変更をログに書き込む（書き込みロックを取得済みで呼び出す）
+// 永続化しない場合は何もしない
+func (s *MemoryStorage) logLocked(rec walRecord) error {
+	if s.journal == nil {
+		return nil
+	}
+	return s.journal.append(rec)
+}
+
+// append はレコードに連番を付けてログの末尾に書き込む
+func (j *journal) append(rec walRecord) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.err != nil {
+		return j.err
+	}
+
+	rec.Seq = j.seq + 1
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	// 1回の書き込みで1行を書く
+	_, err = j.file.Write(line)
+	if err == nil && j.cfg.Sync == SyncAlways {
+		err = j.file.Sync()
+	}
+	if err != nil {
+		// 途中まで書かれたレコードが後続のレコードと混ざらないよう元の長さに戻す
+		if terr := j.file.Truncate(j.size); terr != nil {
+			j.err = fmt.Errorf("write-ahead log is unusable after failed write: %w", errors.Join(err, terr))
+		}
+		return err
+	}
+
+	j.seq = rec.Seq
+	j.size += int64(len(line))
+	j.dirty = j.cfg.Sync == SyncInterval
+	return nil
+}
+
+// sync は fsync していない書き込みがあれば fsync する
+func (j *journal) sync() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if !j.dirty {
+		return nil
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	j.dirty = false
+	return nil
+}
+
+// Compact は現在の状態をスナップショットに書き出して追記ログを空にする
+// 書き出しの間は変更操作を待たせる（読み取りはできる）
+// 永続化しない場合は何もしない
+func (s *MemoryStorage) Compact() error {
+	if s.journal == nil {
+		return nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	j := s.journal
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.err != nil {
+		return j.err
+	}
+	if j.seq == j.snapshotSeq {
+		return nil
+	}
+
+	snap := walSnapshot{
+		Seq:       j.seq,
+		Rooms:     make([]models.Room, 0, len(s.rooms)),
+		Users:     make([]walUser, 0, len(s.users)),
+		Messages:  make([]models.Message, 0),
+		Revisions: s.revisions,
+		Reactions: s.reactions,
+	}
+	for _, room := range s.rooms {
+		snap.Rooms = append(snap.Rooms, room)
+	}
+	for _, user := range s.users {
+		snap.Users = append(snap.Users, *newWALUser(user))
+	}
+	// 読み込むときに返信数を求め直せるように、起点のメッセージを返信より先に並べる
+	for _, messages := range s.messages {
+		snap.Messages = append(snap.Messages, messages...)
+	}
+	for _, replies := range s.threads {
+		snap.Messages = append(snap.Messages, replies...)
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(j.dir, snapshotFileName), data); err != nil {
+		return err
+	}
+	j.snapshotSeq = j.seq
+
+	// ここで停止しても、ログのレコードはスナップショットの連番以下なので読み飛ばされる
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	j.size = 0
+	j.dirty = false
+	return nil
+}
+
+// writeFileAtomic は一時ファイルに書き出して fsync した後に path へ置き換える
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	// 置き換えたことをディレクトリにも反映する
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// runJournal は定期的な fsync とコンパクションを行う
+func (s *MemoryStorage) runJournal() {
+	j := s.journal
+	defer close(j.done)
+
+	var syncC, compactC <-chan time.Time
+	if j.cfg.Sync == SyncInterval && j.cfg.SyncInterval > 0 {
+		ticker := time.NewTicker(j.cfg.SyncInterval)
+		defer ticker.Stop()
+		syncC = ticker.C
+	}
+	if j.cfg.CompactInterval > 0 {
+		ticker := time.NewTicker(j.cfg.CompactInterval)
+		defer ticker.Stop()
+		compactC = ticker.C
+	}
+
+	for {
+		select {
+		case <-syncC:
+			if err := j.sync(); err != nil {
+				slog.Error("Failed to sync write-ahead log", "error", err)
+			}
+		case <-compactC:
+			if err := s.Compact(); err != nil {
+				slog.Error("Failed to compact write-ahead log", "error", err)
+			}
+		case <-j.stop:
+			return
+		}
+	}
+}
+
+// Close は追記ログを fsync して閉じる
+// 閉じた後の変更操作は失敗する。永続化しない場合は何もしない
+func (s *MemoryStorage) Close() error {
+	j := s.journal
+	if j == nil {
+		return nil
+	}
+
+	var err error
+	j.closeOnce.Do(func() {
+		close(j.stop)
+		<-j.done
+
+		// 書き込み中の操作が終わるのを待つ
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		j.err = os.ErrClosed
+		err = errors.Join(j.file.Sync(), j.file.Close())
+	})
+	return err
+}
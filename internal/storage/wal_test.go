@@ -0,0 +1,311 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tasukuchiba/text_messaging_app/internal/models"
+)
+
+// openTestWALStorage は dir の追記ログから MemoryStorage を開く（定期的なコンパクションはしない）
+func openTestWALStorage(t *testing.T, dir string) *MemoryStorage {
+	t.Helper()
+	store, err := OpenMemoryStorage(dir, WALConfig{Sync: SyncAlways})
+	if err != nil {
+		t.Fatalf("OpenMemoryStorage failed: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// populate は復元の確認用に一通りの変更を行う
+func populate(t *testing.T, store *MemoryStorage) {
+	t.Helper()
+	ctx := context.Background()
+	base := time.Date(2026, 1, 1, 9, 0, 0, 123456789, time.FixedZone("JST", 9*60*60))
+
+	steps := []error{
+		store.CreateRoom(ctx, models.Room{ID: "room-1", Name: "general", CreatedAt: base}),
+		store.CreateUser(ctx, models.User{ID: "user-1", Username: "alice", PasswordHash: "hash", CreatedAt: base}),
+		store.Save(ctx, models.Message{ID: "1", Sender: "alice", Content: "Deploy the API", CreatedAt: base, ClientMsgID: "c-1"}),
+		store.Save(ctx, models.Message{ID: "2", RoomID: "room-1", Sender: "bob", Content: "Hello", CreatedAt: base.Add(time.Second)}),
+		store.Save(ctx, models.Message{ID: "3", Sender: "bob", Content: "bye", CreatedAt: base.Add(2 * time.Second)}),
+		store.Save(ctx, models.Message{ID: "3r", Sender: "alice", Content: "see you", CreatedAt: base.Add(3 * time.Second), ParentID: "3", ThreadRootID: "3"}),
+		store.AddReaction(ctx, "3r", "👋", "bob", base.Add(3*time.Second)),
+		store.Delete(ctx, "3"),
+		store.Save(ctx, models.Message{ID: "1r", Sender: "bob", Content: "done", CreatedAt: base.Add(4 * time.Second), ParentID: "1", ThreadRootID: "1"}),
+		store.AddReaction(ctx, "1", "👍", "alice", base.Add(5*time.Second)),
+		store.AddReaction(ctx, "1", "🎉", "bob", base.Add(6*time.Second)),
+		store.AddReaction(ctx, "1", "👍", "bob", base.Add(7*time.Second)),
+		store.RemoveReaction(ctx, "1", "🎉", "bob"),
+	}
+	_, err := store.UpdateContent(ctx, "2", "Hello!", base.Add(time.Minute))
+	steps = append(steps, err)
+	for i, err := range steps {
+		if err != nil {
+			t.Fatalf("step %d failed: %v", i, err)
+		}
+	}
+}
+
+// checkPopulated は populate の結果が復元されていることを確認する
+func checkPopulated(t *testing.T, store *MemoryStorage) {
+	t.Helper()
+	ctx := context.Background()
+
+	messages, err := store.GetAll(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(messages) != 3 || messages[0].ID != "1" || messages[1].ID != "2" || messages[2].ID != "1r" {
+		t.Fatalf("unexpected messages: %+v", messages)
+	}
+	if msg := messages[0]; msg.ReplyCount != 1 || msg.LastReplyAt == nil || !msg.LastReplyAt.Equal(messages[2].CreatedAt) {
+		t.Errorf("unexpected thread stats: %+v", msg)
+	}
+	if msg := messages[1]; msg.RoomID != "room-1" || msg.Content != "Hello!" || !msg.Edited || msg.UpdatedAt == nil {
+		t.Errorf("unexpected edited message: %+v", msg)
+	}
+	if want := time.Date(2026, 1, 1, 0, 0, 0, 123456789, time.UTC); !messages[0].CreatedAt.Equal(want) {
+		t.Errorf("expected created_at %v, got %v", want, messages[0].CreatedAt)
+	}
+
+	revisions, err := store.GetRevisions(ctx, "2")
+	if err != nil || len(revisions) != 1 || revisions[0].Content != "Hello" {
+		t.Errorf("unexpected revisions: %+v (%v)", revisions, err)
+	}
+	if _, err := store.GetRoom(ctx, "room-1"); err != nil {
+		t.Errorf("expected room to be restored, got %v", err)
+	}
+	reactions, err := store.ListReactions(ctx, []string{"1", "3r"}, "alice")
+	if err != nil || len(reactions) != 1 || fmt.Sprint(reactions["1"]) != "[{👍 2 true}]" {
+		t.Errorf("unexpected reactions: %v (%v)", reactions, err)
+	}
+	user, err := store.GetUserByUsername(ctx, "alice")
+	if err != nil || user.PasswordHash != "hash" {
+		t.Errorf("expected user with password hash, got %+v (%v)", user, err)
+	}
+
+	// 重複排除と検索インデックスも復元される
+	if err := store.Save(ctx, models.Message{ID: "4", Sender: "alice", Content: "again", ClientMsgID: "c-1"}); err != ErrDuplicateMessage {
+		t.Errorf("expected ErrDuplicateMessage, got %v", err)
+	}
+	if results, _ := store.Search(ctx, SearchOptions{Query: "deploy"}); len(results) != 1 {
+		t.Errorf("expected search index to be restored, got %+v", results)
+	}
+}
+
+func TestMemoryStorage_WALReplay(t *testing.T) {
+	dir := t.TempDir()
+	store := openTestWALStorage(t, dir)
+	populate(t, store)
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	checkPopulated(t, openTestWALStorage(t, dir))
+}
+
+func TestMemoryStorage_WALSkipsFailedOperations(t *testing.T) {
+	dir := t.TempDir()
+	store := openTestWALStorage(t, dir)
+	ctx := context.Background()
+
+	// 失敗した操作はログに残らないので、開き直しても復元に失敗しない
+	store.Save(ctx, models.Message{ID: "1", RoomID: "missing", Sender: "alice", Content: "x"})
+	store.Save(ctx, models.Message{ID: "2", Sender: "alice", Content: "x", ParentID: "missing", ThreadRootID: "missing"})
+	store.Delete(ctx, "missing")
+	store.UpdateContent(ctx, "missing", "x", time.Now())
+	store.AddReaction(ctx, "missing", "👍", "alice", time.Now())
+	store.RemoveReaction(ctx, "missing", "👍", "alice")
+	store.CreateUser(ctx, models.User{ID: "user-1", Username: "alice"})
+	store.CreateUser(ctx, models.User{ID: "user-2", Username: "alice"})
+	store.Close()
+
+	store = openTestWALStorage(t, dir)
+	user, err := store.GetUserByUsername(ctx, "alice")
+	if err != nil || user.ID != "user-1" {
+		t.Errorf("expected user-1, got %+v (%v)", user, err)
+	}
+	if messages, _ := store.GetAll(ctx); len(messages) != 0 {
+		t.Errorf("expected no messages, got %+v", messages)
+	}
+}
+
+func TestMemoryStorage_Compact(t *testing.T) {
+	dir := t.TempDir()
+	store := openTestWALStorage(t, dir)
+	populate(t, store)
+
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, walFileName)); err != nil || info.Size() != 0 {
+		t.Fatalf("expected empty log after compaction, got %v (%v)", info, err)
+	}
+
+	// コンパクション後の変更はログに追記される
+	ctx := context.Background()
+	if err := store.Save(ctx, models.Message{ID: "5", Sender: "carol", Content: "after", CreatedAt: time.Now()}); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if err := store.Delete(ctx, "5"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	store.Close()
+
+	checkPopulated(t, openTestWALStorage(t, dir))
+}
+
+func TestMemoryStorage_CompactInterruptedBeforeTruncate(t *testing.T) {
+	dir := t.TempDir()
+	store := openTestWALStorage(t, dir)
+	populate(t, store)
+
+	// スナップショットの書き出し後、ログを空にする前に停止した状態を再現する
+	logPath := filepath.Join(dir, walFileName)
+	log, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("failed to read log: %v", err)
+	}
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	store.Close()
+	if err := os.WriteFile(logPath, log, 0o644); err != nil {
+		t.Fatalf("failed to restore log: %v", err)
+	}
+
+	// スナップショットに含まれるレコードは二重に適用されない
+	store = openTestWALStorage(t, dir)
+	checkPopulated(t, store)
+
+	// 続きの連番で書き込める
+	if err := store.CreateRoom(context.Background(), models.Room{ID: "room-2", Name: "random"}); err != nil {
+		t.Fatalf("CreateRoom failed: %v", err)
+	}
+	store.Close()
+	if _, err := openTestWALStorage(t, dir).GetRoom(context.Background(), "room-2"); err != nil {
+		t.Errorf("expected room-2 after reopen, got %v", err)
+	}
+}
+
+func TestMemoryStorage_WALTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	store := openTestWALStorage(t, dir)
+	populate(t, store)
+	store.Close()
+
+	// 書き込みの途中で停止して末尾に不完全なレコードが残った状態
+	logPath := filepath.Join(dir, walFileName)
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatalf("failed to open log: %v", err)
+	}
+	f.WriteString(`{"seq":8,"op":"save","message":{"id":"6"`)
+	f.Close()
+
+	store = openTestWALStorage(t, dir)
+	checkPopulated(t, store)
+
+	// 不完全なレコードは切り捨てられ、続きを書き込める
+	if err := store.Save(context.Background(), models.Message{ID: "6", Sender: "carol", Content: "ok"}); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	store.Close()
+	if _, err := openTestWALStorage(t, dir).GetByID(context.Background(), "6"); err != nil {
+		t.Errorf("expected message 6 after reopen, got %v", err)
+	}
+}
+
+func TestMemoryStorage_WALCorrupt(t *testing.T) {
+	tests := []struct {
+		name string
+		log  string
+	}{
+		{"invalid json", "{\"seq\":1,\"op\":\"create_room\",\"room\":{\"id\":\"r\"}}\nnot json\n"},
+		{"gap in sequence", "{\"seq\":1,\"op\":\"create_room\",\"room\":{\"id\":\"r\"}}\n{\"seq\":3,\"op\":\"delete\",\"id\":\"x\"}\n"},
+		{"unknown message", "{\"seq\":1,\"op\":\"delete\",\"id\":\"x\"}\n"},
+		{"unknown op", "{\"seq\":1,\"op\":\"truncate\"}\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, walFileName), []byte(tt.log), 0o644); err != nil {
+				t.Fatalf("failed to write log: %v", err)
+			}
+			if _, err := OpenMemoryStorage(dir, DefaultWALConfig); !errors.Is(err, ErrCorruptWAL) {
+				t.Errorf("expected ErrCorruptWAL, got %v", err)
+			}
+		})
+	}
+}
+
+func TestMemoryStorage_WALSyncInterval(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenMemoryStorage(dir, WALConfig{Sync: SyncInterval, SyncInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("OpenMemoryStorage failed: %v", err)
+	}
+	populate(t, store)
+
+	// まとめて fsync されるのを待つ
+	deadline := time.Now().Add(time.Second)
+	for {
+		store.journal.mu.Lock()
+		dirty := store.journal.dirty
+		store.journal.mu.Unlock()
+		if !dirty {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected log to be synced")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	store.Close()
+
+	checkPopulated(t, openTestWALStorage(t, dir))
+}
+
+func TestMemoryStorage_CloseWAL(t *testing.T) {
+	store := openTestWALStorage(t, t.TempDir())
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Errorf("expected second Close to succeed, got %v", err)
+	}
+
+	// 閉じた後の変更は失敗し、メモリ上にも反映されない
+	if err := store.CreateRoom(context.Background(), models.Room{ID: "room-1"}); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("expected os.ErrClosed, got %v", err)
+	}
+	if _, err := store.GetRoom(context.Background(), "room-1"); err != ErrRoomNotFound {
+		t.Errorf("expected ErrRoomNotFound, got %v", err)
+	}
+
+	// 永続化しない場合は何もしない
+	if err := NewMemoryStorage().Close(); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+}
+
+func TestSyncPolicy_UnmarshalText(t *testing.T) {
+	for _, text := range []string{"always", "interval", "never"} {
+		var p SyncPolicy
+		if err := p.UnmarshalText([]byte(text)); err != nil || string(p) != text {
+			t.Errorf("UnmarshalText(%q) = %q, %v", text, p, err)
+		}
+	}
+
+	var p SyncPolicy
+	if err := p.UnmarshalText([]byte("sometimes")); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+}
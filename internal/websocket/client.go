@@ -1,27 +1,45 @@
 package websocket
 
 import (
-	"encoding/json"
-	"log"
+	"context"
+	"log/slog"
 	"net/http"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/tasukuchiba/text_messaging_app/internal/auth"
+	"github.com/tasukuchiba/text_messaging_app/internal/logging"
+	"github.com/tasukuchiba/text_messaging_app/internal/storage"
 )
 
-const (
-	// 書き込み待機時間
-	writeWait = 10 * time.Second
+// ClientConfig はWebSocket接続ごとの設定
+type ClientConfig struct {
+	// クライアントから受け付けるフレームの最大サイズ（バイト）
+	MaxMessageSize int64
 
-	// pongメッセージの待機時間
-	pongWait = 60 * time.Second
+	// 送信待ちのフレームを溜めておく数（溢れたクライアントは切断する）
+	SendBufferSize int
 
-	// ping送信間隔（pongWaitより短くする必要がある）
-	pingPeriod = (pongWait * 9) / 10
+	// pongメッセージの待機時間（pingはこの9/10の間隔で送る）
+	PongWait time.Duration
 
-	// 最大メッセージサイズ
-	maxMessageSize = 512
-)
+	// 書き込み待機時間
+	WriteWait time.Duration
+}
+
+// DefaultClientConfig は設定の指定がない場合の値
+var DefaultClientConfig = ClientConfig{
+	MaxMessageSize: 512,
+	SendBufferSize: 256,
+	PongWait:       60 * time.Second,
+	WriteWait:      10 * time.Second,
+}
+
+// pingPeriod はping送信間隔（PongWaitより短くする必要がある）
+func (cfg ClientConfig) pingPeriod() time.Duration {
+	return (cfg.PongWait * 9) / 10
+}
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
@@ -44,29 +62,98 @@ type Client struct {
 
 	// ユーザー識別子
 	sender string
+
+	// 接続ID（ログで同じ接続の行をまとめるために使う）
+	id string
+
+	// 接続IDとユーザー名を付けたロガー
+	log *slog.Logger
+
+	// 接続の設定（作成時にHubから引き継ぐ）
+	cfg ClientConfig
+
+	// 購読中のルームID（Hubのgoroutineからのみ操作する）
+	rooms map[string]bool
+
+	// 接続時に購読したルームIDと再送開始位置（再接続時のみ）
+	initialRooms []string
+	resumeFrom   *storage.Cursor
+
+	// 再送済みのメッセージIDと、再送の完了時点で send に溜まっていて重複を確かめるライブ配信の残り数
+	// 溜まっていた分を確かめ終えたら replayed は nil に戻す（WritePumpのgoroutineからのみ操作する）
+	replayed      map[string]struct{}
+	replayBacklog int
+
+	// 接続の間有効なコンテキスト（ReadPumpの終了時にキャンセルされる）
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// send のクローズ時に送るクローズコード（0の場合はコードなし）
+	// Hubが send をクローズする前に設定する
+	closeCode int
+
+	// WritePump の終了時にクローズされる
+	done chan struct{}
+
+	// 登録時に presence_snapshot を送るかどうか
+	presenceSnapshot bool
+
+	// ネゴシエートしたプロトコルのバージョン
+	protocol string
+
+	// 流量制限を超えた回数と数え始めた時刻（ReadPumpのgoroutineからのみ操作する）
+	strikes      int
+	strikesSince time.Time
 }
 
 // NewClient は新しいClientを作成する
 func NewClient(hub *Hub, conn *websocket.Conn, sender string) *Client {
+	ctx, cancel := context.WithCancel(context.Background())
+	id := uuid.NewString()
+	cfg := DefaultClientConfig
+	if hub != nil {
+		cfg = hub.clientConfig
+	}
 	return &Client{
 		hub:    hub,
 		conn:   conn,
-		send:   make(chan []byte, 256),
+		send:   make(chan []byte, cfg.SendBufferSize),
 		sender: sender,
+		id:     id,
+		log:    slog.Default().With("conn_id", id, "user", sender),
+		cfg:    cfg,
+		rooms:  make(map[string]bool),
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+
+		protocol: ProtocolV1,
+	}
+}
+
+// logger はこの接続のロガーを返す
+// NewClient を使わずに作成された場合は接続IDなしでユーザー名だけを付ける
+func (c *Client) logger() *slog.Logger {
+	if c.log == nil {
+		return slog.Default().With("user", c.sender)
 	}
+	return c.log
 }
 
 // ReadPump はWebSocket接続からメッセージを読み取る
 func (c *Client) ReadPump() {
 	defer func() {
-		c.hub.unregister <- c
+		c.cancel()
+		c.hub.clearTyping(c)
+		c.hub.unregisterClient(c)
+		c.hub.disconnected(c)
 		c.conn.Close()
 	}()
 
-	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetReadLimit(c.cfg.MaxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(c.cfg.PongWait))
 	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		c.conn.SetReadDeadline(time.Now().Add(c.cfg.PongWait))
 		return nil
 	})
 
@@ -74,45 +161,53 @@ func (c *Client) ReadPump() {
 		_, message, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("WebSocket error: %v", err)
+				c.logger().Warn("WebSocket closed unexpectedly", "error", err)
 			}
 			break
 		}
 
-		// 受信メッセージをパース
-		var inMsg IncomingMessage
-		if err := json.Unmarshal(message, &inMsg); err != nil {
-			log.Printf("Failed to parse message: %v", err)
-			continue
-		}
-
-		// メッセージタイプが"message"の場合のみ処理
-		if inMsg.Type == "message" {
-			if err := c.hub.BroadcastMessage(c.sender, inMsg.Content); err != nil {
-				log.Printf("Failed to broadcast message: %v", err)
-			}
+		if err := c.dispatch(message); err != nil {
+			c.logger().Warn("Disconnecting client", "error", err)
+			c.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "rate limit exceeded"),
+				time.Now().Add(c.cfg.WriteWait))
+			break
 		}
 	}
 }
 
 // WritePump はWebSocket接続にメッセージを書き込む
 func (c *Client) WritePump() {
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(c.cfg.pingPeriod())
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
+		close(c.done)
 	}()
 
+	// 再接続の場合は切断中のメッセージを先に送る
+	if c.resumeFrom != nil {
+		if err := c.replay(*c.resumeFrom); err != nil {
+			c.logger().Error("Failed to replay messages", "error", err)
+			return
+		}
+	}
+
 	for {
 		select {
 		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.SetWriteDeadline(time.Now().Add(c.cfg.WriteWait))
 			if !ok {
 				// Hubがチャネルをクローズした
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				c.conn.WriteMessage(websocket.CloseMessage, c.closeMessage())
 				return
 			}
 
+			// 再送済みのメッセージは送らない
+			if c.isReplayed(message) {
+				continue
+			}
+
 			w, err := c.conn.NextWriter(websocket.TextMessage)
 			if err != nil {
 				return
@@ -122,8 +217,12 @@ func (c *Client) WritePump() {
 			// キューに溜まったメッセージも送信
 			n := len(c.send)
 			for i := 0; i < n; i++ {
+				next := <-c.send
+				if c.isReplayed(next) {
+					continue
+				}
 				w.Write([]byte{'\n'})
-				w.Write(<-c.send)
+				w.Write(next)
 			}
 
 			if err := w.Close(); err != nil {
@@ -131,7 +230,7 @@ func (c *Client) WritePump() {
 			}
 
 		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.SetWriteDeadline(time.Now().Add(c.cfg.WriteWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
@@ -139,22 +238,75 @@ func (c *Client) WritePump() {
 	}
 }
 
+// closeMessage は send のクローズ時に送るクローズフレームのペイロードを返す
+func (c *Client) closeMessage() []byte {
+	switch c.closeCode {
+	case 0:
+		return []byte{}
+	case websocket.CloseGoingAway:
+		return websocket.FormatCloseMessage(c.closeCode, "server shutting down")
+	default:
+		return websocket.FormatCloseMessage(c.closeCode, "")
+	}
+}
+
 // ServeWs はWebSocket接続をアップグレードしてクライアントを登録する
+//
+// 再接続時に cursor または last_message_id を指定すると、それ以降のメッセージを
+// ストレージから再送してからライブ配信に切り替える（replay_complete フレームが境界）。
+// 送信者は auth.TokenManager.Middleware で認証済みのユーザーから決まる。
+// Sec-WebSocket-Protocol でプロトコルのバージョンを指定できる（省略時は ProtocolV1）。
 func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
-	sender := r.URL.Query().Get("sender")
-	if sender == "" {
-		http.Error(w, "sender parameter is required", http.StatusBadRequest)
+	id, ok := auth.IdentityFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+	sender := id.Username
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	resume, err := parseResumeOptions(hub, r)
 	if err != nil {
-		log.Printf("WebSocket upgrade error: %v", err)
+		status, msg := resumeErrorStatus(err)
+		http.Error(w, msg, status)
+		return
+	}
+
+	protocol, header, ok := negotiateProtocol(r)
+	if !ok {
+		http.Error(w, "Unsupported WebSocket protocol", http.StatusBadRequest)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, header)
+	if err != nil {
+		slog.WarnContext(r.Context(), "WebSocket upgrade failed", "error", err)
 		return
 	}
 
 	client := NewClient(hub, conn, sender)
-	client.hub.register <- client
+	if requestID := logging.RequestIDFromContext(r.Context()); requestID != "" {
+		// 接続を開いたHTTPリクエストと接続のログを結び付ける
+		client.log = client.log.With("request_id", requestID)
+	}
+	client.initialRooms = resume.rooms
+	client.resumeFrom = resume.from
+	client.presenceSnapshot = true
+	client.protocol = protocol
+	for _, roomID := range resume.rooms {
+		client.rooms[roomID] = true
+	}
+
+	// 再送の読み出しより先に登録し、その間のライブ配信を取りこぼさないようにする
+	if !client.hub.registerClient(client) {
+		// シャットダウン中は接続を受け付けない
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+			time.Now().Add(client.cfg.WriteWait))
+		conn.Close()
+		client.cancel()
+		return
+	}
+	hub.connected(client)
 
 	// goroutineで読み書きを並行実行
 	go client.WritePump()
@@ -1,6 +1,9 @@
 package websocket
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -8,10 +11,76 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/tasukuchiba/text_messaging_app/internal/auth"
+	"github.com/tasukuchiba/text_messaging_app/internal/models"
 	"github.com/tasukuchiba/text_messaging_app/internal/storage"
 )
 
-func TestServeWs_MissingSender(t *testing.T) {
+// testTokens はテスト用のセッショントークンを発行・検証する
+var testTokens = auth.NewTokenManager([]byte("test-secret"), time.Hour)
+
+// newTestServer は認証ミドルウェアを通してServeWsを呼ぶテスト用HTTPサーバーを作成する
+func newTestServer(hub *Hub) *httptest.Server {
+	return httptest.NewServer(testTokens.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWs(hub, w, r)
+	})))
+}
+
+// tokenQuery は指定したユーザーとして接続するためのクエリ文字列を返す
+func tokenQuery(t *testing.T, username string) string {
+	t.Helper()
+	token, _, err := testTokens.Issue(models.User{ID: username + "-id", Username: username})
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+	return "?token=" + token
+}
+
+// frameReader は接続から1フレームずつ読み出すテスト用のヘルパー
+//
+// まとめて書き込まれたフレーム（改行区切り）を分割し、
+// 接続時やユーザーの出入りで届く presence_* フレームは読み飛ばす。
+type frameReader struct {
+	t       *testing.T
+	conn    *websocket.Conn
+	pending [][]byte
+}
+
+// newFrameReader は新しいframeReaderを作成する
+func newFrameReader(t *testing.T, conn *websocket.Conn) *frameReader {
+	return &frameReader{t: t, conn: conn}
+}
+
+// next は presence_* 以外の次のフレームを返す
+func (r *frameReader) next() []byte {
+	r.t.Helper()
+	for {
+		frame := r.read()
+		if !strings.HasPrefix(string(frame), `{"type":"presence_`) {
+			return frame
+		}
+	}
+}
+
+// read は種類に関係なく次のフレームを返す
+func (r *frameReader) read() []byte {
+	r.t.Helper()
+	for len(r.pending) == 0 {
+		r.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, data, err := r.conn.ReadMessage()
+		if err != nil {
+			r.t.Fatalf("Failed to read frame: %v", err)
+		}
+		for _, frame := range strings.Split(string(data), "\n") {
+			r.pending = append(r.pending, []byte(frame))
+		}
+	}
+	frame := r.pending[0]
+	r.pending = r.pending[1:]
+	return frame
+}
+
+func TestServeWs_Unauthenticated(t *testing.T) {
 	store := storage.NewMemoryStorage()
 	hub := NewHub(store)
 	go hub.Run()
@@ -22,8 +91,19 @@ func TestServeWs_MissingSender(t *testing.T) {
 	ServeWs(hub, w, req)
 
 	resp := w.Result()
-	if resp.StatusCode != http.StatusBadRequest {
-		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	// sender クエリパラメータで送信者を名乗ることはできない
+	server := newTestServer(hub)
+	defer server.Close()
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?sender=alice", nil)
+	if err == nil {
+		t.Fatal("Expected connection without token to fail")
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, resp.StatusCode)
 	}
 }
 
@@ -33,13 +113,11 @@ func TestServeWs_Connection(t *testing.T) {
 	go hub.Run()
 
 	// テスト用HTTPサーバーを作成
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ServeWs(hub, w, r)
-	}))
+	server := newTestServer(hub)
 	defer server.Close()
 
 	// HTTP URLをWebSocket URLに変換
-	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "?sender=alice"
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + tokenQuery(t, "alice")
 
 	// WebSocket接続
 	dialer := websocket.Dialer{}
@@ -65,23 +143,21 @@ func TestClient_MessageFlow(t *testing.T) {
 	hub := NewHub(store)
 	go hub.Run()
 
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ServeWs(hub, w, r)
-	}))
+	server := newTestServer(hub)
 	defer server.Close()
 
 	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
 
 	// クライアント1 (alice) を接続
 	dialer := websocket.Dialer{}
-	conn1, _, err := dialer.Dial(wsURL+"?sender=alice", nil)
+	conn1, _, err := dialer.Dial(wsURL+tokenQuery(t, "alice"), nil)
 	if err != nil {
 		t.Fatalf("Failed to connect alice: %v", err)
 	}
 	defer conn1.Close()
 
 	// クライアント2 (bob) を接続
-	conn2, _, err := dialer.Dial(wsURL+"?sender=bob", nil)
+	conn2, _, err := dialer.Dial(wsURL+tokenQuery(t, "bob"), nil)
 	if err != nil {
 		t.Fatalf("Failed to connect bob: %v", err)
 	}
@@ -101,11 +177,7 @@ func TestClient_MessageFlow(t *testing.T) {
 	}
 
 	// bobがメッセージを受信することを確認
-	conn2.SetReadDeadline(time.Now().Add(2 * time.Second))
-	_, msg, err := conn2.ReadMessage()
-	if err != nil {
-		t.Fatalf("Failed to read message: %v", err)
-	}
+	msg := newFrameReader(t, conn2).next()
 
 	if !strings.Contains(string(msg), "Hello from Alice!") {
 		t.Errorf("Expected message to contain 'Hello from Alice!', got '%s'", string(msg))
@@ -116,18 +188,14 @@ func TestClient_MessageFlow(t *testing.T) {
 	}
 
 	// aliceも自分のメッセージを受信することを確認
-	conn1.SetReadDeadline(time.Now().Add(2 * time.Second))
-	_, msg, err = conn1.ReadMessage()
-	if err != nil {
-		t.Fatalf("Failed to read own message: %v", err)
-	}
+	msg = newFrameReader(t, conn1).next()
 
 	if !strings.Contains(string(msg), "Hello from Alice!") {
 		t.Errorf("Expected alice to receive own message")
 	}
 
 	// ストレージにメッセージが保存されていることを確認
-	messages, err := store.GetAll()
+	messages, err := store.GetAll(context.Background())
 	if err != nil {
 		t.Fatalf("Failed to get messages: %v", err)
 	}
@@ -140,17 +208,145 @@ func TestClient_MessageFlow(t *testing.T) {
 	}
 }
 
+func TestClient_AckAndDeduplication(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	hub := NewHub(store)
+	go hub.Run()
+
+	server := newTestServer(hub)
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+tokenQuery(t, "alice"), nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	frames := newFrameReader(t, conn)
+
+	// readUntil は指定した種類のフレームが届くまで読み進める
+	readUntil := func(frameType string) map[string]any {
+		t.Helper()
+		for {
+			var frame map[string]any
+			if err := json.Unmarshal(frames.next(), &frame); err != nil {
+				t.Fatalf("Failed to unmarshal frame: %v", err)
+			}
+			if frame["type"] == frameType {
+				return frame
+			}
+		}
+	}
+
+	send := `{"type":"message","content":"Hello","client_msg_id":"c-1"}`
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(send)); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	ack := readUntil("ack")
+	if ack["client_msg_id"] != "c-1" || ack["id"] == "" || ack["created_at"] == nil {
+		t.Fatalf("Unexpected ack: %v", ack)
+	}
+	if _, ok := ack["duplicate"]; ok {
+		t.Errorf("First ack should not be a duplicate: %v", ack)
+	}
+
+	// 同じ client_msg_id で再送すると、保存済みのメッセージの ack が返る
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(send)); err != nil {
+		t.Fatalf("Failed to resend message: %v", err)
+	}
+	retry := readUntil("ack")
+	if retry["id"] != ack["id"] || retry["duplicate"] != true {
+		t.Errorf("Expected duplicate ack for %v, got %v", ack["id"], retry)
+	}
+
+	messages, _ := store.GetAll(context.Background())
+	if len(messages) != 1 {
+		t.Errorf("Expected 1 message in storage, got %d", len(messages))
+	}
+
+	// 保存に失敗した場合は error フレームが返る
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"message","room_id":"non-existent","content":"Hi","client_msg_id":"c-2"}`)); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	failed := readUntil("error")
+	if failed["ref"] != "c-2" || failed["code"] != "not_found" || failed["message"] != "room not found" {
+		t.Errorf("Unexpected error frame: %v", failed)
+	}
+}
+
+func TestClient_ThreadReply(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	hub := NewHub(store)
+	go hub.Run()
+
+	server := newTestServer(hub)
+	defer server.Close()
+
+	root, err := hub.Messages().CreateMessage(context.Background(), "", "bob", "Lunch?")
+	if err != nil {
+		t.Fatalf("CreateMessage failed: %v", err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+tokenQuery(t, "alice"), nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	frames := newFrameReader(t, conn)
+
+	// readUntil は指定した種類のフレームが届くまで読み進める
+	readUntil := func(frameType string) map[string]any {
+		t.Helper()
+		for {
+			var frame map[string]any
+			if err := json.Unmarshal(frames.next(), &frame); err != nil {
+				t.Fatalf("Failed to unmarshal frame: %v", err)
+			}
+			if frame["type"] == frameType {
+				return frame
+			}
+		}
+	}
+
+	// parent_id を付けると返信になり、起点の返信数を付けた thread_reply が配信される
+	send := `{"type":"message","parent_id":"` + root.ID + `","content":"Sure","client_msg_id":"c-1"}`
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(send)); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	reply := readUntil("thread_reply")
+	if reply["parent_id"] != root.ID || reply["thread_root_id"] != root.ID || reply["content"] != "Sure" {
+		t.Errorf("Unexpected thread_reply: %v", reply)
+	}
+	if reply["reply_count"] != float64(1) || reply["last_reply_at"] != reply["created_at"] {
+		t.Errorf("Expected thread stats in thread_reply, got %v", reply)
+	}
+	if ack := readUntil("ack"); ack["id"] != reply["id"] {
+		t.Errorf("Expected ack for %v, got %v", reply["id"], ack)
+	}
+
+	updated, err := store.GetByID(context.Background(), root.ID)
+	if err != nil || updated.ReplyCount != 1 {
+		t.Errorf("Expected reply count 1, got %+v (%v)", updated, err)
+	}
+
+	// 返信先が存在しない場合は error フレームが返る
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"message","parent_id":"non-existent","content":"Hi","client_msg_id":"c-2"}`)); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	failed := readUntil("error")
+	if failed["ref"] != "c-2" || failed["code"] != "not_found" || failed["message"] != "parent message not found" {
+		t.Errorf("Unexpected error frame: %v", failed)
+	}
+}
+
 func TestClient_Disconnect(t *testing.T) {
 	store := storage.NewMemoryStorage()
 	hub := NewHub(store)
 	go hub.Run()
 
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ServeWs(hub, w, r)
-	}))
+	server := newTestServer(hub)
 	defer server.Close()
 
-	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "?sender=alice"
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + tokenQuery(t, "alice")
 
 	dialer := websocket.Dialer{}
 	conn, _, err := dialer.Dial(wsURL, nil)
@@ -192,4 +388,232 @@ func TestNewClient(t *testing.T) {
 	if client.send == nil {
 		t.Error("send channel is nil")
 	}
+
+	// 接続ごとに異なるIDが割り当てられる
+	if client.id == "" || client.log == nil {
+		t.Error("connection ID and logger should be set")
+	}
+	if other := NewClient(hub, nil, "test-sender"); other.id == client.id {
+		t.Errorf("Expected distinct connection IDs, both were %s", client.id)
+	}
+}
+
+func TestServeWs_ResumeReplaysMissedMessages(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	store.CreateRoom(context.Background(), models.Room{ID: "room-1", Name: "general", CreatedAt: time.Now()})
+	hub := NewHub(store)
+	go hub.Run()
+
+	server := newTestServer(hub)
+	defer server.Close()
+
+	// 切断前に受信していたメッセージと、切断中に届いたメッセージ（全体・購読ルーム）
+	base := time.Now().Add(-time.Minute)
+	seen := models.Message{ID: "seen", Sender: "bob", Content: "before disconnect", CreatedAt: base}
+	store.Save(context.Background(), seen)
+	store.Save(context.Background(), models.Message{ID: "missed-1", Sender: "bob", Content: "missed global", CreatedAt: base.Add(time.Second)})
+	store.Save(context.Background(), models.Message{ID: "missed-2", RoomID: "room-1", Sender: "bob", Content: "missed room", CreatedAt: base.Add(2 * time.Second)})
+	store.AddReaction(context.Background(), "missed-1", "👍", "alice", base.Add(3*time.Second))
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") +
+		tokenQuery(t, "alice") + "&rooms=room-1&last_message_id=" + seen.ID
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	frames := newFrameReader(t, conn)
+	readFrame := func() map[string]any {
+		t.Helper()
+		data := frames.next()
+		var frame map[string]any
+		if err := json.Unmarshal(data, &frame); err != nil {
+			t.Fatalf("Failed to unmarshal frame %s: %v", data, err)
+		}
+		return frame
+	}
+
+	// 作成日時順に再送され、最後に replay_complete が届く
+	for _, want := range []string{"missed-1", "missed-2"} {
+		frame := readFrame()
+		if frame["type"] != "message" || frame["id"] != want {
+			t.Fatalf("Expected replayed message %s, got %v", want, frame)
+		}
+
+		// 再送するメッセージには接続したユーザーから見たリアクションが付く
+		if want == "missed-1" {
+			reactions, _ := frame["reactions"].([]any)
+			if len(reactions) != 1 || fmt.Sprint(reactions[0]) != "map[count:1 emoji:👍 reacted_by_me:true]" {
+				t.Errorf("Expected reactions in replayed message, got %v", frame["reactions"])
+			}
+		}
+	}
+	complete := readFrame()
+	if complete["type"] != "replay_complete" || complete["count"] != float64(2) || complete["truncated"] != false {
+		t.Fatalf("Unexpected replay_complete frame: %v", complete)
+	}
+
+	// 以降はライブ配信に切り替わる
+	if _, err := hub.Messages().CreateMessage(context.Background(), "room-1", "bob", "live"); err != nil {
+		t.Fatalf("CreateMessage failed: %v", err)
+	}
+	live := readFrame()
+	if live["type"] != "message" || live["content"] != "live" {
+		t.Fatalf("Expected live message, got %v", live)
+	}
+
+	// 受け取った cursor で再接続すると、それ以降のみ再送される
+	conn2, _, err := websocket.DefaultDialer.Dial(
+		"ws"+strings.TrimPrefix(server.URL, "http")+tokenQuery(t, "alice")+"&rooms=room-1&cursor="+live["cursor"].(string), nil)
+	if err != nil {
+		t.Fatalf("Failed to reconnect: %v", err)
+	}
+	defer conn2.Close()
+	data := newFrameReader(t, conn2).next()
+	if !strings.Contains(string(data), `"type":"replay_complete","count":0`) {
+		t.Errorf("Expected empty replay, got %s", data)
+	}
+}
+
+func TestServeWs_ResumeReplaysMissedThreadReplies(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	hub := NewHub(store)
+	go hub.Run()
+
+	server := newTestServer(hub)
+	defer server.Close()
+
+	// 切断前から受信していたスレッドの起点に、切断中に返信とメッセージが届く
+	base := time.Now().Add(-time.Minute)
+	root := models.Message{ID: "root", Sender: "bob", Content: "root", CreatedAt: base}
+	store.Save(context.Background(), root)
+	store.Save(context.Background(), models.Message{ID: "reply-1", Sender: "bob", Content: "missed reply", CreatedAt: base.Add(time.Second), ParentID: "root", ThreadRootID: "root"})
+	store.Save(context.Background(), models.Message{ID: "missed", Sender: "bob", Content: "missed message", CreatedAt: base.Add(2 * time.Second)})
+	store.Save(context.Background(), models.Message{ID: "reply-2", Sender: "carol", Content: "missed reply", CreatedAt: base.Add(3 * time.Second), ParentID: "reply-1", ThreadRootID: "root"})
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+tokenQuery(t, "alice")+"&last_message_id="+root.ID, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	frames := newFrameReader(t, conn)
+	readFrame := func() map[string]any {
+		t.Helper()
+		data := frames.next()
+		var frame map[string]any
+		if err := json.Unmarshal(data, &frame); err != nil {
+			t.Fatalf("Failed to unmarshal frame %s: %v", data, err)
+		}
+		return frame
+	}
+
+	// 返信は thread_reply としてメッセージと同じカーソルの順に再送され、起点の現在の返信数が付く
+	for _, want := range []struct{ frameType, id string }{
+		{"thread_reply", "reply-1"},
+		{"message", "missed"},
+		{"thread_reply", "reply-2"},
+	} {
+		frame := readFrame()
+		if frame["type"] != want.frameType || frame["id"] != want.id {
+			t.Fatalf("Expected replayed %s %s, got %v", want.frameType, want.id, frame)
+		}
+		if want.frameType == "thread_reply" && (frame["thread_root_id"] != "root" || frame["reply_count"] != float64(2)) {
+			t.Errorf("Expected thread stats of root, got %v", frame)
+		}
+	}
+	complete := readFrame()
+	if complete["type"] != "replay_complete" || complete["count"] != float64(3) {
+		t.Fatalf("Unexpected replay_complete frame: %v", complete)
+	}
+
+	// 以降の返信はライブ配信で届く
+	if _, _, err := hub.Messages().SendReply(context.Background(), "", "root", "bob", "live reply", ""); err != nil {
+		t.Fatalf("SendReply failed: %v", err)
+	}
+	live := readFrame()
+	if live["type"] != "thread_reply" || live["content"] != "live reply" || live["reply_count"] != float64(3) {
+		t.Fatalf("Expected live thread_reply, got %v", live)
+	}
+}
+
+func TestServeWs_ResumeInvalidParams(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	hub := NewHub(store)
+	go hub.Run()
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+	}{
+		{"invalid cursor", "?cursor=invalid", http.StatusBadRequest},
+		{"unknown last_message_id", "?last_message_id=non-existent", http.StatusNotFound},
+		{"unknown room", "?rooms=non-existent", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/ws"+tt.query, nil)
+			req = req.WithContext(auth.WithIdentity(req.Context(), auth.Identity{UserID: "alice-id", Username: "alice"}))
+			w := httptest.NewRecorder()
+
+			ServeWs(hub, w, req)
+
+			if w.Code != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, w.Code)
+			}
+		})
+	}
+}
+
+func TestClient_IsReplayed(t *testing.T) {
+	client := NewClient(nil, nil, "alice")
+
+	// 再送していなければ全て通す
+	if client.isReplayed([]byte(`{"type":"message","id":"1"}`)) {
+		t.Error("Expected frame to pass before replay")
+	}
+
+	// 再送の完了時点で4件のライブ配信が溜まっていた
+	client.replayed = map[string]struct{}{"1": {}}
+	client.replayBacklog = 4
+
+	if !client.isReplayed([]byte(`{"type":"message","id":"1"}`)) {
+		t.Error("Expected replayed message to be skipped")
+	}
+	if client.isReplayed([]byte(`{"type":"message","id":"2"}`)) {
+		t.Error("Expected new message to pass")
+	}
+	if !client.isReplayed([]byte(`{"type":"thread_reply","id":"1"}`)) {
+		t.Error("Expected replayed thread reply to be skipped")
+	}
+	if client.isReplayed([]byte(`{"type":"message_edited","id":"1"}`)) {
+		t.Error("Expected edit event of replayed message to pass")
+	}
+
+	// 溜まっていた分を確かめ終えたら記録を捨てる
+	if client.replayed != nil {
+		t.Errorf("Expected replayed IDs to be cleared after the backlog, got %v", client.replayed)
+	}
+	if client.isReplayed([]byte(`{"type":"message","id":"1"}`)) {
+		t.Error("Expected frame to pass after the backlog")
+	}
+}
+
+func TestNewClient_UsesHubClientConfig(t *testing.T) {
+	cfg := ClientConfig{MaxMessageSize: 1024, SendBufferSize: 8, PongWait: 10 * time.Second, WriteWait: time.Second}
+	hub := NewHub(storage.NewMemoryStorage(), WithClientConfig(cfg))
+
+	client := NewClient(hub, nil, "alice")
+	if client.cfg != cfg {
+		t.Errorf("Expected client config %+v, got %+v", cfg, client.cfg)
+	}
+	if cap(client.send) != 8 {
+		t.Errorf("Expected send buffer of 8, got %d", cap(client.send))
+	}
+	if got := client.cfg.pingPeriod(); got != 9*time.Second {
+		t.Errorf("Expected ping period of 9s, got %s", got)
+	}
 }
@@ -1,12 +1,20 @@
 package websocket
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/tasukuchiba/text_messaging_app/internal/backplane"
 	"github.com/tasukuchiba/text_messaging_app/internal/models"
+	"github.com/tasukuchiba/text_messaging_app/internal/ratelimit"
+	"github.com/tasukuchiba/text_messaging_app/internal/service"
 	"github.com/tasukuchiba/text_messaging_app/internal/storage"
 )
 
@@ -15,8 +23,8 @@ type Hub struct {
 	// 接続中のクライアント
 	clients map[*Client]bool
 
-	// ブロードキャスト用チャネル
-	broadcast chan []byte
+	// バックプレーン経由で届くブロードキャスト用チャネル
+	broadcast <-chan []byte
 
 	// クライアント登録用チャネル
 	register chan *Client
@@ -24,98 +32,599 @@ type Hub struct {
 	// クライアント登録解除用チャネル
 	unregister chan *Client
 
+	// ルーム購読・購読解除用チャネル
+	subscribe   chan subscription
+	unsubscribe chan subscription
+
+	// 特定のクライアントだけに送るフレーム用チャネル
+	direct chan directFrame
+
 	// メッセージ永続化用ストレージ
 	storage storage.Storage
+
+	// メッセージの書き込みとイベント配信を行うサービス
+	messages *service.MessageService
+
+	// インスタンス間でブロードキャストを中継するバックプレーン
+	backplane backplane.Backplane
+
+	// 接続中のクライアント数（Hubのgoroutine以外から参照するため別に持つ）
+	count atomic.Int64
+
+	// stop はクローズすると Run を終了させる
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	// done は Run の終了時にクローズされる
+	done chan struct{}
+
+	// Run のループが動いているか確認するためのチャネル（Ping で使う）
+	heartbeat chan struct{}
+
+	// 停止時に切断したクライアント（done のクローズ後に Stop が参照する）
+	closing []*Client
+
+	// 入力中のユーザー
+	typing *typingTracker
+
+	// 配信の遅延や切断したクライアントの記録先
+	metrics HubMetrics
+
+	// クライアントから受信するフレームの流量制限（nil の場合は制限しない）
+	limiter *ratelimit.Limiter
+
+	// 入力中の通知フレームの流量制限（nil の場合は制限しない）
+	typingLimiter *ratelimit.Limiter
+
+	// 接続するクライアントの設定
+	clientConfig ClientConfig
+
+	// オンライン中のユーザーと、バックプレーン上でこのインスタンスを区別するID
+	presence *presenceTracker
+	instance string
+}
+
+// ErrHubStopped は停止済みのHubを操作しようとした場合のエラー
+var ErrHubStopped = errors.New("hub stopped")
+
+// HubOption はHubの設定を変更する関数
+type HubOption func(*Hub)
+
+// WithBackplane はブロードキャストに使うバックプレーンを指定する
+// 指定しない場合はプロセス内だけで配信する MemoryBackplane を使う
+func WithBackplane(bp backplane.Backplane) HubOption {
+	return func(h *Hub) {
+		h.backplane = bp
+	}
+}
+
+// HubMetrics はHubの動作を記録するインターフェース
+// metrics.Metrics が実装する
+type HubMetrics interface {
+	// ObserveFanOut はブロードキャストの配信にかかった時間を記録する
+	ObserveFanOut(d time.Duration)
+
+	// ClientDropped は送信バッファが溢れて切断したクライアントを数える
+	ClientDropped()
+}
+
+// noopMetrics は何も記録しない HubMetrics
+type noopMetrics struct{}
+
+func (noopMetrics) ObserveFanOut(time.Duration) {}
+func (noopMetrics) ClientDropped()              {}
+
+// WithMetrics はHubの動作の記録先を指定する
+func WithMetrics(m HubMetrics) HubOption {
+	return func(h *Hub) {
+		h.metrics = m
+	}
+}
+
+// WithFrameRateLimit はクライアントから受信するフレームの流量制限を指定する
+// 同じユーザーの接続は全て同じ制限を共有する
+func WithFrameRateLimit(limiter *ratelimit.Limiter) HubOption {
+	return func(h *Hub) {
+		h.limiter = limiter
+	}
+}
+
+// WithTypingRateLimit は入力中の通知フレーム（typing_start/typing_stop）の流量制限を指定する
+// 同じユーザーの接続は全て同じ制限を共有する
+func WithTypingRateLimit(limiter *ratelimit.Limiter) HubOption {
+	return func(h *Hub) {
+		h.typingLimiter = limiter
+	}
+}
+
+// frameLimiter はバケットの種類に対応する Limiter を返す
+func (h *Hub) frameLimiter(bucket frameBucket) *ratelimit.Limiter {
+	if bucket == bucketTyping {
+		return h.typingLimiter
+	}
+	return h.limiter
+}
+
+// WithClientConfig は接続するクライアントの設定を指定する
+func WithClientConfig(cfg ClientConfig) HubOption {
+	return func(h *Hub) {
+		h.clientConfig = cfg
+	}
 }
 
 // IncomingMessage はクライアントから受信するメッセージの形式
+//
+// 受け付ける Type はプロトコルのバージョンごとに frameHandlers に登録されている。
 type IncomingMessage struct {
 	Type    string `json:"type"`
+	ID      string `json:"id,omitempty"`
+	RoomID  string `json:"room_id,omitempty"`
 	Content string `json:"content"`
+
+	// クライアントが付けたメッセージID（"message" のみ）
+	// 指定すると ack フレームが返り、同じIDでの再送は重複排除される
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+
+	// 返信先のメッセージID（"message" のみ）
+	// 指定するとスレッドへの返信になり、message ではなく thread_reply として配信される
+	ParentID string `json:"parent_id,omitempty"`
+
+	// クライアントが付けた任意の参照ID（error フレームの ref にそのまま返す）
+	// 省略した場合は client_msg_id を使う
+	Ref string `json:"ref,omitempty"`
 }
 
 // OutgoingMessage はクライアントへ送信するメッセージの形式
 type OutgoingMessage struct {
 	Type      string    `json:"type"`
 	ID        string    `json:"id"`
+	RoomID    string    `json:"room_id,omitempty"`
 	Sender    string    `json:"sender"`
 	Content   string    `json:"content"`
 	CreatedAt time.Time `json:"created_at"`
+
+	Edited    bool       `json:"edited,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+
+	// 再接続時に cursor パラメータとして渡すと、このメッセージ以降を再送する
+	Cursor string `json:"cursor,omitempty"`
+
+	// 送信したクライアントが付けたID（送信者の他の接続が自分の送信と照合するため）
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+
+	// スレッドへの返信の場合の返信先と起点のメッセージID
+	ParentID     string `json:"parent_id,omitempty"`
+	ThreadRootID string `json:"thread_root_id,omitempty"`
+
+	// スレッドの返信数と最後の返信日時
+	// thread_reply では、この返信を保存した後の起点の値になる
+	ReplyCount  int        `json:"reply_count,omitempty"`
+	LastReplyAt *time.Time `json:"last_reply_at,omitempty"`
+
+	// 再送するメッセージのリアクションの集計（配信するイベントには付けず、変更は ReactionMessage で知らせる）
+	Reactions []models.Reaction `json:"reactions,omitempty"`
+}
+
+// ReactionMessage はリアクションの追加・削除を知らせるフレーム
+type ReactionMessage struct {
+	Type string `json:"type"`
+
+	// リアクションされたメッセージと、その配信先とスレッド
+	ID           string `json:"id"`
+	RoomID       string `json:"room_id,omitempty"`
+	ThreadRootID string `json:"thread_root_id,omitempty"`
+
+	Emoji string `json:"emoji"`
+	User  string `json:"user"`
+
+	// 変更後のこの絵文字のリアクション数（0 になったら表示から消す）
+	Count int `json:"count"`
+}
+
+// AckMessage は client_msg_id 付きで送信されたメッセージの保存完了を送信者に知らせるフレーム
+type AckMessage struct {
+	Type        string    `json:"type"`
+	ClientMsgID string    `json:"client_msg_id"`
+	ID          string    `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+
+	// 再送されたメッセージが既に保存済みだった場合に true
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+// newOutgoingMessage はメッセージから送信用のフレームを作成する
+func newOutgoingMessage(frameType string, msg models.Message) OutgoingMessage {
+	return OutgoingMessage{
+		Type:      frameType,
+		ID:        msg.ID,
+		RoomID:    msg.RoomID,
+		Sender:    msg.Sender,
+		Content:   msg.Content,
+		CreatedAt: msg.CreatedAt,
+		Edited:    msg.Edited,
+		UpdatedAt: msg.UpdatedAt,
+		Cursor:    storage.CursorOf(msg).Encode(),
+
+		ClientMsgID: msg.ClientMsgID,
+
+		ParentID:     msg.ParentID,
+		ThreadRootID: msg.ThreadRootID,
+		ReplyCount:   msg.ReplyCount,
+		LastReplyAt:  msg.LastReplyAt,
+
+		Reactions: msg.Reactions,
+	}
+}
+
+// envelope はバックプレーンを流れるブロードキャストメッセージ
+type envelope struct {
+	// 配信先のルームID（空の場合は全クライアント）
+	RoomID string `json:"room_id,omitempty"`
+
+	// 配信しない送信者（自分の入力中の状態などを本人の接続に返さないため）
+	Exclude string `json:"exclude,omitempty"`
+
+	// クライアントにそのまま送るフレーム
+	Data json.RawMessage `json:"data,omitempty"`
+
+	// インスタンス間で共有するオンライン状態の変化（Data の代わりに送る）
+	Presence *presenceUpdate `json:"presence,omitempty"`
+
+	// 配信元が送信した時刻（配信にかかった時間の計測に使う）
+	PublishedAt time.Time `json:"published_at"`
+}
+
+// directFrame は特定のクライアントだけに送るフレーム
+type directFrame struct {
+	client *Client
+	data   []byte
+}
+
+// subscription はクライアントのルーム購読要求
+type subscription struct {
+	client *Client
+	roomID string
 }
 
 // NewHub は新しいHubを作成する
-func NewHub(store storage.Storage) *Hub {
-	return &Hub{
-		clients:    make(map[*Client]bool),
-		broadcast:  make(chan []byte),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		storage:    store,
+func NewHub(store storage.Storage, opts ...HubOption) *Hub {
+	h := &Hub{
+		clients:     make(map[*Client]bool),
+		register:    make(chan *Client),
+		unregister:  make(chan *Client),
+		subscribe:   make(chan subscription),
+		unsubscribe: make(chan subscription),
+		direct:      make(chan directFrame),
+		storage:     store,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+		heartbeat:   make(chan struct{}),
+		typing:      newTypingTracker(DefaultTypingTTL),
+		presence:    newPresenceTracker(),
+		instance:    uuid.New().String(),
+		metrics:     noopMetrics{},
+
+		clientConfig: DefaultClientConfig,
+	}
+	for _, opt := range opts {
+		opt(h)
 	}
+	if h.backplane == nil {
+		h.backplane = backplane.NewMemoryBackplane()
+	}
+	h.broadcast = h.backplane.Subscribe()
+	h.messages = service.NewMessageService(store, h)
+	return h
 }
 
 // Run はHubのメインループを開始する
+// Stop が呼ばれると全クライアントを切断して終了する
 func (h *Hub) Run() {
+	defer close(h.done)
+
+	// 先に起動しているインスタンスに接続中のユーザーを問い合わせる
+	go h.requestPresenceSync()
+
+	// 生存していることを定期的に配信し、ハートビートが途絶えたインスタンスのユーザーを取り除く
+	// presenceResyncHeartbeats 回ごとに接続中の全ユーザーも配信し直す
+	presenceTicker := time.NewTicker(h.presence.heartbeat)
+	defer presenceTicker.Stop()
+	heartbeats := 0
+
 	for {
 		select {
+		case <-h.stop:
+			h.closeAll()
+			return
+
 		case client := <-h.register:
 			h.clients[client] = true
-			log.Printf("Client registered: %s (total: %d)", client.sender, len(h.clients))
+			h.count.Store(int64(len(h.clients)))
+			client.logger().Info("Client registered", "total", len(h.clients))
+			if client.presenceSnapshot {
+				h.sendPresenceSnapshot(client)
+			}
 
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
 				delete(h.clients, client)
 				close(client.send)
-				log.Printf("Client unregistered: %s (total: %d)", client.sender, len(h.clients))
+				h.count.Store(int64(len(h.clients)))
+				client.logger().Info("Client unregistered", "total", len(h.clients))
+			}
+
+		case sub := <-h.subscribe:
+			if _, ok := h.clients[sub.client]; ok {
+				sub.client.rooms[sub.roomID] = true
 			}
 
-		case message := <-h.broadcast:
-			for client := range h.clients {
+		case sub := <-h.unsubscribe:
+			delete(sub.client.rooms, sub.roomID)
+
+		case <-h.heartbeat:
+			// Ping に応答するだけ
+
+		case <-presenceTicker.C:
+			// Hubのgoroutineからは配信しない（自分の受信チャネルが詰まると止まるため）
+			heartbeats++
+			go h.sendPresenceHeartbeat(heartbeats%presenceResyncHeartbeats == 0)
+			h.expirePresence()
+
+		case d := <-h.direct:
+			// 登録解除済みのクライアントの send はクローズされているので送らない
+			if _, ok := h.clients[d.client]; ok {
 				select {
-				case client.send <- message:
+				case d.client.send <- d.data:
 				default:
-					close(client.send)
-					delete(h.clients, client)
 				}
 			}
+
+		case payload, ok := <-h.broadcast:
+			if !ok {
+				// バックプレーンが閉じられたので、ハートビートも配信しない
+				h.broadcast = nil
+				presenceTicker.Stop()
+				continue
+			}
+			var env envelope
+			if err := json.Unmarshal(payload, &env); err != nil {
+				slog.Error("Failed to parse broadcast", "error", err)
+				continue
+			}
+			if env.Presence != nil {
+				h.handlePresence(*env.Presence)
+				continue
+			}
+			h.fanOut(env)
+		}
+	}
+}
+
+// fanOut は配信先に該当する接続中のクライアントにフレームを送る
+func (h *Hub) fanOut(env envelope) {
+	for client := range h.clients {
+		// ルーム宛てのメッセージは購読中のクライアントにのみ配信する
+		if env.RoomID != "" && !client.rooms[env.RoomID] {
+			continue
+		}
+		if env.Exclude != "" && client.sender == env.Exclude {
+			continue
+		}
+		select {
+		case client.send <- env.Data:
+		default:
+			close(client.send)
+			delete(h.clients, client)
+			h.count.Store(int64(len(h.clients)))
+			h.metrics.ClientDropped()
+		}
+	}
+
+	if !env.PublishedAt.IsZero() {
+		h.metrics.ObserveFanOut(time.Since(env.PublishedAt))
+	}
+}
+
+// closeAll は全クライアントに going away のクローズフレームを送らせて登録を解除する
+func (h *Hub) closeAll() {
+	for client := range h.clients {
+		// send のクローズより前に書き込むので、WritePump からは同期なしで読める
+		client.closeCode = websocket.CloseGoingAway
+		close(client.send)
+		h.closing = append(h.closing, client)
+		delete(h.clients, client)
+	}
+	h.count.Store(0)
+	slog.Info("Hub stopped", "closing", len(h.closing))
+}
+
+// Stop はHubを停止し、全クライアントにクローズフレームが送られるまで待つ
+//
+// ctx の期限を過ぎた場合は待つのをやめて ctx のエラーを返す。複数回呼んでもよい。
+func (h *Hub) Stop(ctx context.Context) error {
+	h.stopOnce.Do(func() {
+		// 他のインスタンスに残っているクライアントから見てオフラインにする
+		h.leaveAll()
+		close(h.stop)
+	})
+
+	select {
+	case <-h.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	for _, client := range h.closing {
+		select {
+		case <-client.done:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
+	return nil
+}
+
+// registerClient はクライアントを登録する（停止済みの場合は false を返す）
+func (h *Hub) registerClient(client *Client) bool {
+	select {
+	case h.register <- client:
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+// unregisterClient はクライアントの登録を解除する
+func (h *Hub) unregisterClient(client *Client) {
+	select {
+	case h.unregister <- client:
+	case <-h.done:
+	}
 }
 
 // BroadcastMessage はメッセージを全クライアントにブロードキャストする
-func (h *Hub) BroadcastMessage(sender, content string) error {
-	msg := models.Message{
-		ID:        uuid.New().String(),
-		Sender:    sender,
-		Content:   content,
-		CreatedAt: time.Now(),
+func (h *Hub) BroadcastMessage(ctx context.Context, sender, content string) error {
+	return h.BroadcastToRoom(ctx, "", sender, content)
+}
+
+// BroadcastToRoom はメッセージを保存し、ルームを購読中のクライアントに配信する
+// roomID が空の場合は全クライアントに配信する
+func (h *Hub) BroadcastToRoom(ctx context.Context, roomID, sender, content string) error {
+	if _, err := h.messages.CreateMessage(ctx, roomID, sender, content); err != nil {
+		slog.ErrorContext(ctx, "Failed to save message", "user", sender, "room_id", roomID, "error", err)
+		return err
+	}
+	return nil
+}
+
+// EditMessage はメッセージを編集し、変更を message_edited として配信する
+func (h *Hub) EditMessage(ctx context.Context, editor, id, content string) error {
+	if _, err := h.messages.EditMessage(ctx, id, editor, content); err != nil {
+		slog.WarnContext(ctx, "Failed to edit message", "user", editor, "message_id", id, "error", err)
+		return err
 	}
+	return nil
+}
 
-	// ストレージに保存
-	if err := h.storage.Save(msg); err != nil {
-		log.Printf("Failed to save message: %v", err)
+// PublishEvent はメッセージイベントをフレームに変換して配信する
+// service.EventPublisher を実装する
+func (h *Hub) PublishEvent(event service.Event) error {
+	if event.Reaction != nil {
+		return h.publish(event.Message.RoomID, ReactionMessage{
+			Type:         event.Type,
+			ID:           event.Message.ID,
+			RoomID:       event.Message.RoomID,
+			ThreadRootID: event.Message.ThreadRootID,
+			Emoji:        event.Reaction.Emoji,
+			User:         event.Reaction.User,
+			Count:        event.Reaction.Count,
+		})
+	}
+
+	outMsg := newOutgoingMessage(event.Type, event.Message)
+
+	// 削除済みメッセージの本文は配信しない
+	if event.Type == service.EventMessageDeleted {
+		outMsg.Content = ""
+	}
+
+	// スレッドの表示を更新できるように、起点の返信数と最後の返信日時を付ける
+	if event.Thread != nil {
+		outMsg.ReplyCount = event.Thread.ReplyCount
+		outMsg.LastReplyAt = event.Thread.LastReplyAt
+	}
+
+	return h.publish(event.Message.RoomID, outMsg)
+}
+
+// Messages はHubと共有するメッセージサービスを返す
+// REST API からの書き込みもこのサービスを経由させることでWebSocketに配信される
+func (h *Hub) Messages() *service.MessageService {
+	return h.messages
+}
+
+// publish はフレームをバックプレーン経由で全インスタンスに配信する
+func (h *Hub) publish(roomID string, frame any) error {
+	return h.publishExcept(roomID, "", frame)
+}
+
+// publishExcept は exclude の接続を除いてフレームを全インスタンスに配信する
+func (h *Hub) publishExcept(roomID, exclude string, frame any) error {
+	data, err := json.Marshal(frame)
+	if err != nil {
 		return err
 	}
 
-	// 送信用メッセージを作成
-	outMsg := OutgoingMessage{
-		Type:      "message",
-		ID:        msg.ID,
-		Sender:    msg.Sender,
-		Content:   msg.Content,
-		CreatedAt: msg.CreatedAt,
+	return h.publishEnvelope(envelope{RoomID: roomID, Exclude: exclude, Data: data})
+}
+
+// publishEnvelope はエンベロープをバックプレーン経由で全インスタンスに配信する
+func (h *Hub) publishEnvelope(env envelope) error {
+	env.PublishedAt = time.Now()
+	payload, err := json.Marshal(env)
+	if err != nil {
+		return err
 	}
 
-	data, err := json.Marshal(outMsg)
+	return h.backplane.Publish(payload)
+}
+
+// sendTo はフレームを指定したクライアントだけに送る
+func (h *Hub) sendTo(client *Client, frame any) error {
+	data, err := json.Marshal(frame)
 	if err != nil {
 		return err
 	}
+	select {
+	case h.direct <- directFrame{client: client, data: data}:
+		return nil
+	case <-h.done:
+		return ErrHubStopped
+	}
+}
 
-	h.broadcast <- data
-	return nil
+// Subscribe はクライアントにルームを購読させる
+func (h *Hub) Subscribe(ctx context.Context, client *Client, roomID string) error {
+	if _, err := h.storage.GetRoom(ctx, roomID); err != nil {
+		return err
+	}
+	select {
+	case h.subscribe <- subscription{client: client, roomID: roomID}:
+		return nil
+	case <-h.done:
+		return ErrHubStopped
+	}
+}
+
+// Unsubscribe はクライアントのルーム購読を解除する
+func (h *Hub) Unsubscribe(client *Client, roomID string) {
+	select {
+	case h.unsubscribe <- subscription{client: client, roomID: roomID}:
+	case <-h.done:
+	}
+}
+
+// Ping はHubのメインループが動いていて応答できるか確認する
+//
+// 停止が始まっている場合や Run が終了している場合は ErrHubStopped を返す。
+// ctx の期限までに応答がない場合は ctx のエラーを返す。
+func (h *Hub) Ping(ctx context.Context) error {
+	select {
+	case <-h.stop:
+		return ErrHubStopped
+	default:
+	}
+	select {
+	case h.heartbeat <- struct{}{}:
+		return nil
+	case <-h.done:
+		return ErrHubStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // ClientCount は接続中のクライアント数を返す
 func (h *Hub) ClientCount() int {
-	return len(h.clients)
+	return int(h.count.Load())
 }
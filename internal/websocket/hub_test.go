@@ -1,10 +1,16 @@
 package websocket
 
 import (
+	"context"
 	"encoding/json"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/gorilla/websocket"
+	"github.com/tasukuchiba/text_messaging_app/internal/backplane"
+	"github.com/tasukuchiba/text_messaging_app/internal/models"
+	"github.com/tasukuchiba/text_messaging_app/internal/service"
 	"github.com/tasukuchiba/text_messaging_app/internal/storage"
 )
 
@@ -62,7 +68,7 @@ func TestHub_BroadcastMessage(t *testing.T) {
 	}
 
 	// メッセージをブロードキャスト
-	err := hub.BroadcastMessage("alice", "Hello, World!")
+	err := hub.BroadcastMessage(context.Background(), "alice", "Hello, World!")
 	if err != nil {
 		t.Fatalf("BroadcastMessage failed: %v", err)
 	}
@@ -96,7 +102,7 @@ func TestHub_BroadcastMessage(t *testing.T) {
 	}
 
 	// ストレージにも保存されていることを確認
-	messages, err := store.GetAll()
+	messages, err := store.GetAll(context.Background())
 	if err != nil {
 		t.Fatalf("Failed to get messages: %v", err)
 	}
@@ -164,6 +170,255 @@ func TestHub_RegisterUnregister(t *testing.T) {
 	}
 }
 
+func TestHub_RoomBroadcast(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	store.CreateRoom(context.Background(), models.Room{ID: "room-1", Name: "general", CreatedAt: time.Now()})
+	hub := NewHub(store)
+
+	go hub.Run()
+
+	member := NewClient(hub, nil, "member")
+	outsider := NewClient(hub, nil, "outsider")
+	hub.register <- member
+	hub.register <- outsider
+
+	if err := hub.Subscribe(context.Background(), member, "room-1"); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	// 存在しないルームは購読できない
+	if err := hub.Subscribe(context.Background(), outsider, "non-existent"); err != storage.ErrRoomNotFound {
+		t.Errorf("Expected ErrRoomNotFound, got %v", err)
+	}
+
+	if err := hub.BroadcastToRoom(context.Background(), "room-1", "alice", "Hello room"); err != nil {
+		t.Fatalf("BroadcastToRoom failed: %v", err)
+	}
+
+	select {
+	case msg := <-member.send:
+		var outMsg OutgoingMessage
+		if err := json.Unmarshal(msg, &outMsg); err != nil {
+			t.Fatalf("Failed to unmarshal message: %v", err)
+		}
+		if outMsg.RoomID != "room-1" {
+			t.Errorf("Expected room_id 'room-1', got '%s'", outMsg.RoomID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for room message")
+	}
+
+	// 購読していないクライアントには届かない
+	select {
+	case msg := <-outsider.send:
+		t.Errorf("Outsider should not receive room message, got %s", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// 購読解除後は届かない
+	hub.Unsubscribe(member, "room-1")
+	if err := hub.BroadcastToRoom(context.Background(), "room-1", "alice", "Are you there?"); err != nil {
+		t.Fatalf("BroadcastToRoom failed: %v", err)
+	}
+	select {
+	case msg := <-member.send:
+		t.Errorf("Unsubscribed client should not receive room message, got %s", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// 全体チャンネルのメッセージは全員に届く
+	if err := hub.BroadcastMessage(context.Background(), "alice", "Hello everyone"); err != nil {
+		t.Fatalf("BroadcastMessage failed: %v", err)
+	}
+	for _, c := range []*Client{member, outsider} {
+		select {
+		case <-c.send:
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting for global message on %s", c.sender)
+		}
+	}
+}
+
+func TestHub_SharedBackplane(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	bp := backplane.NewMemoryBackplane()
+	defer bp.Close()
+
+	// 同じバックプレーンを共有する2つのHub（別インスタンスを想定）
+	hubA := NewHub(store, WithBackplane(bp))
+	hubB := NewHub(store, WithBackplane(bp))
+	go hubA.Run()
+	go hubB.Run()
+
+	clientA := NewClient(hubA, nil, "client-a")
+	clientB := NewClient(hubB, nil, "client-b")
+	hubA.register <- clientA
+	hubB.register <- clientB
+
+	// Hub A で送信したメッセージが Hub B のクライアントにも届く
+	if err := hubA.BroadcastMessage(context.Background(), "alice", "Hello across instances"); err != nil {
+		t.Fatalf("BroadcastMessage failed: %v", err)
+	}
+
+	for _, c := range []*Client{clientA, clientB} {
+		select {
+		case msg := <-c.send:
+			var outMsg OutgoingMessage
+			if err := json.Unmarshal(msg, &outMsg); err != nil {
+				t.Fatalf("Failed to unmarshal message: %v", err)
+			}
+			if outMsg.Content != "Hello across instances" {
+				t.Errorf("Expected content 'Hello across instances', got '%s'", outMsg.Content)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting for message on %s", c.sender)
+		}
+	}
+}
+
+func TestHub_MessageServiceEvents(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	hub := NewHub(store)
+	go hub.Run()
+
+	client := NewClient(hub, nil, "viewer")
+	hub.register <- client
+
+	receive := func() OutgoingMessage {
+		t.Helper()
+		select {
+		case msg := <-client.send:
+			var outMsg OutgoingMessage
+			if err := json.Unmarshal(msg, &outMsg); err != nil {
+				t.Fatalf("Failed to unmarshal message: %v", err)
+			}
+			return outMsg
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for event")
+		}
+		return OutgoingMessage{}
+	}
+
+	// REST API と同じサービス経由で作成したメッセージが配信される
+	msg, err := hub.Messages().CreateMessage(context.Background(), "", "bot", "Hello from REST")
+	if err != nil {
+		t.Fatalf("CreateMessage failed: %v", err)
+	}
+	created := receive()
+	if created.Type != "message" || created.ID != msg.ID || created.Content != "Hello from REST" {
+		t.Errorf("Unexpected message event: %+v", created)
+	}
+
+	// 編集は message_edited として配信される
+	if err := hub.EditMessage(context.Background(), "bot", msg.ID, "Hello again"); err != nil {
+		t.Fatalf("EditMessage failed: %v", err)
+	}
+	edited := receive()
+	if edited.Type != "message_edited" || edited.Content != "Hello again" || !edited.Edited || edited.UpdatedAt == nil {
+		t.Errorf("Unexpected edit event: %+v", edited)
+	}
+
+	// 送信者以外は編集できない
+	if err := hub.EditMessage(context.Background(), "mallory", msg.ID, "Hacked"); err != service.ErrNotMessageOwner {
+		t.Errorf("Expected ErrNotMessageOwner, got %v", err)
+	}
+
+	// 削除は message_deleted として配信される
+	if err := hub.Messages().DeleteMessage(context.Background(), msg.ID, "bot"); err != nil {
+		t.Fatalf("DeleteMessage failed: %v", err)
+	}
+	deleted := receive()
+	if deleted.Type != "message_deleted" || deleted.ID != msg.ID {
+		t.Errorf("Unexpected delete event: %+v", deleted)
+	}
+	if deleted.Content != "" {
+		t.Errorf("Expected deleted content to be omitted, got '%s'", deleted.Content)
+	}
+}
+
+func TestHub_LongestMessageFitsPayload(t *testing.T) {
+	bp := &limitedBackplane{MemoryBackplane: backplane.NewMemoryBackplane()}
+	defer bp.Close()
+	store := storage.NewMemoryStorage()
+	hub := NewHub(store, WithBackplane(bp))
+	ctx := context.Background()
+
+	root, err := hub.Messages().CreateMessage(ctx, "", "alice", "Hello")
+	if err != nil {
+		t.Fatalf("CreateMessage failed: %v", err)
+	}
+
+	// 本文を上限まで使い、他の項目も長くしたフレームがペイロードの上限に収まる
+	sender := strings.Repeat("a", 64)
+	clientMsgID := strings.Repeat("c", maxClientMsgIDLength-1)
+	for _, content := range []string{
+		strings.Repeat("x", service.MaxContentSize),
+		strings.Repeat("<", service.MaxContentSize/6),
+	} {
+		msg, _, err := hub.Messages().SendReply(ctx, "", root.ID, sender, content, clientMsgID+content[:1])
+		if err != nil {
+			t.Fatalf("SendReply failed: %v", err)
+		}
+		if _, err := hub.Messages().EditMessage(ctx, msg.ID, sender, content); err != nil {
+			t.Fatalf("EditMessage failed: %v", err)
+		}
+	}
+	if n := bp.rejected.Load(); n != 0 {
+		t.Errorf("Expected no payload to exceed the limit, %d were rejected", n)
+	}
+}
+
+func TestHub_ReactionEvents(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	store.CreateRoom(context.Background(), models.Room{ID: "room-1", Name: "general", CreatedAt: time.Now()})
+	hub := NewHub(store)
+	go hub.Run()
+
+	client := NewClient(hub, nil, "viewer")
+	hub.register <- client
+	if err := hub.Subscribe(context.Background(), client, "room-1"); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	receive := func() ReactionMessage {
+		t.Helper()
+		select {
+		case msg := <-client.send:
+			var frame ReactionMessage
+			if err := json.Unmarshal(msg, &frame); err != nil {
+				t.Fatalf("Failed to unmarshal message: %v", err)
+			}
+			return frame
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for event")
+		}
+		return ReactionMessage{}
+	}
+
+	msg, err := hub.Messages().CreateMessage(context.Background(), "room-1", "bot", "Hello")
+	if err != nil {
+		t.Fatalf("CreateMessage failed: %v", err)
+	}
+	receive()
+
+	// リアクションの追加と削除は、変更後の数を付けてメッセージのルームに配信される
+	if _, _, err := hub.Messages().AddReaction(context.Background(), msg.ID, "🎉", "alice"); err != nil {
+		t.Fatalf("AddReaction failed: %v", err)
+	}
+	want := ReactionMessage{Type: "reaction_added", ID: msg.ID, RoomID: "room-1", Emoji: "🎉", User: "alice", Count: 1}
+	if got := receive(); got != want {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+
+	if _, err := hub.Messages().RemoveReaction(context.Background(), msg.ID, "🎉", "alice"); err != nil {
+		t.Fatalf("RemoveReaction failed: %v", err)
+	}
+	want.Type, want.Count = "reaction_removed", 0
+	if got := receive(); got != want {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+}
+
 func TestOutgoingMessage_JSON(t *testing.T) {
 	now := time.Date(2026, 2, 2, 12, 0, 0, 0, time.UTC)
 	msg := OutgoingMessage{
@@ -217,3 +472,119 @@ func TestIncomingMessage_JSON(t *testing.T) {
 		t.Errorf("Expected content 'Hello!', got '%s'", msg.Content)
 	}
 }
+
+func TestHub_StopClosesClients(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	hub := NewHub(store)
+	go hub.Run()
+
+	server := newTestServer(hub)
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + tokenQuery(t, "alice")
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := hub.Stop(ctx); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	// クライアントには（presence_snapshot などの後に）going away のクローズフレームが届く
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for err == nil {
+		_, _, err = conn.ReadMessage()
+	}
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("Expected going away close, got %v", err)
+	}
+	if hub.ClientCount() != 0 {
+		t.Errorf("Expected 0 clients after stop, got %d", hub.ClientCount())
+	}
+
+	// 2回目の Stop もすぐに返る
+	if err := hub.Stop(ctx); err != nil {
+		t.Errorf("Second Stop failed: %v", err)
+	}
+
+	// 停止後の接続はすぐに閉じられる
+	conn2, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn2.Close()
+	conn2.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err = conn2.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("Expected going away close after stop, got %v", err)
+	}
+}
+
+// recordingMetrics は記録されたメトリクスを数えるテスト用のHubMetrics
+type recordingMetrics struct {
+	fanOuts chan time.Duration
+	dropped chan struct{}
+}
+
+func (m *recordingMetrics) ObserveFanOut(d time.Duration) { m.fanOuts <- d }
+func (m *recordingMetrics) ClientDropped()                { m.dropped <- struct{}{} }
+
+func TestHub_Metrics(t *testing.T) {
+	metrics := &recordingMetrics{
+		fanOuts: make(chan time.Duration, 16),
+		dropped: make(chan struct{}, 16),
+	}
+	hub := NewHub(storage.NewMemoryStorage(), WithMetrics(metrics))
+	go hub.Run()
+
+	// 送信バッファが溢れるクライアント
+	slow := &Client{hub: hub, send: make(chan []byte), sender: "slow", rooms: make(map[string]bool)}
+	hub.register <- slow
+
+	if err := hub.BroadcastMessage(context.Background(), "alice", "Hello"); err != nil {
+		t.Fatalf("BroadcastMessage failed: %v", err)
+	}
+
+	select {
+	case <-metrics.dropped:
+	case <-time.After(time.Second):
+		t.Fatal("Expected slow client to be counted as dropped")
+	}
+	select {
+	case d := <-metrics.fanOuts:
+		if d < 0 {
+			t.Errorf("Expected non-negative fan-out latency, got %v", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected fan-out latency to be observed")
+	}
+}
+
+func TestHub_Ping(t *testing.T) {
+	hub := NewHub(storage.NewMemoryStorage())
+
+	// Run が動いていなければ期限までに応答しない
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := hub.Ping(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded before Run, got %v", err)
+	}
+
+	go hub.Run()
+	if err := hub.Ping(context.Background()); err != nil {
+		t.Errorf("Expected running hub to answer ping, got %v", err)
+	}
+
+	if err := hub.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	if err := hub.Ping(context.Background()); err != ErrHubStopped {
+		t.Errorf("Expected ErrHubStopped after Stop, got %v", err)
+	}
+}
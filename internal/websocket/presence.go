@@ -0,0 +1,509 @@
+package websocket
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tasukuchiba/text_messaging_app/internal/backplane"
+)
+
+// DefaultPresenceHeartbeat は各インスタンスが生存していることをバックプレーンに配信する間隔
+const DefaultPresenceHeartbeat = 10 * time.Second
+
+// presenceMissedHeartbeats はインスタンスが停止したとみなすまでに取りこぼしてよいハートビートの回数
+// これを超えてハートビートが届かないインスタンスのユーザーはオフラインにする
+const presenceMissedHeartbeats = 3
+
+// presenceResyncHeartbeats は接続中の全ユーザーを配信し直す間隔（ハートビートの回数）
+// 取りこぼした presence_join / presence_leave はこの間隔で補正される
+const presenceResyncHeartbeats = 6
+
+// presenceChunkBytes は接続中の全ユーザーを配信する際の1回分のユーザー名の合計バイト数
+// 残りはエンベロープの分で、全体がバックプレーンで配信できる大きさに収まるようにする
+const presenceChunkBytes = backplane.MaxPayloadSize / 2
+
+// オンライン状態を知らせるフレームの種類
+const (
+	framePresenceJoin     = "presence_join"
+	framePresenceLeave    = "presence_leave"
+	framePresenceSnapshot = "presence_snapshot"
+)
+
+// PresenceMessage はユーザーのオンライン状態の変化を知らせるフレーム
+//
+// 同じユーザーが複数の接続（タブや端末、インスタンス）を持っていても、
+// 最初の接続で presence_join、最後の切断で presence_leave を1回だけ配信する。
+type PresenceMessage struct {
+	Type string `json:"type"`
+	User string `json:"user"`
+}
+
+// PresenceSnapshotMessage は接続時に送るオンライン中のユーザー一覧
+type PresenceSnapshotMessage struct {
+	Type  string   `json:"type"`
+	Users []string `json:"users"`
+}
+
+// presenceUpdate はバックプレーンを流れるインスタンスごとのオンライン状態の変化
+type presenceUpdate struct {
+	// 変化のあったインスタンス
+	Instance string `json:"instance"`
+
+	// インスタンス内での変化の通し番号
+	// バックプレーン上で順序が入れ替わっても、古い変化で新しい状態を上書きしないために使う
+	Seq uint64 `json:"seq,omitempty"`
+
+	// 対象のユーザー（Sync、Heartbeat、Snapshot の場合は空）
+	User   string `json:"user,omitempty"`
+	Online bool   `json:"online,omitempty"`
+
+	// 起動したインスタンスが他のインスタンスに接続中のユーザーを問い合わせる
+	Sync bool `json:"sync,omitempty"`
+
+	// インスタンスが生存していることを知らせる（ユーザーは含めない）
+	Heartbeat bool `json:"heartbeat,omitempty"`
+
+	// Seq の時点で接続中の全ユーザーを知らせる
+	// ペイロードの上限に収まるよう Parts 個に分割し、Part 番目（0から）の分を Users に入れる
+	Snapshot bool     `json:"snapshot,omitempty"`
+	Users    []string `json:"users,omitempty"`
+	Part     int      `json:"part,omitempty"`
+	Parts    int      `json:"parts,omitempty"`
+}
+
+// presenceChange はユーザー全体のオンライン状態の変化
+type presenceChange struct {
+	user   string
+	online bool
+}
+
+// instancePresence はバックプレーンから届いたインスタンスごとの状態
+type instancePresence struct {
+	// 最後に変化かハートビートが届いた時刻
+	lastSeen time.Time
+
+	// 最後に反映した全ユーザーの一覧の通し番号（これより古い変化は反映しない）
+	floor uint64
+
+	// 一覧より後に反映したユーザーごとの変化の通し番号
+	seqs map[string]uint64
+
+	// 分割して届く途中の一覧
+	pending *pendingSnapshot
+}
+
+// pendingSnapshot は分割して届く全ユーザーの一覧の受信途中の状態
+type pendingSnapshot struct {
+	seq      uint64
+	users    map[string]struct{}
+	received map[int]struct{}
+}
+
+// presenceTracker はオンライン中のユーザーを記録する
+//
+// local はこのインスタンスへの接続数で、変化をバックプレーンに配信するかどうかの判定に使う。
+// online はバックプレーンから届いた全インスタンス分の状態で、一覧の取得に使う。
+// instances はインスタンスごとの最後の通信時刻で、停止したインスタンスのユーザーを取り除くのに使う。
+// 登録・解除を行うgoroutineから配信するため、Hubのgoroutineではなくミューテックスで保護する。
+type presenceTracker struct {
+	mu        sync.Mutex
+	local     map[string]int
+	seq       uint64
+	online    map[string]map[string]struct{}
+	instances map[string]*instancePresence
+
+	// ハートビートを配信する間隔
+	heartbeat time.Duration
+}
+
+// newPresenceTracker は新しいpresenceTrackerを作成する
+func newPresenceTracker() *presenceTracker {
+	return &presenceTracker{
+		local:     make(map[string]int),
+		online:    make(map[string]map[string]struct{}),
+		instances: make(map[string]*instancePresence),
+		heartbeat: DefaultPresenceHeartbeat,
+	}
+}
+
+// connect は接続を記録し、このインスタンスでそのユーザーの最初の接続なら true と変化の通し番号を返す
+func (p *presenceTracker) connect(user string) (uint64, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.local[user]++
+	if p.local[user] != 1 {
+		return 0, false
+	}
+	p.seq++
+	return p.seq, true
+}
+
+// disconnect は切断を記録し、このインスタンスでそのユーザーの最後の接続なら true と変化の通し番号を返す
+func (p *presenceTracker) disconnect(user string) (uint64, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n, ok := p.local[user]
+	if !ok {
+		return 0, false
+	}
+	if n > 1 {
+		p.local[user] = n - 1
+		return 0, false
+	}
+	delete(p.local, user)
+	p.seq++
+	return p.seq, true
+}
+
+// snapshot はこのインスタンスに接続中のユーザーと、その時点の通し番号を返す
+func (p *presenceTracker) snapshot() ([]string, uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	users := make([]string, 0, len(p.local))
+	for user := range p.local {
+		users = append(users, user)
+	}
+	p.seq++
+	return users, p.seq
+}
+
+// currentSeq は最後に割り当てた通し番号を返す
+func (p *presenceTracker) currentSeq() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.seq
+}
+
+// drain はこのインスタンスの接続を全て切断済みにして、その時点の通し番号を返す
+func (p *presenceTracker) drain() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.local = make(map[string]int)
+	p.seq++
+	return p.seq
+}
+
+// apply はインスタンスの状態の変化を反映し、ユーザー全体のオンライン状態が変わった場合に true を返す
+// 同じユーザーについて既に反映した変化より古い変化は無視する
+func (p *presenceTracker) apply(update presenceUpdate, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	inst := p.instanceLocked(update.Instance, now)
+	if update.Seq < max(inst.floor, inst.seqs[update.User]) {
+		return false
+	}
+	inst.seqs[update.User] = update.Seq
+	return p.setLocked(update.User, update.Instance, update.Online)
+}
+
+// touch はインスタンスから通信があったことを記録する
+func (p *presenceTracker) touch(instance string, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.instanceLocked(instance, now)
+}
+
+// sync は分割して届いたインスタンスの接続中ユーザーの一覧を反映し、
+// ユーザー全体のオンライン状態が変わったユーザーを返す
+//
+// 一覧にあるユーザーは届いた分から順にオンラインにし、一覧にないユーザーは全ての分が揃ってからオフラインにする
+// （途中が欠けた一覧ではオフラインにしない）。取りこぼした presence_join / presence_leave もここで補正される。
+// 一覧より後に反映した変化のあるユーザーは、そちらの方が新しいので変更しない。
+func (p *presenceTracker) sync(update presenceUpdate, now time.Time) []presenceChange {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	inst := p.instanceLocked(update.Instance, now)
+	if update.Seq < inst.floor || (inst.pending != nil && update.Seq < inst.pending.seq) {
+		return nil
+	}
+	if inst.pending == nil || inst.pending.seq != update.Seq {
+		inst.pending = &pendingSnapshot{
+			seq:      update.Seq,
+			users:    make(map[string]struct{}),
+			received: make(map[int]struct{}),
+		}
+	}
+	pending := inst.pending
+
+	var changes []presenceChange
+	set := func(user string, online bool) {
+		if inst.seqs[user] > update.Seq {
+			return
+		}
+		// 一覧の途中で届いた古い変化に上書きされないよう、一覧の通し番号を記録しておく
+		inst.seqs[user] = update.Seq
+		if p.setLocked(user, update.Instance, online) {
+			changes = append(changes, presenceChange{user: user, online: online})
+		}
+	}
+	for _, user := range update.Users {
+		pending.users[user] = struct{}{}
+		set(user, true)
+	}
+	pending.received[update.Part] = struct{}{}
+
+	if len(pending.received) >= max(update.Parts, 1) {
+		for user, instances := range p.online {
+			if _, ok := instances[update.Instance]; ok {
+				if _, ok := pending.users[user]; !ok {
+					set(user, false)
+				}
+			}
+		}
+
+		// 一覧より古い変化の記録は不要になる
+		inst.floor = update.Seq
+		inst.pending = nil
+		for user, seq := range inst.seqs {
+			if seq <= update.Seq {
+				delete(inst.seqs, user)
+			}
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].user < changes[j].user })
+	return changes
+}
+
+// expire は presenceMissedHeartbeats 回を超えてハートビートが届いていないインスタンスを取り除き、
+// オフラインになったユーザーを返す（self はこのインスタンスで、取り除かない）
+func (p *presenceTracker) expire(self string, now time.Time) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ttl := p.heartbeat * presenceMissedHeartbeats
+	var offline []string
+	for id, inst := range p.instances {
+		if id == self || now.Sub(inst.lastSeen) <= ttl {
+			continue
+		}
+		delete(p.instances, id)
+		for user, instances := range p.online {
+			if _, ok := instances[id]; ok && p.setLocked(user, id, false) {
+				offline = append(offline, user)
+			}
+		}
+	}
+	sort.Strings(offline)
+	return offline
+}
+
+// instanceLocked はインスタンスの状態を返し、最後の通信時刻を更新する（ロックを取得済みで呼び出す）
+func (p *presenceTracker) instanceLocked(id string, now time.Time) *instancePresence {
+	inst, ok := p.instances[id]
+	if !ok {
+		inst = &instancePresence{seqs: make(map[string]uint64)}
+		p.instances[id] = inst
+	}
+	inst.lastSeen = now
+	return inst
+}
+
+// setLocked はユーザーのインスタンスごとの状態を更新し、ユーザー全体のオンライン状態が変わった場合に true を返す
+// （ロックを取得済みで呼び出す）
+func (p *presenceTracker) setLocked(user, instance string, online bool) bool {
+	instances := p.online[user]
+	wasOnline := len(instances) > 0
+	if online {
+		if instances == nil {
+			instances = make(map[string]struct{})
+			p.online[user] = instances
+		}
+		instances[instance] = struct{}{}
+	} else {
+		delete(instances, instance)
+		if len(instances) == 0 {
+			delete(p.online, user)
+		}
+	}
+	return wasOnline != (len(p.online[user]) > 0)
+}
+
+// users はオンライン中のユーザーを名前順に返す
+func (p *presenceTracker) users() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	users := make([]string, 0, len(p.online))
+	for user := range p.online {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	return users
+}
+
+// OnlineUsers はオンライン中のユーザーを名前順に返す
+func (h *Hub) OnlineUsers() []string {
+	return h.presence.users()
+}
+
+// WithPresenceHeartbeat はインスタンスが生存していることをバックプレーンに配信する間隔を指定する
+// presenceMissedHeartbeats 回を超えてハートビートが届かないインスタンスのユーザーはオフラインになる
+func WithPresenceHeartbeat(interval time.Duration) HubOption {
+	return func(h *Hub) {
+		h.presence.heartbeat = interval
+	}
+}
+
+// connected はクライアントの接続をオンライン状態に反映する
+func (h *Hub) connected(client *Client) {
+	if seq, ok := h.presence.connect(client.sender); ok {
+		h.publishPresence(presenceUpdate{Seq: seq, User: client.sender, Online: true})
+	}
+}
+
+// disconnected はクライアントの切断をオンライン状態に反映する
+func (h *Hub) disconnected(client *Client) {
+	seq, ok := h.presence.disconnect(client.sender)
+	if !ok {
+		return
+	}
+	// 停止後はバックプレーンがクローズされている場合があるので配信しない
+	select {
+	case <-h.done:
+		return
+	default:
+	}
+	h.publishPresence(presenceUpdate{Seq: seq, User: client.sender})
+}
+
+// leaveAll は停止時にこのインスタンスに接続中のユーザーがいなくなったことを配信する
+func (h *Hub) leaveAll() {
+	h.publishPresenceUsers(nil, h.presence.drain())
+}
+
+// requestPresenceSync は他のインスタンスに接続中のユーザーを配信し直してもらう
+func (h *Hub) requestPresenceSync() {
+	h.publishPresence(presenceUpdate{Sync: true})
+}
+
+// sendPresenceHeartbeat はこのインスタンスが生存していることを配信する
+// resync が true の場合は、続けて接続中の全ユーザーも配信する
+func (h *Hub) sendPresenceHeartbeat(resync bool) {
+	// 停止後はバックプレーンがクローズされている場合があるので配信しない
+	select {
+	case <-h.done:
+		return
+	default:
+	}
+	h.publishPresence(presenceUpdate{Seq: h.presence.currentSeq(), Heartbeat: true})
+	if resync {
+		h.resyncPresence()
+	}
+}
+
+// resyncPresence はこのインスタンスに接続中の全ユーザーを配信する
+// 起動したインスタンスからの問い合わせにも、これで答える
+func (h *Hub) resyncPresence() {
+	users, seq := h.presence.snapshot()
+	h.publishPresenceUsers(users, seq)
+}
+
+// publishPresenceUsers は seq の時点で接続中の全ユーザーを、ペイロードの上限に収まるよう分割して配信する
+func (h *Hub) publishPresenceUsers(users []string, seq uint64) {
+	chunks := chunkUsers(users, presenceChunkBytes)
+	for i, chunk := range chunks {
+		h.publishPresence(presenceUpdate{Seq: seq, Snapshot: true, Users: chunk, Part: i, Parts: len(chunks)})
+	}
+}
+
+// chunkUsers はユーザー名の合計バイト数が limit 以下になるようにユーザーを名前順に分割する
+// ユーザーがいない場合も空の分を1つ返す
+func chunkUsers(users []string, limit int) [][]string {
+	sort.Strings(users)
+	chunks := [][]string{nil}
+	size := 0
+	for _, user := range users {
+		// JSONにした場合の引用符と区切りの分を含める
+		n := len(user) + 3
+		last := len(chunks) - 1
+		if size+n > limit && len(chunks[last]) > 0 {
+			chunks = append(chunks, nil)
+			last++
+			size = 0
+		}
+		chunks[last] = append(chunks[last], user)
+		size += n
+	}
+	return chunks
+}
+
+// expirePresence はハートビートが途絶えたインスタンスのユーザーをオフラインにする
+// Hubのgoroutineから呼ばれる
+func (h *Hub) expirePresence() {
+	for _, user := range h.presence.expire(h.instance, time.Now()) {
+		slog.Info("Presence expired", "user", user)
+		h.announcePresence(presenceChange{user: user})
+	}
+}
+
+// handlePresence はバックプレーンから届いたオンライン状態の変化を処理する
+// Hubのgoroutineから呼ばれる
+func (h *Hub) handlePresence(update presenceUpdate) {
+	if update.Sync {
+		if update.Instance != h.instance {
+			// Hubのgoroutineからは配信しない（自分の受信チャネルが詰まると止まるため）
+			go h.resyncPresence()
+		}
+		return
+	}
+
+	if update.Heartbeat {
+		h.presence.touch(update.Instance, time.Now())
+		return
+	}
+
+	if update.Snapshot {
+		for _, change := range h.presence.sync(update, time.Now()) {
+			h.announcePresence(change)
+		}
+		return
+	}
+
+	if h.presence.apply(update, time.Now()) {
+		h.announcePresence(presenceChange{user: update.User, online: update.Online})
+	}
+}
+
+// announcePresence はユーザー全体のオンライン状態の変化を接続中のクライアントに配信する
+// Hubのgoroutineから呼ばれる
+func (h *Hub) announcePresence(change presenceChange) {
+	frameType := framePresenceLeave
+	if change.online {
+		frameType = framePresenceJoin
+	}
+	data, err := json.Marshal(PresenceMessage{Type: frameType, User: change.user})
+	if err != nil {
+		slog.Error("Failed to encode presence frame", "error", err)
+		return
+	}
+	h.fanOut(envelope{Data: data})
+}
+
+// publishPresence はこのインスタンスの状態の変化をバックプレーンに配信する
+func (h *Hub) publishPresence(update presenceUpdate) {
+	update.Instance = h.instance
+	if err := h.publishEnvelope(envelope{Presence: &update}); err != nil {
+		slog.Error("Failed to publish presence", "user", update.User, "error", err)
+	}
+}
+
+// sendPresenceSnapshot は接続したクライアントにオンライン中のユーザー一覧を送る
+// Hubのgoroutineから呼ばれるので、一覧と以降の presence_join / presence_leave の間に抜けはない
+func (h *Hub) sendPresenceSnapshot(client *Client) {
+	data, err := json.Marshal(PresenceSnapshotMessage{
+		Type:  framePresenceSnapshot,
+		Users: h.OnlineUsers(),
+	})
+	if err != nil {
+		slog.Error("Failed to encode presence snapshot", "error", err)
+		return
+	}
+	select {
+	case client.send <- data:
+	default:
+	}
+}
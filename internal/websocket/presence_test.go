@@ -0,0 +1,353 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tasukuchiba/text_messaging_app/internal/backplane"
+	"github.com/tasukuchiba/text_messaging_app/internal/storage"
+)
+
+// readPresence は次のフレームを読み出す
+func readPresence(t *testing.T, frames *frameReader) map[string]any {
+	t.Helper()
+	data := frames.read()
+	var frame map[string]any
+	if err := json.Unmarshal(data, &frame); err != nil {
+		t.Fatalf("Failed to unmarshal frame %s: %v", data, err)
+	}
+	return frame
+}
+
+// waitOnline は OnlineUsers が want になるまで待つ
+func waitOnline(t *testing.T, hub *Hub, want []string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		got := hub.OnlineUsers()
+		if reflect.DeepEqual(got, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected online users %v, got %v", want, got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPresenceTracker_CollapsesConnections(t *testing.T) {
+	p := newPresenceTracker()
+
+	now := time.Now()
+
+	if _, ok := p.connect("alice"); !ok {
+		t.Error("First connection should report a join")
+	}
+	if _, ok := p.connect("alice"); ok {
+		t.Error("Second connection should not report a join")
+	}
+	if _, ok := p.disconnect("alice"); ok {
+		t.Error("Closing one of two connections should not report a leave")
+	}
+	if _, ok := p.disconnect("alice"); !ok {
+		t.Error("Closing the last connection should report a leave")
+	}
+	if _, ok := p.disconnect("alice"); ok {
+		t.Error("Disconnecting an unknown user should not report a leave")
+	}
+
+	// 複数のインスタンスに接続している場合も、最初と最後だけ状態が変わる
+	if !p.apply(presenceUpdate{Instance: "a", Seq: 1, User: "alice", Online: true}, now) {
+		t.Error("Expected alice to come online")
+	}
+	if p.apply(presenceUpdate{Instance: "b", Seq: 1, User: "alice", Online: true}, now) {
+		t.Error("Second instance should not change alice's state")
+	}
+	if p.apply(presenceUpdate{Instance: "a", Seq: 2, User: "alice"}, now) {
+		t.Error("Leaving one instance should not change alice's state")
+	}
+	if got := p.users(); !reflect.DeepEqual(got, []string{"alice"}) {
+		t.Errorf("Expected [alice], got %v", got)
+	}
+	if !p.apply(presenceUpdate{Instance: "b", Seq: 2, User: "alice"}, now) {
+		t.Error("Expected alice to go offline")
+	}
+	if got := p.users(); len(got) != 0 {
+		t.Errorf("Expected no online users, got %v", got)
+	}
+}
+
+func TestPresenceTracker_IgnoresStaleUpdates(t *testing.T) {
+	p := newPresenceTracker()
+	now := time.Now()
+
+	// 切断が接続より先に届いても、古い接続で上書きしない
+	if p.apply(presenceUpdate{Instance: "a", Seq: 2, User: "alice"}, now) {
+		t.Error("Leave of an unknown user should not change the state")
+	}
+	if p.apply(presenceUpdate{Instance: "a", Seq: 1, User: "alice", Online: true}, now) {
+		t.Error("Stale join should be ignored")
+	}
+
+	// 全ユーザーの一覧は取りこぼした変化を補正するが、それより新しい変化は上書きしない
+	p.apply(presenceUpdate{Instance: "a", Seq: 5, User: "carol", Online: true}, now)
+	changes := p.sync(presenceUpdate{Instance: "a", Seq: 4, Snapshot: true, Users: []string{"bob"}}, now)
+	if want := []presenceChange{{user: "bob", online: true}}; !reflect.DeepEqual(changes, want) {
+		t.Errorf("Expected %v, got %v", want, changes)
+	}
+	if got := p.users(); !reflect.DeepEqual(got, []string{"bob", "carol"}) {
+		t.Errorf("Expected [bob carol], got %v", got)
+	}
+
+	// 一覧より古い変化は反映しない
+	if p.apply(presenceUpdate{Instance: "a", Seq: 3, User: "bob"}, now) {
+		t.Error("Leave older than the heartbeat should be ignored")
+	}
+	changes = p.sync(presenceUpdate{Instance: "a", Seq: 6, Snapshot: true, Users: []string{"carol"}}, now)
+	if want := []presenceChange{{user: "bob"}}; !reflect.DeepEqual(changes, want) {
+		t.Errorf("Expected %v, got %v", want, changes)
+	}
+}
+
+func TestPresenceTracker_SyncWaitsForAllParts(t *testing.T) {
+	p := newPresenceTracker()
+	now := time.Now()
+
+	p.apply(presenceUpdate{Instance: "a", Seq: 1, User: "alice", Online: true}, now)
+	p.apply(presenceUpdate{Instance: "a", Seq: 2, User: "bob", Online: true}, now)
+
+	// 一覧にあるユーザーは届いた分から順にオンラインになる
+	changes := p.sync(presenceUpdate{Instance: "a", Seq: 5, Snapshot: true, Users: []string{"carol"}, Part: 0, Parts: 2}, now)
+	if want := []presenceChange{{user: "carol", online: true}}; !reflect.DeepEqual(changes, want) {
+		t.Errorf("Expected %v, got %v", want, changes)
+	}
+	if got := p.users(); !reflect.DeepEqual(got, []string{"alice", "bob", "carol"}) {
+		t.Errorf("Expected users not in the first part to stay online, got %v", got)
+	}
+
+	// 全ての分が揃ってから、一覧にないユーザーがオフラインになる
+	changes = p.sync(presenceUpdate{Instance: "a", Seq: 5, Snapshot: true, Users: []string{"alice"}, Part: 1, Parts: 2}, now)
+	if want := []presenceChange{{user: "bob"}}; !reflect.DeepEqual(changes, want) {
+		t.Errorf("Expected %v, got %v", want, changes)
+	}
+
+	// 途中が欠けた一覧は、次の一覧に置き換えられてオフラインにはしない
+	p.sync(presenceUpdate{Instance: "a", Seq: 7, Snapshot: true, Users: []string{"alice"}, Part: 0, Parts: 2}, now)
+	changes = p.sync(presenceUpdate{Instance: "a", Seq: 8, Snapshot: true, Users: []string{"alice", "carol"}, Part: 1, Parts: 2}, now)
+	if len(changes) != 0 {
+		t.Errorf("Expected no changes from an incomplete snapshot, got %v", changes)
+	}
+}
+
+func TestChunkUsers(t *testing.T) {
+	if got := chunkUsers(nil, 10); len(got) != 1 || len(got[0]) != 0 {
+		t.Errorf("Expected one empty chunk, got %v", got)
+	}
+	got := chunkUsers([]string{"dave", "alice", "bob", "carol"}, 14)
+	if want := [][]string{{"alice", "bob"}, {"carol"}, {"dave"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestPresenceTracker_ExpiresSilentInstances(t *testing.T) {
+	p := newPresenceTracker()
+	p.heartbeat = time.Second
+	now := time.Now()
+
+	p.apply(presenceUpdate{Instance: "self", Seq: 1, User: "alice", Online: true}, now)
+	p.apply(presenceUpdate{Instance: "crashed", Seq: 1, User: "bob", Online: true}, now)
+	p.apply(presenceUpdate{Instance: "crashed", Seq: 2, User: "alice", Online: true}, now)
+	p.sync(presenceUpdate{Instance: "alive", Seq: 1, Snapshot: true, Users: []string{"carol"}}, now)
+
+	// 許容回数まではハートビートが届かなくても取り除かない
+	later := now.Add(presenceMissedHeartbeats * time.Second)
+	if got := p.expire("self", later); len(got) != 0 {
+		t.Errorf("Expected no expiry yet, got %v", got)
+	}
+
+	// ハートビートを送り続けるインスタンスと自分自身は残り、途絶えたインスタンスのユーザーだけがオフラインになる
+	later = later.Add(time.Millisecond)
+	p.touch("alive", later)
+	if got := p.expire("self", later); !reflect.DeepEqual(got, []string{"bob"}) {
+		t.Errorf("Expected bob to expire, got %v", got)
+	}
+	if got := p.users(); !reflect.DeepEqual(got, []string{"alice", "carol"}) {
+		t.Errorf("Expected [alice carol], got %v", got)
+	}
+}
+
+func TestServeWs_Presence(t *testing.T) {
+	hub := NewHub(storage.NewMemoryStorage())
+	go hub.Run()
+
+	server := newTestServer(hub)
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	alice, _, err := websocket.DefaultDialer.Dial(wsURL+tokenQuery(t, "alice"), nil)
+	if err != nil {
+		t.Fatalf("Failed to connect alice: %v", err)
+	}
+	defer alice.Close()
+	aliceFrames := newFrameReader(t, alice)
+
+	if frame := readPresence(t, aliceFrames); frame["type"] != "presence_snapshot" {
+		t.Fatalf("Expected presence_snapshot first, got %v", frame)
+	}
+	if frame := readPresence(t, aliceFrames); frame["type"] != "presence_join" || frame["user"] != "alice" {
+		t.Fatalf("Expected own presence_join, got %v", frame)
+	}
+
+	// 後から接続したクライアントには接続中のユーザー一覧が届く
+	bob, _, err := websocket.DefaultDialer.Dial(wsURL+tokenQuery(t, "bob"), nil)
+	if err != nil {
+		t.Fatalf("Failed to connect bob: %v", err)
+	}
+	defer bob.Close()
+
+	snapshot := readPresence(t, newFrameReader(t, bob))
+	if snapshot["type"] != "presence_snapshot" || !reflect.DeepEqual(snapshot["users"], []any{"alice"}) {
+		t.Fatalf("Expected snapshot [alice], got %v", snapshot)
+	}
+	if frame := readPresence(t, aliceFrames); frame["type"] != "presence_join" || frame["user"] != "bob" {
+		t.Fatalf("Expected presence_join for bob, got %v", frame)
+	}
+	waitOnline(t, hub, []string{"alice", "bob"})
+
+	// 同じユーザーの2つ目の接続では presence_join は届かない
+	alice2, _, err := websocket.DefaultDialer.Dial(wsURL+tokenQuery(t, "alice"), nil)
+	if err != nil {
+		t.Fatalf("Failed to connect second alice: %v", err)
+	}
+	readPresence(t, newFrameReader(t, alice2)) // presence_snapshot
+
+	// 1つ目の接続が残っている間は presence_leave は届かず、
+	// 最後の接続を閉じたユーザーの presence_leave だけが届く
+	alice2.Close()
+	time.Sleep(100 * time.Millisecond)
+	bob.Close()
+
+	if frame := readPresence(t, aliceFrames); frame["type"] != "presence_leave" || frame["user"] != "bob" {
+		t.Fatalf("Expected presence_leave for bob, got %v", frame)
+	}
+	waitOnline(t, hub, []string{"alice"})
+}
+
+func TestHub_PresenceAcrossInstances(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	bp := backplane.NewMemoryBackplane()
+	defer bp.Close()
+
+	hubA := NewHub(store, WithBackplane(bp))
+	go hubA.Run()
+
+	alice := NewClient(hubA, nil, "alice")
+	if !hubA.registerClient(alice) {
+		t.Fatal("registerClient failed")
+	}
+	hubA.connected(alice)
+	waitOnline(t, hubA, []string{"alice"})
+
+	// 後から起動したインスタンスも、既に接続中のユーザーを問い合わせて把握する
+	hubB := NewHub(store, WithBackplane(bp))
+	go hubB.Run()
+	waitOnline(t, hubB, []string{"alice"})
+
+	// 別のインスタンスで同じユーザーが接続・切断しても、最後の切断まではオンラインのまま
+	alice2 := NewClient(hubB, nil, "alice")
+	if !hubB.registerClient(alice2) {
+		t.Fatal("registerClient failed")
+	}
+	hubB.connected(alice2)
+	hubA.disconnected(alice)
+	time.Sleep(50 * time.Millisecond)
+	waitOnline(t, hubA, []string{"alice"})
+
+	hubB.disconnected(alice2)
+	waitOnline(t, hubA, []string{})
+	waitOnline(t, hubB, []string{})
+}
+
+// limitedBackplane は PostgresBackplane と同じくペイロードの上限を超える配信を拒否する
+type limitedBackplane struct {
+	*backplane.MemoryBackplane
+	rejected atomic.Int32
+}
+
+func (b *limitedBackplane) Publish(payload []byte) error {
+	if len(payload) > backplane.MaxPayloadSize {
+		b.rejected.Add(1)
+		return backplane.ErrPayloadTooLarge
+	}
+	return b.MemoryBackplane.Publish(payload)
+}
+
+func TestHub_PresenceManyUsers(t *testing.T) {
+	bp := &limitedBackplane{MemoryBackplane: backplane.NewMemoryBackplane()}
+	defer bp.Close()
+	interval := 20 * time.Millisecond
+
+	// 全員を1回で配信するとペイロードの上限を超える人数が接続している
+	hubA := NewHub(storage.NewMemoryStorage(), WithBackplane(bp), WithPresenceHeartbeat(interval))
+	want := make([]string, 500)
+	for i := range want {
+		want[i] = fmt.Sprintf("user-%04d-%s", i, strings.Repeat("x", 20))
+		hubA.presence.connect(want[i])
+	}
+	go hubA.Run()
+
+	hubB := NewHub(storage.NewMemoryStorage(), WithBackplane(bp), WithPresenceHeartbeat(interval))
+	go hubB.Run()
+
+	// 起動時の問い合わせへの応答が分割して届き、全員がオンラインになる
+	waitOnline(t, hubB, want)
+
+	// ハートビートが届き続けるので、取り除かれない
+	time.Sleep(interval * (presenceMissedHeartbeats + presenceResyncHeartbeats + 2))
+	if got := hubB.OnlineUsers(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %d online users, got %d", len(want), len(got))
+	}
+	if n := bp.rejected.Load(); n != 0 {
+		t.Errorf("Expected no payload to exceed the limit, %d were rejected", n)
+	}
+}
+
+func TestHub_PresenceExpiresCrashedInstance(t *testing.T) {
+	bp := backplane.NewMemoryBackplane()
+	defer bp.Close()
+
+	hub := NewHub(storage.NewMemoryStorage(), WithBackplane(bp), WithPresenceHeartbeat(20*time.Millisecond))
+	go hub.Run()
+
+	client := NewClient(hub, nil, "alice")
+	if !hub.registerClient(client) {
+		t.Fatal("registerClient failed")
+	}
+
+	// 別のインスタンスが bob の接続を配信した後、切断を配信せずに停止する
+	data, _ := json.Marshal(envelope{Presence: &presenceUpdate{Instance: "crashed", Seq: 1, User: "bob", Online: true}})
+	if err := bp.Publish(data); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	waitOnline(t, hub, []string{"bob"})
+
+	// ハートビートが途絶えると presence_leave が配信される
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case frame := <-client.send:
+			if strings.Contains(string(frame), `"presence_leave"`) && strings.Contains(string(frame), `"bob"`) {
+				waitOnline(t, hub, []string{})
+				return
+			}
+		case <-deadline:
+			t.Fatalf("Expected presence_leave for bob, online: %v", hub.OnlineUsers())
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tasukuchiba/text_messaging_app/internal/models"
+	"github.com/tasukuchiba/text_messaging_app/internal/ratelimit"
+	"github.com/tasukuchiba/text_messaging_app/internal/service"
+	"github.com/tasukuchiba/text_messaging_app/internal/storage"
+)
+
+// ProtocolV1 は現在のプロトコルのバージョン（Sec-WebSocket-Protocol の値）
+const ProtocolV1 = "chat.v1"
+
+// maxClientMsgIDLength は client_msg_id と ref の最大文字数
+const maxClientMsgIDLength = 64
+
+// error フレームの code
+const (
+	// フレームがJSONとして不正
+	CodeInvalidJSON = "invalid_json"
+
+	// 知らない type のフレーム
+	CodeUnknownType = "unknown_type"
+
+	// フレームの内容が不正
+	CodeBadRequest = "bad_request"
+
+	// 対象のメッセージやルームが存在しない
+	CodeNotFound = "not_found"
+
+	// 対象のメッセージを操作する権限がない
+	CodeForbidden = "forbidden"
+
+	// 流量制限を超えた（retry_after 秒後に送り直す）
+	CodeRateLimited = "rate_limited"
+
+	// サーバー側の問題で処理できなかった
+	CodeInternal = "internal_error"
+)
+
+// 流量制限を繰り返し超えた接続を切断する条件
+// rateLimitStrikeWindow の間に maxRateLimitStrikes 回超えると切断する
+const (
+	maxRateLimitStrikes   = 10
+	rateLimitStrikeWindow = time.Minute
+)
+
+// errRateLimitAbuse は流量制限を繰り返し超えたため接続を切断する場合のエラー
+var errRateLimitAbuse = errors.New("rate limit repeatedly exceeded")
+
+// frameBucket はフレームの流量制限に使うバケットの種類
+type frameBucket int
+
+const (
+	// bucketFrames はメッセージの送信・編集・購読が共有するバケット
+	bucketFrames frameBucket = iota
+	// bucketTyping は入力中の通知用のバケット
+	// 入力中はフレームを頻繁に送るので、メッセージ送信とは別の緩い制限にする
+	bucketTyping
+)
+
+// rateLimitedFrames は流量制限の対象にするフレームの type と使うバケット
+var rateLimitedFrames = map[string]frameBucket{
+	"message":      bucketFrames,
+	"edit":         bucketFrames,
+	"subscribe":    bucketFrames,
+	"typing_start": bucketTyping,
+	"typing_stop":  bucketTyping,
+}
+
+// ErrorMessage は受信したフレームを処理できなかったことを送信者に知らせるフレーム
+type ErrorMessage struct {
+	Type    string `json:"type"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+
+	// 処理できなかったフレームの ref（client_msg_id）
+	Ref string `json:"ref,omitempty"`
+
+	// rate_limited の場合に、送り直せるようになるまでの秒数
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+// FrameError はフレームの処理に失敗した理由をクライアントに返すエラー
+type FrameError struct {
+	Code    string
+	Message string
+
+	// rate_limited の場合に、送り直せるようになるまでの秒数
+	RetryAfter int
+}
+
+func (e *FrameError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// frameError は新しい FrameError を作成する
+func frameError(code, message string) *FrameError {
+	return &FrameError{Code: code, Message: message}
+}
+
+// toFrameError はフレームの処理で発生したエラーをクライアントに返す形に変換する
+// 内部のエラーの詳細はクライアントに返さない
+func toFrameError(err error) *FrameError {
+	var fe *FrameError
+	switch {
+	case errors.As(err, &fe):
+		return fe
+	case errors.Is(err, storage.ErrNotFound):
+		return frameError(CodeNotFound, "message not found")
+	case errors.Is(err, storage.ErrRoomNotFound):
+		return frameError(CodeNotFound, "room not found")
+	case errors.Is(err, storage.ErrParentNotFound):
+		return frameError(CodeNotFound, "parent message not found")
+	case errors.Is(err, service.ErrNotMessageOwner):
+		return frameError(CodeForbidden, "only the sender can modify this message")
+	case errors.Is(err, service.ErrEmptyContent):
+		return frameError(CodeBadRequest, "content is required")
+	case errors.Is(err, service.ErrContentTooLong):
+		return frameError(CodeBadRequest, service.ErrContentTooLong.Error())
+	case errors.Is(err, ErrTooManyTyping):
+		return frameError(CodeBadRequest, fmt.Sprintf("cannot be typing in more than %d rooms at once", maxTypingRoomsPerClient))
+	default:
+		return frameError(CodeInternal, "internal error")
+	}
+}
+
+// frameHandler は受信したフレームを1種類処理する
+type frameHandler func(c *Client, in IncomingMessage) error
+
+// frameHandlers はプロトコルのバージョンごとの、受信フレームの type と処理の対応
+//
+// IncomingMessage / OutgoingMessage に互換性のない変更を加える場合は、
+// 新しいバージョンを追加して古いバージョンのクライアントにはこれまでの処理を使う。
+var frameHandlers = map[string]map[string]frameHandler{
+	ProtocolV1: {
+		"message":        handleMessage,
+		"edit":           handleEdit,
+		"subscribe":      handleSubscribe,
+		"unsubscribe":    handleUnsubscribe,
+		frameTypingStart: handleTypingStart,
+		frameTypingStop:  handleTypingStop,
+	},
+}
+
+// negotiateProtocol はクライアントが指定したプロトコルから使うバージョンを選ぶ
+//
+// 指定がない場合は ProtocolV1 を使う。指定されたバージョンをどれも扱えない場合は ok が false になる。
+// header はアップグレードのレスポンスに付けるヘッダー。
+func negotiateProtocol(r *http.Request) (protocol string, header http.Header, ok bool) {
+	requested := websocket.Subprotocols(r)
+	if len(requested) == 0 {
+		return ProtocolV1, nil, true
+	}
+	for _, p := range requested {
+		if _, ok := frameHandlers[p]; ok {
+			return p, http.Header{"Sec-WebSocket-Protocol": {p}}, true
+		}
+	}
+	return "", nil, false
+}
+
+// dispatch は受信したフレームをパースして type ごとの処理に渡す
+//
+// 処理できなかった場合は error フレームを返す。
+// 流量制限を繰り返し超えて接続を切断すべき場合は errRateLimitAbuse を返す。
+func (c *Client) dispatch(data []byte) error {
+	var in IncomingMessage
+	if err := json.Unmarshal(data, &in); err != nil {
+		c.logger().Warn("Failed to parse frame", "error", err)
+		c.sendError("", frameError(CodeInvalidJSON, "frame is not valid JSON"))
+		return nil
+	}
+
+	ref := in.Ref
+	if ref == "" {
+		ref = in.ClientMsgID
+	}
+	if len(ref) > maxClientMsgIDLength {
+		c.sendError("", frameError(CodeBadRequest, fmt.Sprintf("ref and client_msg_id must be at most %d characters", maxClientMsgIDLength)))
+		return nil
+	}
+
+	handle, ok := frameHandlers[c.protocol][in.Type]
+	if !ok {
+		c.sendError(ref, frameError(CodeUnknownType, fmt.Sprintf("unknown frame type %q", in.Type)))
+		return nil
+	}
+
+	if bucket, ok := rateLimitedFrames[in.Type]; ok {
+		if allowed, wait := c.hub.frameLimiter(bucket).Allow(ratelimit.UserKey(c.sender)); !allowed {
+			fe := frameError(CodeRateLimited, "rate limit exceeded")
+			fe.RetryAfter = ratelimit.RetryAfterSeconds(wait)
+			c.sendError(ref, fe)
+			return c.strike()
+		}
+	}
+
+	if err := handle(c, in); err != nil {
+		c.logger().Warn("Failed to handle frame", "type", in.Type, "ref", ref, "error", err)
+		c.sendError(ref, toFrameError(err))
+	}
+	return nil
+}
+
+// strike は流量制限を超えた回数を数え、上限に達した場合は errRateLimitAbuse を返す
+func (c *Client) strike() error {
+	now := time.Now()
+	if now.Sub(c.strikesSince) > rateLimitStrikeWindow {
+		c.strikes = 0
+		c.strikesSince = now
+	}
+	c.strikes++
+	if c.strikes >= maxRateLimitStrikes {
+		return errRateLimitAbuse
+	}
+	return nil
+}
+
+// sendError は error フレームを送信者に返す
+func (c *Client) sendError(ref string, fe *FrameError) {
+	frame := ErrorMessage{Type: "error", Code: fe.Code, Message: fe.Message, Ref: ref, RetryAfter: fe.RetryAfter}
+	if err := c.hub.sendTo(c, frame); err != nil {
+		c.logger().Error("Failed to send error frame", "code", fe.Code, "error", err)
+	}
+}
+
+// handleMessage はメッセージを保存・配信し、client_msg_id が指定されていれば ack フレームを返す
+// parent_id が指定されていればスレッドへの返信として保存する
+func handleMessage(c *Client, in IncomingMessage) error {
+	var msg models.Message
+	var duplicate bool
+	var err error
+	if in.ParentID != "" {
+		msg, duplicate, err = c.hub.messages.SendReply(c.ctx, in.RoomID, in.ParentID, c.sender, in.Content, in.ClientMsgID)
+	} else {
+		msg, duplicate, err = c.hub.messages.SendMessage(c.ctx, in.RoomID, c.sender, in.Content, in.ClientMsgID)
+	}
+	if err != nil {
+		return err
+	}
+
+	// 送信したら入力中の表示を消す
+	if err := c.hub.StopTyping(c, in.RoomID); err != nil {
+		c.logger().Error("Failed to publish typing_stop", "room_id", in.RoomID, "error", err)
+	}
+
+	if in.ClientMsgID == "" {
+		return nil
+	}
+	return c.hub.sendTo(c, AckMessage{
+		Type:        "ack",
+		ClientMsgID: in.ClientMsgID,
+		ID:          msg.ID,
+		CreatedAt:   msg.CreatedAt,
+		Duplicate:   duplicate,
+	})
+}
+
+// handleEdit はメッセージを編集する
+func handleEdit(c *Client, in IncomingMessage) error {
+	if in.ID == "" {
+		return frameError(CodeBadRequest, "id is required")
+	}
+	return c.hub.EditMessage(c.ctx, c.sender, in.ID, in.Content)
+}
+
+// handleSubscribe はルームを購読する
+func handleSubscribe(c *Client, in IncomingMessage) error {
+	if in.RoomID == "" {
+		return frameError(CodeBadRequest, "room_id is required")
+	}
+	return c.hub.Subscribe(c.ctx, c, in.RoomID)
+}
+
+// handleUnsubscribe はルームの購読を解除する
+func handleUnsubscribe(c *Client, in IncomingMessage) error {
+	c.hub.Unsubscribe(c, in.RoomID)
+	return nil
+}
+
+// handleTypingStart は入力中であることを配信する
+func handleTypingStart(c *Client, in IncomingMessage) error {
+	return c.hub.StartTyping(c.ctx, c, in.RoomID)
+}
+
+// handleTypingStop は入力をやめたことを配信する
+func handleTypingStop(c *Client, in IncomingMessage) error {
+	return c.hub.StopTyping(c, in.RoomID)
+}
@@ -0,0 +1,320 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tasukuchiba/text_messaging_app/internal/ratelimit"
+	"github.com/tasukuchiba/text_messaging_app/internal/service"
+	"github.com/tasukuchiba/text_messaging_app/internal/storage"
+)
+
+func TestServeWs_NegotiatesProtocol(t *testing.T) {
+	hub := NewHub(storage.NewMemoryStorage())
+	go hub.Run()
+
+	server := newTestServer(hub)
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + tokenQuery(t, "alice")
+
+	// 対応しているバージョンを指定するとそれが選ばれる
+	dialer := websocket.Dialer{Subprotocols: []string{"chat.v9", ProtocolV1}}
+	conn, _, err := dialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if conn.Subprotocol() != ProtocolV1 {
+		t.Errorf("Expected protocol %q, got %q", ProtocolV1, conn.Subprotocol())
+	}
+	conn.Close()
+
+	// 指定しない場合も接続できる（ProtocolV1 として扱う）
+	conn, _, err = websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect without a protocol: %v", err)
+	}
+	if conn.Subprotocol() != "" {
+		t.Errorf("Expected no protocol in the response, got %q", conn.Subprotocol())
+	}
+	conn.Close()
+
+	// 対応していないバージョンだけを指定すると拒否される
+	dialer = websocket.Dialer{Subprotocols: []string{"chat.v9"}}
+	_, resp, err := dialer.Dial(wsURL, nil)
+	if err == nil {
+		t.Fatal("Expected unsupported protocol to be rejected")
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestClient_ErrorFrames(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	hub := NewHub(store)
+	go hub.Run()
+
+	msg, err := hub.Messages().CreateMessage(context.Background(), "", "bob", "Bob's message")
+	if err != nil {
+		t.Fatalf("CreateMessage failed: %v", err)
+	}
+
+	server := newTestServer(hub)
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+tokenQuery(t, "alice"), nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	frames := newFrameReader(t, conn)
+
+	tests := []struct {
+		name  string
+		frame string
+		code  string
+		ref   string
+	}{
+		{"invalid JSON", `{"type":`, CodeInvalidJSON, ""},
+		{"unknown type", `{"type":"shout","ref":"r-1"}`, CodeUnknownType, "r-1"},
+		{"missing id", `{"type":"edit","content":"x","ref":"r-2"}`, CodeBadRequest, "r-2"},
+		{"missing message", `{"type":"edit","id":"non-existent","content":"x","ref":"r-3"}`, CodeNotFound, "r-3"},
+		{"not the owner", `{"type":"edit","id":"` + msg.ID + `","content":"x","ref":"r-4"}`, CodeForbidden, "r-4"},
+		{"missing room", `{"type":"subscribe","room_id":"non-existent","ref":"r-5"}`, CodeNotFound, "r-5"},
+		{"ref from client_msg_id", `{"type":"message","room_id":"non-existent","content":"x","client_msg_id":"c-1"}`, CodeNotFound, "c-1"},
+		{"empty content", `{"type":"message","ref":"r-6"}`, CodeBadRequest, "r-6"},
+		{"ref too long", `{"type":"message","client_msg_id":"` + strings.Repeat("x", maxClientMsgIDLength+1) + `"}`, CodeBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(tt.frame)); err != nil {
+				t.Fatalf("Failed to send frame: %v", err)
+			}
+
+			var got ErrorMessage
+			if err := json.Unmarshal(frames.next(), &got); err != nil {
+				t.Fatalf("Failed to unmarshal frame: %v", err)
+			}
+			if got.Type != "error" || got.Code != tt.code || got.Ref != tt.ref || got.Message == "" {
+				t.Errorf("Expected error %s with ref %q, got %+v", tt.code, tt.ref, got)
+			}
+		})
+	}
+}
+
+func TestClient_EditEmptyContent(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	hub := NewHub(store)
+	go hub.Run()
+
+	msg, err := hub.Messages().CreateMessage(context.Background(), "", "alice", "Hello")
+	if err != nil {
+		t.Fatalf("CreateMessage failed: %v", err)
+	}
+
+	server := newTestServer(hub)
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+tokenQuery(t, "alice"), nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	frames := newFrameReader(t, conn)
+
+	frame := `{"type":"edit","id":"` + msg.ID + `","content":"","ref":"e-1"}`
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+		t.Fatalf("Failed to send frame: %v", err)
+	}
+
+	// 本文を空にする編集は拒否され、本文も編集履歴も変わらない
+	for {
+		var got ErrorMessage
+		if err := json.Unmarshal(frames.next(), &got); err != nil {
+			t.Fatalf("Failed to unmarshal frame: %v", err)
+		}
+		if got.Type != "error" {
+			continue
+		}
+		if got.Code != CodeBadRequest || got.Ref != "e-1" {
+			t.Fatalf("Expected bad_request with ref e-1, got %+v", got)
+		}
+		break
+	}
+
+	stored, err := store.GetByID(context.Background(), msg.ID)
+	if err != nil {
+		t.Fatalf("GetByID failed: %v", err)
+	}
+	if stored.Content != "Hello" || stored.Edited {
+		t.Errorf("Expected message to be unchanged, got %+v", stored)
+	}
+	if revisions, _ := store.GetRevisions(context.Background(), msg.ID); len(revisions) != 0 {
+		t.Errorf("Expected no revisions, got %+v", revisions)
+	}
+}
+
+func TestToFrameError(t *testing.T) {
+	tests := []struct {
+		err  error
+		code string
+	}{
+		{frameError(CodeBadRequest, "bad"), CodeBadRequest},
+		{storage.ErrNotFound, CodeNotFound},
+		{storage.ErrRoomNotFound, CodeNotFound},
+		{storage.ErrParentNotFound, CodeNotFound},
+		{service.ErrNotMessageOwner, CodeForbidden},
+		{service.ErrEmptyContent, CodeBadRequest},
+		{service.ErrContentTooLong, CodeBadRequest},
+		{ErrTooManyTyping, CodeBadRequest},
+		{errors.New("connection refused"), CodeInternal},
+	}
+
+	for _, tt := range tests {
+		fe := toFrameError(tt.err)
+		if fe.Code != tt.code {
+			t.Errorf("toFrameError(%v) = %s, want %s", tt.err, fe.Code, tt.code)
+		}
+		// 内部のエラーの詳細は返さない
+		if tt.code == CodeInternal && strings.Contains(fe.Message, "refused") {
+			t.Errorf("Internal error details leaked: %q", fe.Message)
+		}
+	}
+}
+
+func TestClient_RateLimited(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	hub := NewHub(store, WithFrameRateLimit(ratelimit.NewLimiter(ratelimit.Every(1, time.Minute, 1))))
+	go hub.Run()
+
+	server := newTestServer(hub)
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+tokenQuery(t, "alice"), nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	frames := newFrameReader(t, conn)
+
+	send := func(clientMsgID string) {
+		t.Helper()
+		frame := `{"type":"message","content":"Hello","client_msg_id":"` + clientMsgID + `"}`
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+			t.Fatalf("Failed to send frame: %v", err)
+		}
+	}
+
+	// readType は指定した種類のフレームが届くまで読み進める
+	readType := func(frameType string) map[string]any {
+		t.Helper()
+		for {
+			var frame map[string]any
+			if err := json.Unmarshal(frames.next(), &frame); err != nil {
+				t.Fatalf("Failed to unmarshal frame: %v", err)
+			}
+			if frame["type"] == frameType {
+				return frame
+			}
+		}
+	}
+
+	send("c-0")
+	readType("ack")
+
+	// typing_* はメッセージ送信とは別のバケットで制限する
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"typing_start","room_id":"non-existent"}`)); err != nil {
+		t.Fatalf("Failed to send frame: %v", err)
+	}
+	if missing := readType("error"); missing["code"] != CodeNotFound {
+		t.Fatalf("Expected not_found for typing_start in unknown room, got %v", missing)
+	}
+
+	send("c-1")
+	limited := readType("error")
+	if limited["code"] != CodeRateLimited || limited["ref"] != "c-1" || limited["retry_after"] == nil {
+		t.Fatalf("Unexpected rate_limited frame: %v", limited)
+	}
+
+	// 制限を繰り返し超えると切断される
+	for i := 1; i < maxRateLimitStrikes; i++ {
+		send(fmt.Sprintf("c-%d", i+1))
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err = conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("Expected policy violation close, got %v", err)
+	}
+
+	messages, _ := store.GetAll(context.Background())
+	if len(messages) != 1 {
+		t.Errorf("Expected 1 stored message, got %d", len(messages))
+	}
+}
+
+func TestClient_TypingRateLimited(t *testing.T) {
+	const burst = 3
+	store := storage.NewMemoryStorage()
+	hub := NewHub(store, WithTypingRateLimit(ratelimit.NewLimiter(ratelimit.Every(1, time.Minute, burst))))
+	go hub.Run()
+
+	server := newTestServer(hub)
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+tokenQuery(t, "alice"), nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	frames := newFrameReader(t, conn)
+
+	// 存在しないルームを含め、ルームIDを変えながら typing_start を送り続ける
+	for i := 0; i < burst+1; i++ {
+		frame := fmt.Sprintf(`{"type":"typing_start","room_id":"room-%d","ref":"t-%d"}`, i, i)
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+			t.Fatalf("Failed to send frame: %v", err)
+		}
+	}
+	for i := 0; i < burst+1; i++ {
+		var frame map[string]any
+		if err := json.Unmarshal(frames.next(), &frame); err != nil {
+			t.Fatalf("Failed to unmarshal frame: %v", err)
+		}
+		want := CodeNotFound
+		if i == burst {
+			want = CodeRateLimited
+		}
+		if frame["type"] != "error" || frame["code"] != want || frame["ref"] != fmt.Sprintf("t-%d", i) {
+			t.Fatalf("Expected %s for frame %d, got %v", want, i, frame)
+		}
+	}
+
+	// 制限を繰り返し超えると切断される
+	for i := 1; i < maxRateLimitStrikes; i++ {
+		frame := fmt.Sprintf(`{"type":"typing_start","room_id":"room-%d"}`, burst+i)
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err = conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("Expected policy violation close, got %v", err)
+	}
+}
@@ -0,0 +1,235 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tasukuchiba/text_messaging_app/internal/models"
+	"github.com/tasukuchiba/text_messaging_app/internal/service"
+	"github.com/tasukuchiba/text_messaging_app/internal/storage"
+)
+
+// maxReplayMessages は再接続時にチャンネル（全体・各ルーム）ごとに再送するメッセージとスレッドへの返信それぞれの最大件数
+// これを超える分はREST APIでページングして取得してもらう
+const maxReplayMessages = 1000
+
+// ReplayCompleteMessage は再送の完了をクライアントに知らせるフレーム
+type ReplayCompleteMessage struct {
+	Type string `json:"type"`
+
+	// 再送したメッセージ数
+	Count int `json:"count"`
+
+	// 件数の上限に達して再送しきれなかったメッセージがあるかどうか
+	Truncated bool `json:"truncated"`
+}
+
+// resumeOptions は再接続時の購読ルームと再送開始位置
+type resumeOptions struct {
+	rooms []string
+	from  *storage.Cursor
+}
+
+// parseResumeOptions はクエリパラメータから購読ルームと再送開始位置を取得する
+//
+// クエリパラメータ:
+//   - rooms: 接続と同時に購読するルームID（カンマ区切り）
+//   - cursor: 最後に受信したメッセージの cursor（優先）
+//   - last_message_id: 最後に受信したメッセージのID
+func parseResumeOptions(hub *Hub, r *http.Request) (resumeOptions, error) {
+	query := r.URL.Query()
+	var opts resumeOptions
+
+	if v := query.Get("rooms"); v != "" {
+		for _, roomID := range strings.Split(v, ",") {
+			if roomID == "" {
+				continue
+			}
+			if _, err := hub.storage.GetRoom(r.Context(), roomID); err != nil {
+				return resumeOptions{}, err
+			}
+			opts.rooms = append(opts.rooms, roomID)
+		}
+	}
+
+	if v := query.Get("cursor"); v != "" {
+		c, err := storage.DecodeCursor(v)
+		if err != nil {
+			return resumeOptions{}, err
+		}
+		opts.from = &c
+	} else if v := query.Get("last_message_id"); v != "" {
+		msg, err := hub.storage.GetByID(r.Context(), v)
+		if err != nil {
+			return resumeOptions{}, err
+		}
+		c := storage.CursorOf(msg)
+		opts.from = &c
+	}
+
+	return opts, nil
+}
+
+// resumeErrorStatus は parseResumeOptions のエラーをHTTPステータスに変換する
+func resumeErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, storage.ErrRoomNotFound):
+		return http.StatusNotFound, "room not found"
+	case errors.Is(err, storage.ErrNotFound):
+		return http.StatusNotFound, "last_message_id not found"
+	case errors.Is(err, storage.ErrInvalidCursor):
+		return http.StatusBadRequest, "invalid cursor"
+	default:
+		return http.StatusInternalServerError, "internal server error"
+	}
+}
+
+// replay は切断中に届いたメッセージとスレッドへの返信をストレージから読み出して接続に直接書き込む
+// 返信は thread_reply として、メッセージと同じカーソルの順に並べて送る
+//
+// クライアントはHubに登録済みなので、読み出しと並行して届いたライブ配信は
+// send チャネルに溜まる。再送したメッセージのIDを記録しておき、
+// WritePump でライブ配信側の重複を取り除くことで、境界での欠落と重複を防ぐ。
+// 記録は再送の完了時点で溜まっていたライブ配信を確かめ終えた時点で捨てる。
+func (c *Client) replay(from storage.Cursor) error {
+	var messages []models.Message
+	truncated := false
+
+	for _, roomID := range append([]string{""}, c.initialRooms...) {
+		for _, list := range []listFunc{c.hub.messages.ListMessages, c.hub.messages.ListReplies} {
+			msgs, more, err := c.missedMessages(list, roomID, from)
+			if err != nil {
+				return err
+			}
+			messages = append(messages, msgs...)
+			truncated = truncated || more
+		}
+	}
+
+	// 複数チャンネルの結果を作成日時順に並べる
+	sort.Slice(messages, func(i, j int) bool {
+		return storage.CursorOf(messages[i]).Compare(storage.CursorOf(messages[j])) < 0
+	})
+
+	threads := make(map[string]*models.Message)
+	c.replayed = make(map[string]struct{}, len(messages))
+	for _, msg := range messages {
+		frame := newOutgoingMessage("message", msg)
+		if msg.IsReply() {
+			frame.Type = service.EventThreadReply
+			if err := c.attachThreadStats(&frame, threads); err != nil {
+				return err
+			}
+		}
+		if err := c.writeFrame(frame); err != nil {
+			return err
+		}
+		c.replayed[msg.ID] = struct{}{}
+	}
+
+	if err := c.writeFrame(ReplayCompleteMessage{
+		Type:      "replay_complete",
+		Count:     len(messages),
+		Truncated: truncated,
+	}); err != nil {
+		return err
+	}
+
+	// 読み出しの後に届くライブ配信は再送したメッセージと重ならないので、今溜まっている分だけを照合する
+	c.replayBacklog = len(c.send)
+	if c.replayBacklog == 0 {
+		c.replayed = nil
+	}
+	return nil
+}
+
+// listFunc はチャンネルのメッセージをページ単位で取得する関数（service.MessageService の ListMessages と ListReplies）
+type listFunc func(ctx context.Context, opts storage.ListOptions, viewer string) (storage.MessagePage, error)
+
+// missedMessages は list で指定チャンネルの from より新しいメッセージを最大 maxReplayMessages 件取得する
+// リアクションは接続しているユーザーから見た集計を付ける
+func (c *Client) missedMessages(list listFunc, roomID string, from storage.Cursor) ([]models.Message, bool, error) {
+	var messages []models.Message
+	after := from.Encode()
+
+	for len(messages) < maxReplayMessages {
+		page, err := list(c.ctx, storage.ListOptions{
+			RoomID: roomID,
+			After:  after,
+			Limit:  min(storage.MaxListLimit, maxReplayMessages-len(messages)),
+		}, c.sender)
+		if err != nil {
+			return nil, false, err
+		}
+		messages = append(messages, page.Messages...)
+		if page.NextCursor == "" {
+			return messages, false, nil
+		}
+		after = page.NextCursor
+	}
+
+	return messages, true, nil
+}
+
+// attachThreadStats は再送する返信のフレームに起点の現在の返信数と最後の返信日時を付ける
+// 起点は threads にキャッシュし、同じスレッドへの返信では読み直さない
+func (c *Client) attachThreadStats(frame *OutgoingMessage, threads map[string]*models.Message) error {
+	root, ok := threads[frame.ThreadRootID]
+	if !ok {
+		msg, err := c.hub.storage.GetByID(c.ctx, frame.ThreadRootID)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+		// 読み出しと並行して削除された起点は統計を付けずに送る
+		if err == nil {
+			root = &msg
+		}
+		threads[frame.ThreadRootID] = root
+	}
+	if root != nil {
+		frame.ReplyCount = root.ReplyCount
+		frame.LastReplyAt = root.LastReplyAt
+	}
+	return nil
+}
+
+// writeFrame はフレームをJSONにして接続に直接書き込む（WritePumpのgoroutineからのみ呼ぶ）
+func (c *Client) writeFrame(frame any) error {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(c.cfg.WriteWait))
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// isReplayed はライブ配信のフレームが再送済みのメッセージまたはスレッドへの返信かどうかを判定する
+// 再送の完了時点で溜まっていた数のフレームを確かめたら、再送済みのメッセージIDの記録を捨てる
+func (c *Client) isReplayed(frame []byte) bool {
+	if c.replayed == nil {
+		return false
+	}
+	c.replayBacklog--
+	if c.replayBacklog <= 0 {
+		defer func() { c.replayed = nil }()
+	}
+
+	var head struct {
+		Type string `json:"type"`
+		ID   string `json:"id"`
+	}
+	if err := json.Unmarshal(frame, &head); err != nil {
+		return false
+	}
+	if head.Type != "message" && head.Type != service.EventThreadReply {
+		return false
+	}
+	_, ok := c.replayed[head.ID]
+	return ok
+}
@@ -0,0 +1,252 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// 入力中の状態を知らせるフレームの種類
+const (
+	frameTypingStart = "typing_start"
+	frameTypingStop  = "typing_stop"
+)
+
+// DefaultTypingTTL は typing_start を受けてから自動的に typing_stop を配信するまでの時間
+// クライアントは入力を続けている間、これより短い間隔で typing_start を送り直す
+const DefaultTypingTTL = 6 * time.Second
+
+// maxTypingRoomsPerClient は1つの接続が同時に入力中にできるルームの数（全体チャンネルは数えない）
+const maxTypingRoomsPerClient = 10
+
+// ErrTooManyTyping は1つの接続で入力中のルームが多すぎる場合のエラー
+var ErrTooManyTyping = errors.New("typing in too many rooms")
+
+// TypingMessage は入力中の状態をクライアントに知らせるフレーム
+//
+// ストレージには保存せず、送信者以外のクライアントにだけ配信する。
+type TypingMessage struct {
+	Type   string `json:"type"`
+	RoomID string `json:"room_id,omitempty"`
+	Sender string `json:"sender"`
+
+	// typing_start の有効期限
+	// 他のインスタンスが停止して typing_stop が届かない場合に、クライアント側でも消せるようにする
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// typingKey は入力中の状態を区別するキー（ユーザーとルームの組）
+type typingKey struct {
+	sender string
+	roomID string
+}
+
+// typingEntry は入力中のユーザー1人分の状態
+type typingEntry struct {
+	// typing_start を送ってきた接続（切断時にこの接続の状態を消す）
+	owner *Client
+
+	// 期限切れで typing_stop を配信するタイマー
+	timer *time.Timer
+
+	// 入力中の状態の期限（延長するたびに更新する）
+	// 発火済みのタイマーのコールバックが延長と入れ違いになった場合に、延長後の状態を消さないために使う
+	expiresAt time.Time
+
+	// 最後に typing_start を配信した時刻
+	publishedAt time.Time
+}
+
+// typingTracker は入力中のユーザーを記録し、期限切れを検出する
+//
+// タイマーのコールバックから配信するため、Hubのgoroutineではなくミューテックスで保護する。
+// （Hubのgoroutineからバックプレーンに配信すると、自分が読み出すチャネルの詰まりで止まりうる）
+type typingTracker struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[typingKey]*typingEntry
+
+	// 接続ごとのルームでの入力中の状態の数（maxTypingRoomsPerClient を超えないようにする）
+	// 全体チャンネルの状態はユーザーごとに1つしかないので数えない
+	owned map[*Client]int
+}
+
+// newTypingTracker は新しいtypingTrackerを作成する
+func newTypingTracker(ttl time.Duration) *typingTracker {
+	return &typingTracker{
+		ttl:     ttl,
+		entries: make(map[typingKey]*typingEntry),
+		owned:   make(map[*Client]int),
+	}
+}
+
+// setOwnerLocked は入力中の状態を送ってきた接続を記録する（ロックを取得済みで呼び出す）
+func (t *typingTracker) setOwnerLocked(key typingKey, entry *typingEntry, client *Client) {
+	if entry.owner == client {
+		return
+	}
+	if key.roomID != "" {
+		if entry.owner != nil {
+			t.releaseLocked(entry.owner)
+		}
+		t.owned[client]++
+	}
+	entry.owner = client
+}
+
+// removeLocked は入力中の状態を削除する（ロックを取得済みで呼び出す）
+func (t *typingTracker) removeLocked(key typingKey, entry *typingEntry) {
+	entry.timer.Stop()
+	delete(t.entries, key)
+	if key.roomID != "" {
+		t.releaseLocked(entry.owner)
+	}
+}
+
+// releaseLocked は接続の入力中の状態の数を1つ減らす（ロックを取得済みで呼び出す）
+func (t *typingTracker) releaseLocked(client *Client) {
+	if t.owned[client] <= 1 {
+		delete(t.owned, client)
+		return
+	}
+	t.owned[client]--
+}
+
+// WithTypingTTL は入力中の状態が自動的に解除されるまでの時間を指定する
+func WithTypingTTL(ttl time.Duration) HubOption {
+	return func(h *Hub) {
+		h.typing = newTypingTracker(ttl)
+	}
+}
+
+// StartTyping はクライアントが入力中であることを同じルームの他のクライアントに配信する
+//
+// 続けて呼ばれた場合は期限を延長するだけで、配信は期限の半分ごとに行う。
+// roomID が空の場合は全体チャンネルで入力中にする。存在しないルームの場合は storage.ErrRoomNotFound、
+// 接続が既に maxTypingRoomsPerClient 個のルームで入力中の場合は ErrTooManyTyping を返す。
+func (h *Hub) StartTyping(ctx context.Context, client *Client, roomID string) error {
+	t := h.typing
+	key := typingKey{sender: client.sender, roomID: roomID}
+
+	// ルームの確認は入力中の状態を新しく作る場合だけ行う
+	t.mu.Lock()
+	_, ok := t.entries[key]
+	t.mu.Unlock()
+	if !ok && roomID != "" {
+		if _, err := h.storage.GetRoom(ctx, roomID); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	t.mu.Lock()
+	entry, ok := t.entries[key]
+	if !ok {
+		if roomID != "" && t.owned[client] >= maxTypingRoomsPerClient {
+			t.mu.Unlock()
+			return ErrTooManyTyping
+		}
+		entry = &typingEntry{}
+		entry.timer = time.AfterFunc(t.ttl, func() { h.expireTyping(key, entry) })
+		t.entries[key] = entry
+	} else {
+		entry.timer.Reset(t.ttl)
+	}
+	entry.expiresAt = now.Add(t.ttl)
+	t.setOwnerLocked(key, entry, client)
+	publish := !ok || now.Sub(entry.publishedAt) >= t.ttl/2
+	if publish {
+		entry.publishedAt = now
+	}
+	t.mu.Unlock()
+
+	if !publish {
+		return nil
+	}
+	expiresAt := now.Add(t.ttl)
+	return h.publishTyping(frameTypingStart, key, &expiresAt)
+}
+
+// StopTyping はクライアントが入力をやめたことを配信する
+// 入力中でない場合は何もしない
+func (h *Hub) StopTyping(client *Client, roomID string) error {
+	t := h.typing
+	key := typingKey{sender: client.sender, roomID: roomID}
+
+	t.mu.Lock()
+	entry, ok := t.entries[key]
+	if ok {
+		t.removeLocked(key, entry)
+	}
+	t.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	return h.publishTyping(frameTypingStop, key, nil)
+}
+
+// clearTyping は切断したクライアントの入力中の状態を全て解除する
+func (h *Hub) clearTyping(client *Client) {
+	t := h.typing
+
+	var keys []typingKey
+	t.mu.Lock()
+	for key, entry := range t.entries {
+		if entry.owner != client {
+			continue
+		}
+		t.removeLocked(key, entry)
+		keys = append(keys, key)
+	}
+	t.mu.Unlock()
+
+	for _, key := range keys {
+		if err := h.publishTyping(frameTypingStop, key, nil); err != nil {
+			client.logger().Error("Failed to publish typing_stop", "room_id", key.roomID, "error", err)
+		}
+	}
+}
+
+// expireTyping は期限までに typing_start が送り直されなかった状態を解除する
+func (h *Hub) expireTyping(key typingKey, entry *typingEntry) {
+	t := h.typing
+
+	t.mu.Lock()
+	current, ok := t.entries[key]
+	// 解除と入れ違いになった場合は何もしない
+	if !ok || current != entry {
+		t.mu.Unlock()
+		return
+	}
+	// タイマーの発火後、ロックを待つ間に延長された場合も何もしない（延長時に Reset したタイマーが改めて発火する）
+	if time.Now().Before(entry.expiresAt) {
+		t.mu.Unlock()
+		return
+	}
+	t.removeLocked(key, entry)
+	t.mu.Unlock()
+
+	// 停止後はバックプレーンがクローズされている場合があるので配信しない
+	select {
+	case <-h.done:
+		return
+	default:
+	}
+
+	if err := h.publishTyping(frameTypingStop, key, nil); err != nil {
+		slog.Error("Failed to publish typing_stop", "user", key.sender, "room_id", key.roomID, "error", err)
+	}
+}
+
+// publishTyping は入力中の状態を送信者以外のクライアントに配信する
+func (h *Hub) publishTyping(frameType string, key typingKey, expiresAt *time.Time) error {
+	return h.publishExcept(key.roomID, key.sender, TypingMessage{
+		Type:      frameType,
+		RoomID:    key.roomID,
+		Sender:    key.sender,
+		ExpiresAt: expiresAt,
+	})
+}
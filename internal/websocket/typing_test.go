@@ -0,0 +1,221 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tasukuchiba/text_messaging_app/internal/models"
+	"github.com/tasukuchiba/text_messaging_app/internal/storage"
+)
+
+// newTypingTestHub は room-1 を作成したHubを起動し、alice と bob を room-1 に購読させる
+func newTypingTestHub(t *testing.T, opts ...HubOption) (hub *Hub, alice, bob *Client) {
+	t.Helper()
+	store := storage.NewMemoryStorage()
+	store.CreateRoom(context.Background(), models.Room{ID: "room-1", Name: "general", CreatedAt: time.Now()})
+	hub = NewHub(store, opts...)
+	go hub.Run()
+
+	alice = NewClient(hub, nil, "alice")
+	bob = NewClient(hub, nil, "bob")
+	for _, c := range []*Client{alice, bob} {
+		hub.register <- c
+		if err := hub.Subscribe(context.Background(), c, "room-1"); err != nil {
+			t.Fatalf("Subscribe failed: %v", err)
+		}
+	}
+	return hub, alice, bob
+}
+
+// receiveTyping はクライアントに届いた入力中フレームを取り出す
+func receiveTyping(t *testing.T, c *Client) TypingMessage {
+	t.Helper()
+	select {
+	case msg := <-c.send:
+		var typing TypingMessage
+		if err := json.Unmarshal(msg, &typing); err != nil {
+			t.Fatalf("Failed to unmarshal typing frame: %v", err)
+		}
+		return typing
+	case <-time.After(time.Second):
+		t.Fatalf("Timeout waiting for typing frame on %s", c.sender)
+	}
+	return TypingMessage{}
+}
+
+// expectNoFrame はクライアントに何も届かないことを確認する
+func expectNoFrame(t *testing.T, c *Client) {
+	t.Helper()
+	select {
+	case msg := <-c.send:
+		t.Errorf("%s should not receive a frame, got %s", c.sender, msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestHub_TypingRelayedToOthers(t *testing.T) {
+	hub, alice, bob := newTypingTestHub(t)
+
+	if err := hub.StartTyping(context.Background(), alice, "room-1"); err != nil {
+		t.Fatalf("StartTyping failed: %v", err)
+	}
+
+	typing := receiveTyping(t, bob)
+	if typing.Type != "typing_start" || typing.Sender != "alice" {
+		t.Errorf("Expected typing_start from alice, got %+v", typing)
+	}
+	if typing.ExpiresAt == nil {
+		t.Error("Expected expires_at on typing_start")
+	}
+
+	// 送信者本人には届かない
+	expectNoFrame(t, alice)
+
+	// 続けて送られた typing_start は期限の延長だけで配信しない
+	if err := hub.StartTyping(context.Background(), alice, "room-1"); err != nil {
+		t.Fatalf("StartTyping failed: %v", err)
+	}
+	expectNoFrame(t, bob)
+
+	if err := hub.StopTyping(alice, "room-1"); err != nil {
+		t.Fatalf("StopTyping failed: %v", err)
+	}
+	if typing := receiveTyping(t, bob); typing.Type != "typing_stop" || typing.Sender != "alice" {
+		t.Errorf("Expected typing_stop from alice, got %+v", typing)
+	}
+
+	// 入力中でなければ typing_stop は配信しない
+	if err := hub.StopTyping(alice, "room-1"); err != nil {
+		t.Fatalf("StopTyping failed: %v", err)
+	}
+	expectNoFrame(t, bob)
+}
+
+func TestHub_TypingExpires(t *testing.T) {
+	hub, alice, bob := newTypingTestHub(t, WithTypingTTL(100*time.Millisecond))
+
+	if err := hub.StartTyping(context.Background(), alice, "room-1"); err != nil {
+		t.Fatalf("StartTyping failed: %v", err)
+	}
+	if typing := receiveTyping(t, bob); typing.Type != "typing_start" {
+		t.Fatalf("Expected typing_start, got %+v", typing)
+	}
+
+	// typing_start が送り直されなければ期限切れで typing_stop が届く
+	if typing := receiveTyping(t, bob); typing.Type != "typing_stop" || typing.Sender != "alice" {
+		t.Errorf("Expected typing_stop from alice, got %+v", typing)
+	}
+}
+
+func TestHub_TypingClearedOnDisconnect(t *testing.T) {
+	hub, alice, bob := newTypingTestHub(t)
+
+	if err := hub.StartTyping(context.Background(), alice, "room-1"); err != nil {
+		t.Fatalf("StartTyping failed: %v", err)
+	}
+	receiveTyping(t, bob)
+
+	// 切断したクライアントの入力中の状態はすぐに解除される
+	hub.clearTyping(alice)
+	if typing := receiveTyping(t, bob); typing.Type != "typing_stop" || typing.Sender != "alice" {
+		t.Errorf("Expected typing_stop from alice, got %+v", typing)
+	}
+}
+
+func TestHub_TypingRequiresRoom(t *testing.T) {
+	hub, alice, bob := newTypingTestHub(t)
+
+	// 存在しないルームでは入力中の状態を作らない
+	if err := hub.StartTyping(context.Background(), alice, "non-existent"); !errors.Is(err, storage.ErrRoomNotFound) {
+		t.Errorf("Expected ErrRoomNotFound, got %v", err)
+	}
+	if len(hub.typing.entries) != 0 {
+		t.Errorf("Expected no typing entries, got %d", len(hub.typing.entries))
+	}
+	expectNoFrame(t, bob)
+
+	// 空のルームIDは全体チャンネルとして扱い、ルームの上限にも数えない
+	if err := hub.StartTyping(context.Background(), alice, ""); err != nil {
+		t.Fatalf("StartTyping on global channel failed: %v", err)
+	}
+	if typing := receiveTyping(t, bob); typing.Type != "typing_start" || typing.RoomID != "" {
+		t.Errorf("Expected global typing_start, got %+v", typing)
+	}
+	if n := hub.typing.owned[alice]; n != 0 {
+		t.Errorf("Expected global typing not to count toward the room limit, got %d", n)
+	}
+	if err := hub.StopTyping(alice, ""); err != nil {
+		t.Fatalf("StopTyping on global channel failed: %v", err)
+	}
+	if typing := receiveTyping(t, bob); typing.Type != "typing_stop" {
+		t.Errorf("Expected global typing_stop, got %+v", typing)
+	}
+}
+
+func TestHub_TypingLimitPerClient(t *testing.T) {
+	hub, alice, _ := newTypingTestHub(t)
+	ctx := context.Background()
+	for i := 0; i <= maxTypingRoomsPerClient; i++ {
+		hub.storage.CreateRoom(ctx, models.Room{ID: fmt.Sprintf("room-%d", i+2), CreatedAt: time.Now()})
+	}
+
+	for i := 0; i < maxTypingRoomsPerClient; i++ {
+		if err := hub.StartTyping(ctx, alice, fmt.Sprintf("room-%d", i+2)); err != nil {
+			t.Fatalf("StartTyping failed: %v", err)
+		}
+	}
+
+	// 上限に達すると新しいルームでは入力中にできないが、既存の状態は延長できる
+	extra := fmt.Sprintf("room-%d", maxTypingRoomsPerClient+2)
+	if err := hub.StartTyping(ctx, alice, extra); !errors.Is(err, ErrTooManyTyping) {
+		t.Errorf("Expected ErrTooManyTyping, got %v", err)
+	}
+	if err := hub.StartTyping(ctx, alice, "room-2"); err != nil {
+		t.Errorf("Expected extension to succeed, got %v", err)
+	}
+
+	// 解除すると空きができる
+	if err := hub.StopTyping(alice, "room-2"); err != nil {
+		t.Fatalf("StopTyping failed: %v", err)
+	}
+	if err := hub.StartTyping(ctx, alice, extra); err != nil {
+		t.Errorf("Expected StartTyping to succeed after StopTyping, got %v", err)
+	}
+
+	hub.clearTyping(alice)
+	if n := len(hub.typing.owned); n != 0 {
+		t.Errorf("Expected no owned entries after disconnect, got %d", n)
+	}
+}
+
+func TestHub_TypingExpiryRacingExtension(t *testing.T) {
+	hub, alice, bob := newTypingTestHub(t)
+	ctx := context.Background()
+
+	if err := hub.StartTyping(ctx, alice, "room-1"); err != nil {
+		t.Fatalf("StartTyping failed: %v", err)
+	}
+	receiveTyping(t, bob)
+	key := typingKey{sender: "alice", roomID: "room-1"}
+	hub.typing.mu.Lock()
+	entry := hub.typing.entries[key]
+	hub.typing.mu.Unlock()
+
+	// 発火済みのタイマーのコールバックが、延長の後にロックを取った場合を再現する
+	if err := hub.StartTyping(ctx, alice, "room-1"); err != nil {
+		t.Fatalf("StartTyping failed: %v", err)
+	}
+	hub.expireTyping(key, entry)
+
+	hub.typing.mu.Lock()
+	_, ok := hub.typing.entries[key]
+	hub.typing.mu.Unlock()
+	if !ok {
+		t.Error("Expected extended typing entry to survive a stale expiry")
+	}
+	expectNoFrame(t, bob)
+}